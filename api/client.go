@@ -4,15 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/jmorganca/ollama/npipe"
 	"github.com/jmorganca/ollama/version"
 )
 
@@ -26,8 +32,15 @@ type Client struct {
 	Base    url.URL
 	HTTP    http.Client
 	Headers http.Header
+
+	// Retries is how many times requests which are safe to repeat, such as List and Show, are retried when the
+	// server can't be reached or is busy. retries wait RetryBackoff, 500ms if it's zero, doubling after each one
+	Retries      int
+	RetryBackoff time.Duration
 }
 
+const defaultRetries = 3
+
 func checkError(resp *http.Response, body []byte) error {
 	if resp.StatusCode < http.StatusBadRequest {
 		return nil
@@ -58,6 +71,22 @@ func Host() string {
 // if the host is invalid.
 func FromEnv() (*Client, error) {
 	h := Host()
+
+	// a local server listening on a unix socket or named pipe
+	if dial, ok := localDialer(h); ok {
+		client := Client{
+			Base:    url.URL{Scheme: "http", Host: "localhost"},
+			HTTP:    http.Client{Transport: &http.Transport{DialContext: dial}},
+			Retries: defaultRetries,
+		}
+
+		if key := os.Getenv("OLLAMA_API_KEY"); key != "" {
+			client.Headers = http.Header{"Authorization": []string{"Bearer " + key}}
+		}
+
+		return &client, nil
+	}
+
 	if !strings.HasPrefix(h, "http://") && !strings.HasPrefix(h, "https://") {
 		h = "http://" + h
 	}
@@ -71,7 +100,51 @@ func FromEnv() (*Client, error) {
 		u.Host += ":11434"
 	}
 
-	return &Client{Base: *u, HTTP: http.Client{}}, nil
+	client := Client{Base: *u, HTTP: http.Client{}, Retries: defaultRetries}
+
+	// servers with a self signed certificate are trusted with OLLAMA_CA_CERT, e.g. ~/.ollama/tls/cert.pem
+	if file := os.Getenv("OLLAMA_CA_CERT"); file != "" && u.Scheme == "https" {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+
+		client.HTTP.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	// servers which require an api key are sent it as a bearer token
+	if key := os.Getenv("OLLAMA_API_KEY"); key != "" {
+		client.Headers = http.Header{"Authorization": []string{"Bearer " + key}}
+	}
+
+	return &client, nil
+}
+
+// localDialer returns how to connect to host if it's a unix socket, unix:///path, or a windows named pipe,
+// npipe:////./pipe/name
+func localDialer(host string) (func(ctx context.Context, _, _ string) (net.Conn, error), bool) {
+	if path, ok := strings.CutPrefix(host, "unix://"); ok {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}, true
+	}
+
+	if name, ok := npipe.Name(host); ok {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return npipe.Dial(ctx, name)
+		}, true
+	}
+
+	return nil, false
 }
 
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
@@ -102,7 +175,7 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 
 	respObj, err := c.HTTP.Do(request)
 	if err != nil {
-		return err
+		return connectError(err)
 	}
 	defer respObj.Body.Close()
 
@@ -144,16 +217,22 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
-	response, err := http.DefaultClient.Do(request)
+	for k, v := range c.Headers {
+		request.Header[k] = v
+	}
+
+	response, err := c.HTTP.Do(request)
 	if err != nil {
-		return err
+		return connectError(err)
 	}
 	defer response.Body.Close()
 
 	scanner := bufio.NewScanner(response.Body)
 	for scanner.Scan() {
 		var errorResponse struct {
-			Error string `json:"error,omitempty"`
+			Error   string         `json:"error,omitempty"`
+			Code    ErrorCode      `json:"code,omitempty"`
+			Details map[string]any `json:"details,omitempty"`
 		}
 
 		bts := scanner.Bytes()
@@ -161,16 +240,18 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return fmt.Errorf("unmarshal: %w", err)
 		}
 
-		if errorResponse.Error != "" {
-			return fmt.Errorf(errorResponse.Error)
-		}
+		// an error in the middle of a stream comes after a success status
+		if response.StatusCode >= http.StatusBadRequest || errorResponse.Error != "" {
+			apiError := StatusError{ErrorMessage: errorResponse.Error, Code: errorResponse.Code, Details: errorResponse.Details}
+			if response.StatusCode >= http.StatusBadRequest {
+				apiError.StatusCode = response.StatusCode
+			}
 
-		if response.StatusCode >= http.StatusBadRequest {
-			return StatusError{
-				StatusCode:   response.StatusCode,
-				Status:       response.Status,
-				ErrorMessage: errorResponse.Error,
+			if apiError.ErrorMessage == "" {
+				apiError.Status = response.Status
 			}
+
+			return apiError
 		}
 
 		if err := fn(bts); err != nil {
@@ -178,7 +259,40 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		}
 	}
 
-	return nil
+	return scanner.Err()
+}
+
+// retry runs fn again when it fails to reach the server or the server is busy, up to c.Retries times and for
+// as long as ctx isn't done. only requests which are safe to repeat are retried
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	for try := 0; ; try++ {
+		err := fn()
+		if err == nil || try >= c.Retries || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+func retryable(err error) bool {
+	var statusError StatusError
+	if errors.As(err, &statusError) && (statusError.StatusCode == http.StatusBadGateway || statusError.StatusCode == http.StatusGatewayTimeout) {
+		return true
+	}
+
+	return errors.Is(err, ErrConnectionRefused) || errors.Is(err, ErrServerBusy)
 }
 
 type GenerateResponseFunc func(GenerateResponse) error
@@ -194,8 +308,70 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 	})
 }
 
+type ChatResponseFunc func(ChatResponse) error
+
+func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/chat", req, func(bts []byte) error {
+		var resp ChatResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+// CancelGenerate stops the running generate request with id
+func (c *Client) CancelGenerate(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/generate/%s/cancel", id), nil, nil)
+}
+
 type PullProgressFunc func(ProgressResponse) error
 
+// Tag gives req.Source each of req.Tags, returning the models which share its layers
+func (c *Client) Tag(ctx context.Context, req *TagRequest) (*TagResponse, error) {
+	var resp TagResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tag", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Verify re-hashes the blobs of a model, and downloads corrupted ones again if req.Repair is set
+func (c *Client) Verify(ctx context.Context, req *VerifyRequest, fn PullProgressFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/verify", req, func(bts []byte) error {
+		var resp ProgressResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+type DoctorCheckFunc func(DoctorCheck) error
+
+// Doctor runs the server's checks of the path to the registry, fn is called with the result of each one
+func (c *Client) Doctor(ctx context.Context, req *DoctorRequest, fn DoctorCheckFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/doctor", req, func(bts []byte) error {
+		var check DoctorCheck
+		if err := json.Unmarshal(bts, &check); err != nil {
+			return err
+		}
+
+		return fn(check)
+	})
+}
+
+// Check asks the registry whether models have changed since they were pulled, without pulling them
+func (c *Client) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	var cr CheckResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodPost, "/api/check", req, &cr) }); err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
 func (c *Client) Pull(ctx context.Context, req *PullRequest, fn PullProgressFunc) error {
 	return c.stream(ctx, http.MethodPost, "/api/pull", req, func(bts []byte) error {
 		var resp ProgressResponse
@@ -235,12 +411,153 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest, fn CreateProgre
 
 func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	var lr ListResponse
-	if err := c.do(ctx, http.MethodGet, "/api/tags", nil, &lr); err != nil {
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodGet, "/api/tags", nil, &lr) }); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// Export writes a tar archive of the model, with everything needed to import it elsewhere, to w
+func (c *Client) Export(ctx context.Context, req *ExportRequest, w io.Writer) error {
+	bts, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Base.JoinPath("/api/export").String(), bytes.NewReader(bts))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+
+	for k, v := range c.Headers {
+		request.Header[k] = v
+	}
+
+	resp, err := c.HTTP.Do(request)
+	if err != nil {
+		return connectError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		return checkError(resp, body)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import sends a tar archive written by Export to the server and returns the models it contained
+func (c *Client) Import(ctx context.Context, r io.Reader) (*ImportResponse, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Base.JoinPath("/api/import").String(), r)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-tar")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+
+	for k, v := range c.Headers {
+		request.Header[k] = v
+	}
+
+	resp, err := c.HTTP.Do(request)
+	if err != nil {
+		return nil, connectError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkError(resp, body); err != nil {
+		return nil, err
+	}
+
+	var ir ImportResponse
+	if err := json.Unmarshal(body, &ir); err != nil {
+		return nil, err
+	}
+	return &ir, nil
+}
+
+func (c *Client) Prune(ctx context.Context, req *PruneRequest) (*PruneResponse, error) {
+	var resp PruneResponse
+	if err := c.do(ctx, http.MethodDelete, "/api/blobs/unused", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) ListDownloads(ctx context.Context) (*ListDownloadsResponse, error) {
+	var lr ListDownloadsResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodGet, "/api/downloads", nil, &lr) }); err != nil {
 		return nil, err
 	}
 	return &lr, nil
 }
 
+func (c *Client) ListBackgroundPulls(ctx context.Context) (*ListBackgroundPullsResponse, error) {
+	var lr ListBackgroundPullsResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodGet, "/api/pulls", nil, &lr) }); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// CancelBackgroundPull removes a queued pull, or stops it if it's running
+func (c *Client) CancelBackgroundPull(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/pulls/%s", id), nil, nil)
+}
+
+func (c *Client) PauseDownload(ctx context.Context, digest string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/downloads/%s/pause", digest), nil, nil)
+}
+
+func (c *Client) ResumeDownload(ctx context.Context, digest string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/downloads/%s/resume", digest), nil, nil)
+}
+
+func (c *Client) CancelDownload(ctx context.Context, digest string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/downloads/%s/cancel", digest), nil, nil)
+}
+
+// ListRunning returns the models loaded in memory
+func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
+	var pr ProcessResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodGet, "/api/ps", nil, &pr) }); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// Load loads the model name into memory ahead of any requests for it
+func (c *Client) Load(ctx context.Context, name string, req *LoadRequest) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/load", name), req, nil)
+}
+
+// AcknowledgeLicense acknowledges the licenses of the model name, servers which require it only run models
+// once their license has been acknowledged
+func (c *Client) AcknowledgeLicense(ctx context.Context, name string) (*LicenseResponse, error) {
+	var resp LicenseResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/license", name), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Unload unloads the model name from memory
+func (c *Client) Unload(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/models/%s/unload", name), nil, nil)
+}
+
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	if err := c.do(ctx, http.MethodPost, "/api/copy", req, nil); err != nil {
 		return err
@@ -257,7 +574,23 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
-	if err := c.do(ctx, http.MethodPost, "/api/show", req, &resp); err != nil {
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodPost, "/api/show", req, &resp) }); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp) }); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.retry(ctx, func() error { return c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp) }); err != nil {
 		return nil, err
 	}
 	return &resp, nil
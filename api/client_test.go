@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	refused := connectError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)})
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad gateway", StatusError{StatusCode: http.StatusBadGateway}, true},
+		{"service unavailable", StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"gateway timeout", StatusError{StatusCode: http.StatusGatewayTimeout}, true},
+		{"too many requests", StatusError{StatusCode: http.StatusTooManyRequests, Code: CodeTooManyRequests}, true},
+		{"server busy", StatusError{StatusCode: http.StatusServiceUnavailable, Code: CodeServerBusy}, true},
+		{"connection refused", refused, true},
+		{"wrapped connection refused", fmt.Errorf("list: %w", refused), true},
+		{"bad request", StatusError{StatusCode: http.StatusBadRequest}, false},
+		{"internal error", StatusError{StatusCode: http.StatusInternalServerError}, false},
+		{"model not found", StatusError{StatusCode: http.StatusNotFound, Code: CodeModelNotFound}, false},
+		{"cancelled", context.Canceled, false},
+	}
+
+	for _, tt := range cases {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("%s: retryable(%v) = %t, want %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	busy := StatusError{StatusCode: http.StatusServiceUnavailable}
+	bad := StatusError{StatusCode: http.StatusBadRequest}
+
+	cases := []struct {
+		name      string
+		errs      []error // what each try returns, the last is repeated
+		wantTries int
+		wantErr   error
+	}{
+		{"succeeds", []error{nil}, 1, nil},
+		{"succeeds after retrying", []error{busy, busy, nil}, 3, nil},
+		{"isn't retryable", []error{bad}, 1, bad},
+		{"runs out of retries", []error{busy}, 4, busy},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Client{Retries: 3, RetryBackoff: time.Millisecond}
+
+			var tries int
+			err := c.retry(context.Background(), func() error {
+				err := tt.errs[len(tt.errs)-1]
+				if tries < len(tt.errs) {
+					err = tt.errs[tries]
+				}
+
+				tries++
+				return err
+			})
+
+			if tries != tt.wantTries || !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("got %d tries and %v, want %d and %v", tries, err, tt.wantTries, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenDone(t *testing.T) {
+	c := Client{Retries: 10, RetryBackoff: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	var tries int
+	start := time.Now()
+	err := c.retry(ctx, func() error {
+		tries++
+		return StatusError{StatusCode: http.StatusServiceUnavailable}
+	})
+
+	// the last error is returned rather than waiting out the backoff
+	if tries != 1 || !errors.Is(err, ErrServerBusy) {
+		t.Errorf("got %d tries and %v", tries, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry waited %s after ctx was done", elapsed)
+	}
+}
+
+func TestListRetries(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error": "server busy, too many requests waiting", "code": "SERVER_BUSY"}`))
+			return
+		}
+
+		w.Write([]byte(`{"models": []}`))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Client{Base: *u, Retries: 3, RetryBackoff: time.Millisecond}
+	if _, err := c.List(context.Background()); err != nil || requests != 2 {
+		t.Errorf("got %v after %d requests", err, requests)
+	}
+
+	// nothing listening
+	srv.Close()
+	requests = 0
+	if _, err := c.List(context.Background()); !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("expected %v, got %v", ErrConnectionRefused, err)
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var (
+	// ErrConnectionRefused is the error of a request to a server which isn't running, nothing is listening at
+	// its address
+	ErrConnectionRefused = errors.New("could not connect to ollama server")
+	// ErrModelNotFound is the error of a request for a model which hasn't been pulled or created
+	ErrModelNotFound = errors.New("model not found")
+	// ErrServerBusy is the error of a request the server turned away because too many requests are waiting
+	ErrServerBusy = errors.New("server busy")
+)
+
+// ErrorCode is the code of an error response, it tells clients what went wrong without matching the message
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "INVALID_REQUEST"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeConflict             ErrorCode = "CONFLICT"
+	CodeLimitExceeded        ErrorCode = "LIMIT_EXCEEDED"
+	CodeTooManyRequests      ErrorCode = "TOO_MANY_REQUESTS"
+	CodeInternal             ErrorCode = "INTERNAL_ERROR"
+	CodeServerBusy           ErrorCode = "SERVER_BUSY"
+	CodeTimeout              ErrorCode = "TIMEOUT"
+	CodeCancelled            ErrorCode = "CANCELLED"
+	CodeModelNotFound        ErrorCode = "MODEL_NOT_FOUND"
+	CodeModelReadOnly        ErrorCode = "MODEL_READ_ONLY"
+	CodeLicenseRequired      ErrorCode = "LICENSE_REQUIRED"
+	CodeInsufficientMemory   ErrorCode = "INSUFFICIENT_MEMORY"
+	CodeDownloadFailed       ErrorCode = "DOWNLOAD_FAILED"
+	CodeRegistryUnauthorized ErrorCode = "REGISTRY_UNAUTHORIZED"
+)
+
+// Is lets errors.Is tell what the error of a response was, as one of ErrModelNotFound or ErrServerBusy. servers
+// from before error codes are matched by their message
+func (e StatusError) Is(target error) bool {
+	switch target {
+	case ErrModelNotFound:
+		if e.Code != "" {
+			return e.Code == CodeModelNotFound
+		}
+
+		return (e.StatusCode == http.StatusNotFound || e.StatusCode == 0) && strings.HasPrefix(e.ErrorMessage, "model ") && strings.Contains(e.ErrorMessage, "not found")
+	case ErrServerBusy:
+		if e.Code != "" {
+			return e.Code == CodeServerBusy || e.Code == CodeTooManyRequests
+		}
+
+		// errors in the middle of a stream have no status of their own
+		return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests ||
+			(e.StatusCode == 0 && strings.HasPrefix(e.ErrorMessage, "server busy"))
+	}
+
+	return false
+}
+
+// wsaeconnrefused is the error of a refused connection on windows
+const wsaeconnrefused = syscall.Errno(10061)
+
+// connectError wraps the error of a request which couldn't connect, so it matches ErrConnectionRefused if the
+// server isn't listening
+func connectError(err error) error {
+	// a unix socket or named pipe which doesn't exist is a server which isn't running too
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, wsaeconnrefused) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrConnectionRefused, err)
+	}
+
+	return err
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestStatusErrorIs(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      StatusError
+		notFound bool
+		busy     bool
+	}{
+		{"coded model not found", StatusError{StatusCode: http.StatusNotFound, Code: CodeModelNotFound, ErrorMessage: "model 'llama2' not found"}, true, false},
+		{"coded server busy", StatusError{StatusCode: http.StatusServiceUnavailable, Code: CodeServerBusy}, false, true},
+		{"coded too many requests", StatusError{StatusCode: http.StatusTooManyRequests, Code: CodeTooManyRequests}, false, true},
+		{"coded in a stream", StatusError{Code: CodeServerBusy, ErrorMessage: "server busy, too many requests waiting"}, false, true},
+		{"the code wins over the message", StatusError{StatusCode: http.StatusNotFound, Code: CodeNotFound, ErrorMessage: "model 'llama2' not found"}, false, false},
+		{"coded other error", StatusError{StatusCode: http.StatusServiceUnavailable, Code: CodeInternal}, false, false},
+		{"legacy model not found", StatusError{StatusCode: http.StatusNotFound, ErrorMessage: "model 'llama2' not found, try pulling it first"}, true, false},
+		{"legacy model not found in a stream", StatusError{ErrorMessage: "model 'llama2' not found"}, true, false},
+		{"legacy other not found", StatusError{StatusCode: http.StatusNotFound, ErrorMessage: "blob not found"}, false, false},
+		{"legacy not found with another status", StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "model 'llama2' not found"}, false, false},
+		{"legacy service unavailable", StatusError{StatusCode: http.StatusServiceUnavailable}, false, true},
+		{"legacy too many requests", StatusError{StatusCode: http.StatusTooManyRequests}, false, true},
+		{"legacy busy in a stream", StatusError{ErrorMessage: "server busy, too many requests waiting"}, false, true},
+		{"legacy busy with another status", StatusError{StatusCode: http.StatusInternalServerError, ErrorMessage: "server busy"}, false, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// wrapped as the client's callers see them
+			err := fmt.Errorf("pull: %w", tt.err)
+			if got := errors.Is(err, ErrModelNotFound); got != tt.notFound {
+				t.Errorf("errors.Is(ErrModelNotFound) = %t, want %t", got, tt.notFound)
+			}
+
+			if got := errors.Is(err, ErrServerBusy); got != tt.busy {
+				t.Errorf("errors.Is(ErrServerBusy) = %t, want %t", got, tt.busy)
+			}
+
+			if errors.Is(err, ErrConnectionRefused) {
+				t.Error("expected a response not to be a refused connection")
+			}
+		})
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		refused bool
+	}{
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"connection refused on windows", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connectex", wsaeconnrefused)}, true},
+		{"missing unix socket", &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ENOENT)}, true},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, false},
+		{"other", errors.New("tls: handshake failure"), false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := connectError(tt.err)
+			if got := errors.Is(err, ErrConnectionRefused); got != tt.refused {
+				t.Errorf("errors.Is(ErrConnectionRefused) = %t, want %t", got, tt.refused)
+			}
+
+			// the original error is kept
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected %v to wrap %v", err, tt.err)
+			}
+		})
+	}
+}
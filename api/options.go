@@ -0,0 +1,230 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// predictOptions only change how a loaded model generates, a request can set them without the model being
+// loaded again with them
+var predictOptions = map[string]bool{
+	"seed":              true,
+	"num_predict":       true,
+	"top_k":             true,
+	"top_p":             true,
+	"tfs_z":             true,
+	"typical_p":         true,
+	"repeat_last_n":     true,
+	"temperature":       true,
+	"repeat_penalty":    true,
+	"presence_penalty":  true,
+	"frequency_penalty": true,
+	"mirostat":          true,
+	"mirostat_tau":      true,
+	"mirostat_eta":      true,
+	"penalize_newline":  true,
+	"stop":              true,
+}
+
+// IsPredictOption reports whether the option can change for each request to a loaded model
+func IsPredictOption(name string) bool {
+	return predictOptions[name]
+}
+
+// optionRanges are the lowest and highest values of numeric options, options which aren't listed can be any
+// number
+var optionRanges = map[string][2]float64{
+	"num_ctx":          {1, math.Inf(1)},
+	"num_keep":         {-1, math.Inf(1)},
+	"num_batch":        {1, math.Inf(1)},
+	"num_gqa":          {0, math.Inf(1)},
+	"num_gpu":          {-1, math.Inf(1)},
+	"main_gpu":         {0, math.Inf(1)},
+	"num_draft":        {1, math.Inf(1)},
+	"num_prompt_cache": {0, math.Inf(1)},
+	"num_thread":       {0, math.Inf(1)},
+	"num_predict":      {-2, math.Inf(1)},
+	"top_k":            {0, math.Inf(1)},
+	"top_p":            {0, 1},
+	"tfs_z":            {0, math.Inf(1)},
+	"typical_p":        {0, 1},
+	"repeat_last_n":    {-1, math.Inf(1)},
+	"temperature":      {0, math.Inf(1)},
+	"repeat_penalty":   {0, math.Inf(1)},
+	"mirostat":         {0, 2},
+	"mirostat_tau":     {0, math.Inf(1)},
+	"mirostat_eta":     {0, math.Inf(1)},
+}
+
+// OptionError is an option of a request which can't be used, and why
+type OptionError struct {
+	Option string `json:"option"`
+	Reason string `json:"reason"`
+}
+
+// OptionsError lists every option of a request which can't be used
+type OptionsError struct {
+	Errors []OptionError
+}
+
+func (e *OptionsError) Error() string {
+	reasons := make([]string, len(e.Errors))
+	for i, oe := range e.Errors {
+		reasons[i] = fmt.Sprintf("%s %s", oe.Option, oe.Reason)
+	}
+
+	return "invalid options: " + strings.Join(reasons, ", ")
+}
+
+// optionFields are the fields of Options by their json names
+func optionFields() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Options{})) {
+		if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+			fields[name] = field
+		}
+	}
+
+	return fields
+}
+
+// ValidateOptions checks the options of a request, as they are decoded from json. it returns an *OptionsError
+// listing each option which is unknown, has a value of the wrong type or is out of range
+func ValidateOptions(m map[string]interface{}) error {
+	fields := optionFields()
+
+	var errs []OptionError
+	for name, val := range m {
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, OptionError{Option: name, Reason: "is not a known option"})
+			continue
+		}
+
+		if val == nil {
+			continue
+		}
+
+		if reason := checkOption(name, field.Type.Kind(), val); reason != "" {
+			errs = append(errs, OptionError{Option: name, Reason: reason})
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Option < errs[j].Option })
+	return &OptionsError{Errors: errs}
+}
+
+func checkOption(name string, kind reflect.Kind, val interface{}) string {
+	switch kind {
+	case reflect.Int, reflect.Float32:
+		f, ok := val.(float64)
+		if !ok {
+			return "must be a number"
+		}
+
+		if kind == reflect.Int && f != math.Trunc(f) {
+			return "must be a whole number"
+		}
+
+		if r, ok := optionRanges[name]; ok && (f < r[0] || f > r[1]) {
+			if math.IsInf(r[1], 1) {
+				return fmt.Sprintf("must be at least %g", r[0])
+			}
+
+			return fmt.Sprintf("must be between %g and %g", r[0], r[1])
+		}
+	case reflect.Bool:
+		if _, ok := val.(bool); !ok {
+			return "must be true or false"
+		}
+	case reflect.String:
+		if _, ok := val.(string); !ok {
+			return "must be a string"
+		}
+	case reflect.Slice:
+		list, ok := val.([]interface{})
+		if !ok {
+			return "must be a list of strings"
+		}
+
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return "must be a list of strings"
+			}
+		}
+	}
+
+	return ""
+}
+
+// Map returns every option by its json name, including the ones which are zero
+func (opts Options) Map() map[string]interface{} {
+	m := make(map[string]interface{})
+	v := reflect.ValueOf(opts)
+	for name, field := range optionFields() {
+		m[name] = v.FieldByIndex(field.Index).Interface()
+	}
+
+	return m
+}
+
+// ParseOption converts the values of an option written as text, such as in a Modelfile, to the option's type.
+// only list options, like stop, can have more than one value
+func ParseOption(name string, values ...string) (interface{}, error) {
+	field, ok := optionFields()[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a known option", name)
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s needs a value", name)
+	}
+
+	kind := field.Type.Kind()
+	if len(values) > 1 && kind != reflect.Slice {
+		return nil, fmt.Errorf("%s takes one value", name)
+	}
+
+	var val interface{}
+	switch kind {
+	case reflect.Int, reflect.Float32:
+		f, err := strconv.ParseFloat(values[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", name)
+		}
+
+		val = f
+	case reflect.Bool:
+		b, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", name)
+		}
+
+		val = b
+	case reflect.String:
+		val = values[0]
+	case reflect.Slice:
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+
+		val = list
+	default:
+		return nil, fmt.Errorf("%s can't be set", name)
+	}
+
+	if reason := checkOption(name, kind, val); reason != "" {
+		return nil, fmt.Errorf("%s %s", name, reason)
+	}
+
+	return val, nil
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+// Stream is the responses of a streaming request, read one at a time like a bufio.Scanner:
+//
+//	stream := client.GenerateStream(ctx, req)
+//	defer stream.Close()
+//	for stream.Next() {
+//		fmt.Print(stream.Current().Response)
+//	}
+//	if err := stream.Err(); err != nil {
+//		...
+//	}
+//
+// the request stops when ctx is done or the stream is closed
+type Stream[T any] struct {
+	ch     chan T
+	cancel context.CancelFunc
+
+	current T
+	closed  bool
+
+	mu  sync.Mutex
+	err error
+}
+
+func newStream[T any](ctx context.Context, run func(context.Context, func(T) error) error) *Stream[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream[T]{ch: make(chan T), cancel: cancel}
+
+	go func() {
+		defer close(s.ch)
+		// err is set before ch is closed, so it's seen by whoever sees the stream end
+		err := run(ctx, func(v T) error {
+			select {
+			case s.ch <- v:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.err = err
+	}()
+
+	return s
+}
+
+// Next waits for the next response, it returns false once there are no more or the request failed
+func (s *Stream[T]) Next() bool {
+	v, ok := <-s.ch
+	if !ok {
+		return false
+	}
+
+	s.current = v
+	return true
+}
+
+// Current is the response Next waited for
+func (s *Stream[T]) Current() T {
+	return s.current
+}
+
+// C returns the channel of responses, for reading the stream in a select. the channel is closed when the stream
+// ends, Err is then why
+func (s *Stream[T]) C() <-chan T {
+	return s.ch
+}
+
+// Err is the error the stream ended with, if it didn't finish. it's only set once Next has returned false, and
+// is nil once the stream is closed
+func (s *Stream[T]) Err() error {
+	if s.closed {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the request if it's still streaming
+func (s *Stream[T]) Close() {
+	s.closed = true
+	s.cancel()
+	for range s.ch {
+	}
+}
+
+// GenerateStream is Generate with its responses read from a Stream
+func (c *Client) GenerateStream(ctx context.Context, req *GenerateRequest) *Stream[GenerateResponse] {
+	return newStream(ctx, func(ctx context.Context, fn func(GenerateResponse) error) error {
+		return c.Generate(ctx, req, fn)
+	})
+}
+
+// ChatStream is Chat with its responses read from a Stream
+func (c *Client) ChatStream(ctx context.Context, req *ChatRequest) *Stream[ChatResponse] {
+	return newStream(ctx, func(ctx context.Context, fn func(ChatResponse) error) error {
+		return c.Chat(ctx, req, fn)
+	})
+}
+
+// PullStream is Pull with its progress read from a Stream
+func (c *Client) PullStream(ctx context.Context, req *PullRequest) *Stream[ProgressResponse] {
+	return newStream(ctx, func(ctx context.Context, fn func(ProgressResponse) error) error {
+		return c.Pull(ctx, req, fn)
+	})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// streamServer streams lines to /api/generate, each one flushed. a line is only sent once the previous one has
+// been read from next, if it's set
+func streamServer(t *testing.T, lines []string, next chan struct{}, done chan struct{}) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i, line := range lines {
+			if i > 0 && next != nil {
+				select {
+				case <-next:
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			fmt.Fprintln(w, line)
+			w.(http.Flusher).Flush()
+		}
+
+		// wait for the client to go, so a closed stream is seen as a cancelled request
+		if next != nil {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Client{Base: *u}
+}
+
+func TestStream(t *testing.T) {
+	done := make(chan struct{})
+	c := streamServer(t, []string{`{"response": "a"}`, `{"response": "b"}`, `{"response": "c", "done": true}`}, nil, done)
+
+	stream := c.GenerateStream(context.Background(), &GenerateRequest{Model: "llama2"})
+	defer stream.Close()
+
+	var got string
+	for stream.Next() {
+		got += stream.Current().Response
+		if err := stream.Err(); err != nil {
+			t.Fatalf("expected no error while the stream is running, got %v", err)
+		}
+	}
+
+	if got != "abc" || !stream.Current().Done {
+		t.Errorf("got %q, done %t", got, stream.Current().Done)
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Errorf("expected a finished stream to have no error, got %v", err)
+	}
+
+	if stream.Next() {
+		t.Error("expected a finished stream to stay finished")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	next, done := make(chan struct{}), make(chan struct{})
+	c := streamServer(t, []string{`{"response": "a"}`, `{"error": "server busy, too many requests waiting", "code": "SERVER_BUSY"}`}, next, done)
+
+	stream := c.GenerateStream(context.Background(), &GenerateRequest{Model: "llama2"})
+	defer stream.Close()
+
+	if !stream.Next() || stream.Current().Response != "a" {
+		t.Fatalf("expected the first response, got %+v, %v", stream.Current(), stream.Err())
+	}
+
+	// the error isn't seen until Next has returned false
+	if err := stream.Err(); err != nil {
+		t.Fatalf("expected no error before the stream ends, got %v", err)
+	}
+
+	next <- struct{}{}
+	if stream.Next() {
+		t.Fatalf("expected the stream to end, got %+v", stream.Current())
+	}
+
+	var statusError StatusError
+	if err := stream.Err(); !errors.As(err, &statusError) || !errors.Is(err, ErrServerBusy) {
+		t.Errorf("expected the stream's error, got %v", err)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	next, done := make(chan struct{}), make(chan struct{})
+	c := streamServer(t, []string{`{"response": "a"}`, `{"response": "b"}`}, next, done)
+
+	stream := c.GenerateStream(context.Background(), &GenerateRequest{Model: "llama2"})
+	if !stream.Next() {
+		t.Fatalf("expected the first response, got %v", stream.Err())
+	}
+
+	// closing in the middle of the stream stops the request
+	stream.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to stop")
+	}
+
+	if stream.Next() {
+		t.Errorf("expected a closed stream to end, got %+v", stream.Current())
+	}
+
+	// the request was cancelled by Close, it didn't fail
+	if err := stream.Err(); err != nil {
+		t.Errorf("expected no error after Close, got %v", err)
+	}
+}
+
+func TestStreamContextDone(t *testing.T) {
+	next, done := make(chan struct{}), make(chan struct{})
+	c := streamServer(t, []string{`{"response": "a"}`, `{"response": "b"}`}, next, done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := c.GenerateStream(ctx, &GenerateRequest{Model: "llama2"})
+	defer stream.Close()
+
+	if !stream.Next() {
+		t.Fatalf("expected the first response, got %v", stream.Err())
+	}
+
+	cancel()
+	if stream.Next() {
+		t.Errorf("expected the stream to end, got %+v", stream.Current())
+	}
+
+	if err := stream.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -15,6 +14,11 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// Code is what went wrong, and Details what it went wrong with, such as the digest and offset of a failed
+	// download. they're empty in errors from servers before error codes
+	Code    ErrorCode      `json:"code,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
 }
 
 func (e StatusError) Error() string {
@@ -38,31 +42,206 @@ type GenerateRequest struct {
 	Template string `json:"template"`
 	Context  []int  `json:"context,omitempty"`
 
+	// Images are shown to multimodal models with the prompt, they're base64 in json
+	Images []ImageData `json:"images,omitempty"`
+
+	// Logprobs returns the log probability of each generated token, TopLogprobs is how many of the tokens which
+	// were most likely to be generated in its place are returned with it
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
+	// Format is json to constrain the output to a json object, Grammar to a gbnf grammar and JSONSchema to json
+	// matching a schema. only one of them can be set
+	Format     string          `json:"format,omitempty"`
+	Grammar    string          `json:"grammar,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// ID identifies the request to cancel it with, one is made up if it is left empty
+	ID string `json:"id,omitempty"`
+
+	// KeepAlive is how long the model stays loaded after the request, it defaults to 5 minutes
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// NoCache runs the model even if the server has cached the response to the same request
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// Adapter is a model created FROM Model with an ADAPTER, its LoRA adapter is applied to Model for this request
+	// without loading another model
+	Adapter string `json:"adapter,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+// Message is a turn in a conversation, Role is system, user, assistant or tool. tool messages are the results of
+// the assistant's tool calls
+type Message struct {
+	Role      string      `json:"role"`
+	Content   string      `json:"content"`
+	Images    []ImageData `json:"images,omitempty"`
+	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+}
+
+// ImageData is an image file such as a png or jpeg
+type ImageData []byte
+
+// Tool is a function the model can call, Parameters is a json schema of its arguments
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type LoadRequest struct {
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
+type ProcessModelResponse struct {
+	Name    string `json:"name"`
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	SizeCPU int64  `json:"size_cpu"`
+	SizeGPU int64  `json:"size_gpu"`
+
+	// ExpiresAt is when the model will be unloaded, it is left out if the model is kept loaded until unloaded
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type ProcessResponse struct {
+	Models []ProcessModelResponse `json:"models"`
+}
+
+// GPU is a GPU the server can offload models to, its VRAM is in bytes
+type GPU struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	TotalVRAM int64  `json:"total_vram"`
+	FreeVRAM  int64  `json:"free_vram"`
+}
+
+type GPUsResponse struct {
+	GPUs []GPU `json:"gpus"`
+}
+
+const (
+	HealthStatusOK      = "ok"
+	HealthStatusFailing = "failing"
+	HealthStatusSkipped = "skipped"
+)
+
+// HealthResponse is whether the server is alive, or ready for requests with the status of each component it
+// needs for them
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// ComponentStatus is the status of one of the server's components, Message says why if it's failing
+type ComponentStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// DoctorRequest checks the path to the registry of Model, SampleSize is how many bytes of the model are downloaded
+// and written to the blob store to measure their throughput
+type DoctorRequest struct {
+	Model      string `json:"model,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	SampleSize int64  `json:"sample_size,omitempty"`
+}
+
+// DoctorCheck is the result of one of the checks of /api/doctor, a check is skipped if one it depends on failed
+type DoctorCheck struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Message  string        `json:"message,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
 type EmbeddingRequest struct {
 	Model  string `json:"model"`
 	Prompt string `json:"prompt"`
 
+	// Prompts embeds several prompts at once, instead of Prompt
+	Prompts []string `json:"prompts,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float64 `json:"embedding"`
+	Embedding []float64 `json:"embedding,omitempty"`
+
+	// a batch of prompts streams its progress, then the embeddings in the same order as the prompts
+	Embeddings [][]float64 `json:"embeddings,omitempty"`
+	Total      int         `json:"total,omitempty"`
+	Completed  int         `json:"completed,omitempty"`
+}
+
+// TokenizeRequest converts Text to the model's tokens
+type TokenizeRequest struct {
+	Model   string                 `json:"model"`
+	Text    string                 `json:"text"`
+	Options map[string]interface{} `json:"options"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+	Count  int   `json:"count"`
+}
+
+// DetokenizeRequest converts the model's Tokens back to text
+type DetokenizeRequest struct {
+	Model   string                 `json:"model"`
+	Tokens  []int                  `json:"tokens"`
+	Options map[string]interface{} `json:"options"`
+}
+
+type DetokenizeResponse struct {
+	Text  string `json:"text"`
+	Count int    `json:"count"`
 }
 
 type CreateRequest struct {
 	Name string `json:"name"`
 	Path string `json:"path"`
+
+	// Quantize is the file type to quantize an f16 or f32 model to, such as q4_K_M
+	Quantize string `json:"quantize,omitempty"`
 }
 
 type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+type FlushPromptCacheRequest struct {
+	// Model only flushes this model's cache, every loaded model's cache is flushed if it's empty
+	Model string `json:"model,omitempty"`
+}
+
+type FlushPromptCacheResponse struct {
+	Models []string `json:"models"`
+}
+
 type ShowRequest struct {
 	Name string `json:"name"`
+
+	// Verbose includes the model's metadata and tensors, read from its gguf file
+	Verbose bool `json:"verbose,omitempty"`
 }
 
 type ShowResponse struct {
@@ -71,6 +250,52 @@ type ShowResponse struct {
 	Parameters string `json:"parameters,omitempty"`
 	Template   string `json:"template,omitempty"`
 	System     string `json:"system,omitempty"`
+
+	// Messages are the example conversation the model starts chats with
+	Messages []Message `json:"messages,omitempty"`
+
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	Stats *ModelStats `json:"stats,omitempty"`
+
+	// ModelInfo and Tensors are the key values and tensors of a gguf model, shown with Verbose
+	ModelInfo map[string]any `json:"model_info,omitempty"`
+	Tensors   []TensorInfo   `json:"tensors,omitempty"`
+}
+
+// ModelStats is what a model has served on the server, it's kept across restarts. GPUSeconds is the time requests
+// spent running on the model while it had layers on a GPU
+type ModelStats struct {
+	Requests        int       `json:"requests"`
+	PromptTokens    int       `json:"prompt_tokens"`
+	GeneratedTokens int       `json:"generated_tokens"`
+	GPUSeconds      float64   `json:"gpu_seconds"`
+	LastUsedAt      time.Time `json:"last_used_at"`
+}
+
+// Provenance is where a model came from and under what license
+type Provenance struct {
+	// Source is the url of the model's upstream repository, Checkpoint the digest of the weights it was created
+	// from, before any conversion or quantization
+	Source     string `json:"source,omitempty"`
+	Checkpoint string `json:"checkpoint,omitempty"`
+
+	// Licenses are the digests of the model's license layers, LicenseAcknowledged is set once every one of them
+	// has been acknowledged on the server
+	Licenses            []string `json:"licenses,omitempty"`
+	LicenseAcknowledged bool     `json:"license_acknowledged,omitempty"`
+}
+
+// LicenseResponse is the licenses of a model which were acknowledged
+type LicenseResponse struct {
+	Licenses       []string  `json:"licenses"`
+	AcknowledgedAt time.Time `json:"acknowledged_at"`
+}
+
+type TensorInfo struct {
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Shape []uint64 `json:"shape"`
 }
 
 type CopyRequest struct {
@@ -78,20 +303,120 @@ type CopyRequest struct {
 	Destination string `json:"destination"`
 }
 
+// TagRequest gives Source each of Tags, a bare tag such as v2 is a tag in the source's repository
+type TagRequest struct {
+	Source string   `json:"source"`
+	Tags   []string `json:"tags"`
+}
+
+type TagResponse struct {
+	Name string `json:"name"`
+
+	// Shared are the other models with layers in common, tags of the model have all of them
+	Shared []SharedModel `json:"shared"`
+}
+
+type SharedModel struct {
+	Name         string `json:"name"`
+	Digest       string `json:"digest"`
+	Tag          bool   `json:"tag"`
+	SharedLayers int    `json:"shared_layers"`
+	SharedSize   int    `json:"shared_size"`
+}
+
 type PullRequest struct {
+	Name          string `json:"name"`
+	Insecure      bool   `json:"insecure,omitempty"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	WithReferrers bool   `json:"with_referrers,omitempty"`
+
+	// Background queues the pull to run at a low priority instead of now, After is when it may start, a local
+	// time such as "01:00" or an RFC 3339 time. a pull with After is always a background pull
+	Background bool   `json:"background,omitempty"`
+	After      string `json:"after,omitempty"`
+}
+
+// BackgroundPull is a pull queued to run in the background, State is one of the BackgroundPull values
+type BackgroundPull struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Insecure      bool      `json:"insecure,omitempty"`
+	WithReferrers bool      `json:"with_referrers,omitempty"`
+	QueuedAt      time.Time `json:"queued_at"`
+	After         time.Time `json:"after"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+
+	// Total and Completed are the bytes of the layers being downloaded, while the pull is running
+	Total     int `json:"total,omitempty"`
+	Completed int `json:"completed,omitempty"`
+}
+
+const (
+	BackgroundPullQueued  = "queued"
+	BackgroundPullRunning = "running"
+	BackgroundPullFailed  = "failed"
+)
+
+type ListBackgroundPullsResponse struct {
+	Pulls []BackgroundPull `json:"pulls"`
+}
+
+// VerifyRequest re-hashes the blobs of a model, with Repair the corrupted ones are downloaded again
+// CheckRequest checks the model name for updates, or every installed model if it's empty
+type CheckRequest struct {
+	Name     string `json:"name,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+}
+
+type CheckResponse struct {
+	Models []ModelUpdate `json:"models"`
+}
+
+// ModelUpdate is whether the registry has a newer version of a model, error is why it couldn't be checked
+type ModelUpdate struct {
+	Name            string    `json:"name"`
+	UpdateAvailable bool      `json:"update_available"`
+	CheckedAt       time.Time `json:"checked_at,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type VerifyRequest struct {
 	Name     string `json:"name"`
+	Repair   bool   `json:"repair,omitempty"`
 	Insecure bool   `json:"insecure,omitempty"`
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
 type ProgressResponse struct {
-	Status    string `json:"status"`
-	Digest    string `json:"digest,omitempty"`
-	Total     int    `json:"total,omitempty"`
-	Completed int    `json:"completed,omitempty"`
+	Status       string `json:"status"`
+	Digest       string `json:"digest,omitempty"`
+	Total        int    `json:"total,omitempty"`
+	Completed    int    `json:"completed,omitempty"`
+	DownloadID   string `json:"download_id,omitempty"`
+	CancelReason string `json:"cancel_reason,omitempty"`
+
+	// speed and time left are estimated from recent progress, they are left out until there is enough to go on
+	BytesPerSecond int64         `json:"bytes_per_second,omitempty"`
+	ETA            time.Duration `json:"eta,omitempty"`
+
+	// State is the state of the layer in Digest, one of the ProgressState values
+	State string `json:"state,omitempty"`
+
+	// Seq numbers the progress responses of a request in the order they were sent, starting from 1
+	Seq int `json:"seq,omitempty"`
 }
 
+const (
+	ProgressStateDownloading = "downloading"
+	ProgressStateUploading   = "uploading"
+	ProgressStatePaused      = "paused"
+	ProgressStateStopped     = "stopped"
+	ProgressStateComplete    = "complete"
+)
+
 type PushRequest struct {
 	Name     string `json:"name"`
 	Insecure bool   `json:"insecure,omitempty"`
@@ -99,38 +424,263 @@ type PushRequest struct {
 	Password string `json:"password"`
 }
 
+type ExportRequest struct {
+	Name string `json:"name"`
+}
+
+type ImportResponse struct {
+	Models []string `json:"models"`
+}
+
+type PruneRequest struct {
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type PruneResponse struct {
+	Removed   int   `json:"removed"`
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+type DownloadResponse struct {
+	Digest     string `json:"digest"`
+	DownloadID string `json:"download_id"`
+	Total      int    `json:"total"`
+	Completed  int    `json:"completed"`
+	Paused     bool   `json:"paused,omitempty"`
+}
+
+type ListDownloadsResponse struct {
+	Downloads []DownloadResponse `json:"downloads"`
+}
+
+// Event is something which happened on the server, it's posted to webhooks and streamed from /api/events
+type Event struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Model string    `json:"model,omitempty"`
+
+	// ID is the generation's id, for generation events
+	ID    string         `json:"id,omitempty"`
+	Error string         `json:"error,omitempty"`
+	Data  map[string]any `json:"data,omitempty"`
+
+	// Text describes the event, chat webhooks such as slack's post it as the message
+	Text string `json:"text"`
+}
+
+// UsageResponse is what each model used over a time window, from the server's audit log
+type UsageResponse struct {
+	Usage []ModelUsage `json:"usage"`
+}
+
+type ModelUsage struct {
+	Model          string        `json:"model"`
+	Requests       int           `json:"requests"`
+	Errors         int           `json:"errors"`
+	PromptTokens   int           `json:"prompt_tokens"`
+	ResponseTokens int           `json:"response_tokens"`
+	TotalDuration  time.Duration `json:"total_duration"`
+}
+
 type ListResponse struct {
 	Models []ModelResponse `json:"models"`
+
+	// Total is how many models matched the request's filters, the response has up to its limit of them
+	Total int `json:"total"`
 }
 
 type ModelResponse struct {
-	Name       string    `json:"name"`
-	ModifiedAt time.Time `json:"modified_at"`
-	Size       int       `json:"size"`
-	Digest     string    `json:"digest"`
+	Name       string       `json:"name"`
+	ModifiedAt time.Time    `json:"modified_at"`
+	Size       int          `json:"size"`
+	Digest     string       `json:"digest"`
+	Details    ModelDetails `json:"details"`
+
+	// LastUsedAt is when the model last ran a request, it is left out if it never has
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+	Stats *ModelStats `json:"stats,omitempty"`
+
+	// Layers are the digests of the model's layers
+	Layers []string `json:"layers,omitempty"`
+
+	// UpdateAvailable is set once a check finds the registry has a newer version of the model
+	UpdateAvailable bool `json:"update_available,omitempty"`
+
+	// ReadOnly is set if the model is in one of the server's read only model directories
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+type ModelDetails struct {
+	Format            string `json:"format,omitempty"`
+	Family            string `json:"family,omitempty"`
+	ParameterSize     string `json:"parameter_size,omitempty"`
+	QuantizationLevel string `json:"quantization_level,omitempty"`
 }
 
 type TokenResponse struct {
-	Token string `json:"token"`
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in,omitempty"`
 }
 
 type GenerateResponse struct {
 	Model     string    `json:"model"`
+	ID        string    `json:"id,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response,omitempty"`
 
+	// Logprobs are the log probabilities of the tokens in Response, if the request asked for them
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
+	// Options are the options the response was generated with, they're set in the final response
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	// Cached is set when the response is one the server cached for the same request, without running the model
+	Cached bool `json:"cached,omitempty"`
+
+	// set while the request waits for its turn to run, position 1 runs next
+	QueuePosition int           `json:"queue_position,omitempty"`
+	QueueWait     time.Duration `json:"queue_wait,omitempty"`
+
+	Metrics
+}
+
+// ChatRequest continues the conversation in Messages, the model's template is applied to every turn
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+
+	// Session continues a session's conversation, Messages are added to it along with the reply. Model can be
+	// left empty to use the session's
+	Session string `json:"session,omitempty"`
+
+	// Tools are the functions the model can call instead of replying, the reply is then the message's ToolCalls
+	Tools []Tool `json:"tools,omitempty"`
+
+	// Logprobs returns the log probability of each generated token, TopLogprobs is how many of the tokens which
+	// were most likely to be generated in its place are returned with it
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
+	// Format is json to constrain the output to a json object, Grammar to a gbnf grammar and JSONSchema to json
+	// matching a schema. only one of them can be set
+	Format     string          `json:"format,omitempty"`
+	Grammar    string          `json:"grammar,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	// ID identifies the request to cancel it with, one is made up if it is left empty
+	ID string `json:"id,omitempty"`
+
+	// KeepAlive is how long the model stays loaded after the request, it defaults to 5 minutes
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// NoCache runs the model even if the server has cached the response to the same request
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// Adapter is a model created FROM Model with an ADAPTER, its LoRA adapter is applied to Model for this request
+	// without loading another model
+	Adapter string `json:"adapter,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+// SessionRequest creates a session, a conversation kept on the server with the model loaded between chats
+type SessionRequest struct {
+	Model string `json:"model"`
+
+	// Messages start the conversation, such as with a system message
+	Messages []Message `json:"messages,omitempty"`
+
+	// IdleTimeout is how long the session is kept without a chat, it defaults to 30 minutes
+	IdleTimeout *Duration `json:"idle_timeout,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+type SessionResponse struct {
+	ID           string    `json:"id"`
+	Model        string    `json:"model"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MessageCount int       `json:"message_count"`
+
+	// Messages are the conversation so far, they're only set when getting a session
+	Messages []Message `json:"messages,omitempty"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+type ChatResponse struct {
+	Model     string    `json:"model"`
+	ID        string    `json:"id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   *Message  `json:"message,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens in Message, if the request asked for them
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
+	Done bool `json:"done"`
+
+	// Options are the options the message was generated with, they're set in the final response
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	// Cached is set when the response is one the server cached for the same request, without running the model
+	Cached bool `json:"cached,omitempty"`
+
+	// set while the request waits for its turn to run, position 1 runs next
+	QueuePosition int           `json:"queue_position,omitempty"`
+	QueueWait     time.Duration `json:"queue_wait,omitempty"`
+
+	Metrics
+}
+
+// TokenLogprob is a generated token and its log probability, with the tokens which were most likely to be
+// generated in its place
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	TopLogprobs []TopLogprob `json:"top_logprobs,omitempty"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Metrics are the timings and token counts of a finished request
+type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// DraftCount is how many tokens the draft model drafted, DraftAcceptedCount how many of them the model
+	// accepted. they're only set when the model has a draft
+	DraftCount         int `json:"draft_count,omitempty"`
+	DraftAcceptedCount int `json:"draft_accepted_count,omitempty"`
+
+	// PromptCacheCount is how many of the prompt's tokens were reused from the prompt cache instead of being
+	// evaluated, they aren't counted in PromptEvalCount
+	PromptCacheCount int `json:"prompt_cache_count,omitempty"`
 }
 
-func (r *GenerateResponse) Summary() {
+// DraftAcceptanceRate is the share of drafted tokens which were accepted
+func (r *Metrics) DraftAcceptanceRate() float64 {
+	if r.DraftCount == 0 {
+		return 0
+	}
+
+	return float64(r.DraftAcceptedCount) / float64(r.DraftCount)
+}
+
+func (r *Metrics) Summary() {
 	if r.TotalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "total duration:       %v\n", r.TotalDuration)
 	}
@@ -143,6 +693,10 @@ func (r *GenerateResponse) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", r.PromptEvalCount)
 	}
 
+	if r.PromptCacheCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt cache count:   %d token(s)\n", r.PromptCacheCount)
+	}
+
 	if r.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", r.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(r.PromptEvalCount)/r.PromptEvalDuration.Seconds())
@@ -156,6 +710,11 @@ func (r *GenerateResponse) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", r.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(r.EvalCount)/r.EvalDuration.Seconds())
 	}
+
+	if r.DraftCount > 0 {
+		fmt.Fprintf(os.Stderr, "draft count:          %d token(s)\n", r.DraftCount)
+		fmt.Fprintf(os.Stderr, "draft acceptance:     %.2f%%\n", 100*r.DraftAcceptanceRate())
+	}
 }
 
 type Options struct {
@@ -171,6 +730,7 @@ type Options struct {
 	NumGQA             int     `json:"num_gqa,omitempty"`
 	NumGPU             int     `json:"num_gpu,omitempty"`
 	MainGPU            int     `json:"main_gpu,omitempty"`
+	TensorSplit        string  `json:"tensor_split,omitempty"`
 	LowVRAM            bool    `json:"low_vram,omitempty"`
 	F16KV              bool    `json:"f16_kv,omitempty"`
 	LogitsAll          bool    `json:"logits_all,omitempty"`
@@ -181,6 +741,15 @@ type Options struct {
 	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
 	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
 
+	// DraftModel is the name of a small model to draft tokens with for speculative decoding, instead of
+	// the model's DRAFT. NumDraft is how many tokens it drafts at a time
+	DraftModel string `json:"draft_model,omitempty"`
+	NumDraft   int    `json:"num_draft,omitempty"`
+
+	// NumPromptCache is how many prompts the runner keeps evaluated, so prompts starting the same as one of
+	// them skip evaluating what they share. 0 turns prompt caching off
+	NumPromptCache int `json:"num_prompt_cache,omitempty"`
+
 	// Predict options
 	NumPredict       int      `json:"num_predict,omitempty"`
 	TopK             int      `json:"top_k,omitempty"`
@@ -300,6 +869,8 @@ func DefaultOptions() Options {
 		RopeFrequencyBase:  10000.0,
 		RopeFrequencyScale: 1.0,
 		EmbeddingOnly:      true,
+		NumDraft:           16,
+		NumPromptCache:     1,
 
 		RepeatLastN:      64,
 		RepeatPenalty:    1.1,
@@ -319,10 +890,15 @@ func DefaultOptions() Options {
 	}
 }
 
+// Duration is a duration such as "5m" or a number of seconds, a negative duration means forever
 type Duration struct {
 	time.Duration
 }
 
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
 func (d *Duration) UnmarshalJSON(b []byte) (err error) {
 	var v any
 	if err := json.Unmarshal(b, &v); err != nil {
@@ -333,11 +909,7 @@ func (d *Duration) UnmarshalJSON(b []byte) (err error) {
 
 	switch t := v.(type) {
 	case float64:
-		if t < 0 {
-			t = math.MaxFloat64
-		}
-
-		d.Duration = time.Duration(t)
+		d.Duration = time.Duration(t * float64(time.Second))
 	case string:
 		d.Duration, err = time.ParseDuration(t)
 		if err != nil {
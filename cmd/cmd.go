@@ -15,6 +15,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -69,7 +70,17 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	var currentDigest string
 	var bar *progressbar.ProgressBar
 
-	request := api.CreateRequest{Name: args[0], Path: filename}
+	quantize, err := cmd.Flags().GetString("quantize")
+	if err != nil {
+		return err
+	}
+
+	// embeddings, quantization and conversion report progress as a count of lines or tensors rather than bytes
+	counted := func(status string) bool {
+		return strings.Contains(status, "embeddings") || strings.HasPrefix(status, "quantizing") || strings.HasPrefix(status, "converting")
+	}
+
+	request := api.CreateRequest{Name: args[0], Path: filename, Quantize: quantize}
 	fn := func(resp api.ProgressResponse) error {
 		if resp.Digest != currentDigest && resp.Digest != "" {
 			if spinner != nil {
@@ -77,7 +88,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 			currentDigest = resp.Digest
 			switch {
-			case strings.Contains(resp.Status, "embeddings"):
+			case counted(resp.Status):
 				bar = progressbar.Default(int64(resp.Total), resp.Status)
 				bar.Set(resp.Completed)
 			default:
@@ -86,9 +97,13 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 					int64(resp.Total),
 					resp.Status,
 				)
+				bar.SetRate(float64(resp.BytesPerSecond), resp.ETA)
 				bar.Set(resp.Completed)
 			}
 		} else if resp.Digest == currentDigest && resp.Digest != "" {
+			if !counted(resp.Status) {
+				bar.SetRate(float64(resp.BytesPerSecond), resp.ETA)
+			}
 			bar.Set(resp.Completed)
 		} else {
 			currentDigest = ""
@@ -164,8 +179,10 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 				fmt.Sprintf("pushing %s...", resp.Digest[7:19]),
 			)
 
+			bar.SetRate(float64(resp.BytesPerSecond), resp.ETA)
 			bar.Set(resp.Completed)
 		} else if resp.Digest == currentDigest && resp.Digest != "" {
+			bar.SetRate(float64(resp.BytesPerSecond), resp.ETA)
 			bar.Set(resp.Completed)
 		} else {
 			currentDigest = ""
@@ -175,7 +192,7 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 	}
 
 	if err := client.Push(context.Background(), &request, fn); err != nil {
-		return err
+		return registryErrorHint(err)
 	}
 
 	if bar != nil && !bar.IsFinished() {
@@ -200,12 +217,61 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 
 	for _, m := range models.Models {
 		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
-			data = append(data, []string{m.Name, m.Digest[:12], humanize.Bytes(uint64(m.Size)), format.HumanTime(m.ModifiedAt, "Never")})
+			var lastUsed time.Time
+			if m.LastUsedAt != nil {
+				lastUsed = *m.LastUsedAt
+			}
+
+			data = append(data, []string{m.Name, m.Digest[:12], humanize.Bytes(uint64(m.Size)), format.HumanTime(m.ModifiedAt, "Never"), format.HumanTime(lastUsed, "Never")})
+		}
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"NAME", "ID", "SIZE", "MODIFIED", "LAST USED"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("\t")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func ListRunningHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	models, err := client.ListRunning(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+
+	for _, m := range models.Models {
+		processor := "100% CPU"
+		switch {
+		case m.SizeCPU == 0:
+			processor = "100% GPU"
+		case m.SizeGPU > 0:
+			processor = fmt.Sprintf("%d%%/%d%% CPU/GPU", m.SizeCPU*100/m.Size, m.SizeGPU*100/m.Size)
 		}
+
+		until := "Forever"
+		if m.ExpiresAt != nil {
+			until = format.HumanTime(*m.ExpiresAt, "Never")
+		}
+
+		data = append(data, []string{m.Name, m.Digest[:12], humanize.Bytes(uint64(m.Size)), processor, until})
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "MODIFIED"})
+	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"})
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -234,6 +300,89 @@ func DeleteHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func SaveHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	} else if term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("refusing to write an archive to a terminal, use -o or redirect the output")
+	}
+
+	if err := client.Export(context.Background(), &api.ExportRequest{Name: args[0]}, w); err != nil {
+		if output != "" {
+			os.Remove(output)
+		}
+		return err
+	}
+
+	if output != "" {
+		fmt.Fprintf(os.Stderr, "saved '%s' to %s\n", args[0], output)
+	}
+	return nil
+}
+
+func LoadHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := client.Import(context.Background(), f)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range resp.Models {
+		fmt.Printf("loaded '%s'\n", name)
+	}
+	return nil
+}
+
+func PruneHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Prune(context.Background(), &api.PruneRequest{DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("would remove %d unused blobs, reclaiming %s\n", resp.Removed, humanize.Bytes(uint64(resp.Reclaimed)))
+	} else {
+		fmt.Printf("removed %d unused blobs, reclaimed %s\n", resp.Removed, humanize.Bytes(uint64(resp.Reclaimed)))
+	}
+	return nil
+}
+
 func ShowHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.FromEnv()
 	if err != nil {
@@ -249,8 +398,9 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	parameters, errParams := cmd.Flags().GetBool("parameters")
 	system, errSystem := cmd.Flags().GetBool("system")
 	template, errTemplate := cmd.Flags().GetBool("template")
+	modelinfo, errModelinfo := cmd.Flags().GetBool("modelinfo")
 
-	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate} {
+	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate, errModelinfo} {
 		if boolErr != nil {
 			return errors.New("error retrieving flags")
 		}
@@ -284,13 +434,18 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		showType = "template"
 	}
 
+	if modelinfo {
+		flagsSet++
+		showType = "modelinfo"
+	}
+
 	if flagsSet > 1 {
-		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', or '--template' can be specified")
+		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', '--template' or '--modelinfo' can be specified")
 	} else if flagsSet == 0 {
-		return errors.New("one of '--license', '--modelfile', '--parameters', '--system', or '--template' must be specified")
+		return errors.New("one of '--license', '--modelfile', '--parameters', '--system', '--template' or '--modelinfo' must be specified")
 	}
 
-	req := api.ShowRequest{Name: args[0]}
+	req := api.ShowRequest{Name: args[0], Verbose: modelinfo}
 	resp, err := client.Show(context.Background(), &req)
 	if err != nil {
 		return err
@@ -307,6 +462,29 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		fmt.Println(resp.System)
 	case "template":
 		fmt.Println(resp.Template)
+	case "modelinfo":
+		if len(resp.ModelInfo) == 0 {
+			return errors.New("the model has no metadata, only gguf models do")
+		}
+
+		var keys []string
+		for k := range resp.ModelInfo {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := resp.ModelInfo[k]
+			if v == nil {
+				v = "..."
+			}
+			fmt.Printf("%-40s %v\n", k, v)
+		}
+
+		fmt.Println()
+		for _, t := range resp.Tensors {
+			fmt.Printf("%-40s %-6s %v\n", t.Name, t.Type, t.Shape)
+		}
 	}
 
 	return nil
@@ -326,35 +504,278 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// TagHandler gives a model the tags in args, then lists the models which share its layers
+func TagHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Tag(context.Background(), &api.TagRequest{Source: args[0], Tags: args[1:]})
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+	for _, m := range resp.Shared {
+		shared := "tag"
+		if !m.Tag {
+			shared = fmt.Sprintf("%d layers", m.SharedLayers)
+		}
+
+		data = append(data, []string{m.Name, m.Digest[:12], shared, humanize.Bytes(uint64(m.SharedSize))})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"NAME", "ID", "SHARES", "SHARED SIZE"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("\t")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
 		return err
 	}
 
-	return pull(args[0], insecure)
+	// only the pull command has this flag, other commands which pull implicitly don't need referrers
+	withReferrers, _ := cmd.Flags().GetBool("with-referrers")
+
+	if check, _ := cmd.Flags().GetBool("verify"); check {
+		return verify(args[0], insecure, false)
+	}
+
+	if check, _ := cmd.Flags().GetBool("check"); check {
+		_, err := checkUpdates(args, insecure)
+		return err
+	}
+
+	background, _ := cmd.Flags().GetBool("background")
+	after, _ := cmd.Flags().GetString("after")
+	if background || after != "" {
+		return pullBackground(args[0], insecure, withReferrers, after)
+	}
+
+	return pull(args[0], insecure, withReferrers)
 }
 
-func pull(model string, insecure bool) error {
+// pullBackground queues a pull for the server to run at a low priority, after a time such as 01:00
+func pullBackground(model string, insecure, withReferrers bool, after string) error {
 	client, err := api.FromEnv()
 	if err != nil {
 		return err
 	}
 
-	var currentDigest string
+	request := api.PullRequest{Name: model, Insecure: insecure, WithReferrers: withReferrers, Background: true, After: after}
+	return client.Pull(context.Background(), &request, func(resp api.ProgressResponse) error {
+		fmt.Println(resp.Status)
+		return nil
+	})
+}
+
+// LicenseHandler prints a model's license and where it came from, and acknowledges the license with --accept
+func LicenseHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	accept, err := cmd.Flags().GetBool("accept")
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Show(context.Background(), &api.ShowRequest{Name: args[0]})
+	if err != nil {
+		return err
+	}
+
+	if resp.Provenance == nil || len(resp.Provenance.Licenses) == 0 {
+		return fmt.Errorf("%s has no license", args[0])
+	}
+
+	if !accept {
+		fmt.Println(resp.License)
+		fmt.Println()
+		if resp.Provenance.Source != "" {
+			fmt.Printf("source:     %s\n", resp.Provenance.Source)
+		}
+
+		if resp.Provenance.Checkpoint != "" {
+			fmt.Printf("checkpoint: %s\n", resp.Provenance.Checkpoint)
+		}
+
+		if resp.Provenance.LicenseAcknowledged {
+			fmt.Println("the license has been acknowledged")
+		} else {
+			fmt.Printf("the license hasn't been acknowledged, acknowledge it with 'ollama license --accept %s'\n", args[0])
+		}
+
+		return nil
+	}
+
+	ack, err := client.AcknowledgeLicense(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("acknowledged the license of %s at %s\n", args[0], ack.AcknowledgedAt.Local().Format(time.RFC1123))
+	return nil
+}
+
+func DoctorHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	request := api.DoctorRequest{Insecure: insecure}
+	if len(args) > 0 {
+		request.Model = args[0]
+	}
+
+	fmt.Printf("%-10s %-8s %-8s ollama %s on %s/%s, server %s\n", "client", api.HealthStatusOK, "", version.Version, runtime.GOOS, runtime.GOARCH, client.Base.String())
+
+	var failed int
+	fn := func(check api.DoctorCheck) error {
+		if check.Status == api.HealthStatusFailing {
+			failed++
+		}
+
+		fmt.Printf("%-10s %-8s %-8s %s\n", check.Name, check.Status, check.Duration.Round(time.Millisecond), check.Message)
+		return nil
+	}
+
+	if err := client.Doctor(context.Background(), &request, fn); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed, include this report in bug reports", failed)
+	}
+
+	return nil
+}
+
+func UpdateHandler(cmd *cobra.Command, args []string) error {
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+
+	if all == (len(args) > 0) {
+		return errors.New("name the models to update, or update --all of them")
+	}
+
+	names, err := checkUpdates(args, insecure)
+	if err != nil {
+		return err
+	}
+
+	// layers the models already have aren't pulled again
+	for _, name := range names {
+		if err := pull(name, insecure, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkUpdates prints whether each model, or every model if there are none, has an update. it returns the ones
+// which do
+func checkUpdates(models []string, insecure bool) ([]string, error) {
+	client, err := api.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var checked []api.ModelUpdate
+	if len(models) == 0 {
+		resp, err := client.Check(context.Background(), &api.CheckRequest{Insecure: insecure})
+		if err != nil {
+			return nil, err
+		}
+
+		checked = resp.Models
+	}
+
+	for _, model := range models {
+		resp, err := client.Check(context.Background(), &api.CheckRequest{Name: model, Insecure: insecure})
+		if err != nil {
+			return nil, err
+		}
+
+		checked = append(checked, resp.Models...)
+	}
+
+	var names []string
+	for _, u := range checked {
+		switch {
+		case u.Error != "":
+			fmt.Printf("%s: couldn't check for updates: %s\n", u.Name, u.Error)
+		case u.UpdateAvailable:
+			fmt.Printf("%s: update available\n", u.Name)
+			names = append(names, u.Name)
+		default:
+			fmt.Printf("%s: up to date\n", u.Name)
+		}
+	}
+
+	return names, nil
+}
+
+func RepairHandler(cmd *cobra.Command, args []string) error {
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	return verify(args[0], insecure, true)
+}
+
+// verify re-hashes the blobs of model, with repair the corrupted ones are downloaded again
+func verify(model string, insecure, repair bool) error {
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	var currentDigest, currentAction string
 	var bar *progressbar.ProgressBar
 
-	request := api.PullRequest{Name: model, Insecure: insecure}
+	request := api.VerifyRequest{Name: model, Insecure: insecure, Repair: repair}
 	fn := func(resp api.ProgressResponse) error {
-		if resp.Digest != currentDigest && resp.Digest != "" {
-			currentDigest = resp.Digest
-			bar = progressbar.DefaultBytes(
-				int64(resp.Total),
-				fmt.Sprintf("pulling %s...", resp.Digest[7:19]),
-			)
+		if resp.Digest != "" && resp.Total > 0 {
+			// a corrupted blob is verified, then pulled again
+			action := "pulling"
+			if strings.HasPrefix(resp.Status, "verifying") {
+				action = "verifying"
+			}
+
+			if resp.Digest != currentDigest || action != currentAction {
+				currentDigest, currentAction = resp.Digest, action
+				bar = progressbar.DefaultBytes(int64(resp.Total), fmt.Sprintf("%s %s...", action, resp.Digest[7:19]))
+			}
 
-			bar.Set(resp.Completed)
-		} else if resp.Digest == currentDigest && resp.Digest != "" {
 			bar.Set(resp.Completed)
 		} else {
 			currentDigest = ""
@@ -364,17 +785,71 @@ func pull(model string, insecure bool) error {
 		return nil
 	}
 
-	if err := client.Pull(context.Background(), &request, fn); err != nil {
+	return client.Verify(context.Background(), &request, fn)
+}
+
+func pull(model string, insecure, withReferrers bool) error {
+	client, err := api.FromEnv()
+	if err != nil {
 		return err
 	}
 
-	if bar != nil && !bar.IsFinished() {
-		return errors.New("unexpected end to pull model")
+	// layers are downloaded several at once, so their progress is interleaved
+	bars := make(map[string]*progressbar.ProgressBar)
+
+	request := api.PullRequest{Name: model, Insecure: insecure, WithReferrers: withReferrers}
+	fn := func(resp api.ProgressResponse) error {
+		if resp.Digest == "" {
+			fmt.Println(resp.Status)
+			return nil
+		}
+
+		bar, ok := bars[resp.Digest]
+		if !ok {
+			bar = progressbar.DefaultBytes(
+				int64(resp.Total),
+				fmt.Sprintf("pulling %s...", resp.Digest[7:19]),
+			)
+			bars[resp.Digest] = bar
+		}
+
+		bar.SetRate(float64(resp.BytesPerSecond), resp.ETA)
+		bar.Set(resp.Completed)
+		return nil
+	}
+
+	if err := client.Pull(context.Background(), &request, fn); err != nil {
+		return registryErrorHint(err)
+	}
+
+	for _, bar := range bars {
+		if !bar.IsFinished() {
+			return errors.New("unexpected end to pull model")
+		}
 	}
 
 	return nil
 }
 
+// registryErrorHint adds what to do about the error of a pull or push, by its code
+func registryErrorHint(err error) error {
+	var serr api.StatusError
+	if !errors.As(err, &serr) {
+		return err
+	}
+
+	switch serr.Code {
+	case api.CodeRegistryUnauthorized:
+		return fmt.Errorf("%w\nthe registry refused the request, check that your public key ~/.ollama/id_ed25519.pub is added to your account", err)
+	case api.CodeDownloadFailed:
+		if offset, ok := serr.Details["offset"].(float64); ok && offset > 0 {
+			return fmt.Errorf("%w\npull again to resume from %s", err, humanize.Bytes(uint64(offset)))
+		}
+	}
+
+	return err
+}
+
 func RunGenerate(cmd *cobra.Command, args []string) error {
 	if len(args) > 1 {
 		// join all args into a single prompt
@@ -430,7 +905,17 @@ func generate(cmd *cobra.Command, model, prompt string) error {
 	var wordBuffer string
 
 	request := api.GenerateRequest{Model: model, Prompt: prompt, Context: generateContext}
+	if opts, ok := cmd.Context().Value(generateContextKey("options")).(runOptions); ok {
+		request.System = opts.System
+		request.Options = opts.Options
+	}
+
 	fn := func(response api.GenerateResponse) error {
+		if response.QueuePosition > 0 {
+			spinner.Describe(fmt.Sprintf("waiting in queue, position %d", response.QueuePosition))
+			return nil
+		}
+
 		if !spinner.IsFinished() {
 			spinner.Finish()
 		}
@@ -505,182 +990,6 @@ func generate(cmd *cobra.Command, model, prompt string) error {
 	return nil
 }
 
-func generateInteractive(cmd *cobra.Command, model string) error {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return err
-	}
-
-	// load the model
-	if err := generate(cmd, model, ""); err != nil {
-		return err
-	}
-
-	completer := readline.NewPrefixCompleter(
-		readline.PcItem("/help"),
-		readline.PcItem("/list"),
-		readline.PcItem("/set",
-			readline.PcItem("history"),
-			readline.PcItem("nohistory"),
-			readline.PcItem("wordwrap"),
-			readline.PcItem("nowordwrap"),
-			readline.PcItem("verbose"),
-			readline.PcItem("quiet"),
-		),
-		readline.PcItem("/show",
-			readline.PcItem("license"),
-			readline.PcItem("modelfile"),
-			readline.PcItem("parameters"),
-			readline.PcItem("system"),
-			readline.PcItem("template"),
-		),
-		readline.PcItem("/exit"),
-		readline.PcItem("/bye"),
-	)
-
-	usage := func() {
-		fmt.Fprintln(os.Stderr, "commands:")
-		fmt.Fprintln(os.Stderr, completer.Tree("  "))
-	}
-
-	var painter Painter
-
-	config := readline.Config{
-		Painter:      &painter,
-		Prompt:       ">>> ",
-		HistoryFile:  filepath.Join(home, ".ollama", "history"),
-		AutoComplete: completer,
-	}
-
-	scanner, err := readline.NewEx(&config)
-	if err != nil {
-		return err
-	}
-	defer scanner.Close()
-
-	var multiLineBuffer string
-	var isMultiLine bool
-
-	for {
-		line, err := scanner.Readline()
-		switch {
-		case errors.Is(err, io.EOF):
-			return nil
-		case errors.Is(err, readline.ErrInterrupt):
-			if line == "" {
-				return nil
-			}
-
-			continue
-		case err != nil:
-			return err
-		}
-
-		line = strings.TrimSpace(line)
-
-		switch {
-		case isMultiLine:
-			if strings.HasSuffix(line, `"""`) {
-				isMultiLine = false
-				painter.IsMultiLine = isMultiLine
-				multiLineBuffer += strings.TrimSuffix(line, `"""`)
-				line = multiLineBuffer
-				multiLineBuffer = ""
-				scanner.SetPrompt(">>> ")
-			} else {
-				multiLineBuffer += line + " "
-				continue
-			}
-		case strings.HasPrefix(line, `"""`):
-			isMultiLine = true
-			painter.IsMultiLine = isMultiLine
-			multiLineBuffer = strings.TrimPrefix(line, `"""`) + " "
-			scanner.SetPrompt("... ")
-			continue
-		case strings.HasPrefix(line, "/list"):
-			args := strings.Fields(line)
-			if err := ListHandler(cmd, args[1:]); err != nil {
-				return err
-			}
-		case strings.HasPrefix(line, "/set"):
-			args := strings.Fields(line)
-			if len(args) > 1 {
-				switch args[1] {
-				case "history":
-					scanner.HistoryEnable()
-				case "nohistory":
-					scanner.HistoryDisable()
-				case "wordwrap":
-					cmd.Flags().Set("nowordwrap", "false")
-					fmt.Println("Set 'wordwrap' mode.")
-				case "nowordwrap":
-					cmd.Flags().Set("nowordwrap", "true")
-					fmt.Println("Set 'nowordwrap' mode.")
-				case "verbose":
-					cmd.Flags().Set("verbose", "true")
-					fmt.Println("Set 'verbose' mode.")
-				case "quiet":
-					cmd.Flags().Set("verbose", "false")
-					fmt.Println("Set 'quiet' mode.")
-				case "mode":
-					if len(args) > 2 {
-						switch args[2] {
-						case "vim":
-							scanner.SetVimMode(true)
-						case "emacs", "default":
-							scanner.SetVimMode(false)
-						default:
-							usage()
-						}
-					} else {
-						usage()
-					}
-				}
-			} else {
-				usage()
-			}
-		case strings.HasPrefix(line, "/show"):
-			args := strings.Fields(line)
-			if len(args) > 1 {
-				resp, err := server.GetModelInfo(model)
-				if err != nil {
-					fmt.Println("error: couldn't get model")
-				}
-
-				switch args[1] {
-				case "license":
-					fmt.Println(resp.License)
-				case "modelfile":
-					fmt.Println(resp.Modelfile)
-				case "parameters":
-					fmt.Println(resp.Parameters)
-				case "system":
-					fmt.Println(resp.System)
-				case "template":
-					fmt.Println(resp.Template)
-				default:
-					fmt.Println("error: unknown command")
-				}
-			} else {
-				usage()
-			}
-		case line == "/help", line == "/?":
-			usage()
-		case line == "/exit", line == "/bye":
-			return nil
-		case strings.HasPrefix(line, "/"):
-			args := strings.Fields(line)
-			fmt.Printf("Unknown command '%s'. Type /? for help\n", args[0])
-		}
-
-		if len(line) > 0 && line[0] != '/' {
-			if err := generate(cmd, model, line); err != nil {
-				return err
-			}
-		}
-	}
-}
-
 func generateBatch(cmd *cobra.Command, model string) error {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -695,19 +1004,19 @@ func generateBatch(cmd *cobra.Command, model string) error {
 }
 
 func RunServer(cmd *cobra.Command, _ []string) error {
-	host, port, err := net.SplitHostPort(os.Getenv("OLLAMA_HOST"))
-	if err != nil {
-		host, port = "127.0.0.1", "11434"
-		if ip := net.ParseIP(strings.Trim(os.Getenv("OLLAMA_HOST"), "[]")); ip != nil {
-			host = ip.String()
-		}
-	}
-
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	// OLLAMA_LISTEN adds addresses to listen on as well as OLLAMA_HOST, such as a unix socket
+	addrs := []string{serverAddr(os.Getenv("OLLAMA_HOST"))}
+	for _, addr := range strings.Split(os.Getenv("OLLAMA_LISTEN"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	lns, err := server.Listen(addrs)
 	if err != nil {
 		return err
 	}
@@ -723,7 +1032,25 @@ func RunServer(cmd *cobra.Command, _ []string) error {
 		}
 	}
 
-	return server.Serve(ln, origins)
+	return server.Serve(lns, origins)
+}
+
+// serverAddr is the address to listen on for OLLAMA_HOST, a unix socket or named pipe is listened on as it is
+// so the server doesn't open a network port
+func serverAddr(host string) string {
+	if strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://") {
+		return host
+	}
+
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = "127.0.0.1", "11434"
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			h = ip.String()
+		}
+	}
+
+	return net.JoinHostPort(h, port)
 }
 
 func initializeKeypair() error {
@@ -812,7 +1139,7 @@ func checkServerHeartbeat(_ *cobra.Command, _ []string) error {
 		return err
 	}
 	if err := client.Heartbeat(context.Background()); err != nil {
-		if !strings.Contains(err.Error(), "connection refused") {
+		if !errors.Is(err, api.ErrConnectionRefused) {
 			return err
 		}
 		if runtime.GOOS == "darwin" {
@@ -851,6 +1178,7 @@ func NewCLI() *cobra.Command {
 	}
 
 	createCmd.Flags().StringP("file", "f", "Modelfile", "Name of the Modelfile (default \"Modelfile\")")
+	createCmd.Flags().StringP("quantize", "q", "", "Quantize an f16 or f32 model to this type, such as q4_K_M")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -865,6 +1193,7 @@ func NewCLI() *cobra.Command {
 	showCmd.Flags().Bool("parameters", false, "Show parameters of a model")
 	showCmd.Flags().Bool("template", false, "Show template of a model")
 	showCmd.Flags().Bool("system", false, "Show system prompt of a model")
+	showCmd.Flags().Bool("modelinfo", false, "Show metadata and tensors of a gguf model")
 
 	runCmd := &cobra.Command{
 		Use:     "run MODEL [PROMPT]",
@@ -894,6 +1223,51 @@ func NewCLI() *cobra.Command {
 	}
 
 	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().Bool("with-referrers", false, "Also pull artifacts (e.g. signatures, SBOMs) referring to the model layers")
+	pullCmd.Flags().Bool("verify", false, "Check the local copy of the model against its digests instead of pulling it")
+	pullCmd.Flags().Bool("check", false, "Check whether the registry has a newer version of the model instead of pulling it")
+	pullCmd.Flags().Bool("background", false, "Queue the pull to run at a low priority, pausing while models are generating")
+	pullCmd.Flags().String("after", "", "Queue the pull to run in the background after a time, e.g. 01:00")
+
+	updateCmd := &cobra.Command{
+		Use:     "update [MODEL...]",
+		Short:   "Pull the models which have changed in the registry",
+		PreRunE: checkServerHeartbeat,
+		RunE:    UpdateHandler,
+	}
+
+	updateCmd.Flags().Bool("all", false, "Update every installed model")
+	updateCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+
+	licenseCmd := &cobra.Command{
+		Use:     "license MODEL",
+		Short:   "Show the license of a model, or acknowledge it",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    LicenseHandler,
+	}
+
+	licenseCmd.Flags().Bool("accept", false, "Acknowledge the license so the model can be used")
+
+	doctorCmd := &cobra.Command{
+		Use:     "doctor [MODEL]",
+		Short:   "Check the server's connection to the registry, its blob store and GPUs",
+		Args:    cobra.MaximumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    DoctorHandler,
+	}
+
+	doctorCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+
+	repairCmd := &cobra.Command{
+		Use:     "repair MODEL",
+		Short:   "Download the corrupted layers of a model again",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    RepairHandler,
+	}
+
+	repairCmd.Flags().Bool("insecure", false, "Use an insecure registry")
 
 	pushCmd := &cobra.Command{
 		Use:     "push MODEL",
@@ -913,6 +1287,13 @@ func NewCLI() *cobra.Command {
 		RunE:    ListHandler,
 	}
 
+	psCmd := &cobra.Command{
+		Use:     "ps",
+		Short:   "List loaded models",
+		PreRunE: checkServerHeartbeat,
+		RunE:    ListRunningHandler,
+	}
+
 	copyCmd := &cobra.Command{
 		Use:     "cp",
 		Short:   "Copy a model",
@@ -921,6 +1302,14 @@ func NewCLI() *cobra.Command {
 		RunE:    CopyHandler,
 	}
 
+	tagCmd := &cobra.Command{
+		Use:     "tag MODEL [TAG...]",
+		Short:   "Tag a model and list the models sharing its layers",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    TagHandler,
+	}
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm",
 		Short:   "Remove a model",
@@ -929,16 +1318,52 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	saveCmd := &cobra.Command{
+		Use:     "save MODEL",
+		Short:   "Save a model to a tar archive",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    SaveHandler,
+	}
+
+	saveCmd.Flags().StringP("output", "o", "", "Write the archive to a file instead of stdout")
+
+	loadCmd := &cobra.Command{
+		Use:     "load FILE",
+		Short:   "Load models from a tar archive",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    LoadHandler,
+	}
+
+	pruneCmd := &cobra.Command{
+		Use:     "prune",
+		Short:   "Remove blobs which aren't used by any model",
+		PreRunE: checkServerHeartbeat,
+		RunE:    PruneHandler,
+	}
+
+	pruneCmd.Flags().Bool("dry-run", false, "Show what would be removed without removing it")
+
 	rootCmd.AddCommand(
 		serveCmd,
 		createCmd,
 		showCmd,
 		runCmd,
 		pullCmd,
+		repairCmd,
+		updateCmd,
+		licenseCmd,
 		pushCmd,
 		listCmd,
+		psCmd,
 		copyCmd,
+		tagCmd,
 		deleteCmd,
+		saveCmd,
+		loadCmd,
+		pruneCmd,
+		doctorCmd,
 	)
 
 	return rootCmd
@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pdevine/readline"
+	"github.com/spf13/cobra"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// runOptions are the system prompt and options set with /set, they're sent with each prompt of an interactive
+// session
+type runOptions struct {
+	System  string                 `json:"system,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// savedSession is an interactive session saved with /save, it's loaded again with /load
+type savedSession struct {
+	Model string `json:"model"`
+	runOptions
+	Context []int `json:"context,omitempty"`
+}
+
+// sessionPath is the file of the session name in ~/.ollama/sessions
+func sessionPath(name string) (string, error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid session name %q", name)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "sessions", name+".json"), nil
+}
+
+func saveSession(name string, sess savedSession) error {
+	fp, err := sessionPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fp, bts, 0o600)
+}
+
+func loadSession(name string) (savedSession, error) {
+	fp, err := sessionPath(name)
+	if err != nil {
+		return savedSession{}, err
+	}
+
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return savedSession{}, fmt.Errorf("session '%s' not found", name)
+	} else if err != nil {
+		return savedSession{}, err
+	}
+
+	var sess savedSession
+	if err := json.Unmarshal(bts, &sess); err != nil {
+		return savedSession{}, fmt.Errorf("session '%s' is invalid: %w", name, err)
+	}
+
+	return sess, nil
+}
+
+// setGenerateContext sets the conversation and options the next prompt is generated with
+func setGenerateContext(cmd *cobra.Command, conversation []int, opts runOptions) {
+	ctx := context.WithValue(cmd.Context(), generateContextKey("context"), conversation)
+	ctx = context.WithValue(ctx, generateContextKey("options"), opts)
+	cmd.SetContext(ctx)
+}
+
+// showInfo prints the model's architecture, size and quantization, as read from its gguf file
+func showInfo(client *api.Client, model string) error {
+	resp, err := client.Show(context.Background(), &api.ShowRequest{Name: model, Verbose: true})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("  %-16s %s\n", "model", model)
+	arch, _ := resp.ModelInfo["general.architecture"].(string)
+	if arch != "" {
+		fmt.Printf("  %-16s %s\n", "architecture", arch)
+	}
+
+	var params uint64
+	types := make(map[string]int)
+	for _, t := range resp.Tensors {
+		n := uint64(1)
+		for _, d := range t.Shape {
+			n *= d
+		}
+
+		params += n
+		types[t.Type]++
+	}
+
+	if params > 0 {
+		fmt.Printf("  %-16s %.2fB\n", "parameters", float64(params)/1e9)
+	}
+
+	// the quantization is the type of most of the tensors, a few such as norms are kept in higher precision
+	var quantization string
+	for t, n := range types {
+		if n > types[quantization] || (n == types[quantization] && t < quantization) {
+			quantization = t
+		}
+	}
+
+	if quantization != "" {
+		fmt.Printf("  %-16s %s\n", "quantization", quantization)
+	}
+
+	for _, key := range []string{"context_length", "embedding_length"} {
+		if v, ok := resp.ModelInfo[arch+"."+key]; ok && arch != "" {
+			fmt.Printf("  %-16s %v\n", strings.ReplaceAll(key, "_", " "), v)
+		}
+	}
+
+	return nil
+}
+
+func generateInteractive(cmd *cobra.Command, model string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	client, err := api.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	// load the model
+	if err := generate(cmd, model, ""); err != nil {
+		return err
+	}
+
+	var opts runOptions
+	completer := readline.NewPrefixCompleter(
+		readline.PcItem("/help"),
+		readline.PcItem("/list"),
+		readline.PcItem("/set",
+			readline.PcItem("parameter"),
+			readline.PcItem("system"),
+			readline.PcItem("history"),
+			readline.PcItem("nohistory"),
+			readline.PcItem("wordwrap"),
+			readline.PcItem("nowordwrap"),
+			readline.PcItem("verbose"),
+			readline.PcItem("quiet"),
+		),
+		readline.PcItem("/show",
+			readline.PcItem("info"),
+			readline.PcItem("license"),
+			readline.PcItem("modelfile"),
+			readline.PcItem("parameters"),
+			readline.PcItem("system"),
+			readline.PcItem("template"),
+		),
+		readline.PcItem("/save"),
+		readline.PcItem("/load"),
+		readline.PcItem("/clear"),
+		readline.PcItem("/exit"),
+		readline.PcItem("/bye"),
+	)
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "commands:")
+		fmt.Fprintln(os.Stderr, completer.Tree("  "))
+		fmt.Fprintln(os.Stderr, `use """ to begin and end a multiline message`)
+	}
+
+	var painter Painter
+
+	// history is kept between sessions in ~/.ollama/history
+	historyFile := filepath.Join(home, ".ollama", "history")
+	if err := os.MkdirAll(filepath.Dir(historyFile), 0o755); err != nil {
+		return err
+	}
+
+	config := readline.Config{
+		Painter:      &painter,
+		Prompt:       ">>> ",
+		HistoryFile:  historyFile,
+		AutoComplete: completer,
+	}
+
+	scanner, err := readline.NewEx(&config)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	var multiLineBuffer strings.Builder
+	var isMultiLine bool
+
+	endMultiLine := func() string {
+		isMultiLine = false
+		painter.IsMultiLine = false
+		scanner.SetPrompt(">>> ")
+
+		line := multiLineBuffer.String()
+		multiLineBuffer.Reset()
+		return line
+	}
+
+	for {
+		line, err := scanner.Readline()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, readline.ErrInterrupt):
+			if isMultiLine {
+				endMultiLine()
+				continue
+			}
+
+			if line == "" {
+				return nil
+			}
+
+			continue
+		case err != nil:
+			return err
+		}
+
+		// lines of a multiline message keep their newlines and indentation
+		if isMultiLine {
+			if before, ok := strings.CutSuffix(strings.TrimRight(line, " \t"), `"""`); ok {
+				multiLineBuffer.WriteString(before)
+				line = endMultiLine()
+			} else {
+				multiLineBuffer.WriteString(line + "\n")
+				continue
+			}
+		} else {
+			line = strings.TrimSpace(line)
+			if after, ok := strings.CutPrefix(line, `"""`); ok {
+				// a message can also start and end on the same line
+				if before, ok := strings.CutSuffix(after, `"""`); ok {
+					line = before
+				} else {
+					isMultiLine = true
+					painter.IsMultiLine = true
+					if after != "" {
+						multiLineBuffer.WriteString(after + "\n")
+					}
+					scanner.SetPrompt("... ")
+					continue
+				}
+			} else if strings.HasPrefix(line, "/") {
+				if err := runCommand(cmd, client, scanner, &model, &opts, line, usage); err != nil {
+					if errors.Is(err, errExitInteractive) {
+						return nil
+					}
+
+					return err
+				}
+
+				continue
+			}
+		}
+
+		if strings.TrimSpace(line) != "" {
+			if err := generate(cmd, model, line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var errExitInteractive = errors.New("exit")
+
+// runCommand runs a slash command of an interactive session. errors which only the command failed with are
+// printed, the returned error ends the session
+func runCommand(cmd *cobra.Command, client *api.Client, scanner *readline.Instance, model *string, opts *runOptions, line string, usage func()) error {
+	args := strings.Fields(line)
+	conversation, _ := cmd.Context().Value(generateContextKey("context")).([]int)
+
+	switch args[0] {
+	case "/list":
+		return ListHandler(cmd, args[1:])
+	case "/set":
+		if len(args) < 2 {
+			usage()
+			return nil
+		}
+
+		switch args[1] {
+		case "parameter":
+			if len(args) < 4 {
+				fmt.Println("Usage: /set parameter <name> <value>")
+				return nil
+			}
+
+			val, err := api.ParseOption(args[2], args[3:]...)
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				return nil
+			}
+
+			if opts.Options == nil {
+				opts.Options = make(map[string]interface{})
+			}
+
+			opts.Options[args[2]] = val
+			setGenerateContext(cmd, conversation, *opts)
+			fmt.Printf("Set parameter '%s' to '%s'\n", args[2], strings.Join(args[3:], ", "))
+		case "system":
+			opts.System = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, "/set")), "system"))
+			setGenerateContext(cmd, conversation, *opts)
+			if opts.System == "" {
+				fmt.Println("Cleared the system prompt, the model's is used.")
+			} else {
+				fmt.Println("Set system prompt.")
+			}
+		case "history":
+			scanner.HistoryEnable()
+		case "nohistory":
+			scanner.HistoryDisable()
+		case "wordwrap":
+			cmd.Flags().Set("nowordwrap", "false")
+			fmt.Println("Set 'wordwrap' mode.")
+		case "nowordwrap":
+			cmd.Flags().Set("nowordwrap", "true")
+			fmt.Println("Set 'nowordwrap' mode.")
+		case "verbose":
+			cmd.Flags().Set("verbose", "true")
+			fmt.Println("Set 'verbose' mode.")
+		case "quiet":
+			cmd.Flags().Set("verbose", "false")
+			fmt.Println("Set 'quiet' mode.")
+		case "mode":
+			if len(args) < 3 {
+				usage()
+				return nil
+			}
+
+			switch args[2] {
+			case "vim":
+				scanner.SetVimMode(true)
+			case "emacs", "default":
+				scanner.SetVimMode(false)
+			default:
+				usage()
+			}
+		default:
+			fmt.Printf("Unknown command '/set %s'. Type /? for help\n", args[1])
+		}
+	case "/show":
+		if len(args) < 2 {
+			usage()
+			return nil
+		}
+
+		if args[1] == "info" {
+			if err := showInfo(client, *model); err != nil {
+				fmt.Printf("error: %s\n", err)
+			}
+
+			return nil
+		}
+
+		resp, err := client.Show(context.Background(), &api.ShowRequest{Name: *model})
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			return nil
+		}
+
+		switch args[1] {
+		case "license":
+			fmt.Println(resp.License)
+		case "modelfile":
+			fmt.Println(resp.Modelfile)
+		case "parameters":
+			fmt.Println(resp.Parameters)
+
+			// the parameters set in this session override the model's
+			names := make([]string, 0, len(opts.Options))
+			for name := range opts.Options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				fmt.Printf("%-30s %v (set)\n", name, opts.Options[name])
+			}
+		case "system":
+			if opts.System != "" {
+				fmt.Println(opts.System)
+			} else {
+				fmt.Println(resp.System)
+			}
+		case "template":
+			fmt.Println(resp.Template)
+		default:
+			fmt.Println("error: unknown command")
+		}
+	case "/save":
+		if len(args) != 2 {
+			fmt.Println("Usage: /save <session>")
+			return nil
+		}
+
+		if err := saveSession(args[1], savedSession{Model: *model, runOptions: *opts, Context: conversation}); err != nil {
+			fmt.Printf("error: %s\n", err)
+			return nil
+		}
+
+		fmt.Printf("Saved session '%s'.\n", args[1])
+	case "/load":
+		if len(args) != 2 {
+			fmt.Println("Usage: /load <session>")
+			return nil
+		}
+
+		sess, err := loadSession(args[1])
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			return nil
+		}
+
+		// the conversation continues with the model it was saved with
+		if sess.Model != *model {
+			if err := generate(cmd, sess.Model, ""); err != nil {
+				fmt.Printf("error: %s\n", err)
+				return nil
+			}
+
+			*model = sess.Model
+		}
+
+		*opts = sess.runOptions
+		setGenerateContext(cmd, sess.Context, *opts)
+		fmt.Printf("Loaded session '%s' with %s.\n", args[1], sess.Model)
+	case "/clear":
+		setGenerateContext(cmd, []int{}, *opts)
+		fmt.Println("Cleared session context.")
+	case "/help", "/?":
+		usage()
+	case "/exit", "/bye":
+		return errExitInteractive
+	default:
+		fmt.Printf("Unknown command '%s'. Type /? for help\n", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,560 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// models are converted from hugging face checkpoints, a directory with the model's config.json, its weights in
+// safetensors files and a sentencepiece tokenizer.model
+
+type checkpointConfig struct {
+	Architectures []string `json:"architectures"`
+
+	HiddenSize            uint32  `json:"hidden_size"`
+	IntermediateSize      uint32  `json:"intermediate_size"`
+	NumHiddenLayers       uint32  `json:"num_hidden_layers"`
+	NumAttentionHeads     uint32  `json:"num_attention_heads"`
+	NumKeyValueHeads      uint32  `json:"num_key_value_heads"`
+	MaxPositionEmbeddings uint32  `json:"max_position_embeddings"`
+	RMSNormEps            float32 `json:"rms_norm_eps"`
+	RopeTheta             float32 `json:"rope_theta"`
+	VocabSize             int     `json:"vocab_size"`
+
+	BOSTokenID *uint32 `json:"bos_token_id"`
+	EOSTokenID *uint32 `json:"eos_token_id"`
+}
+
+// safetensor is a tensor in a safetensors file
+type safetensor struct {
+	file   string
+	name   string
+	dtype  string
+	shape  []uint64
+	offset int64 // from the start of the file
+	size   int64
+}
+
+const (
+	ggmlTypeF32 uint32 = 0
+	ggmlTypeF16 uint32 = 1
+)
+
+// convertTensor is a tensor to write to the gguf file
+type convertTensor struct {
+	*safetensor
+	name    string
+	dims    []uint64 // gguf order, the fastest changing dimension first
+	typ     uint32
+	offset  uint64 // from the start of the tensor data
+	permute uint32 // the number of heads to permute rows for, 0 if the rows are kept in order
+}
+
+func (t *convertTensor) size() uint64 {
+	n := uint64(1)
+	for _, d := range t.dims {
+		n *= d
+	}
+
+	if t.typ == ggmlTypeF16 {
+		return n * 2
+	}
+
+	return n * 4
+}
+
+// IsCheckpoint reports whether dir is a model checkpoint which Convert can convert
+func IsCheckpoint(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "config.json"))
+	return err == nil
+}
+
+// Convert writes the llama architecture checkpoint in dir to dst as a gguf model. weights are stored as f16 and
+// norms as f32. fn is called with how many of the model's tensors have been converted
+func Convert(ctx context.Context, dir, dst string, fn func(completed, total int)) error {
+	var config checkpointConfig
+	bts, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bts, &config); err != nil {
+		return fmt.Errorf("config.json: %w", err)
+	}
+
+	if len(config.Architectures) == 0 {
+		return errors.New("config.json does not name the model's architecture")
+	}
+
+	switch config.Architectures[0] {
+	case "LlamaForCausalLM", "MistralForCausalLM":
+	default:
+		return fmt.Errorf("unsupported architecture %s, only llama models can be converted", config.Architectures[0])
+	}
+
+	if config.NumAttentionHeads == 0 || config.HiddenSize%config.NumAttentionHeads != 0 {
+		return errors.New("config.json has an invalid number of attention heads")
+	}
+
+	if config.NumKeyValueHeads == 0 {
+		config.NumKeyValueHeads = config.NumAttentionHeads
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.safetensors"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		if bins, _ := filepath.Glob(filepath.Join(dir, "*.bin")); len(bins) > 0 {
+			return errors.New("pytorch checkpoints can't be converted, save the model as safetensors first")
+		}
+
+		return errors.New("no safetensors files found")
+	}
+
+	var tensors []*convertTensor
+	for _, file := range files {
+		sts, err := readSafetensors(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+
+		for _, st := range sts {
+			t, err := llamaTensor(st, config)
+			if err != nil {
+				return err
+			}
+
+			if t != nil {
+				tensors = append(tensors, t)
+			}
+		}
+	}
+
+	sort.Slice(tensors, func(i, j int) bool {
+		return tensors[i].name < tensors[j].name
+	})
+
+	vocab, err := readSentencePiece(filepath.Join(dir, "tokenizer.model"))
+	if err != nil {
+		return fmt.Errorf("tokenizer.model: %w", err)
+	}
+
+	if err := vocab.addTokens(filepath.Join(dir, "added_tokens.json")); err != nil {
+		return fmt.Errorf("added_tokens.json: %w", err)
+	}
+
+	vocab.pad(config.VocabSize)
+
+	kv := []ggufKV{
+		{"general.architecture", "llama"},
+		{"general.name", filepath.Base(filepath.Clean(dir))},
+		{"general.file_type", fileTypeF16},
+		{"llama.context_length", config.MaxPositionEmbeddings},
+		{"llama.embedding_length", config.HiddenSize},
+		{"llama.block_count", config.NumHiddenLayers},
+		{"llama.feed_forward_length", config.IntermediateSize},
+		{"llama.rope.dimension_count", config.HiddenSize / config.NumAttentionHeads},
+		{"llama.attention.head_count", config.NumAttentionHeads},
+		{"llama.attention.head_count_kv", config.NumKeyValueHeads},
+		{"llama.attention.layer_norm_rms_epsilon", config.RMSNormEps},
+		{"tokenizer.ggml.model", "llama"},
+		{"tokenizer.ggml.tokens", vocab.tokens},
+		{"tokenizer.ggml.scores", vocab.scores},
+		{"tokenizer.ggml.token_type", vocab.types},
+		{"tokenizer.ggml.unknown_token_id", vocab.unknown},
+	}
+
+	if config.RopeTheta > 0 {
+		kv = append(kv, ggufKV{"llama.rope.freq_base", config.RopeTheta})
+	}
+
+	if config.BOSTokenID != nil {
+		kv = append(kv, ggufKV{"tokenizer.ggml.bos_token_id", *config.BOSTokenID})
+	}
+
+	if config.EOSTokenID != nil {
+		kv = append(kv, ggufKV{"tokenizer.ggml.eos_token_id", *config.EOSTokenID})
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeGGUF(ctx, f, kv, tensors, fn); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+var llamaLayerTensor = regexp.MustCompile(`^model\.layers\.(\d+)\.(.+)$`)
+
+var llamaLayerNames = map[string]string{
+	"input_layernorm.weight":          "attn_norm.weight",
+	"self_attn.q_proj.weight":         "attn_q.weight",
+	"self_attn.k_proj.weight":         "attn_k.weight",
+	"self_attn.v_proj.weight":         "attn_v.weight",
+	"self_attn.o_proj.weight":         "attn_output.weight",
+	"post_attention_layernorm.weight": "ffn_norm.weight",
+	"mlp.gate_proj.weight":            "ffn_gate.weight",
+	"mlp.up_proj.weight":              "ffn_up.weight",
+	"mlp.down_proj.weight":            "ffn_down.weight",
+}
+
+// llamaTensor maps a llama checkpoint tensor to its gguf tensor, tensors which aren't needed are nil
+func llamaTensor(st *safetensor, config checkpointConfig) (*convertTensor, error) {
+	t := &convertTensor{safetensor: st}
+
+	switch st.name {
+	case "model.embed_tokens.weight":
+		t.name = "token_embd.weight"
+	case "model.norm.weight":
+		t.name = "output_norm.weight"
+	case "lm_head.weight":
+		t.name = "output.weight"
+	default:
+		m := llamaLayerTensor.FindStringSubmatch(st.name)
+		if m == nil {
+			return nil, fmt.Errorf("unexpected tensor %s", st.name)
+		}
+
+		if m[2] == "self_attn.rotary_emb.inv_freq" {
+			// llama.cpp computes these itself
+			return nil, nil
+		}
+
+		name, ok := llamaLayerNames[m[2]]
+		if !ok {
+			return nil, fmt.Errorf("unexpected tensor %s", st.name)
+		}
+
+		t.name = fmt.Sprintf("blk.%s.%s", m[1], name)
+
+		// llama.cpp expects the rows of the query and key weights in a different order for rotary embeddings
+		switch m[2] {
+		case "self_attn.q_proj.weight":
+			t.permute = config.NumAttentionHeads
+		case "self_attn.k_proj.weight":
+			t.permute = config.NumKeyValueHeads
+		}
+	}
+
+	switch st.dtype {
+	case "F32", "F16", "BF16":
+	default:
+		return nil, fmt.Errorf("tensor %s has unsupported type %s", st.name, st.dtype)
+	}
+
+	for i := len(st.shape) - 1; i >= 0; i-- {
+		t.dims = append(t.dims, st.shape[i])
+	}
+
+	t.typ = ggmlTypeF16
+	if len(t.dims) == 1 {
+		t.typ = ggmlTypeF32
+	}
+
+	if t.permute > 0 && (len(st.shape) != 2 || st.shape[0]%(uint64(t.permute)*2) != 0) {
+		return nil, fmt.Errorf("tensor %s has an unexpected shape %v", st.name, st.shape)
+	}
+
+	return t, nil
+}
+
+func readSafetensors(file string) ([]*safetensor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var n uint64
+	if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	if n > 100<<20 {
+		return nil, errors.New("invalid safetensors header")
+	}
+
+	header := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(io.LimitReader(f, int64(n))).Decode(&header); err != nil {
+		return nil, err
+	}
+
+	var tensors []*safetensor
+	for name, raw := range header {
+		if name == "__metadata__" {
+			continue
+		}
+
+		var info struct {
+			DType       string   `json:"dtype"`
+			Shape       []uint64 `json:"shape"`
+			DataOffsets [2]int64 `json:"data_offsets"`
+		}
+
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return nil, fmt.Errorf("tensor %s: %w", name, err)
+		}
+
+		tensors = append(tensors, &safetensor{
+			file:   file,
+			name:   name,
+			dtype:  info.DType,
+			shape:  info.Shape,
+			offset: 8 + int64(n) + info.DataOffsets[0],
+			size:   info.DataOffsets[1] - info.DataOffsets[0],
+		})
+	}
+
+	return tensors, nil
+}
+
+type ggufKV struct {
+	key   string
+	value any
+}
+
+const ggufAlignment = 32
+
+// writeGGUF writes a version 2 gguf file with kv and tensors, reading the tensors' data from their safetensors
+func writeGGUF(ctx context.Context, f *os.File, kv []ggufKV, tensors []*convertTensor, fn func(completed, total int)) error {
+	w := bufio.NewWriterSize(f, 1<<20)
+	var written uint64
+	write := func(v any) {
+		binary.Write(w, binary.LittleEndian, v)
+		written += uint64(binary.Size(v))
+	}
+
+	writeString := func(s string) {
+		write(uint64(len(s)))
+		w.WriteString(s)
+		written += uint64(len(s))
+	}
+
+	write(uint32(FILE_MAGIC_GGUF))
+	write(uint32(2))
+	write(uint64(len(tensors)))
+	write(uint64(len(kv)))
+
+	for _, e := range kv {
+		writeString(e.key)
+		switch v := e.value.(type) {
+		case string:
+			write(ggufTypeString)
+			writeString(v)
+		case uint32:
+			write(ggufTypeUint32)
+			write(v)
+		case float32:
+			write(ggufTypeFloat32)
+			write(v)
+		case []string:
+			write(ggufTypeArray)
+			write(ggufTypeString)
+			write(uint64(len(v)))
+			for _, s := range v {
+				writeString(s)
+			}
+		case []float32:
+			write(ggufTypeArray)
+			write(ggufTypeFloat32)
+			write(uint64(len(v)))
+			write(v)
+		case []int32:
+			write(ggufTypeArray)
+			write(ggufTypeInt32)
+			write(uint64(len(v)))
+			write(v)
+		default:
+			return fmt.Errorf("unsupported gguf value for %s: %T", e.key, v)
+		}
+	}
+
+	var offset uint64
+	for _, t := range tensors {
+		t.offset = offset
+		offset += alignOffset(t.size())
+
+		writeString(t.name)
+		write(uint32(len(t.dims)))
+		write(t.dims)
+		write(t.typ)
+		write(t.offset)
+	}
+
+	padding := make([]byte, ggufAlignment)
+	w.Write(padding[:alignOffset(written)-written])
+
+	for i, t := range tensors {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := writeTensor(w, t); err != nil {
+			return fmt.Errorf("tensor %s: %w", t.safetensor.name, err)
+		}
+
+		w.Write(padding[:alignOffset(t.size())-t.size()])
+		fn(i+1, len(tensors))
+	}
+
+	return w.Flush()
+}
+
+func alignOffset(n uint64) uint64 {
+	return (n + ggufAlignment - 1) / ggufAlignment * ggufAlignment
+}
+
+// writeTensor writes t's data converted to its gguf type a row at a time
+func writeTensor(w io.Writer, t *convertTensor) error {
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	srcSize := int64(2)
+	if t.dtype == "F32" {
+		srcSize = 4
+	}
+
+	rowLen := t.dims[0]
+	rows := uint64(1)
+	for _, d := range t.dims[1:] {
+		rows *= d
+	}
+
+	if int64(rowLen*rows)*srcSize != t.safetensor.size {
+		return errors.New("size doesn't match its shape")
+	}
+
+	src := make([]byte, int64(rowLen)*srcSize)
+	dst := make([]byte, t.size()/rows)
+	for row := uint64(0); row < rows; row++ {
+		from := row
+		if t.permute > 0 {
+			// rows are grouped by head as pairs of halves, llama.cpp expects the halves interleaved
+			perHead := rows / uint64(t.permute)
+			half := perHead / 2
+			head, i := row/perHead, row%perHead
+			from = head*perHead + (i%2)*half + i/2
+		}
+
+		if _, err := f.ReadAt(src, t.safetensor.offset+int64(from)*int64(len(src))); err != nil {
+			return err
+		}
+
+		for j := uint64(0); j < rowLen; j++ {
+			var v float32
+			switch t.dtype {
+			case "F32":
+				v = math.Float32frombits(binary.LittleEndian.Uint32(src[j*4:]))
+			case "F16":
+				if t.typ == ggmlTypeF16 {
+					copy(dst[j*2:], src[j*2:j*2+2])
+					continue
+				}
+				v = float16ToFloat32(binary.LittleEndian.Uint16(src[j*2:]))
+			case "BF16":
+				v = math.Float32frombits(uint32(binary.LittleEndian.Uint16(src[j*2:])) << 16)
+			}
+
+			if t.typ == ggmlTypeF16 {
+				binary.LittleEndian.PutUint16(dst[j*2:], float32ToFloat16(v))
+			} else {
+				binary.LittleEndian.PutUint32(dst[j*4:], math.Float32bits(v))
+			}
+		}
+
+		if _, err := w.Write(dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0x1f:
+		// inf or nan
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+
+		// subnormal, normalize it
+		exp = 127 - 15 + 1
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+
+		return math.Float32frombits(sign | exp<<23 | (mant&0x3ff)<<13)
+	}
+
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
+
+// float32ToFloat16 rounds f to the nearest half precision float, ties to even
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		// inf or nan
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		// too large, inf
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			// too small, zero
+			return sign
+		}
+
+		// subnormal
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := uint16(mant >> shift)
+		rem, mid := mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > mid || (rem == mid && half&1 == 1) {
+			half++
+		}
+		return sign | half
+	}
+
+	// rounding up can carry into the exponent, which is still the nearest value
+	half := sign | uint16(exp)<<10 | uint16(mant>>13)
+	if rem := mant & 0x1fff; rem > 0x1000 || (rem == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return half
+}
@@ -0,0 +1,239 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFloat32ToFloat16(t *testing.T) {
+	cases := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{65504, 0x7bff},
+		{65520, 0x7c00}, // rounds up to inf
+		{float32(math.Inf(1)), 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+		{float32(math.NaN()), 0x7e00},
+		{1 + 1.0/2048, 0x3c00},    // halfway, ties to even
+		{1 + 3.0/2048, 0x3c02},    // halfway, ties to even
+		{1 + 1.5/2048, 0x3c01},    // nearest
+		{1.0 / (1 << 24), 0x0001}, // smallest subnormal
+		{1.0 / (1 << 25), 0x0000}, // halfway to the smallest subnormal, ties to even
+		{3.0 / (1 << 25), 0x0002}, // halfway, ties to even
+		{1.0 / (1 << 14), 0x0400}, // smallest normal
+		{1.0 / (1 << 30), 0x0000}, // too small
+	}
+
+	for _, tt := range cases {
+		if got := float32ToFloat16(tt.f); got != tt.want {
+			t.Errorf("float32ToFloat16(%g) = %#04x, want %#04x", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestFloat16RoundTrip(t *testing.T) {
+	for h := 0; h <= 0xffff; h++ {
+		f := float16ToFloat32(uint16(h))
+		if math.IsNaN(float64(f)) {
+			if h&0x7c00 != 0x7c00 || h&0x3ff == 0 {
+				t.Errorf("float16ToFloat32(%#04x) = NaN", h)
+			}
+			continue
+		}
+
+		if got := float32ToFloat16(f); got != uint16(h) {
+			t.Errorf("float32ToFloat16(float16ToFloat32(%#04x)) = %#04x, %g", h, got, f)
+		}
+	}
+
+	if f := float16ToFloat32(0x0001); f != 1.0/(1<<24) {
+		t.Errorf("float16ToFloat32(0x0001) = %g, want the smallest subnormal", f)
+	}
+}
+
+// writeSafetensors writes a safetensors file with F32 tensors, each of the given shape with its values
+func writeSafetensors(t *testing.T, file string, tensors map[string][]uint64, values map[string][]float32) {
+	t.Helper()
+
+	header := make(map[string]any)
+	var data bytes.Buffer
+	for name, shape := range tensors {
+		start := data.Len()
+		binary.Write(&data, binary.LittleEndian, values[name])
+		header[name] = map[string]any{"dtype": "F32", "shape": shape, "data_offsets": []int{start, data.Len()}}
+	}
+
+	bts, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint64(len(bts)))
+	b.Write(bts)
+	b.Write(data.Bytes())
+	if err := os.WriteFile(file, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteTensorPermutesQueryRows(t *testing.T) {
+	// 2 heads of 4 rows, each row is its index in both columns
+	var values []float32
+	for row := 0; row < 8; row++ {
+		values = append(values, float32(row), float32(row))
+	}
+
+	file := filepath.Join(t.TempDir(), "model.safetensors")
+	name := "model.layers.0.self_attn.q_proj.weight"
+	writeSafetensors(t, file, map[string][]uint64{name: {8, 2}}, map[string][]float32{name: values})
+
+	sts, err := readSafetensors(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tensor, err := llamaTensor(sts[0], checkpointConfig{NumAttentionHeads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := writeTensor(&b, tensor); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []int
+	for i := 0; i < b.Len(); i += 4 {
+		rows = append(rows, int(float16ToFloat32(binary.LittleEndian.Uint16(b.Bytes()[i:]))))
+	}
+
+	// the two halves of each head are interleaved, as llama.cpp's convert.py permutes them
+	if want := []int{0, 2, 1, 3, 4, 6, 5, 7}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, want %v", rows, want)
+	}
+}
+
+func TestWriteGGUF(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "model.safetensors")
+	values := map[string][]float32{
+		"model.norm.weight":         {1, 2, 3, 4},
+		"model.embed_tokens.weight": {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+	writeSafetensors(t, file, map[string][]uint64{"model.norm.weight": {4}, "model.embed_tokens.weight": {3, 4}}, values)
+
+	sts, err := readSafetensors(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tensors []*convertTensor
+	for _, st := range sts {
+		tensor, err := llamaTensor(st, checkpointConfig{NumAttentionHeads: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tensors = append(tensors, tensor)
+	}
+
+	kv := []ggufKV{
+		{"general.architecture", "llama"},
+		{"llama.block_count", uint32(1)},
+		{"llama.attention.layer_norm_rms_epsilon", float32(1e-5)},
+		{"tokenizer.ggml.tokens", []string{"<unk>", "a"}},
+		{"tokenizer.ggml.scores", []float32{0, -1}},
+		{"tokenizer.ggml.token_type", []int32{tokenTypeUnknown, tokenTypeNormal}},
+	}
+
+	f, err := os.Create(filepath.Join(dir, "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var completed int
+	if err := writeGGUF(context.Background(), f, kv, tensors, func(n, total int) { completed = n }); err != nil {
+		t.Fatal(err)
+	}
+
+	if completed != len(tensors) {
+		t.Errorf("got %d tensors converted, want %d", completed, len(tensors))
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ggml, err := DecodeGGML(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"general.architecture":                   "llama",
+		"llama.block_count":                      uint32(1),
+		"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+		"tokenizer.ggml.tokens":                  []any{"<unk>", "a"},
+		"tokenizer.ggml.scores":                  []any{float32(0), float32(-1)},
+		"tokenizer.ggml.token_type":              []any{tokenTypeUnknown, tokenTypeNormal},
+	}
+	if got := ggml.KV(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got key values %v, want %v", got, want)
+	}
+
+	got := make(map[string]Tensor)
+	for _, tensor := range ggml.Tensors() {
+		got[tensor.Name] = tensor
+	}
+
+	wantTensors := map[string]Tensor{
+		"output_norm.weight": {Name: "output_norm.weight", Type: "F32", Shape: []uint64{4}},
+		"token_embd.weight":  {Name: "token_embd.weight", Type: "F16", Shape: []uint64{4, 3}},
+	}
+	if !reflect.DeepEqual(got, wantTensors) {
+		t.Errorf("got tensors %v, want %v", got, wantTensors)
+	}
+
+	// the tensors' data is at the end of the file, each aligned
+	bts, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bts)%ggufAlignment != 0 {
+		t.Errorf("got a file of %d bytes, want it aligned to %d", len(bts), ggufAlignment)
+	}
+
+	last := tensors[len(tensors)-1]
+	data := bts[uint64(len(bts))-last.offset-alignOffset(last.size()):]
+	for _, tensor := range tensors {
+		var got []float32
+		for i := tensor.offset; i < tensor.offset+tensor.size(); {
+			if tensor.typ == ggmlTypeF16 {
+				got = append(got, float16ToFloat32(binary.LittleEndian.Uint16(data[i:])))
+				i += 2
+			} else {
+				got = append(got, math.Float32frombits(binary.LittleEndian.Uint32(data[i:])))
+				i += 4
+			}
+		}
+
+		if want := values[tensor.safetensor.name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %s %v, want %v", tensor.name, got, want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package llm
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -73,6 +74,67 @@ func fileType(fileType uint32) string {
 	}
 }
 
+// Tensor is a tensor's name, its type such as Q4_K or F16, and its dimensions
+type Tensor struct {
+	Name  string
+	Type  string
+	Shape []uint64
+}
+
+// KV returns the key values of a gguf model, other models have none
+func (ggml *GGML) KV() map[string]any {
+	if m, ok := ggml.model.(*ggufModel); ok {
+		return m.kv
+	}
+
+	return nil
+}
+
+// Tensors returns the tensors of a gguf model, other models have none
+func (ggml *GGML) Tensors() []Tensor {
+	if m, ok := ggml.model.(*ggufModel); ok {
+		return m.tensors
+	}
+
+	return nil
+}
+
+// tensorType is the name of a ggml tensor type
+func tensorType(t uint32) string {
+	switch t {
+	case 0:
+		return "F32"
+	case 1:
+		return "F16"
+	case 2:
+		return "Q4_0"
+	case 3:
+		return "Q4_1"
+	case 6:
+		return "Q5_0"
+	case 7:
+		return "Q5_1"
+	case 8:
+		return "Q8_0"
+	case 9:
+		return "Q8_1"
+	case 10:
+		return "Q2_K"
+	case 11:
+		return "Q3_K"
+	case 12:
+		return "Q4_K"
+	case 13:
+		return "Q5_K"
+	case 14:
+		return "Q6_K"
+	case 15:
+		return "Q8_K"
+	default:
+		return fmt.Sprintf("unknown(%d)", t)
+	}
+}
+
 type model interface {
 	ModelFamily() string
 	ModelType() string
@@ -67,6 +67,7 @@ type kv map[string]any
 type ggufModel struct {
 	*containerGGUF
 	kv
+	tensors []Tensor
 }
 
 func newGGUFModel(container *containerGGUF) *ggufModel {
@@ -84,6 +85,14 @@ func (llm *ggufModel) NumKV() uint64 {
 	return llm.V2.NumKV
 }
 
+func (llm *ggufModel) NumTensor() uint64 {
+	if llm.Version == 1 {
+		return uint64(llm.V1.NumTensor)
+	}
+
+	return llm.V2.NumTensor
+}
+
 func (llm *ggufModel) ModelFamily() string {
 	t, ok := llm.kv["general.architecture"].(string)
 	if ok {
@@ -192,6 +201,29 @@ func (llm *ggufModel) Decode(r io.Reader) error {
 		llm.kv[k] = v
 	}
 
+	// the tensor infos follow the key values, each has its name, its dimensions, its type and its offset
+	for i := 0; uint64(i) < llm.NumTensor(); i++ {
+		name, err := read(r)
+		if err != nil {
+			return err
+		}
+
+		t := Tensor{Name: name}
+		dims := llm.readU32(r)
+		for j := uint32(0); j < dims; j++ {
+			if llm.Version == 1 {
+				t.Shape = append(t.Shape, uint64(llm.readU32(r)))
+			} else {
+				t.Shape = append(t.Shape, llm.readU64(r))
+			}
+		}
+
+		t.Type = tensorType(llm.readU32(r))
+		llm.readU64(r)
+
+		llm.tensors = append(llm.tensors, t)
+	}
+
 	return nil
 }
 
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
@@ -20,6 +21,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmorganca/ollama/api"
@@ -32,34 +34,52 @@ type ModelRunner struct {
 	Path string // path to the model runner executable
 }
 
-func chooseRunners(workDir, runnerType string) []ModelRunner {
+// runnerPaths returns the paths of the runners of runnerType for the OS in the embed, in priority order
+func runnerPaths(runnerType string) []string {
 	buildPath := path.Join("llama.cpp", runnerType, "build")
-	var runners []string
 
 	// set the runners based on the OS
 	// IMPORTANT: the order of the runners in the array is the priority order
 	switch runtime.GOOS {
 	case "darwin":
-		runners = []string{
+		return []string{
 			path.Join(buildPath, "metal", "bin", "server"),
 			path.Join(buildPath, "cpu", "bin", "server"),
 		}
 	case "linux":
-		runners = []string{
+		return []string{
 			path.Join(buildPath, "cuda", "bin", "server"),
 			path.Join(buildPath, "cpu", "bin", "server"),
 		}
 	case "windows":
 		// TODO: select windows GPU runner here when available
-		runners = []string{
+		return []string{
 			path.Join(buildPath, "cpu", "bin", "Release", "server.exe"),
 		}
 	default:
 		log.Printf("unknown OS, running on CPU: %s", runtime.GOOS)
-		runners = []string{
+		return []string{
 			path.Join(buildPath, "cpu", "bin", "server"),
 		}
 	}
+}
+
+// AvailableRunners returns the runners ollama was built with for the OS, such as llama.cpp/gguf/build/cuda/bin/server
+func AvailableRunners() []string {
+	var available []string
+	for _, runnerType := range []string{"gguf", "ggml"} {
+		for _, r := range runnerPaths(runnerType) {
+			if _, err := fs.Stat(llamaCppEmbed, r); err == nil {
+				available = append(available, r)
+			}
+		}
+	}
+
+	return available
+}
+
+func chooseRunners(workDir, runnerType string) []ModelRunner {
+	runners := runnerPaths(runnerType)
 
 	runnerAvailable := false // if no runner files are found in the embed, this flag will cause a fast fail
 	for _, r := range runners {
@@ -182,6 +202,28 @@ type Running struct {
 type llama struct {
 	api.Options
 	Running
+
+	size      int64 // size of the model file in bytes
+	numLayers int64
+	gpuLayers int64
+
+	// cache tracks the prompts held in the runner's slots, it's nil when prompts aren't cached
+	cache *promptCache
+
+	// vision is set when the runner has a projector for images
+	vision bool
+
+	// adapters are the ids of the LoRA adapters the runner loaded without applying them, by path. it's nil
+	// unless the runner can swap adapters, applied are the adapters a prediction applies unless it sets one
+	adapters map[string]int
+	applied  []string
+}
+
+var errNoVision = errors.New("this model doesn't support images, it needs a PROJECTOR")
+
+// ImageTag is where the image with id goes in a prompt, ids are the image's index in PredictOpts.Images
+func ImageTag(id int) string {
+	return fmt.Sprintf("[img-%d]", id)
 }
 
 var errNoGPU = errors.New("nvidia-smi command failed")
@@ -211,63 +253,169 @@ func CheckVRAM() (int, error) {
 	return total, nil
 }
 
-func NumGPU(numLayer, fileSizeBytes int64, opts api.Options) int {
-	if opts.NumGPU != -1 {
-		return opts.NumGPU
+// nvidiaSMITimeout is how long nvidia-smi has to list the GPUs, it can hang when the driver is in a bad state
+var nvidiaSMITimeout = 5 * time.Second
+
+// GPUs returns the NVIDIA GPUs nvidia-smi finds with their total and free VRAM, there are none if the nvidia
+// driver isn't installed
+func GPUs() ([]api.GPU, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nvidiaSMITimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=index,name,memory.total,memory.free", "--format=csv,noheader,nounits")
+	cmd.WaitDelay = time.Second
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("nvidia-smi didn't respond in %s", nvidiaSMITimeout)
+		}
+
+		return nil, nil
 	}
-	n := 1 // default to enable metal on macOS
-	if runtime.GOOS == "linux" {
-		vramMib, err := CheckVRAM()
+
+	var gpus []api.GPU
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("failed to parse GPU %q", scanner.Text())
+		}
+
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		index, err := strconv.Atoi(fields[0])
 		if err != nil {
-			if err.Error() != "nvidia-smi command failed" {
-				log.Print(err.Error())
-			}
-			// nvidia driver not installed or no nvidia GPU found
-			return 0
+			return nil, fmt.Errorf("failed to parse GPU index: %v", err)
+		}
+
+		total, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse total VRAM: %v", err)
 		}
 
-		totalVramBytes := int64(vramMib) * 1024 * 1024 // 1 MiB = 1024^2 bytes
+		free, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse free VRAM: %v", err)
+		}
+
+		gpus = append(gpus, api.GPU{
+			Index:     index,
+			Name:      fields[1],
+			TotalVRAM: total * 1024 * 1024,
+			FreeVRAM:  free * 1024 * 1024,
+		})
+	}
+
+	return gpus, nil
+}
+
+// parseTensorSplit checks a tensor_split, the comma separated proportions of the model to put on each GPU
+func parseTensorSplit(s string) error {
+	for _, p := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("invalid tensor_split %q, expected proportions for each GPU such as 3,1", s)
+		}
+	}
+
+	return nil
+}
+
+// NumGPU is how many layers to offload to the GPU. unless the user set num_gpu, it's as many as fit in the free
+// VRAM of NVIDIA GPUs on Linux, and 1 to enable metal on macOS
+func NumGPU(ggml *GGML, fileSizeBytes int64, opts api.Options) int {
+	if opts.NumGPU != -1 {
+		return opts.NumGPU
+	}
+
+	if runtime.GOOS != "linux" {
+		// default to enable metal on macOS
+		return 1
+	}
+
+	gpus, err := GPUs()
+	if err != nil {
+		log.Print(err.Error())
+		return 0
+	}
 
-		// Calculate bytes per layer
-		// TODO: this is a rough heuristic, better would be to calculate this based on number of layers and context size
-		bytesPerLayer := fileSizeBytes / numLayer
+	if len(gpus) == 0 {
+		// nvidia driver not installed or no nvidia GPU found
+		return 0
+	}
 
-		// set n to the max number of layers we can fit in VRAM
-		return int(totalVramBytes / bytesPerLayer)
+	var free int64
+	for _, gpu := range gpus {
+		free += gpu.FreeVRAM
+	}
 
-		log.Printf("%d MiB VRAM available, loading up to %d GPU layers", vramMib, n)
+	numLayers := ggml.NumLayers()
+	n, ok := estimateGPULayers(ggml, opts, free)
+	if !ok && numLayers > 0 {
+		// without tensor sizes, guess each layer takes the same share of the file
+		bytesPerLayer := fileSizeBytes / numLayers
+		n = int((free - vramReserve) / bytesPerLayer)
+		if n < 0 {
+			n = 0
+		}
 	}
-	// default to enable metal on macOS
-	return 1
+
+	logOffload(free, n, numLayers)
+	return n
 }
 
-func newLlama(model string, adapters []string, runners []ModelRunner, numLayers int64, opts api.Options) (*llama, error) {
+func newLlama(model string, adapters, swappable []string, projector, draft string, runners []ModelRunner, ggml *GGML, opts api.Options) (*llama, error) {
+	numLayers := ggml.NumLayers()
 	fileInfo, err := os.Stat(model)
 	if err != nil {
 		return nil, err
 	}
 
+	size := fileInfo.Size()
+	if draft != "" {
+		fi, err := os.Stat(draft)
+		if err != nil {
+			return nil, err
+		}
+
+		size += fi.Size()
+	}
+
 	if len(adapters) > 1 {
 		return nil, errors.New("ollama supports only one lora adapter, but multiple were provided")
 	}
 
+	numGPU := NumGPU(ggml, fileInfo.Size(), opts)
+
 	params := []string{
 		"--model", model,
-		"--ctx-size", fmt.Sprintf("%d", opts.NumCtx),
 		"--rope-freq-base", fmt.Sprintf("%f", opts.RopeFrequencyBase),
 		"--rope-freq-scale", fmt.Sprintf("%f", opts.RopeFrequencyScale),
 		"--batch-size", fmt.Sprintf("%d", opts.NumBatch),
-		"--n-gpu-layers", fmt.Sprintf("%d", NumGPU(numLayers, fileInfo.Size(), opts)),
 		"--embedding",
 	}
 
-	if opts.NumGQA > 0 {
-		params = append(params, "--gqa", fmt.Sprintf("%d", opts.NumGQA))
+	if opts.MainGPU > 0 {
+		params = append(params, "--main-gpu", fmt.Sprintf("%d", opts.MainGPU))
 	}
 
-	if len(adapters) > 0 {
-		// TODO: applying multiple adapters is not supported by the llama.cpp server yet
-		params = append(params, "--lora", adapters[0])
+	if opts.TensorSplit != "" {
+		if err := parseTensorSplit(opts.TensorSplit); err != nil {
+			return nil, err
+		}
+
+		params = append(params, "--tensor-split", strings.ReplaceAll(opts.TensorSplit, " ", ""))
+	}
+
+	if opts.LowVRAM {
+		params = append(params, "--low-vram")
+	}
+
+	if opts.NumGQA > 0 {
+		params = append(params, "--gqa", fmt.Sprintf("%d", opts.NumGQA))
 	}
 
 	if opts.NumThread > 0 {
@@ -287,56 +435,146 @@ func newLlama(model string, adapters []string, runners []ModelRunner, numLayers
 		params = append(params, "--numa")
 	}
 
-	// start the llama.cpp server with a retry in case the port is already in use
-	for _, runner := range runners {
-		if _, err := os.Stat(runner.Path); err != nil {
-			log.Printf("llama runner not found: %v", err)
-			continue
+	// start the llama.cpp server with a retry in case the port is already in use. if no runner starts with the
+	// estimated gpu layers, such as when the model runs out of VRAM, try again with fewer
+	for i, numGPU := range offloadAttempts(numGPU, opts) {
+		if i > 0 {
+			log.Printf("retrying with %d GPU layers", numGPU)
 		}
 
-		port := rand.Intn(65535-49152) + 49152 // get a random port in the ephemeral range
-		ctx, cancel := context.WithCancel(context.Background())
-		cmd := exec.CommandContext(
-			ctx,
-			runner.Path,
-			append(params, "--port", strconv.Itoa(port))...,
-		)
-		cmd.Env = append(os.Environ(), fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(runner.Path)))
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		for _, runner := range runners {
+			if _, err := os.Stat(runner.Path); err != nil {
+				log.Printf("llama runner not found: %v", err)
+				continue
+			}
 
-		llm := &llama{Options: opts, Running: Running{Port: port, Cmd: cmd, Cancel: cancel}}
+			args := append([]string{}, params...)
+			args = append(args, "--n-gpu-layers", fmt.Sprintf("%d", numGPU))
+
+			// each slot caches a prompt and has the whole context, a runner without slots caches its last prompt
+			slots := 1
+			if opts.NumPromptCache > 1 {
+				if runnerSupports(runner.Path, "--parallel") {
+					slots = opts.NumPromptCache
+					args = append(args, "--parallel", fmt.Sprintf("%d", slots))
+				} else {
+					log.Printf("WARNING: llama runner %s doesn't support slots, caching only the last prompt", runner.Path)
+				}
+			}
+			args = append(args, "--ctx-size", fmt.Sprintf("%d", opts.NumCtx*slots))
+			vision := false
+			if projector != "" {
+				if runnerSupports(runner.Path, "--mmproj") {
+					args = append(args, "--mmproj", projector)
+					vision = true
+				} else {
+					log.Printf("WARNING: llama runner %s doesn't support images, ignoring the projector", runner.Path)
+				}
+			}
 
-		log.Print("starting llama runner")
-		if err := llm.Cmd.Start(); err != nil {
-			log.Printf("error starting the external llama runner: %v", err)
-			continue
-		}
+			// swappable adapters are loaded alongside the model's own and applied by each prediction
+			var loras map[string]int
+			switch {
+			case len(swappable) > 0 && runnerSupports(runner.Path, "--lora-init-without-apply"):
+				loras = make(map[string]int)
+				for _, adapter := range append(append([]string{}, adapters...), swappable...) {
+					if _, ok := loras[adapter]; !ok {
+						loras[adapter] = len(loras)
+						args = append(args, "--lora", adapter)
+					}
+				}
+				args = append(args, "--lora-init-without-apply")
+			case len(adapters) > 0:
+				if len(swappable) > 0 {
+					log.Printf("WARNING: llama runner %s doesn't support swapping adapters", runner.Path)
+				}
 
-		// monitor the command, it is blocking, so if it exits we need to capture that
-		go func() {
-			err := llm.Cmd.Wait() // this will block until the command exits
-			if err != nil {
-				log.Printf("llama runner exited with error: %v", err)
-			} else {
-				log.Printf("llama runner exited")
+				// TODO: applying multiple adapters is not supported by the llama.cpp server yet
+				args = append(args, "--lora", adapters[0])
 			}
-		}()
 
-		if err := waitForServer(llm); err != nil {
-			log.Printf("error starting llama runner: %v", err)
-			llm.Close()
-			// try again
-			continue
-		}
+			if draft != "" {
+				if runnerSupports(runner.Path, "--model-draft") {
+					args = append(args, "--model-draft", draft, "--draft", fmt.Sprintf("%d", opts.NumDraft))
+				} else {
+					log.Printf("WARNING: llama runner %s doesn't support speculative decoding, ignoring the draft model", runner.Path)
+				}
+			}
+
+			port := rand.Intn(65535-49152) + 49152 // get a random port in the ephemeral range
+			ctx, cancel := context.WithCancel(context.Background())
+			cmd := exec.CommandContext(
+				ctx,
+				runner.Path,
+				append(args, "--port", strconv.Itoa(port))...,
+			)
+			cmd.Env = append(os.Environ(), fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(runner.Path)))
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+
+			llm := &llama{
+				Options:   opts,
+				Running:   Running{Port: port, Cmd: cmd, Cancel: cancel},
+				size:      size,
+				numLayers: numLayers,
+				gpuLayers: int64(numGPU),
+				vision:    vision,
+				adapters:  loras,
+				applied:   adapters,
+			}
+
+			if opts.NumPromptCache > 0 {
+				llm.cache = newPromptCache(slots)
+			}
+
+			log.Print("starting llama runner")
+			if err := llm.Cmd.Start(); err != nil {
+				log.Printf("error starting the external llama runner: %v", err)
+				continue
+			}
+
+			// monitor the command, it is blocking, so if it exits we need to capture that
+			go func() {
+				err := llm.Cmd.Wait() // this will block until the command exits
+				if err != nil {
+					log.Printf("llama runner exited with error: %v", err)
+				} else {
+					log.Printf("llama runner exited")
+				}
+			}()
+
+			if err := waitForServer(llm); err != nil {
+				log.Printf("error starting llama runner: %v", err)
+				llm.Close()
+				// try again
+				continue
+			}
 
-		// server started successfully
-		return llm, nil
+			// server started successfully
+			return llm, nil
+		}
 	}
 
 	return nil, fmt.Errorf("failed to start a llama runner")
 }
 
+// runnerHelp caches the --help output of each runner, by its path
+var runnerHelp sync.Map
+
+// runnerSupports reports whether the runner at path has the flag, runners are built from different versions
+// of llama.cpp
+func runnerSupports(path, flag string) bool {
+	help, ok := runnerHelp.Load(path)
+	if !ok {
+		cmd := exec.Command(path, "--help")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(path)))
+		out, _ := cmd.CombinedOutput()
+		help, _ = runnerHelp.LoadOrStore(path, string(out))
+	}
+
+	return strings.Contains(help.(string), flag)
+}
+
 func waitForServer(llm *llama) error {
 	// wait for the server to start responding
 	start := time.Now()
@@ -367,6 +605,40 @@ func (llm *llama) Close() {
 	llm.Cancel()
 }
 
+// Memory estimates the memory used by the model's weights in system memory and on the gpu, from the share
+// of its layers offloaded to the gpu
+func (llm *llama) Memory() (cpu, gpu int64) {
+	switch {
+	case llm.gpuLayers <= 0:
+		return llm.size, 0
+	case runtime.GOOS == "darwin":
+		// metal uses unified memory, the whole model is available to the gpu
+		return 0, llm.size
+	case llm.numLayers <= 0 || llm.gpuLayers >= llm.numLayers:
+		return 0, llm.size
+	}
+
+	gpu = llm.size * llm.gpuLayers / llm.numLayers
+	return llm.size - gpu, gpu
+}
+
+// FlushPromptCache evaluates the next prompt in each slot in full, instead of reusing what was cached
+func (llm *llama) FlushPromptCache() {
+	if llm.cache != nil {
+		llm.cache.flush()
+	}
+}
+
+// cachedTokens is how many of a prompt's tokens weren't evaluated because they were cached, the runner only
+// counts the tokens it evaluated
+func cachedTokens(prompt, evaluated int) int {
+	if prompt > evaluated {
+		return prompt - evaluated
+	}
+
+	return 0
+}
+
 func (llm *llama) SetOptions(opts api.Options) {
 	llm.Options = opts
 }
@@ -402,6 +674,10 @@ type Timings struct {
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+
+	// set by runners decoding with a draft model
+	DraftN         int `json:"draft_n"`
+	DraftNAccepted int `json:"draft_n_accepted"`
 }
 
 type Prediction struct {
@@ -410,9 +686,26 @@ type Prediction struct {
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
 
+	// CompletionProbabilities are the probabilities of the tokens in Content, when they're asked for
+	CompletionProbabilities []completionProbability `json:"completion_probabilities"`
+
 	Timings `json:"timings"`
 }
 
+type completionProbability struct {
+	Content string `json:"content"`
+	Probs   []struct {
+		TokStr string  `json:"tok_str"`
+		Prob   float64 `json:"prob"`
+	} `json:"probs"`
+}
+
+// imageData is an image in a prompt, the runner decodes it from base64
+type imageData struct {
+	Data []byte `json:"data"`
+	ID   int    `json:"id"`
+}
+
 type PredictRequest struct {
 	Stream           bool            `json:"stream"`
 	NPredict         int             `json:"n_predict,omitempty"`
@@ -436,39 +729,127 @@ type PredictRequest struct {
 	LogitBias        map[int]float32 `json:"logit_bias,omitempty"`
 	IgnoreEos        bool            `json:"ignore_eos,omitempty"`
 	Stop             []string        `json:"stop,omitempty"`
+	Grammar          string          `json:"grammar,omitempty"`
+
+	// CachePrompt reuses the part of the slot's last prompt this prompt starts with
+	CachePrompt bool `json:"cache_prompt,omitempty"`
+	SlotID      *int `json:"slot_id,omitempty"`
+
+	ImageData []imageData `json:"image_data,omitempty"`
+
+	// Lora is the scale of each adapter the runner loaded, adapters it leaves out aren't applied
+	Lora []loraScale `json:"lora,omitempty"`
+}
+
+type loraScale struct {
+	ID    int     `json:"id"`
+	Scale float32 `json:"scale"`
 }
 
-func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string, fn func(api.GenerateResponse)) error {
-	prevConvo, err := llm.Decode(ctx, prevContext)
+// HasAdapter reports whether a prediction can apply the adapter at path
+func (llm *llama) HasAdapter(path string) bool {
+	_, ok := llm.adapters[path]
+	return ok
+}
+
+// loraScales applies adapter to a prediction, or the model's own adapters if it's empty
+func (llm *llama) loraScales(adapter string) []loraScale {
+	apply := llm.applied
+	if adapter != "" {
+		apply = []string{adapter}
+	}
+
+	scales := make([]loraScale, len(llm.adapters))
+	for path, id := range llm.adapters {
+		scales[id] = loraScale{ID: id}
+		for _, a := range apply {
+			if a == path {
+				scales[id].Scale = 1
+			}
+		}
+	}
+
+	return scales
+}
+
+func (llm *llama) Predict(ctx context.Context, predict PredictOpts, fn func(api.GenerateResponse)) error {
+	if len(predict.Images) > 0 && !llm.vision {
+		return errNoVision
+	}
+
+	if predict.Adapter != "" && !llm.HasAdapter(predict.Adapter) {
+		return fmt.Errorf("the runner didn't load the adapter %s", predict.Adapter)
+	}
+
+	prevConvo, err := llm.Decode(ctx, predict.Context)
 	if err != nil {
 		return err
 	}
 
 	var nextContext strings.Builder
 	nextContext.WriteString(prevConvo)
-	nextContext.WriteString(prompt)
+	nextContext.WriteString(predict.Prompt)
+
+	opts := llm.Options
+	if predict.Options != nil {
+		opts = *predict.Options
+	}
 
 	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", llm.Port)
 	predReq := PredictRequest{
 		Prompt:           nextContext.String(),
 		Stream:           true,
-		NPredict:         llm.NumPredict,
-		NKeep:            llm.NumKeep,
-		Temperature:      llm.Temperature,
-		TopK:             llm.TopK,
-		TopP:             llm.TopP,
-		TfsZ:             llm.TFSZ,
-		TypicalP:         llm.TypicalP,
-		RepeatLastN:      llm.RepeatLastN,
-		RepeatPenalty:    llm.RepeatPenalty,
-		PresencePenalty:  llm.PresencePenalty,
-		FrequencyPenalty: llm.FrequencyPenalty,
-		Mirostat:         llm.Mirostat,
-		MirostatTau:      llm.MirostatTau,
-		MirostatEta:      llm.MirostatEta,
-		PenalizeNl:       llm.PenalizeNewline,
-		Stop:             llm.Stop,
+		NPredict:         opts.NumPredict,
+		Seed:             opts.Seed,
+		NKeep:            opts.NumKeep,
+		Temperature:      opts.Temperature,
+		TopK:             opts.TopK,
+		TopP:             opts.TopP,
+		TfsZ:             opts.TFSZ,
+		TypicalP:         opts.TypicalP,
+		RepeatLastN:      opts.RepeatLastN,
+		RepeatPenalty:    opts.RepeatPenalty,
+		PresencePenalty:  opts.PresencePenalty,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		Mirostat:         opts.Mirostat,
+		MirostatTau:      opts.MirostatTau,
+		MirostatEta:      opts.MirostatEta,
+		PenalizeNl:       opts.PenalizeNewline,
+		Stop:             opts.Stop,
+		Grammar:          predict.Grammar,
+	}
+
+	if llm.adapters != nil {
+		predReq.Lora = llm.loraScales(predict.Adapter)
+	}
+
+	if predict.Logprobs {
+		predReq.NProbs = predict.TopLogprobs
+		if predReq.NProbs < logprobCandidates {
+			predReq.NProbs = logprobCandidates
+		}
+	}
+
+	for i, image := range predict.Images {
+		predReq.ImageData = append(predReq.ImageData, imageData{Data: image, ID: i})
+	}
+
+	var promptTokens int
+	if llm.cache != nil {
+		tokens, err := llm.Encode(ctx, nextContext.String())
+		if err != nil {
+			return err
+		}
+
+		promptTokens = len(tokens)
+		slot, reuse := llm.cache.choose(predict.Adapter, tokens)
+		// the same prompt with other images has to be evaluated again
+		predReq.CachePrompt = reuse && len(predict.Images) == 0
+		if len(llm.cache.slots) > 1 {
+			predReq.SlotID = &slot
+		}
 	}
+
 	data, err := json.Marshal(predReq)
 	if err != nil {
 		return fmt.Errorf("error marshaling data: %v", err)
@@ -482,8 +863,9 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("POST predict: %v", err)
+		return fmt.Errorf("POST predict: %w", err)
 	}
+	// closing the response stops the runner generating, once ctx is done the transport closes it too
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
@@ -515,8 +897,14 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 					return fmt.Errorf("error unmarshaling llm prediction response: %v", err)
 				}
 
+				// the last event has the probabilities of every token again
 				if p.Content != "" {
-					fn(api.GenerateResponse{Response: p.Content})
+					r := api.GenerateResponse{Response: p.Content}
+					if predict.Logprobs && !p.Stop {
+						r.Logprobs = logprobs(p.CompletionProbabilities, predict.TopLogprobs)
+					}
+
+					fn(r)
 					nextContext.WriteString(p.Content)
 				}
 
@@ -527,12 +915,17 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 					}
 
 					fn(api.GenerateResponse{
-						Done:               true,
-						Context:            embd,
-						PromptEvalCount:    p.PromptN,
-						PromptEvalDuration: parseDurationMs(p.PromptMS),
-						EvalCount:          p.PredictedN,
-						EvalDuration:       parseDurationMs(p.PredictedMS),
+						Done:    true,
+						Context: embd,
+						Metrics: api.Metrics{
+							PromptEvalCount:    p.PromptN,
+							PromptEvalDuration: parseDurationMs(p.PromptMS),
+							EvalCount:          p.PredictedN,
+							EvalDuration:       parseDurationMs(p.PredictedMS),
+							DraftCount:         p.DraftN,
+							DraftAcceptedCount: p.DraftNAccepted,
+							PromptCacheCount:   cachedTokens(promptTokens, p.PromptN),
+						},
 					})
 
 					return nil
@@ -542,12 +935,60 @@ func (llm *llama) Predict(ctx context.Context, prevContext []int, prompt string,
 	}
 
 	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			// the request was cancelled while waiting for the next token
+			return ctx.Err()
+		}
+
 		return fmt.Errorf("error reading llm response: %v", err)
 	}
 
 	return nil
 }
 
+// logprobCandidates is the fewest tokens the runner returns probabilities for, the generated token is found
+// among them
+const logprobCandidates = 20
+
+// logprobs converts the runner's probabilities of each token to log probabilities, keeping the top most likely
+// tokens for each
+func logprobs(probs []completionProbability, top int) []api.TokenLogprob {
+	var lps []api.TokenLogprob
+	for _, p := range probs {
+		lp := api.TokenLogprob{Token: p.Content}
+		found := false
+		var least float64
+		for i, c := range p.Probs {
+			if c.Prob <= 0 {
+				continue
+			}
+
+			logprob := math.Log(c.Prob)
+			if !found && c.TokStr == p.Content {
+				lp.Logprob = logprob
+				found = true
+			}
+
+			if i == 0 || logprob < least {
+				least = logprob
+			}
+
+			if len(lp.TopLogprobs) < top {
+				lp.TopLogprobs = append(lp.TopLogprobs, api.TopLogprob{Token: c.TokStr, Logprob: logprob})
+			}
+		}
+
+		// the generated token isn't always among the candidates, it's at most as likely as the least likely of them
+		if !found {
+			lp.Logprob = least
+		}
+
+		lps = append(lps, lp)
+	}
+
+	return lps
+}
+
 type TokenizeRequest struct {
 	Content string `json:"content"`
 }
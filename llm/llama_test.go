@@ -0,0 +1,53 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeNvidiaSMI puts a nvidia-smi which runs script first in the PATH
+func fakeNvidiaSMI(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("nvidia-smi is faked with a shell script")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestGPUs(t *testing.T) {
+	fakeNvidiaSMI(t, `echo "0, NVIDIA GeForce RTX 4090, 24564, 23012"`)
+
+	gpus, err := GPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gpus) != 1 || gpus[0].Name != "NVIDIA GeForce RTX 4090" || gpus[0].FreeVRAM != 23012*1024*1024 {
+		t.Errorf("got %+v, want the RTX 4090", gpus)
+	}
+}
+
+func TestGPUsTimeout(t *testing.T) {
+	fakeNvidiaSMI(t, "sleep 10")
+
+	nvidiaSMITimeout = 100 * time.Millisecond
+	defer func() { nvidiaSMITimeout = 5 * time.Second }()
+
+	start := time.Now()
+	if _, err := GPUs(); err == nil {
+		t.Error("expected nvidia-smi hanging to be an error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("waited %s for nvidia-smi", elapsed)
+	}
+}
@@ -2,6 +2,7 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,17 +12,71 @@ import (
 	"github.com/jmorganca/ollama/api"
 )
 
+// PredictOpts are what a single prediction generates from
+type PredictOpts struct {
+	Prompt string
+
+	// Context is the encoded conversation to continue, from a previous response
+	Context []int
+
+	// Grammar is a gbnf grammar the output is constrained to, if it is set
+	Grammar string
+
+	// Images are shown to a multimodal model where their ImageTag is in the prompt
+	Images []api.ImageData
+
+	// Logprobs returns each token's log probability with the TopLogprobs most likely tokens
+	Logprobs    bool
+	TopLogprobs int
+
+	// Options are the sampling options of this prediction, the runner's options are used if they're nil
+	Options *api.Options
+
+	// Adapter is the path of a LoRA adapter to apply instead of the model's own, the runner must have been
+	// started with it, see AdapterSwapper
+	Adapter string
+}
+
+// ErrInsufficientMemory is the error of loading a model which needs more memory than the system has
+var ErrInsufficientMemory = errors.New("insufficient memory")
+
+// memoryError is an ErrInsufficientMemory saying how much memory the model needs
+type memoryError string
+
+func (e memoryError) Error() string {
+	return string(e)
+}
+
+func (e memoryError) Is(target error) bool {
+	return target == ErrInsufficientMemory
+}
+
 type LLM interface {
-	Predict(context.Context, []int, string, func(api.GenerateResponse)) error
+	Predict(context.Context, PredictOpts, func(api.GenerateResponse)) error
 	Embedding(context.Context, string) ([]float64, error)
 	Encode(context.Context, string) ([]int, error)
 	Decode(context.Context, []int) (string, error)
 	SetOptions(api.Options)
 	Close()
 	Ping(context.Context) error
+	Memory() (cpu, gpu int64)
 }
 
-func New(workDir, model string, adapters []string, opts api.Options) (LLM, error) {
+// Batcher is implemented by runners which can generate for several requests at once, such as with continuous
+// batching. NumParallel is how many requests they can take
+type Batcher interface {
+	NumParallel() int
+}
+
+// AdapterSwapper is implemented by runners which can apply a different LoRA adapter to each prediction without
+// loading the model again. HasAdapter reports whether the adapter at path can be set in PredictOpts
+type AdapterSwapper interface {
+	HasAdapter(path string) bool
+}
+
+// New starts a runner for model with adapters applied. swappable are LoRA adapters for the model which aren't
+// applied, predictions can apply one of them instead if the runner is an AdapterSwapper
+func New(workDir, model string, adapters, swappable []string, projector, draft string, opts api.Options) (LLM, error) {
 	if _, err := os.Stat(model); err != nil {
 		return nil, err
 	}
@@ -58,42 +113,50 @@ func New(workDir, model string, adapters []string, opts api.Options) (LLM, error
 	switch ggml.ModelType() {
 	case "3B", "7B":
 		if ggml.FileType() == "F16" && totalResidentMemory < 16*1024*1024 {
-			return nil, fmt.Errorf("F16 model requires at least 16GB of memory")
+			return nil, memoryError("F16 model requires at least 16GB of memory")
 		} else if totalResidentMemory < 8*1024*1024 {
-			return nil, fmt.Errorf("model requires at least 8GB of memory")
+			return nil, memoryError("model requires at least 8GB of memory")
 		}
 	case "13B":
 		if ggml.FileType() == "F16" && totalResidentMemory < 32*1024*1024 {
-			return nil, fmt.Errorf("F16 model requires at least 32GB of memory")
+			return nil, memoryError("F16 model requires at least 32GB of memory")
 		} else if totalResidentMemory < 16*1024*1024 {
-			return nil, fmt.Errorf("model requires at least 16GB of memory")
+			return nil, memoryError("model requires at least 16GB of memory")
 		}
 	case "30B", "34B", "40B":
 		if ggml.FileType() == "F16" && totalResidentMemory < 64*1024*1024 {
-			return nil, fmt.Errorf("F16 model requires at least 64GB of memory")
+			return nil, memoryError("F16 model requires at least 64GB of memory")
 		} else if totalResidentMemory < 32*1024*1024 {
-			return nil, fmt.Errorf("model requires at least 32GB of memory")
+			return nil, memoryError("model requires at least 32GB of memory")
 		}
 	case "65B", "70B":
 		if ggml.FileType() == "F16" && totalResidentMemory < 128*1024*1024 {
-			return nil, fmt.Errorf("F16 model requires at least 128GB of memory")
+			return nil, memoryError("F16 model requires at least 128GB of memory")
 		} else if totalResidentMemory < 64*1024*1024 {
-			return nil, fmt.Errorf("model requires at least 64GB of memory")
+			return nil, memoryError("model requires at least 64GB of memory")
 		}
 	case "180B":
 		if ggml.FileType() == "F16" && totalResidentMemory < 512*1024*1024 {
-			return nil, fmt.Errorf("F16 model requires at least 512GB of memory")
+			return nil, memoryError("F16 model requires at least 512GB of memory")
 		} else if totalResidentMemory < 128*1024*1024 {
-			return nil, fmt.Errorf("model requires at least 128GB of memory")
+			return nil, memoryError("model requires at least 128GB of memory")
 		}
 	}
 
 	switch ggml.Name() {
 	case "gguf":
 		opts.NumGQA = 0 // TODO: remove this when llama.cpp runners differ enough to need separate newLlama functions
-		return newLlama(model, adapters, chooseRunners(workDir, "gguf"), ggml.NumLayers(), opts)
+		return newLlama(model, adapters, swappable, projector, draft, chooseRunners(workDir, "gguf"), ggml, opts)
 	case "ggml", "ggmf", "ggjt", "ggla":
-		return newLlama(model, adapters, chooseRunners(workDir, "ggml"), ggml.NumLayers(), opts)
+		if draft != "" {
+			log.Printf("WARNING: speculative decoding needs a gguf model, ignoring the draft model")
+		}
+
+		if projector != "" {
+			log.Printf("WARNING: images need a gguf model, ignoring the projector")
+		}
+
+		return newLlama(model, adapters, nil, "", "", chooseRunners(workDir, "ggml"), ggml, opts)
 	default:
 		return nil, fmt.Errorf("unknown ggml type: %s", ggml.ModelFamily())
 	}
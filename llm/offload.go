@@ -0,0 +1,171 @@
+package llm
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// tensorBlocks are the elements in a block of each tensor type and the bytes the block takes
+var tensorBlocks = map[string]struct{ elements, bytes uint64 }{
+	"F32":  {1, 4},
+	"F16":  {1, 2},
+	"Q4_0": {32, 18},
+	"Q4_1": {32, 20},
+	"Q5_0": {32, 22},
+	"Q5_1": {32, 24},
+	"Q8_0": {32, 34},
+	"Q8_1": {32, 36},
+	"Q2_K": {256, 84},
+	"Q3_K": {256, 110},
+	"Q4_K": {256, 144},
+	"Q5_K": {256, 176},
+	"Q6_K": {256, 210},
+	"Q8_K": {256, 292},
+}
+
+// Size is the bytes the tensor's weights take, it's 0 for types which aren't known
+func (t Tensor) Size() uint64 {
+	block, ok := tensorBlocks[t.Type]
+	if !ok {
+		return 0
+	}
+
+	elements := uint64(1)
+	for _, dim := range t.Shape {
+		elements *= dim
+	}
+
+	return elements * block.bytes / block.elements
+}
+
+// vramReserve is the least VRAM left free when offloading, for the runner's scratch buffers and the rest of
+// the system. a tenth of the free VRAM is left if that's more
+const vramReserve = 512 * 1024 * 1024
+
+// estimateGPULayers picks how many layers of the model fit in free bytes of VRAM, counting each layer's
+// weights and its share of the kv cache. layers are offloaded in order, so it's as many as fit one after
+// the other. it isn't ok for models without tensor sizes, such as ggml models
+func estimateGPULayers(ggml *GGML, opts api.Options, free int64) (int, bool) {
+	numLayers := ggml.NumLayers()
+	tensors := ggml.Tensors()
+	if numLayers <= 0 || len(tensors) == 0 {
+		return 0, false
+	}
+
+	layers := make([]int64, numLayers)
+	var output int64
+	for _, t := range tensors {
+		size := int64(t.Size())
+		if size == 0 {
+			return 0, false
+		}
+
+		if rest, ok := strings.CutPrefix(t.Name, "blk."); ok {
+			n, _, _ := strings.Cut(rest, ".")
+			i, err := strconv.Atoi(n)
+			if err != nil || i < 0 || int64(i) >= numLayers {
+				return 0, false
+			}
+
+			layers[i] += size
+		} else if t.Name != "token_embd.weight" {
+			// the embeddings stay on the cpu, the output and its norm are offloaded after every layer
+			output += size
+		}
+	}
+
+	kv := kvCacheLayer(ggml, opts)
+
+	reserve := free / 10
+	if reserve < vramReserve {
+		reserve = vramReserve
+	}
+
+	available := free - reserve
+	n := 0
+	for _, size := range layers {
+		if size+kv > available {
+			break
+		}
+
+		available -= size + kv
+		n++
+	}
+
+	// llama.cpp offloads the output once there are more gpu layers than the model has
+	if n == len(layers) && output <= available {
+		n++
+	}
+
+	return n, true
+}
+
+// kvCacheLayer is the bytes of kv cache each layer needs for the context of each of the runner's slots
+func kvCacheLayer(ggml *GGML, opts api.Options) int64 {
+	family := ggml.ModelFamily()
+	embd := kvUint(ggml, family+".embedding_length")
+	heads := kvUint(ggml, family+".attention.head_count")
+	headsKV := kvUint(ggml, family+".attention.head_count_kv")
+	if headsKV == 0 {
+		headsKV = heads
+	}
+
+	if embd == 0 || heads == 0 {
+		return 0
+	}
+
+	slots := int64(1)
+	if opts.NumPromptCache > 1 {
+		slots = int64(opts.NumPromptCache)
+	}
+
+	elementSize := int64(2)
+	if !opts.F16KV {
+		elementSize = 4
+	}
+
+	// a key and a value for each token of the context
+	return 2 * int64(opts.NumCtx) * slots * embd * headsKV / heads * elementSize
+}
+
+func kvUint(ggml *GGML, key string) int64 {
+	switch v := ggml.KV()[key].(type) {
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case int32:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+// offloadAttempts are the gpu layers to try starting the runner with, fewer each time so a model which
+// doesn't fit in VRAM after all still loads. layers the user set are only tried as they are
+func offloadAttempts(numGPU int, opts api.Options) []int {
+	if opts.NumGPU != -1 || numGPU <= 0 {
+		return []int{numGPU}
+	}
+
+	attempts := []int{numGPU}
+	if half := numGPU / 2; half > 0 {
+		attempts = append(attempts, half)
+	}
+
+	return append(attempts, 0)
+}
+
+func logOffload(free int64, n int, numLayers int64) {
+	switch {
+	case n > int(numLayers):
+		log.Printf("%d MiB VRAM free, offloading all %d layers and the output to the GPU", free/1024/1024, numLayers)
+	case n > 0:
+		log.Printf("%d MiB VRAM free, offloading %d of %d layers to the GPU", free/1024/1024, n, numLayers)
+	default:
+		log.Printf("%d MiB VRAM free, not enough to offload a layer to the GPU", free/1024/1024)
+	}
+}
@@ -0,0 +1,143 @@
+package llm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const mib = 1024 * 1024
+
+// testModel is a gguf llama model with tensors, but no data
+func testModel(kvs kv, tensors ...Tensor) *GGML {
+	m := newGGUFModel(&containerGGUF{Version: 2})
+	m.kv = kv{"general.architecture": "llama"}
+	for k, v := range kvs {
+		m.kv[k] = v
+	}
+
+	m.tensors = tensors
+	return &GGML{magic: FILE_MAGIC_GGUF, container: m.containerGGUF, model: m}
+}
+
+// testLayers are 2 MiB f16 tensors for each of n layers, the output and the embeddings
+func testLayers(n int) []Tensor {
+	tensors := []Tensor{
+		{Name: "token_embd.weight", Type: "F16", Shape: []uint64{1024, 1024}},
+		{Name: "output.weight", Type: "F16", Shape: []uint64{1024, 1024}},
+	}
+
+	for i := 0; i < n; i++ {
+		tensors = append(tensors, Tensor{Name: fmt.Sprintf("blk.%d.attn_q.weight", i), Type: "F16", Shape: []uint64{1024, 1024}})
+	}
+
+	return tensors
+}
+
+func TestTensorSize(t *testing.T) {
+	cases := []struct {
+		tensor Tensor
+		want   uint64
+	}{
+		{Tensor{Type: "F32", Shape: []uint64{10}}, 40},
+		{Tensor{Type: "F16", Shape: []uint64{4, 4}}, 32},
+		{Tensor{Type: "Q4_0", Shape: []uint64{32, 2}}, 36},
+		{Tensor{Type: "Q4_K", Shape: []uint64{256, 4}}, 576},
+		{Tensor{Type: "Q8_0", Shape: []uint64{4096, 4096}}, 4096 * 4096 / 32 * 34},
+		{Tensor{Type: "IQ9", Shape: []uint64{32}}, 0},
+	}
+
+	for _, tt := range cases {
+		if got := tt.tensor.Size(); got != tt.want {
+			t.Errorf("%s %v: got %d bytes, want %d", tt.tensor.Type, tt.tensor.Shape, got, tt.want)
+		}
+	}
+}
+
+func TestKVCacheLayer(t *testing.T) {
+	llama := kv{"llama.embedding_length": uint32(1024), "llama.attention.head_count": uint32(8)}
+	gqa := kv{"llama.embedding_length": uint32(1024), "llama.attention.head_count": uint32(8), "llama.attention.head_count_kv": uint32(2)}
+
+	cases := []struct {
+		name string
+		kv   kv
+		opts api.Options
+		want int64
+	}{
+		{"f16", llama, api.Options{NumCtx: 256, F16KV: true}, 1 * mib},
+		{"f32", llama, api.Options{NumCtx: 256}, 2 * mib},
+		{"grouped query attention", gqa, api.Options{NumCtx: 256, F16KV: true}, mib / 4},
+		{"prompt cache slots", llama, api.Options{NumCtx: 256, F16KV: true, NumPromptCache: 3}, 3 * mib},
+		{"no embedding length", kv{"llama.attention.head_count": uint32(8)}, api.Options{NumCtx: 256}, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kvCacheLayer(testModel(tt.kv), tt.opts); got != tt.want {
+				t.Errorf("got %d bytes, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateGPULayers(t *testing.T) {
+	// each layer takes 2 MiB of weights and 1 MiB of kv cache, the output 2 MiB
+	llama := kv{
+		"llama.block_count":          uint32(4),
+		"llama.embedding_length":     uint32(1024),
+		"llama.attention.head_count": uint32(8),
+	}
+	opts := api.Options{NumCtx: 256, F16KV: true}
+
+	cases := []struct {
+		name   string
+		ggml   *GGML
+		free   int64
+		want   int
+		wantOK bool
+	}{
+		{"fits with the output", testModel(llama, testLayers(4)...), vramReserve + 14*mib, 5, true},
+		{"fits without the output", testModel(llama, testLayers(4)...), vramReserve + 13*mib, 4, true},
+		{"fits partially", testModel(llama, testLayers(4)...), vramReserve + 7*mib, 2, true},
+		{"doesn't fit", testModel(llama, testLayers(4)...), vramReserve + 2*mib, 0, true},
+		{"less than the reserve", testModel(llama, testLayers(4)...), 100 * mib, 0, true},
+		{"unknown tensor type", testModel(llama, append(testLayers(4), Tensor{Name: "blk.0.ffn_up.weight", Type: "IQ9", Shape: []uint64{32}})...), vramReserve + 14*mib, 0, false},
+		{"layer out of range", testModel(llama, testLayers(5)...), vramReserve + 14*mib, 0, false},
+		{"no tensors", testModel(llama), vramReserve + 14*mib, 0, false},
+		{"no layers", testModel(kv{}, testLayers(4)...), vramReserve + 14*mib, 0, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := estimateGPULayers(tt.ggml, opts, tt.free)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %d layers, %t, want %d, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOffloadAttempts(t *testing.T) {
+	cases := []struct {
+		name   string
+		numGPU int
+		opts   api.Options
+		want   []int
+	}{
+		{"estimated", 10, api.Options{NumGPU: -1}, []int{10, 5, 0}},
+		{"one layer", 1, api.Options{NumGPU: -1}, []int{1, 0}},
+		{"no layers", 0, api.Options{NumGPU: -1}, []int{0}},
+		{"set by the user", 20, api.Options{NumGPU: 20}, []int{20}},
+		{"cpu only", 0, api.Options{NumGPU: 0}, []int{0}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := offloadAttempts(tt.numGPU, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package llm
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// promptBlock is how many tokens are hashed together, prompts are matched a block at a time
+const promptBlock = 64
+
+// PromptCacher is implemented by runners which keep the prompts they have evaluated, so a prompt which starts
+// the same as an earlier one skips evaluating what they share
+type PromptCacher interface {
+	FlushPromptCache()
+}
+
+// promptCache tracks which prompt is held in each of a runner's slots. the runner keeps the evaluated prompt of
+// each slot, a prompt is sent to the slot which shares the longest prefix with it
+type promptCache struct {
+	mu    sync.Mutex
+	slots []promptSlot
+}
+
+type promptSlot struct {
+	// hashes are the hash of the prompt up to the end of each of its blocks
+	hashes   []uint64
+	lastUsed time.Time
+
+	// adapter is the LoRA adapter the prompt was evaluated with, a prompt evaluated with another adapter can't
+	// be reused
+	adapter string
+
+	// flushed slots have to evaluate their next prompt from the start
+	flushed bool
+}
+
+func newPromptCache(size int) *promptCache {
+	return &promptCache{slots: make([]promptSlot, size)}
+}
+
+// prefixHashes hashes tokens a block at a time, each hash covers every token before it so two prompts share
+// a prefix for as long as their hashes match
+func prefixHashes(tokens []int) []uint64 {
+	h := fnv.New64a()
+	var hashes []uint64
+	var buf [8]byte
+	for i, t := range tokens {
+		binary.LittleEndian.PutUint64(buf[:], uint64(t))
+		h.Write(buf[:])
+
+		if (i+1)%promptBlock == 0 {
+			hashes = append(hashes, h.Sum64())
+		}
+	}
+
+	return hashes
+}
+
+// choose returns the slot to evaluate tokens with adapter in and whether the slot's cached prompt can be reused.
+// it's the slot sharing the most blocks with tokens, or the least recently used slot if none share any
+func (c *promptCache) choose(adapter string, tokens []int) (int, bool) {
+	hashes := prefixHashes(tokens)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	best, shared := 0, 0
+	for i, s := range c.slots {
+		n := 0
+		for s.adapter == adapter && n < len(s.hashes) && n < len(hashes) && s.hashes[n] == hashes[n] {
+			n++
+		}
+
+		if n > shared || (shared == 0 && s.lastUsed.Before(c.slots[best].lastUsed)) {
+			best, shared = i, n
+		}
+	}
+
+	slot := &c.slots[best]
+	reuse := !slot.flushed && slot.adapter == adapter
+	slot.hashes = hashes
+	slot.adapter = adapter
+	slot.lastUsed = time.Now()
+	slot.flushed = false
+	return best, reuse
+}
+
+// flush forgets every slot's prompt, their next prompts are evaluated in full
+func (c *promptCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.slots {
+		c.slots[i] = promptSlot{flushed: true}
+	}
+}
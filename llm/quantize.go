@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// QuantizeTypes are the file types a model can be quantized to
+var QuantizeTypes = []string{
+	"Q4_0", "Q4_1", "Q5_0", "Q5_1", "Q8_0",
+	"Q2_K", "Q3_K_S", "Q3_K_M", "Q3_K_L", "Q4_K_S", "Q4_K_M", "Q5_K_S", "Q5_K_M", "Q6_K",
+}
+
+// quantize logs a line for each tensor as it goes, starting with [ n/ total]
+var quantizeProgress = regexp.MustCompile(`^\[\s*(\d+)/\s*(\d+)\]`)
+
+// Quantize writes the gguf model at src to dst with its weights quantized to fileType, such as q4_K_M. fn is
+// called with how many of the model's tensors have been quantized
+func Quantize(ctx context.Context, workDir, src, dst, fileType string, fn func(completed, total int)) error {
+	fileType = strings.ToUpper(fileType)
+
+	var supported bool
+	for _, t := range QuantizeTypes {
+		if t == fileType {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("unsupported quantization type %s, expected one of %s", fileType, strings.Join(QuantizeTypes, ", "))
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	ggml, err := DecodeGGML(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if ggml.Name() != "gguf" {
+		return fmt.Errorf("only gguf models can be quantized, model is %s", ggml.Name())
+	}
+
+	switch ggml.FileType() {
+	case "F16", "F32":
+	default:
+		return fmt.Errorf("only f16 and f32 models can be quantized, model is %s", ggml.FileType())
+	}
+
+	bin, err := quantizeBinary(workDir)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	cmd := exec.CommandContext(ctx, bin, src, dst, fileType)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("LD_LIBRARY_PATH=%s", filepath.Dir(bin)))
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start quantize: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		done <- err
+	}()
+
+	// keep the end of the output to explain a failure
+	var tail []string
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := quantizeProgress.FindStringSubmatch(line); m != nil {
+			completed, _ := strconv.Atoi(m[1])
+			total, _ := strconv.Atoi(m[2])
+			fn(completed, total)
+		}
+
+		tail = append(tail, line)
+		if len(tail) > 5 {
+			tail = tail[1:]
+		}
+	}
+
+	if err := <-done; err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("quantize failed: %v: %s", err, strings.Join(tail, "\n"))
+	}
+
+	return nil
+}
+
+// quantizeBinary returns the path of llama.cpp's quantize tool, built with the gguf runners
+func quantizeBinary(workDir string) (string, error) {
+	name := "quantize"
+	if runtime.GOOS == "windows" {
+		name = "quantize.exe"
+	}
+
+	for _, r := range chooseRunners(workDir, "gguf") {
+		bin := filepath.Join(filepath.Dir(r.Path), name)
+		if _, err := os.Stat(bin); err == nil {
+			return bin, nil
+		}
+	}
+
+	return "", fmt.Errorf("quantize not found, ollama was built without it")
+}
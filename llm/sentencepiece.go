@@ -0,0 +1,182 @@
+package llm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// sentencepiece token types, gguf uses the same values
+const (
+	tokenTypeNormal      int32 = 1
+	tokenTypeUnknown     int32 = 2
+	tokenTypeControl     int32 = 3
+	tokenTypeUserDefined int32 = 4
+	tokenTypeUnused      int32 = 5
+	tokenTypeByte        int32 = 6
+)
+
+type vocabulary struct {
+	tokens  []string
+	scores  []float32
+	types   []int32
+	unknown uint32
+}
+
+// readSentencePiece reads the vocabulary from a sentencepiece model. the model is a protobuf ModelProto, its
+// pieces are field 1, each with the piece in field 1, its score in field 2 and its type in field 3
+func readSentencePiece(file string) (*vocabulary, error) {
+	bts, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var v vocabulary
+	err = readProtobuf(bts, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+
+		piece, score, typ := "", float32(0), tokenTypeNormal
+		if err := readProtobuf(value, func(field int, value []byte) error {
+			switch field {
+			case 1:
+				piece = string(value)
+			case 2:
+				if len(value) != 4 {
+					return errors.New("invalid piece score")
+				}
+				score = math.Float32frombits(binary.LittleEndian.Uint32(value))
+			case 3:
+				n, _ := binary.Uvarint(value)
+				typ = int32(n)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if typ == tokenTypeUnknown {
+			v.unknown = uint32(len(v.tokens))
+		}
+
+		v.tokens = append(v.tokens, piece)
+		v.scores = append(v.scores, score)
+		v.types = append(v.types, typ)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v.tokens) == 0 {
+		return nil, errors.New("no tokens found")
+	}
+
+	return &v, nil
+}
+
+// readProtobuf calls fn with each field in the protobuf message bts. varints are passed encoded, fixed size values
+// as their little endian bytes and length delimited values as their contents
+func readProtobuf(bts []byte, fn func(field int, value []byte) error) error {
+	for len(bts) > 0 {
+		key, n := binary.Uvarint(bts)
+		if n <= 0 {
+			return errors.New("invalid protobuf")
+		}
+		bts = bts[n:]
+
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(bts)
+			if n <= 0 {
+				return errors.New("invalid protobuf")
+			}
+			value, bts = bts[:n], bts[n:]
+		case 1:
+			if len(bts) < 8 {
+				return errors.New("invalid protobuf")
+			}
+			value, bts = bts[:8], bts[8:]
+		case 2:
+			size, n := binary.Uvarint(bts)
+			if n <= 0 || uint64(len(bts)-n) < size {
+				return errors.New("invalid protobuf")
+			}
+			value, bts = bts[n:n+int(size)], bts[n+int(size):]
+		case 5:
+			if len(bts) < 4 {
+				return errors.New("invalid protobuf")
+			}
+			value, bts = bts[:4], bts[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+
+		if err := fn(int(key>>3), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addTokens adds the tokens from a hugging face added_tokens.json, if there is one
+func (v *vocabulary) addTokens(file string) error {
+	bts, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	added := make(map[string]int)
+	if err := json.Unmarshal(bts, &added); err != nil {
+		return err
+	}
+
+	type token struct {
+		piece string
+		id    int
+	}
+
+	var tokens []token
+	for piece, id := range added {
+		tokens = append(tokens, token{piece, id})
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].id < tokens[j].id
+	})
+
+	for _, t := range tokens {
+		if t.id < len(v.tokens) {
+			// already in the sentencepiece model
+			continue
+		}
+
+		if t.id != len(v.tokens) {
+			return fmt.Errorf("added token %q has id %d, expected %d", t.piece, t.id, len(v.tokens))
+		}
+
+		v.tokens = append(v.tokens, t.piece)
+		v.scores = append(v.scores, -1000)
+		v.types = append(v.types, tokenTypeUserDefined)
+	}
+
+	return nil
+}
+
+// pad fills the vocabulary up to size with unused tokens, models often have more embeddings than tokens
+func (v *vocabulary) pad(size int) {
+	for i := len(v.tokens); i < size; i++ {
+		v.tokens = append(v.tokens, fmt.Sprintf("[PAD%d]", i))
+		v.scores = append(v.scores, -1000)
+		v.types = append(v.types, tokenTypeUnused)
+	}
+}
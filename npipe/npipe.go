@@ -0,0 +1,25 @@
+// Package npipe serves and dials the API over windows named pipes, such as \\.\pipe\ollama
+package npipe
+
+import (
+	"errors"
+	"strings"
+)
+
+var errUnsupported = errors.New("named pipes are only supported on windows")
+
+// Name returns the pipe of an address written as npipe:////./pipe/name, the way docker writes them, and whether
+// addr is a pipe address
+func Name(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, "npipe://")
+	if !ok {
+		return "", false
+	}
+
+	return strings.ReplaceAll(path, "/", `\`), true
+}
+
+type pipeAddr string
+
+func (pipeAddr) Network() string  { return "pipe" }
+func (a pipeAddr) String() string { return string(a) }
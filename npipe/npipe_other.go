@@ -0,0 +1,16 @@
+//go:build !windows
+
+package npipe
+
+import (
+	"context"
+	"net"
+)
+
+func Listen(name string) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+func Dial(ctx context.Context, name string) (net.Conn, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,22 @@
+package npipe
+
+import "testing"
+
+func TestName(t *testing.T) {
+	cases := []struct {
+		addr string
+		want string
+		ok   bool
+	}{
+		{"npipe:////./pipe/ollama", `\\.\pipe\ollama`, true},
+		{"npipe:////./pipe/a/b", `\\.\pipe\a\b`, true},
+		{"127.0.0.1:11434", "", false},
+		{"unix:///tmp/ollama.sock", "", false},
+	}
+
+	for _, tt := range cases {
+		if got, ok := Name(tt.addr); got != tt.want || ok != tt.ok {
+			t.Errorf("Name(%q) = %q, %t, want %q, %t", tt.addr, got, ok, tt.want, tt.ok)
+		}
+	}
+}
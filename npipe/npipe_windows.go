@@ -0,0 +1,328 @@
+package npipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// bufferSize is the pipe's buffer in each direction
+const bufferSize = 64 * 1024
+
+// listener waits for clients on one instance of the pipe at a time, a new instance is created as each client
+// connects. the handles are overlapped so accepting, reading and writing can be cancelled
+type listener struct {
+	name string
+
+	mu     sync.Mutex
+	h      windows.Handle // the instance the next client connects to
+	closed windows.Handle // an event set once the listener is closed
+}
+
+// Listen creates the pipe name, only for local clients. it fails if another server has the pipe
+func Listen(name string) (net.Listener, error) {
+	closed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{name: name, closed: closed}
+	if l.h, err = l.create(true); err != nil {
+		windows.CloseHandle(closed)
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *listener) create(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return 0, err
+	}
+
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, bufferSize, bufferSize, 0, nil)
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	h := l.h
+	l.mu.Unlock()
+
+	if h == windows.InvalidHandle {
+		return nil, net.ErrClosed
+	}
+
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(ev)
+
+	o := windows.Overlapped{HEvent: ev}
+	switch err := windows.ConnectNamedPipe(h, &o); err {
+	case nil, windows.ERROR_PIPE_CONNECTED:
+	case windows.ERROR_IO_PENDING:
+		i, err := windows.WaitForMultipleObjects([]windows.Handle{ev, l.closed}, false, windows.INFINITE)
+		if err != nil {
+			return nil, err
+		}
+
+		if i != windows.WAIT_OBJECT_0 {
+			// Close cancelled the connect, wait for it to finish before ev is closed
+			var n uint32
+			windows.GetOverlappedResult(h, &o, &n, true)
+			return nil, net.ErrClosed
+		}
+
+		var n uint32
+		if err := windows.GetOverlappedResult(h, &o, &n, false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h == windows.InvalidHandle {
+		windows.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+
+	next, err := l.create(false)
+	if err != nil {
+		return nil, err
+	}
+
+	l.h = next
+	return newConn(h, l.name)
+}
+
+func (l *listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h == windows.InvalidHandle {
+		return net.ErrClosed
+	}
+
+	windows.SetEvent(l.closed)
+	windows.CancelIoEx(l.h, nil)
+	err := windows.CloseHandle(l.h)
+	l.h = windows.InvalidHandle
+	return err
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
+
+// Dial connects to the pipe name, waiting while every instance of it is busy
+func Dial(ctx context.Context, name string) (net.Conn, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return newConn(h, name)
+		}
+
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, &os.PathError{Op: "dial", Path: name, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// conn is a connected instance of a pipe. each direction has a deadline, and an event which is set when its
+// deadline changes or the conn is closed, so a pending read or write notices
+type conn struct {
+	h    windows.Handle
+	name string
+
+	mu      sync.Mutex
+	closed  bool
+	pending int // reads and writes which haven't returned, the events are closed after the last of them
+	read    direction
+	write   direction
+}
+
+type direction struct {
+	deadline time.Time
+	wake     windows.Handle
+}
+
+func newConn(h windows.Handle, name string) (*conn, error) {
+	c := &conn{h: h, name: name}
+	for _, d := range []*direction{&c.read, &c.write} {
+		wake, err := windows.CreateEvent(nil, 0, 0, nil)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		d.wake = wake
+	}
+
+	return c, nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.do(&c.read, b, windows.ReadFile)
+	if errors.Is(err, windows.ERROR_BROKEN_PIPE) || errors.Is(err, windows.ERROR_PIPE_NOT_CONNECTED) {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	return c.do(&c.write, b, windows.WriteFile)
+}
+
+// do runs op overlapped, cancelling it if the conn is closed or d's deadline passes first
+func (c *conn) do(d *direction, b []byte, op func(windows.Handle, []byte, *uint32, *windows.Overlapped) error) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.pending++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pending--; c.closed && c.pending == 0 {
+			c.closeEvents()
+		}
+	}()
+
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(ev)
+
+	o := windows.Overlapped{HEvent: ev}
+	var n uint32
+	if err := op(c.h, b, &n, &o); err != windows.ERROR_IO_PENDING {
+		return int(n), err
+	}
+
+	for {
+		c.mu.Lock()
+		closed, deadline := c.closed, d.deadline
+		c.mu.Unlock()
+
+		timeout := uint32(windows.INFINITE)
+		if !deadline.IsZero() {
+			timeout = 0
+			if left := time.Until(deadline); left > 0 {
+				timeout = uint32(left.Milliseconds()) + 1
+			}
+		}
+
+		// Close has already cancelled the operation
+		if closed {
+			windows.GetOverlappedResult(c.h, &o, &n, true)
+			return int(n), net.ErrClosed
+		}
+
+		if timeout == 0 {
+			windows.CancelIoEx(c.h, &o)
+			windows.GetOverlappedResult(c.h, &o, &n, true)
+			return int(n), os.ErrDeadlineExceeded
+		}
+
+		i, err := windows.WaitForMultipleObjects([]windows.Handle{ev, d.wake}, false, timeout)
+		if err != nil {
+			return 0, err
+		}
+
+		if i == windows.WAIT_OBJECT_0 {
+			err := windows.GetOverlappedResult(c.h, &o, &n, false)
+			return int(n), err
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	c.closed = true
+	for _, d := range []*direction{&c.read, &c.write} {
+		if d.wake != 0 {
+			windows.SetEvent(d.wake)
+		}
+	}
+
+	windows.CancelIoEx(c.h, nil)
+	err := windows.CloseHandle(c.h)
+	if c.pending == 0 {
+		c.closeEvents()
+	}
+
+	return err
+}
+
+func (c *conn) closeEvents() {
+	for _, d := range []*direction{&c.read, &c.write} {
+		if d.wake != 0 {
+			windows.CloseHandle(d.wake)
+			d.wake = 0
+		}
+	}
+}
+
+func (c *conn) setDeadline(d *direction, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d.deadline = t
+	if d.wake != 0 {
+		windows.SetEvent(d.wake)
+	}
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.setDeadline(&c.read, t)
+	c.setDeadline(&c.write, t)
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return pipeAddr(c.name) }
+func (c *conn) RemoteAddr() net.Addr { return pipeAddr(c.name) }
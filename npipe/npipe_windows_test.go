@@ -0,0 +1,198 @@
+package npipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testPipe is a pipe name no other test or server uses
+func testPipe() string {
+	return fmt.Sprintf(`\\.\pipe\ollama-test-%d-%d`, os.Getpid(), time.Now().UnixNano())
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := Listen(testPipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// connect dials l and returns both ends of the connection
+func connect(t *testing.T, l net.Listener) (server, client net.Conn) {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		accepted <- c
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case server = <-accepted:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out accepting")
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server, client
+}
+
+func TestReadWrite(t *testing.T) {
+	l := listen(t)
+	server, client := connect(t, l)
+
+	go func() {
+		io.Copy(server, server)
+		server.Close()
+	}()
+
+	want := []byte("hello over a pipe")
+	if _, err := client.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAcceptEachClient(t *testing.T) {
+	l := listen(t)
+
+	// a new instance of the pipe is created for each client
+	for i := 0; i < 3; i++ {
+		server, client := connect(t, l)
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(server, b); err != nil || b[0] != byte(i) {
+			t.Fatalf("client %d: got %v, %v", i, b, err)
+		}
+	}
+}
+
+func TestListenTwice(t *testing.T) {
+	l := listen(t)
+	if l2, err := Listen(l.Addr().String()); err == nil {
+		l2.Close()
+		t.Fatal("expected the second listener to fail")
+	}
+}
+
+func TestCloseWhileAccepting(t *testing.T) {
+	l, err := Listen(testPipe())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected %v, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected %v accepting after Close, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	l := listen(t)
+	server, _ := connect(t, l)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected %v, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't return after Close")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	l := listen(t)
+	server, client := connect(t, l)
+
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+	}
+
+	// the conn still works once the deadline is cleared
+	server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(server, b); err != nil || string(b) != "a" {
+		t.Errorf("got %q, %v", b, err)
+	}
+}
+
+func TestClientDisconnects(t *testing.T) {
+	l := listen(t)
+	server, client := connect(t, l)
+
+	client.Close()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %v reading after the client disconnected, got %v", io.EOF, err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 )
 
 type Command struct {
@@ -40,9 +41,19 @@ func Parse(reader io.Reader) ([]Command, error) {
 			command.Args = string(fields[1])
 			// copy command for validation
 			modelCommand = command
-		case "LICENSE", "TEMPLATE", "SYSTEM", "PROMPT", "EMBED", "ADAPTER":
+		case "LICENSE", "TEMPLATE", "SYSTEM", "PROMPT", "EMBED", "ADAPTER", "DRAFT", "PROJECTOR", "SOURCE":
 			command.Name = string(bytes.ToLower(fields[0]))
 			command.Args = string(fields[1])
+		case "MESSAGE":
+			command.Name = "message"
+			command.Args = string(fields[1])
+
+			role, _, _ := strings.Cut(command.Args, " ")
+			switch role {
+			case "system", "user", "assistant":
+			default:
+				return nil, fmt.Errorf("invalid message role %q, expected system, user or assistant", role)
+			}
 		case "PARAMETER":
 			fields = bytes.SplitN(fields[1], []byte(" "), 2)
 			if len(fields) < 2 {
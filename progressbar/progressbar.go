@@ -52,6 +52,11 @@ type state struct {
 	finished     bool
 	exit         bool // Progress bar exit halfway
 
+	// rate and time left reported by SetRate, used instead of the bar's own measurements
+	rateReported bool
+	reportedRate float64
+	reportedETA  time.Duration
+
 	rendered string
 }
 
@@ -499,6 +504,16 @@ func (p *ProgressBar) Add(num int) error {
 	return p.Add64(int64(num))
 }
 
+// SetRate reports the rate, in bytes or iterations per second, and the time left, measured by whatever the
+// bar is tracking. They are shown instead of the bar's own measurements from the next render
+func (p *ProgressBar) SetRate(rate float64, eta time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.rateReported = true
+	p.state.reportedRate = rate
+	p.state.reportedETA = eta
+}
+
 // Set will set the bar to a current number
 func (p *ProgressBar) Set(num int) error {
 	return p.Set64(int64(num))
@@ -741,6 +756,10 @@ func renderProgressBar(c config, s *state) (int, error) {
 		}
 	}
 
+	if s.rateReported && !s.finished {
+		averageRate = s.reportedRate
+	}
+
 	// show iteration count in "current/total" iterations format
 	if c.showIterationsCount {
 		if sb.Len() == 0 {
@@ -782,6 +801,16 @@ func renderProgressBar(c config, s *state) (int, error) {
 		sb.WriteString(fmt.Sprintf("%s%s/s", currentHumanize, currentSuffix))
 	}
 
+	// show the reported time left
+	if s.rateReported && !s.finished && s.reportedETA > 0 {
+		if sb.Len() == 0 {
+			sb.WriteString("(")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s left", s.reportedETA.Round(time.Second)))
+	}
+
 	// show iterations rate
 	if c.showIterationsPerSecond {
 		if sb.Len() == 0 {
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// requestAdapter returns the model named by a request's adapter, a model created FROM the request's model with
+// an ADAPTER. it replies with an error if the adapter can't be applied to the model
+func requestAdapter(c *gin.Context, model *Model, name string) (*Model, bool) {
+	if name == "" {
+		return nil, true
+	}
+
+	adapter, err := GetModel(name)
+	if errors.Is(err, os.ErrNotExist) {
+		replyError(c, http.StatusNotFound, withCode(api.CodeModelNotFound, fmt.Errorf("adapter '%s' not found, try pulling it first", name), map[string]any{"model": name}))
+		return nil, false
+	} else if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	if len(adapter.AdapterPaths) != 1 || adapter.ModelPath != model.ModelPath {
+		replyError(c, http.StatusBadRequest, fmt.Errorf("'%s' isn't an adapter of '%s', it has to be created FROM it with one ADAPTER", name, model.ShortName))
+		return nil, false
+	}
+
+	if !checkLicense(c, adapter) {
+		return nil, false
+	}
+
+	return adapter, true
+}
+
+// acquireAdapter is acquireModel for a request applying adapter to model, it also returns the path of the adapter
+// for the prediction. the adapter is applied by the model's runner if it can swap adapters, otherwise the adapter
+// model is loaded on its own
+func acquireAdapter(ctx context.Context, workDir string, model, adapter *Model, opts map[string]interface{}, sessionDuration time.Duration, queued func(int, time.Duration)) (*runnerRef, string, error) {
+	runner, err := acquireModel(ctx, workDir, model, opts, sessionDuration, queued)
+	if err != nil || adapter == nil {
+		return runner, "", err
+	}
+
+	path := adapter.AdapterPaths[0]
+	if s, ok := runner.llm.(llm.AdapterSwapper); ok && s.HasAdapter(path) {
+		return runner, path, nil
+	}
+
+	// the runner was loaded before the adapter was created, or it can't swap adapters
+	log.Printf("%s can't apply the adapter %s, loading it on its own", model.ShortName, adapter.ShortName)
+	runner.release()
+
+	runner, err = acquireModel(ctx, workDir, adapter, opts, sessionDuration, queued)
+	return runner, "", err
+}
+
+// swappableAdapters returns the adapters of the local models created FROM model with one ADAPTER, a runner for
+// model loads them so requests can apply them without loading another model
+func swappableAdapters(model *Model) []string {
+	own := make(map[string]bool)
+	for _, path := range model.AdapterPaths {
+		own[path] = true
+	}
+
+	seen := make(map[string]bool)
+	var adapters []string
+	walkFunc := func(mp ModelPath, _ os.FileInfo) error {
+		manifest, _, err := GetManifest(mp)
+		if err != nil {
+			return nil
+		}
+
+		var base bool
+		var layers []string
+		for _, layer := range manifest.Layers {
+			blob, err := findBlob(layer.Digest)
+			if err != nil {
+				return nil
+			}
+
+			switch layer.MediaType {
+			case "application/vnd.ollama.image.model":
+				base = blob == model.ModelPath
+			case "application/vnd.ollama.image.adapter":
+				layers = append(layers, blob)
+			}
+		}
+
+		if base && len(layers) == 1 && !own[layers[0]] && !seen[layers[0]] {
+			seen[layers[0]] = true
+			adapters = append(adapters, layers[0])
+		}
+
+		return nil
+	}
+
+	if err := walkManifests(walkFunc); err != nil {
+		log.Printf("couldn't find the adapters of %s: %v", model.ShortName, err)
+	}
+
+	return adapters
+}
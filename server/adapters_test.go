@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeAdapterModel writes a model with the model layer data and, if it's set, an adapter layer
+func writeAdapterModel(t *testing.T, name, data, adapter string) {
+	t.Helper()
+
+	layers := []testLayer{{"application/vnd.ollama.image.model", data}}
+	if adapter != "" {
+		layers = append(layers, testLayer{"application/vnd.ollama.image.adapter", adapter})
+	}
+
+	writeModel(t, name, layers, nil)
+}
+
+func TestAdapters(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	writeAdapterModel(t, "base", "base weights", "")
+	writeAdapterModel(t, "tenant-a", "base weights", "adapter a")
+	writeAdapterModel(t, "tenant-b", "base weights", "adapter b")
+	writeAdapterModel(t, "other", "other weights", "adapter c")
+
+	base, err := GetModel("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := GetModel("tenant-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapters := swappableAdapters(base)
+	if len(adapters) != 2 {
+		t.Fatalf("got %d adapters, want the 2 created from the base model: %v", len(adapters), adapters)
+	}
+
+	// a model's own adapter isn't swappable, it's always applied
+	for _, adapter := range swappableAdapters(tenant) {
+		if adapter == tenant.AdapterPaths[0] {
+			t.Errorf("expected the model's own adapter not to be swappable")
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	for name, code := range map[string]int{
+		"tenant-a": http.StatusOK,
+		"other":    http.StatusBadRequest,
+		"base":     http.StatusBadRequest,
+		"missing":  http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		// the recorder's code stays 200 unless there's an error
+		adapter, ok := requestAdapter(c, base, name)
+		if w.Code != code {
+			t.Errorf("%s: got %d, want %d: %s", name, w.Code, code, w.Body)
+		}
+
+		if ok && adapter.AdapterPaths[0] != tenant.AdapterPaths[0] {
+			t.Errorf("%s: got the adapter %s", name, adapter.AdapterPaths[0])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiRole is what an api key is allowed to do, each role can do everything the roles before it can
+type apiRole int
+
+const (
+	// roleRead can list and show models, and read the server's status
+	roleRead apiRole = iota
+	// roleGenerate can also generate, chat and embed with models which are already pulled
+	roleGenerate
+	// roleAdmin can do anything, including pulling, pushing, creating and deleting models
+	roleAdmin
+)
+
+var apiRoles = map[string]apiRole{
+	"read":     roleRead,
+	"generate": roleGenerate,
+	"admin":    roleAdmin,
+}
+
+func (r apiRole) String() string {
+	for name, role := range apiRoles {
+		if role == r {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// generateRoutes are the routes a generate key can post to, other than the read routes
+var generateRoutes = map[string]bool{
+	"/api/generate":            true,
+	"/api/generate/:id/cancel": true,
+	"/api/chat":                true,
+	"/api/embeddings":          true,
+	"/api/tokenize":            true,
+	"/api/detokenize":          true,
+	"/api/models/*path":        true,
+	"/v1/chat/completions":     true,
+	"/v1/completions":          true,
+	"/v1/embeddings":           true,
+}
+
+// sessionRoutes need a generate key for every method, reading a session returns its conversation
+var sessionRoutes = map[string]bool{
+	"/api/sessions":     true,
+	"/api/sessions/:id": true,
+}
+
+// publicRoutes don't need a key. /, /api/health and /api/ready are the health checks and /v2 is only routed
+// when blobs are shared with peers, which don't have a key
+var publicRoutes = map[string]bool{
+	"/":           true,
+	"/api/health": true,
+	"/api/ready":  true,
+	"/v2/*path":   true,
+}
+
+// requiredRole returns the role needed for a request to route. routes which aren't listed need an admin key
+func requiredRole(method, route string) apiRole {
+	switch {
+	case sessionRoutes[route]:
+		return roleGenerate
+	case method == http.MethodGet || method == http.MethodHead:
+		return roleRead
+	case route == "/api/show":
+		return roleRead
+	case generateRoutes[route]:
+		return roleGenerate
+	}
+
+	return roleAdmin
+}
+
+// loadAPIKeys reads the api keys the server accepts, from OLLAMA_API_KEYS and the file OLLAMA_API_KEYS_FILE.
+// OLLAMA_API_KEYS is a comma separated list of keys, each optionally followed by :role. the file has a key
+// and optionally a role on each line. keys without a role are admin keys
+func loadAPIKeys() (map[string]apiRole, error) {
+	keys := make(map[string]apiRole)
+	add := func(key, role string) error {
+		if role == "" {
+			role = "admin"
+		}
+
+		r, ok := apiRoles[role]
+		if !ok {
+			return fmt.Errorf("invalid role %q for api key, expected read, generate or admin", role)
+		}
+
+		keys[key] = r
+		return nil
+	}
+
+	for _, s := range strings.Split(os.Getenv("OLLAMA_API_KEYS"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		key, role, _ := strings.Cut(s, ":")
+		if err := add(strings.TrimSpace(key), strings.TrimSpace(role)); err != nil {
+			return nil, fmt.Errorf("OLLAMA_API_KEYS: %w", err)
+		}
+	}
+
+	if file := os.Getenv("OLLAMA_API_KEYS_FILE"); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) > 2 {
+				return nil, fmt.Errorf("%s:%d: expected a key and a role", file, n)
+			}
+
+			var role string
+			if len(fields) == 2 {
+				role = fields[1]
+			}
+
+			if err := add(fields[0], role); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// apiKeyMiddleware rejects requests which don't have a bearer token for one of keys, or whose key's role
+// doesn't allow the route. the request's "apiKey" is set to a hash of its key, which identifies it without
+// keeping the key
+func apiKeyMiddleware(keys map[string]apiRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" || publicRoutes[route] {
+			c.Next()
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(http.StatusUnauthorized, errors.New("an api key is required, set OLLAMA_API_KEY")))
+			return
+		}
+
+		role, ok := lookupAPIKey(keys, token)
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(http.StatusUnauthorized, errors.New("invalid api key")))
+			return
+		}
+
+		if required := requiredRole(c.Request.Method, route); role < required {
+			c.AbortWithStatusJSON(http.StatusForbidden, errorResponse(http.StatusForbidden, fmt.Errorf("api key has the %s role, %s %s needs %s", role, c.Request.Method, c.Request.URL.Path, required)))
+			return
+		}
+
+		c.Set("apiKey", apiKeyID(token))
+		c.Next()
+	}
+}
+
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey finds token in keys, comparing every key in constant time so the time taken doesn't reveal them
+func lookupAPIKey(keys map[string]apiRole, token string) (apiRole, bool) {
+	var found bool
+	var role apiRole
+	for key, r := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			found, role = true, r
+		}
+	}
+
+	return role, found
+}
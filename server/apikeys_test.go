@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte("# keys\nreader read\n\nwriter\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("OLLAMA_API_KEYS", "gen:generate")
+	t.Setenv("OLLAMA_API_KEYS_FILE", file)
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(apiKeyMiddleware(keys))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/", ok)
+	r.GET("/api/tags", ok)
+	r.POST("/api/show", ok)
+	r.POST("/api/generate", ok)
+	r.POST("/api/pull", ok)
+	r.DELETE("/api/delete", ok)
+	r.GET("/api/sessions", ok)
+	r.GET("/api/sessions/:id", ok)
+	r.DELETE("/api/sessions/:id", ok)
+
+	cases := []struct {
+		method, path, key string
+		status            int
+	}{
+		{http.MethodGet, "/", "", http.StatusOK},
+		{http.MethodGet, "/api/tags", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tags", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tags", "reader", http.StatusOK},
+		{http.MethodPost, "/api/show", "reader", http.StatusOK},
+		{http.MethodPost, "/api/generate", "reader", http.StatusForbidden},
+		{http.MethodPost, "/api/generate", "gen", http.StatusOK},
+		{http.MethodPost, "/api/pull", "gen", http.StatusForbidden},
+		{http.MethodDelete, "/api/delete", "gen", http.StatusForbidden},
+		{http.MethodGet, "/api/sessions", "reader", http.StatusForbidden},
+		{http.MethodGet, "/api/sessions/sess-1", "reader", http.StatusForbidden},
+		{http.MethodGet, "/api/sessions/sess-1", "gen", http.StatusOK},
+		{http.MethodDelete, "/api/sessions/sess-1", "gen", http.StatusOK},
+		{http.MethodPost, "/api/pull", "writer", http.StatusOK},
+		{http.MethodDelete, "/api/delete", "writer", http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with key %q: expected %d, got %d", tt.method, tt.path, tt.key, tt.status, w.Code)
+		}
+	}
+}
+
+func TestLoadAPIKeysInvalidRole(t *testing.T) {
+	t.Setenv("OLLAMA_API_KEYS", "key:owner")
+	if _, err := loadAPIKeys(); err == nil {
+		t.Fatal("expected an error for an invalid role")
+	}
+}
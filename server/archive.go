@@ -0,0 +1,227 @@
+package server
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// models are exported as a tar archive of their manifests, at manifests/<registry>/<namespace>/<repository>/<tag>,
+// and their blobs, at blobs/sha256-<hex>
+
+var errInvalidArchive = errors.New("invalid model archive")
+
+var archiveBlobPattern = regexp.MustCompile(`^blobs/sha256-([0-9a-f]{64})$`)
+
+// ExportModel writes a tar archive of the model name, including every blob it needs, to w
+func ExportModel(name string, w io.Writer) error {
+	mp := ParseModelPath(name)
+	manifest, _, err := GetManifest(mp)
+	if err != nil {
+		return err
+	}
+
+	fp, _, err := mp.findManifestPath()
+	if err != nil {
+		return err
+	}
+
+	bts, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: path.Join("manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag),
+		Mode: 0o644,
+		Size: int64(len(bts)),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(bts); err != nil {
+		return err
+	}
+
+	layers := append([]*Layer{&manifest.Config}, manifest.Layers...)
+	written := make(map[string]bool)
+	for _, layer := range layers {
+		if written[layer.Digest] {
+			continue
+		}
+
+		if err := exportBlob(tw, layer.Digest); err != nil {
+			return err
+		}
+
+		written[layer.Digest] = true
+	}
+
+	return tw.Close()
+}
+
+func exportBlob(tw *tar.Writer, digest string) error {
+	fp, err := findBlob(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: path.Join("blobs", strings.ReplaceAll(digest, ":", "-")),
+		Mode: 0o644,
+		Size: fi.Size(),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportModel reads a tar archive written by ExportModel from r, verifying each blob against its digest,
+// and returns the names of the models it contained
+func ImportModel(r io.Reader) ([]string, error) {
+	// blobs are written before the manifests which use them
+	blobsMu.RLock()
+	defer blobsMu.RUnlock()
+
+	manifests := make(map[string][]byte)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(hdr.Name, "manifests/"):
+			bts, err := io.ReadAll(io.LimitReader(tr, maxManifestSize()+1))
+			if err != nil {
+				return nil, err
+			}
+
+			if int64(len(bts)) > maxManifestSize() {
+				return nil, fmt.Errorf("%w: %s", errManifestTooLarge, hdr.Name)
+			}
+
+			manifests[hdr.Name] = bts
+		case archiveBlobPattern.MatchString(hdr.Name):
+			digest := "sha256:" + archiveBlobPattern.FindStringSubmatch(hdr.Name)[1]
+			if err := importBlob(tr, digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var names []string
+	for name, bts := range manifests {
+		mp, err := archiveModelPath(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest ManifestV2
+		if err := json.Unmarshal(bts, &manifest); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errInvalidArchive, name, err)
+		}
+
+		for _, layer := range append([]*Layer{&manifest.Config}, manifest.Layers...) {
+			fp, err := GetBlobsPath(layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := os.Stat(fp); err != nil {
+				return nil, fmt.Errorf("%w: %s is missing blob %s", errInvalidArchive, mp.GetShortTagname(), layer.Digest)
+			}
+		}
+
+		fp, err := mp.GetManifestPath(true)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(fp, bts, 0o644); err != nil {
+			return nil, err
+		}
+
+		names = append(names, mp.GetShortTagname())
+	}
+
+	return names, nil
+}
+
+// importBlob copies the blob read from r into the blobs directory if it isn't there already
+func importBlob(r io.Reader, digest string) error {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(fp); err == nil {
+		return nil
+	}
+
+	return writeBlob(digest, func(w io.Writer) error {
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+			return err
+		}
+
+		if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest {
+			return fmt.Errorf("%w: %w: want %s, got %s", errInvalidArchive, errDigestMismatch, digest, got)
+		}
+
+		return nil
+	})
+}
+
+// archiveModelPath returns the model for a manifest at name in an archive
+func archiveModelPath(name string) (ModelPath, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 5 {
+		return ModelPath{}, fmt.Errorf("%w: unexpected manifest %s", errInvalidArchive, name)
+	}
+
+	for i, part := range parts[1:] {
+		// only the registry may have a port
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) || (i > 0 && strings.Contains(part, ":")) {
+			return ModelPath{}, fmt.Errorf("%w: unexpected manifest %s", errInvalidArchive, name)
+		}
+	}
+
+	return ModelPath{
+		ProtocolScheme: DefaultProtocolScheme,
+		Registry:       parts[1],
+		Namespace:      parts[2],
+		Repository:     parts[3],
+		Tag:            parts[4],
+	}, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func writeTestModel(t *testing.T, name string, blob []byte) {
+	t.Helper()
+	writeModel(t, name, []testLayer{{"application/vnd.ollama.image.model", string(blob)}}, nil)
+}
+
+func TestExportImportModel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	writeTestModel(t, "test:latest", []byte("model data"))
+
+	var archive bytes.Buffer
+	if err := ExportModel("test:latest", &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	names, err := ImportModel(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0] != "test:latest" {
+		t.Fatalf("got %v, want [test:latest]", names)
+	}
+
+	if _, _, err := GetManifest(ParseModelPath("test:latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a blob which doesn't match its digest is rejected
+	tampered := bytes.Replace(archive.Bytes(), []byte("model data"), []byte("MODEL DATA"), 1)
+	t.Setenv("HOME", t.TempDir())
+	if _, err := ImportModel(bytes.NewReader(tampered)); !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("got %v, want %v", err, errDigestMismatch)
+	}
+}
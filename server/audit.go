@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// auditEntry is a line of the audit log, one for each request
+type auditEntry struct {
+	Time           time.Time     `json:"time"`
+	Method         string        `json:"method"`
+	Path           string        `json:"path"`
+	Status         int           `json:"status"`
+	Client         string        `json:"client,omitempty"`
+	Model          string        `json:"model,omitempty"`
+	PromptTokens   int           `json:"prompt_tokens,omitempty"`
+	ResponseTokens int           `json:"response_tokens,omitempty"`
+	Duration       time.Duration `json:"duration"`
+}
+
+// auditUsage is what a request's handler used, handlers set it with auditModel and auditTokens
+type auditUsage struct {
+	mu             sync.Mutex
+	model          string
+	promptTokens   int
+	responseTokens int
+}
+
+// auditLog appends an entry for each request to a jsonl file
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// openAuditLog opens the audit log at OLLAMA_AUDIT_LOG, it's nil if the variable is unset
+func openAuditLog() (*auditLog, error) {
+	path := os.Getenv("OLLAMA_AUDIT_LOG")
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+
+	return &auditLog{path: path, f: f}, nil
+}
+
+func (a *auditLog) write(e auditEntry) error {
+	bts, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.f.Write(append(bts, '\n'))
+	return err
+}
+
+// middleware logs each request once it's done, including streamed responses
+func (a *auditLog) middleware(c *gin.Context) {
+	start := time.Now()
+	usage := &auditUsage{}
+	c.Set("audit", usage)
+	c.Set("auditLog", a)
+
+	c.Next()
+
+	usage.mu.Lock()
+	e := auditEntry{
+		Time:           start.UTC(),
+		Method:         c.Request.Method,
+		Path:           c.Request.URL.Path,
+		Status:         c.Writer.Status(),
+		Client:         c.ClientIP(),
+		Model:          usage.model,
+		PromptTokens:   usage.promptTokens,
+		ResponseTokens: usage.responseTokens,
+		Duration:       time.Since(start),
+	}
+	usage.mu.Unlock()
+
+	if err := a.write(e); err != nil {
+		log.Printf("audit log: %v", err)
+	}
+}
+
+// auditModel records the model a request used
+func auditModel(c *gin.Context, name string) {
+	if v, ok := c.Get("audit"); ok {
+		usage := v.(*auditUsage)
+		usage.mu.Lock()
+		usage.model = name
+		usage.mu.Unlock()
+	}
+}
+
+// auditTokens records the tokens a request's prompt and response took
+func auditTokens(c *gin.Context, m api.Metrics) {
+	if v, ok := c.Get("audit"); ok {
+		usage := v.(*auditUsage)
+		usage.mu.Lock()
+		usage.promptTokens += m.PromptEvalCount
+		usage.responseTokens += m.EvalCount
+		usage.mu.Unlock()
+	}
+}
+
+// usage totals the entries in the audit log between since and until by model. requests which didn't use a
+// model are left out, and so are other models if model is set
+func (a *auditLog) usage(model string, since, until time.Time) ([]api.ModelUsage, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byModel := make(map[string]*api.ModelUsage)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a line can be cut short if the server stopped while writing it
+			continue
+		}
+
+		if e.Model == "" || (model != "" && e.Model != model) {
+			continue
+		}
+
+		if e.Time.Before(since) || (!until.IsZero() && !e.Time.Before(until)) {
+			continue
+		}
+
+		u, ok := byModel[e.Model]
+		if !ok {
+			u = &api.ModelUsage{Model: e.Model}
+			byModel[e.Model] = u
+		}
+
+		u.Requests++
+		if e.Status >= http.StatusBadRequest {
+			u.Errors++
+		}
+		u.PromptTokens += e.PromptTokens
+		u.ResponseTokens += e.ResponseTokens
+		u.TotalDuration += e.Duration
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	usage := make([]api.ModelUsage, 0, len(byModel))
+	for _, u := range byModel {
+		usage = append(usage, *u)
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Model < usage[j].Model
+	})
+
+	return usage, nil
+}
+
+// queryTime parses a time in the query, either RFC 3339 or a duration before now such as 24h
+func queryTime(c *gin.Context, key string) (time.Time, error) {
+	s := c.Query(key)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, expected a time such as 2023-11-01T00:00:00Z or a duration such as 24h", key, s)
+	}
+
+	return t, nil
+}
+
+// UsageHandler totals the requests, tokens and time each model used, from the audit log
+func UsageHandler(c *gin.Context) {
+	v, ok := c.Get("auditLog")
+	if !ok {
+		replyError(c, http.StatusNotFound, errors.New("the audit log isn't enabled, set OLLAMA_AUDIT_LOG"))
+		return
+	}
+
+	since, err := queryTime(c, "since")
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	until, err := queryTime(c, "until")
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	usage, err := v.(*auditLog).usage(c.Query("model"), since, until)
+	if errors.Is(err, os.ErrNotExist) {
+		usage = []api.ModelUsage{}
+	} else if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.UsageResponse{Usage: usage})
+}
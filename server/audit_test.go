@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestAuditLog(t *testing.T) {
+	t.Setenv("OLLAMA_AUDIT_LOG", filepath.Join(t.TempDir(), "audit.jsonl"))
+
+	audit, err := openAuditLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(audit.middleware)
+	r.POST("/api/generate", func(c *gin.Context) {
+		auditModel(c, c.Query("model"))
+		auditTokens(c, api.Metrics{PromptEvalCount: 10, EvalCount: 20})
+		c.Status(http.StatusOK)
+	})
+	r.POST("/api/chat", func(c *gin.Context) {
+		auditModel(c, c.Query("model"))
+		c.Status(http.StatusBadRequest)
+	})
+	r.DELETE("/api/delete", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/api/usage", UsageHandler)
+
+	for _, path := range []string{"/api/generate?model=a", "/api/generate?model=a", "/api/generate?model=b", "/api/chat?model=a"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/delete", nil))
+
+	usage := func(query string) []api.ModelUsage {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/usage"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("usage%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+		}
+
+		var resp api.UsageResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Usage
+	}
+
+	all := usage("?since=1h")
+	if len(all) != 2 {
+		t.Fatalf("expected usage for 2 models, got %+v", all)
+	}
+
+	if a := all[0]; a.Model != "a" || a.Requests != 3 || a.Errors != 1 || a.PromptTokens != 20 || a.ResponseTokens != 40 {
+		t.Errorf("unexpected usage for a: %+v", a)
+	}
+
+	if b := usage("?model=b"); len(b) != 1 || b[0].Requests != 1 || b[0].ResponseTokens != 20 {
+		t.Errorf("unexpected usage for b: %+v", b)
+	}
+
+	if future := usage("?since=2100-01-01T00:00:00Z"); len(future) != 0 {
+		t.Errorf("expected no usage in the future, got %+v", future)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/usage?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid time, got %d", w.Code)
+	}
+}
@@ -72,14 +72,75 @@ func (r AuthRedirect) URL() (*url.URL, error) {
 }
 
 func getAuthToken(ctx context.Context, redirData AuthRedirect) (string, error) {
-	redirectURL, err := redirData.URL()
+	tok, err := requestAuthToken(ctx, redirData)
 	if err != nil {
 		return "", err
 	}
 
+	return tok.Token, nil
+}
+
+// tokenRefreshMargin is how long before a token expires that it is replaced
+const tokenRefreshMargin = 30 * time.Second
+
+// authenticate gets a token for the bearer challenge of an unauthorized response and stores it in regOpts,
+// along with the challenge so the token can be refreshed before it expires. the layers of a pull are
+// refused at the same time, only the first of them gets a token and the others use it
+func authenticate(ctx context.Context, challenge string, regOpts *RegistryOptions) error {
+	refused := time.Now()
+
+	regOpts.authMu.Lock()
+	defer regOpts.authMu.Unlock()
+
+	regOpts.mu.Lock()
+	issuedAt := regOpts.issuedAt
+	regOpts.mu.Unlock()
+	if issuedAt.After(refused) {
+		return nil
+	}
+
+	redirData := ParseAuthRedirectString(challenge)
+	tok, err := requestAuthToken(ctx, redirData)
+	if err != nil {
+		return err
+	}
+
+	var expiry time.Time
+	if tok.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+
+	regOpts.setToken(tok.Token, challenge, expiry)
+	return nil
+}
+
+// refreshToken replaces the token in regOpts if it is about to expire, long downloads can outlive a token
+func refreshToken(ctx context.Context, regOpts *RegistryOptions) error {
+	if regOpts == nil {
+		return nil
+	}
+
+	regOpts.mu.Lock()
+	challenge, expiry := regOpts.challenge, regOpts.tokenExpiry
+	regOpts.mu.Unlock()
+
+	if challenge == "" || expiry.IsZero() || time.Until(expiry) > tokenRefreshMargin {
+		return nil
+	}
+
+	log.Printf("refreshing registry token")
+	return authenticate(ctx, challenge, regOpts)
+}
+
+func requestAuthToken(ctx context.Context, redirData AuthRedirect) (*api.TokenResponse, error) {
+	redirectURL, err := redirData.URL()
+	if err != nil {
+		return nil, err
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	keyPath := filepath.Join(home, ".ollama", "id_ed25519")
@@ -87,7 +148,7 @@ func getAuthToken(ctx context.Context, redirData AuthRedirect) (string, error) {
 	rawKey, err := os.ReadFile(keyPath)
 	if err != nil {
 		log.Printf("Failed to load private key: %v", err)
-		return "", err
+		return nil, err
 	}
 
 	s := SignatureData{
@@ -98,7 +159,7 @@ func getAuthToken(ctx context.Context, redirData AuthRedirect) (string, error) {
 
 	sig, err := s.Sign(rawKey)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	headers := make(http.Header)
@@ -106,25 +167,26 @@ func getAuthToken(ctx context.Context, redirData AuthRedirect) (string, error) {
 	resp, err := makeRequest(ctx, "GET", redirectURL, headers, nil, nil)
 	if err != nil {
 		log.Printf("couldn't get token: %q", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= http.StatusBadRequest {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("on pull registry responded with code %d: %s", resp.StatusCode, body)
+		return nil, registryError("pull", resp.StatusCode, body)
 	}
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var tok api.TokenResponse
 	if err := json.Unmarshal(respBody, &tok); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return tok.Token, nil
+	return &tok, nil
 }
 
 // Bytes returns a byte slice of the data to sign for the request
@@ -0,0 +1,455 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const (
+	// defaultBackgroundParallelLayers is how many layers a background pull downloads at once, override it with
+	// OLLAMA_BACKGROUND_PARALLEL_LAYERS
+	defaultBackgroundParallelLayers = 1
+
+	// defaultBackgroundDownloadRate is the bytes per second background pulls download at, override it with
+	// OLLAMA_BACKGROUND_DOWNLOAD_RATE, 0 doesn't limit them
+	defaultBackgroundDownloadRate = 10 * 1000 * 1000
+
+	// defaultBackgroundIdle is how long there have to be no generations for paused background pulls to carry
+	// on, override it with OLLAMA_BACKGROUND_IDLE
+	defaultBackgroundIdle = 30 * time.Second
+
+	// backgroundPullsRetry is how long until the queue is read again when it couldn't be
+	backgroundPullsRetry = time.Minute
+)
+
+const cancelBackgroundPull cancelReason = "background pull cancelled"
+
+// backgroundBucket limits the rate of background downloads, on top of OLLAMA_MAX_DOWNLOAD_RATE
+var backgroundBucket = &tokenBucket{}
+
+// activity counts the generations running, background pulls pause while there are any
+type activity struct {
+	mu      sync.Mutex
+	active  int
+	last    time.Time     // when the last generation finished
+	changed chan struct{} // closed when a generation starts or finishes, for waiters to look again
+}
+
+var interactive = &activity{}
+
+func (a *activity) begin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active++
+	a.notify()
+}
+
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	a.last = time.Now()
+	a.notify()
+}
+
+// notify wakes the waiters, a must be locked
+func (a *activity) notify() {
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+}
+
+// busy reports whether a generation is running or finished less than quiet ago
+func (a *activity) busy(quiet time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.active > 0 || time.Since(a.last) < quiet
+}
+
+// waitIdle blocks until there have been no generations for quiet, it returns early if ctx is done
+func (a *activity) waitIdle(ctx context.Context, quiet time.Duration) error {
+	for {
+		a.mu.Lock()
+		active, last := a.active, a.last
+		if a.changed == nil {
+			a.changed = make(chan struct{})
+		}
+		changed := a.changed
+		a.mu.Unlock()
+
+		var quieted <-chan time.Time
+		if active == 0 {
+			left := quiet - time.Since(last)
+			if left <= 0 {
+				return nil
+			}
+
+			quieted = time.After(left)
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-changed:
+		case <-quieted:
+		}
+	}
+}
+
+// backgroundPull is a queued pull, with what isn't saved to disk
+type backgroundPull struct {
+	api.BackgroundPull
+
+	// the credentials are only kept in memory, a pull queued with them is pulled without them after a restart
+	username string
+	password string
+
+	cancel   context.CancelCauseFunc
+	progress map[string]api.ProgressResponse // the progress of each layer, by digest
+}
+
+// backgroundPulls are the queued pulls in the order they were queued, kept in ~/.ollama/pulls.json. one runs
+// at a time
+var backgroundPulls = struct {
+	sync.Mutex
+	pulls  []*backgroundPull
+	loaded bool
+	wake   chan struct{} // signalled when a pull is queued or removed
+}{wake: make(chan struct{}, 1)}
+
+func backgroundPullsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "pulls.json"), nil
+}
+
+// loadBackgroundPulls reads the queued pulls the first time they're needed, backgroundPulls must be locked. a
+// pull which was running when the server stopped is queued again, and the queue starts empty if the file is
+// corrupt
+func loadBackgroundPulls() error {
+	if backgroundPulls.loaded {
+		return nil
+	}
+
+	fp, err := backgroundPullsPath()
+	if err != nil {
+		return err
+	}
+
+	var saved []api.BackgroundPull
+	if err := readStateFile(fp, &saved); err != nil {
+		return err
+	}
+
+	for _, p := range saved {
+		if p.State == api.BackgroundPullRunning {
+			p.State = api.BackgroundPullQueued
+		}
+
+		backgroundPulls.pulls = append(backgroundPulls.pulls, &backgroundPull{BackgroundPull: p})
+	}
+
+	backgroundPulls.loaded = true
+	return nil
+}
+
+// saveBackgroundPulls writes the queued pulls to disk, backgroundPulls must be locked
+func saveBackgroundPulls() error {
+	saved := make([]api.BackgroundPull, 0, len(backgroundPulls.pulls))
+	for _, p := range backgroundPulls.pulls {
+		saved = append(saved, p.BackgroundPull)
+	}
+
+	fp, err := backgroundPullsPath()
+	if err != nil {
+		return err
+	}
+
+	return writeStateFile(fp, saved)
+}
+
+// parseAfter parses when a background pull may start, a time of day is its next occurrence after now
+func parseAfter(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+
+	if t, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		after := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !after.After(now) {
+			after = after.AddDate(0, 0, 1)
+		}
+
+		return after, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid after %q, expected a time such as 01:00 or 2006-01-02T15:04:05Z", s)
+	}
+
+	return t, nil
+}
+
+// queueBackgroundPull queues req to be pulled in the background once after has passed
+func queueBackgroundPull(req api.PullRequest, after time.Time) (api.BackgroundPull, error) {
+	backgroundPulls.Lock()
+	defer backgroundPulls.Unlock()
+
+	if err := loadBackgroundPulls(); err != nil {
+		return api.BackgroundPull{}, err
+	}
+
+	p := &backgroundPull{
+		BackgroundPull: api.BackgroundPull{
+			ID:            generationID(),
+			Name:          req.Name,
+			Insecure:      req.Insecure,
+			WithReferrers: req.WithReferrers,
+			QueuedAt:      time.Now().UTC(),
+			After:         after,
+			State:         api.BackgroundPullQueued,
+		},
+		username: req.Username,
+		password: req.Password,
+	}
+
+	backgroundPulls.pulls = append(backgroundPulls.pulls, p)
+	if err := saveBackgroundPulls(); err != nil {
+		backgroundPulls.pulls = backgroundPulls.pulls[:len(backgroundPulls.pulls)-1]
+		return api.BackgroundPull{}, err
+	}
+
+	wakeBackgroundPulls()
+	return p.BackgroundPull, nil
+}
+
+// removeBackgroundPull removes the pull with id from the queue, stopping it if it's running
+func removeBackgroundPull(id string) (bool, error) {
+	backgroundPulls.Lock()
+	defer backgroundPulls.Unlock()
+
+	if err := loadBackgroundPulls(); err != nil {
+		return false, err
+	}
+
+	for i, p := range backgroundPulls.pulls {
+		if p.ID == id {
+			if p.cancel != nil {
+				p.cancel(cancelBackgroundPull)
+			}
+
+			backgroundPulls.pulls = append(backgroundPulls.pulls[:i], backgroundPulls.pulls[i+1:]...)
+			wakeBackgroundPulls()
+			return true, saveBackgroundPulls()
+		}
+	}
+
+	return false, nil
+}
+
+func wakeBackgroundPulls() {
+	select {
+	case backgroundPulls.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextBackgroundPull returns the first queued pull which may start now and marks it running, or else how long
+// until the next one may. a wait of 0 means nothing is queued
+func nextBackgroundPull(now time.Time) (*backgroundPull, time.Duration, error) {
+	backgroundPulls.Lock()
+	defer backgroundPulls.Unlock()
+
+	if err := loadBackgroundPulls(); err != nil {
+		return nil, 0, err
+	}
+
+	var wait time.Duration
+	for _, p := range backgroundPulls.pulls {
+		if p.State != api.BackgroundPullQueued {
+			continue
+		}
+
+		if left := p.After.Sub(now); left > 0 {
+			if wait == 0 || left < wait {
+				wait = left
+			}
+
+			continue
+		}
+
+		p.State = api.BackgroundPullRunning
+		p.progress = make(map[string]api.ProgressResponse)
+		if err := saveBackgroundPulls(); err != nil {
+			// the pull runs anyway, it's only queued again after a restart if it was saved as running
+			log.Printf("couldn't save background pulls: %v", err)
+		}
+
+		return p, 0, nil
+	}
+
+	return nil, wait, nil
+}
+
+// startBackgroundPulls runs the queued pulls one at a time, each once its time has come
+func startBackgroundPulls() {
+	go func() {
+		for {
+			p, wait, err := nextBackgroundPull(time.Now())
+			if err != nil {
+				// the queue is read again later, or as soon as a pull is queued
+				log.Printf("couldn't read background pulls, trying again in %s: %v", backgroundPullsRetry, err)
+				wait = backgroundPullsRetry
+			}
+
+			if p != nil {
+				runBackgroundPull(p)
+				continue
+			}
+
+			var next <-chan time.Time
+			if wait > 0 {
+				next = time.After(wait)
+			}
+
+			select {
+			case <-backgroundPulls.wake:
+			case <-next:
+			}
+		}
+	}()
+}
+
+func runBackgroundPull(p *backgroundPull) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	backgroundPulls.Lock()
+	p.cancel = cancel
+	backgroundPulls.Unlock()
+
+	log.Printf("pulling %s in the background", p.Name)
+	regOpts := &RegistryOptions{
+		Insecure:      p.Insecure,
+		Username:      p.username,
+		Password:      p.password,
+		WithReferrers: p.WithReferrers,
+		Background:    true,
+	}
+
+	err := PullModel(ctx, p.Name, regOpts, func(r api.ProgressResponse) {
+		if r.Digest == "" {
+			return
+		}
+
+		backgroundPulls.Lock()
+		defer backgroundPulls.Unlock()
+
+		p.progress[r.Digest] = r
+		p.Total, p.Completed = 0, 0
+		for _, layer := range p.progress {
+			p.Total += layer.Total
+			p.Completed += layer.Completed
+		}
+	})
+
+	backgroundPulls.Lock()
+	defer backgroundPulls.Unlock()
+
+	p.cancel = nil
+	p.progress = nil
+	p.Total, p.Completed = 0, 0
+
+	switch {
+	case errors.Is(err, cancelBackgroundPull):
+		// removed from the queue while it was running
+		return
+	case errors.Is(err, cancelServerShutdown):
+		// it's still saved as running, so it's queued again and carries on from where it stopped once the
+		// server is back
+		return
+	case err != nil:
+		log.Printf("background pull of %s failed: %v", p.Name, err)
+		p.State = api.BackgroundPullFailed
+		p.Error = err.Error()
+	default:
+		for i := range backgroundPulls.pulls {
+			if backgroundPulls.pulls[i] == p {
+				backgroundPulls.pulls = append(backgroundPulls.pulls[:i], backgroundPulls.pulls[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if err := saveBackgroundPulls(); err != nil {
+		log.Printf("couldn't save background pulls: %v", err)
+	}
+}
+
+// queueBackgroundPullHandler replies to a pull with Background or After by queueing it
+func queueBackgroundPullHandler(c *gin.Context, req api.PullRequest) {
+	after, err := parseAfter(req.After, time.Now())
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	p, err := queueBackgroundPull(req, after)
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := fmt.Sprintf("queued %s to pull in the background", p.Name)
+	if req.After != "" {
+		status = fmt.Sprintf("queued %s to pull in the background after %s", p.Name, p.After.Local().Format("2006-01-02 15:04"))
+	}
+
+	replayResponse(c, api.ProgressResponse{Status: status})
+}
+
+func ListBackgroundPullsHandler(c *gin.Context) {
+	backgroundPulls.Lock()
+	defer backgroundPulls.Unlock()
+
+	if err := loadBackgroundPulls(); err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	pulls := make([]api.BackgroundPull, 0, len(backgroundPulls.pulls))
+	for _, p := range backgroundPulls.pulls {
+		pulls = append(pulls, p.BackgroundPull)
+	}
+
+	c.JSON(http.StatusOK, api.ListBackgroundPullsResponse{Pulls: pulls})
+}
+
+func CancelBackgroundPullHandler(c *gin.Context) {
+	id := c.Param("id")
+	ok, err := removeBackgroundPull(id)
+	switch {
+	case err != nil:
+		replyError(c, http.StatusInternalServerError, err)
+	case !ok:
+		replyError(c, http.StatusNotFound, fmt.Errorf("background pull '%s' not found", id))
+	default:
+		c.JSON(http.StatusOK, nil)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestParseAfter(t *testing.T) {
+	now := time.Date(2023, 11, 20, 14, 30, 0, 0, time.Local)
+	cases := map[string]time.Time{
+		"":                     now,
+		"16:00":                time.Date(2023, 11, 20, 16, 0, 0, 0, time.Local),
+		"01:00":                time.Date(2023, 11, 21, 1, 0, 0, 0, time.Local),
+		"14:30":                time.Date(2023, 11, 21, 14, 30, 0, 0, time.Local),
+		"2023-12-01T02:00:00Z": time.Date(2023, 12, 1, 2, 0, 0, 0, time.UTC),
+	}
+
+	for s, want := range cases {
+		got, err := parseAfter(s, now)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+		} else if !got.Equal(want) {
+			t.Errorf("%q: got %s, want %s", s, got, want)
+		}
+	}
+
+	if _, err := parseAfter("tonight", now); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestBackgroundPullQueue(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	now := time.Now()
+	later, err := queueBackgroundPull(api.PullRequest{Name: "later"}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := queueBackgroundPull(api.PullRequest{Name: "now"}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pull whose time has come runs first, even though it was queued after
+	p, _, err := nextBackgroundPull(now)
+	if err != nil {
+		t.Fatal(err)
+	} else if p == nil || p.Name != "now" {
+		t.Fatalf("got %v, want now", p)
+	}
+
+	p, wait, err := nextBackgroundPull(now)
+	if err != nil {
+		t.Fatal(err)
+	} else if p != nil || wait != time.Hour {
+		t.Fatalf("got %v, expected to wait an hour, got %s", p, wait)
+	}
+
+	// the queue is read back from disk with the running pull queued again
+	backgroundPulls.Lock()
+	backgroundPulls.pulls, backgroundPulls.loaded = nil, false
+	backgroundPulls.Unlock()
+
+	p, _, err = nextBackgroundPull(now)
+	if err != nil {
+		t.Fatal(err)
+	} else if p == nil || p.Name != "now" {
+		t.Fatalf("got %v, want now", p)
+	}
+
+	if ok, err := removeBackgroundPull(later.ID); err != nil || !ok {
+		t.Fatalf("couldn't remove %s: %v", later.ID, err)
+	}
+
+	if p, wait, _ := nextBackgroundPull(now); p != nil || wait != 0 {
+		t.Errorf("expected nothing to be queued, got %v", p)
+	}
+
+	backgroundPulls.Lock()
+	backgroundPulls.pulls, backgroundPulls.loaded = nil, false
+	backgroundPulls.Unlock()
+}
+
+func TestBackgroundPullsReadAgain(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// a directory in place of the file can't be read
+	fp := filepath.Join(home, ".ollama", "pulls.json")
+	if err := os.MkdirAll(fp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := nextBackgroundPull(time.Now()); err == nil {
+		t.Fatal("expected an error reading the queue")
+	}
+
+	// a queue which couldn't be read is read again the next time the scheduler looks
+	if err := os.Remove(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, []byte(`[{"id":"1","name":"later","state":"queued"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _, err := nextBackgroundPull(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	} else if p == nil || p.Name != "later" {
+		t.Fatalf("got %v, want later", p)
+	}
+
+	backgroundPulls.Lock()
+	backgroundPulls.pulls, backgroundPulls.loaded = nil, false
+	backgroundPulls.Unlock()
+}
+
+func TestBackgroundPullsCorrupt(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	fp := filepath.Join(home, ".ollama", "pulls.json")
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, []byte(`[{"id":"1","name":"lat`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a queue truncated by a crash is moved aside and starts empty
+	p, err := queueBackgroundPull(api.PullRequest{Name: "llama2"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backgroundPulls.Lock()
+	backgroundPulls.pulls, backgroundPulls.loaded = nil, false
+	backgroundPulls.Unlock()
+	defer func() {
+		backgroundPulls.Lock()
+		backgroundPulls.pulls, backgroundPulls.loaded = nil, false
+		backgroundPulls.Unlock()
+	}()
+
+	next, _, err := nextBackgroundPull(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	} else if next == nil || next.ID != p.ID {
+		t.Fatalf("got %v, want %s", next, p.ID)
+	}
+
+	if _, err := os.Stat(fp + ".corrupt"); err != nil {
+		t.Errorf("expected the corrupt queue to be kept: %v", err)
+	}
+}
+
+func TestBackgroundPullsWaitForGenerations(t *testing.T) {
+	a := &activity{}
+	if a.busy(time.Millisecond) {
+		t.Fatal("expected no generations to be running")
+	}
+
+	a.begin()
+	if !a.busy(time.Millisecond) {
+		t.Fatal("expected a generation to be running")
+	}
+
+	idle := make(chan error)
+	go func() {
+		idle <- a.waitIdle(context.Background(), 20*time.Millisecond)
+	}()
+
+	select {
+	case <-idle:
+		t.Fatal("expected to wait while the generation is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.end()
+	select {
+	case err := <-idle:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected to stop waiting once generations had stopped")
+	}
+}
+
+func TestBackgroundDownloadPauseReleasesConnection(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_BACKGROUND_IDLE", "10ms")
+	t.Setenv("OLLAMA_BACKGROUND_DOWNLOAD_RATE", "0")
+
+	chunkSize = 1024
+	defer func() { chunkSize = 1024 * 1024 }()
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generating sync.Once
+	paused := make(chan struct{})
+	released := make(chan int, 1)
+	go func() {
+		<-paused
+		// the connection is given up once the download has stopped
+		deadline := time.Now().Add(time.Second)
+		for {
+			downloadConnections.mu.Lock()
+			active := downloadConnections.active
+			downloadConnections.mu.Unlock()
+			if active == 0 || time.Now().After(deadline) {
+				released <- active
+				interactive.end()
+				return
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	err = downloadBlob(context.Background(), downloadOpts{
+		mp: ModelPath{
+			ProtocolScheme: "http",
+			Registry:       u.Host,
+			Namespace:      DefaultNamespace,
+			Repository:     "test",
+			Tag:            DefaultTag,
+		},
+		digest:  digest,
+		regOpts: &RegistryOptions{Insecure: true, Background: true},
+		fn: func(r api.ProgressResponse) {
+			switch {
+			case r.State == api.ProgressStateDownloading && r.Completed == chunkSize:
+				// a generation starts part way through the download
+				generating.Do(interactive.begin)
+			case r.State == api.ProgressStatePaused:
+				close(paused)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active := <-released; active != 0 {
+		t.Errorf("got %d connections held while paused, want 0", active)
+	}
+
+	if err := verifyBlob(digest); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"bytes=0-", "bytes=1024-"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got ranges %v, want %v", ranges, want)
+	}
+}
+
+func TestForegroundPullLiftsBackgroundDownload(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_BACKGROUND_DOWNLOAD_RATE", "1000")
+	t.Setenv("OLLAMA_BACKGROUND_IDLE", "0")
+
+	chunkSize = 1024
+	defer func() { chunkSize = 1024 * 1024 }()
+
+	blob := bytes.Repeat([]byte("ollama"), 2048)
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := downloadOpts{
+		mp: ModelPath{
+			ProtocolScheme: "http",
+			Registry:       u.Host,
+			Namespace:      DefaultNamespace,
+			Repository:     "test",
+			Tag:            DefaultTag,
+		},
+		digest:  digest,
+		regOpts: &RegistryOptions{Insecure: true},
+		fn:      func(api.ProgressResponse) {},
+	}
+
+	background := opts
+	background.regOpts = &RegistryOptions{Insecure: true, Background: true}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- downloadBlob(context.Background(), background)
+	}()
+
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the foreground pull joins the background download before the registry replies
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+
+	start := time.Now()
+	if err := downloadBlob(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// the blob takes 12 seconds at the background rate
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("foreground pull took %s, it waited on the background rate", elapsed)
+	}
+
+	if err := verifyBlob(digest); err != nil {
+		t.Fatal(err)
+	}
+}
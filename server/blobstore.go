@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// BlobStore holds blobs by their digest
+type BlobStore interface {
+	Get(ctx context.Context, digest string) (io.ReadCloser, error)
+	// Put stores size bytes of r as the blob digest, replacing it if the store already has it
+	Put(ctx context.Context, digest string, r io.Reader, size int64) error
+	// Stat returns the size of the blob, the error wraps os.ErrNotExist if the store doesn't have it
+	Stat(ctx context.Context, digest string) (int64, error)
+	Delete(ctx context.Context, digest string) error
+	List(ctx context.Context) ([]string, error)
+}
+
+// localBlobs are the blobs in ~/.ollama/models/blobs, or in the model directories of OLLAMA_MODEL_DIRS which are
+// read but never written. runners load models from here, so every blob a model uses is kept here even when blobs
+// are shared through another store
+var localBlobs BlobStore = fsBlobStore{}
+
+// sharedBlobs is the store set with OLLAMA_BLOB_STORE, which several servers pull blobs from and push them to
+// instead of each downloading them from the registry. it's nil if blobs aren't shared
+var sharedBlobs BlobStore
+
+type fsBlobStore struct{}
+
+func (fsBlobStore) Get(_ context.Context, digest string) (io.ReadCloser, error) {
+	fp, err := findBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(fp)
+}
+
+// Put writes the blob to a partial file first, so a blob is never seen half written
+func (fsBlobStore) Put(_ context.Context, digest string, r io.Reader, size int64) error {
+	return writeBlob(digest, func(w io.Writer) error {
+		n, err := io.Copy(w, r)
+		if err != nil {
+			return err
+		}
+
+		if size >= 0 && n != size {
+			return fmt.Errorf("blob %s is %d bytes, expected %d", digest, n, size)
+		}
+
+		return nil
+	})
+}
+
+// partialBlobSuffix marks the files of blobs which are still being written, they are only renamed to the
+// blob's digest once they're complete and synced
+const partialBlobSuffix = "-partial"
+
+func isPartialBlob(name string) bool {
+	return strings.Contains(name, partialBlobSuffix)
+}
+
+// writeBlob writes the blob digest with fn to a partial file, then syncs it and moves it into place. the
+// partial file is removed if fn fails
+func writeBlob(digest string, fn func(io.Writer) error) error {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fp), filepath.Base(fp)+partialBlobSuffix+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fp)
+}
+
+func (fsBlobStore) Stat(_ context.Context, digest string) (int64, error) {
+	fp, err := findBlob(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (fsBlobStore) Delete(_ context.Context, digest string) error {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(fp)
+}
+
+// List returns the digests of the blobs in the blobs directory, blobs which are still being written aren't
+// listed
+func (fsBlobStore) List(_ context.Context) ([]string, error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	for _, entry := range entries {
+		if entry.IsDir() || isPartialBlob(entry.Name()) {
+			continue
+		}
+
+		name := entry.Name()
+		if runtime.GOOS == "windows" {
+			name = strings.ReplaceAll(name, "-", ":")
+		}
+
+		digests = append(digests, name)
+	}
+
+	return digests, nil
+}
+
+// openSharedBlobs sets sharedBlobs from OLLAMA_BLOB_STORE, such as s3://bucket/prefix
+func openSharedBlobs() error {
+	s := os.Getenv("OLLAMA_BLOB_STORE")
+	if s == "" {
+		return nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("OLLAMA_BLOB_STORE: %w", err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		store, err := newS3BlobStore(u)
+		if err != nil {
+			return fmt.Errorf("OLLAMA_BLOB_STORE: %w", err)
+		}
+
+		sharedBlobs = store
+	default:
+		return fmt.Errorf("OLLAMA_BLOB_STORE: unsupported blob store %q", s)
+	}
+
+	log.Printf("sharing blobs through %s", s)
+	return nil
+}
+
+// fetchSharedBlob copies layer from the shared blob store, if it has it. a store which fails is logged and
+// reported as not having the blob, so the pull carries on from the registry
+func fetchSharedBlob(ctx context.Context, layer *Layer, fn func(api.ProgressResponse)) (bool, error) {
+	if sharedBlobs == nil {
+		return false, nil
+	}
+
+	size, err := sharedBlobs.Stat(ctx, layer.Digest)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("couldn't check the blob store for %s: %v", layer.Digest, err)
+		}
+
+		return false, ctx.Err()
+	}
+
+	fn(api.ProgressResponse{Status: fmt.Sprintf("pulling %s from the blob store", layer.Digest), Digest: layer.Digest, Total: int(size)})
+
+	r, err := sharedBlobs.Get(ctx, layer.Digest)
+	if err != nil {
+		log.Printf("couldn't get %s from the blob store: %v", layer.Digest, err)
+		return false, ctx.Err()
+	}
+	defer r.Close()
+
+	if err := localBlobs.Put(ctx, layer.Digest, r, size); err != nil {
+		log.Printf("couldn't copy %s from the blob store: %v", layer.Digest, err)
+		return false, ctx.Err()
+	}
+
+	fn(api.ProgressResponse{Digest: layer.Digest, Total: int(size), Completed: int(size), State: api.ProgressStateComplete})
+	return true, nil
+}
+
+// sharing are the digests of the blobs being copied to the shared blob store, so a blob pulled or created by
+// several requests at once is only copied once
+var sharing sync.Map
+
+// shareBlobsInBackground copies the blobs of layers to the shared blob store without holding up the pull or
+// create which saved them, see shareBlobs
+func shareBlobsInBackground(layers []*Layer) {
+	if sharedBlobs == nil {
+		return
+	}
+
+	go shareBlobs(context.Background(), sharedBlobs, layers)
+}
+
+// shareBlobs copies the local blobs of layers which store doesn't have to it. the blobs are already saved
+// locally, so failures are only logged
+func shareBlobs(ctx context.Context, store BlobStore, layers []*Layer) {
+	for _, layer := range layers {
+		if _, copying := sharing.LoadOrStore(layer.Digest, true); copying {
+			continue
+		}
+
+		if err := shareBlob(ctx, store, layer.Digest); err != nil {
+			log.Printf("couldn't copy %s to the blob store: %v", layer.Digest, err)
+		}
+
+		sharing.Delete(layer.Digest)
+	}
+}
+
+// shareBlob copies the blob to store, unless it already has it
+func shareBlob(ctx context.Context, store BlobStore, digest string) error {
+	if _, err := store.Stat(ctx, digest); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	size, err := localBlobs.Stat(ctx, digest)
+	if err != nil {
+		return err
+	}
+
+	r, err := localBlobs.Get(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return store.Put(ctx, digest, r, size)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cancelReason is set as the cause of a pull's or generation's context to record why it was stopped
+type cancelReason string
+
+const (
+	cancelClientDisconnected cancelReason = "client disconnected"
+	cancelRequested          cancelReason = "cancelled by request"
+)
+
+func (r cancelReason) Error() string {
+	return string(r)
+}
+
+type cancelReasonKey struct{}
+
+// withCancelReason returns a context of parent which can be cancelled with a reason, cancelCause gives reason
+// for it being cancelled because parent was
+func withCancelReason(parent context.Context, reason cancelReason) (context.Context, context.CancelCauseFunc) {
+	return context.WithCancelCause(context.WithValue(parent, cancelReasonKey{}, reason))
+}
+
+// cancelCause is the cause of ctx being done, a parent of withCancelReason being cancelled is mapped to its
+// reason
+func cancelCause(ctx context.Context) error {
+	cause := context.Cause(ctx)
+
+	var reason cancelReason
+	if errors.As(cause, &reason) || !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+
+	if reason, ok := ctx.Value(cancelReasonKey{}).(cancelReason); ok {
+		return reason
+	}
+
+	return cause
+}
+
+// cancelReasonOf returns why ctx was cancelled
+func cancelReasonOf(ctx context.Context) string {
+	return cancelCause(ctx).Error()
+}
+
+var generations sync.Map // map of running generation ids to their cancel funcs
+
+// trackGeneration registers a generation with id so it can be cancelled through the api, the returned context is
+// cancelled when ctx is done or the generation is cancelled. done must be called once the generation ends
+func trackGeneration(ctx context.Context, id string) (_ context.Context, done func(), err error) {
+	ctx, cancel := withCancelReason(ctx, cancelClientDisconnected)
+	if _, ok := generations.LoadOrStore(id, cancel); ok {
+		cancel(nil)
+		return nil, nil, fmt.Errorf("generation '%s' is already running", id)
+	}
+
+	ctx, stop := withRequestTimeout(ctx)
+	interactive.begin()
+	return ctx, func() {
+		interactive.end()
+		generations.Delete(id)
+		stop(nil)
+		cancel(nil)
+	}, nil
+}
+
+func generationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func CancelGenerateHandler(c *gin.Context) {
+	id := c.Param("id")
+	v, ok := generations.Load(id)
+	if !ok {
+		replyError(c, http.StatusNotFound, fmt.Errorf("generation '%s' not found", id))
+		return
+	}
+
+	v.(context.CancelCauseFunc)(cancelRequested)
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCancelGenerate(t *testing.T) {
+	r := gin.New()
+	r.POST("/api/generate/:id/cancel", CancelGenerateHandler)
+
+	ctx, done, err := trackGeneration(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	if _, _, err := trackGeneration(context.Background(), "test"); err == nil {
+		t.Error("expected a second generation with the same id to fail")
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate/test/cancel", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{}" {
+		t.Fatalf("expected status 200 with {}, got %d %s", w.Code, w.Body)
+	}
+
+	<-ctx.Done()
+	if reason := cancelReasonOf(ctx); reason != string(cancelRequested) {
+		t.Errorf("expected %q, got %q", cancelRequested, reason)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate/missing/cancel", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+type testKey struct{}
+
+func TestWithCancelReason(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), testKey{}, "request"))
+	ctx, cancel := withCancelReason(parent, cancelClientDisconnected)
+	defer cancel(nil)
+
+	if v, _ := ctx.Value(testKey{}).(string); v != "request" {
+		t.Errorf("expected the parent's values, got %q", v)
+	}
+
+	// the parent being cancelled is the reason
+	cancelParent()
+	<-ctx.Done()
+	if reason := cancelReasonOf(ctx); reason != string(cancelClientDisconnected) {
+		t.Errorf("expected %q, got %q", cancelClientDisconnected, reason)
+	}
+
+	ctx, cancel = withCancelReason(context.Background(), cancelClientDisconnected)
+	cancel(cancelRequested)
+	if err := cancelCause(ctx); !errors.Is(err, cancelRequested) {
+		t.Errorf("expected %q, got %v", cancelRequested, err)
+	}
+
+	// a deadline isn't a cancellation
+	deadline, stop := context.WithTimeout(context.Background(), time.Millisecond)
+	defer stop()
+
+	ctx, cancel = withCancelReason(deadline, cancelClientDisconnected)
+	defer cancel(nil)
+
+	<-ctx.Done()
+	if err := cancelCause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline, got %v", err)
+	}
+}
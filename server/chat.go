@@ -0,0 +1,389 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// chatPrompt renders messages with the model's template, each user message is a turn and is followed by the
+// assistant's reply to it, if there is one. system messages apply to the turns after them, replacing the model's
+// system prompt. the conversation starts with the model's own messages. with tools, the system prompt describes
+// them, tool results are user turns and the assistant's replies are rendered as the json the model replied with
+func chatPrompt(model *Model, messages []api.Message, tools []api.Tool) (string, error) {
+	history := append([]api.Message{}, model.Messages...)
+
+	var describeTools string
+	if len(tools) > 0 {
+		var err error
+		if describeTools, err = toolsPrompt(tools); err != nil {
+			return "", err
+		}
+	}
+
+	var sb strings.Builder
+	var system []string
+	var context []int
+	for _, m := range append(history, messages...) {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+		case "user", "tool":
+			prompt := m.Content
+			if m.Role == "tool" {
+				prompt = "Tool result: " + m.Content
+			}
+
+			s := strings.Join(system, "\n")
+			if describeTools != "" {
+				if s == "" {
+					s = model.System
+				}
+				s = strings.TrimSpace(s + "\n\n" + describeTools)
+			}
+
+			p, err := model.Prompt(api.GenerateRequest{
+				Prompt:  prompt,
+				System:  s,
+				Context: context,
+			}, "")
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString(p)
+
+			// later turns are not the first, in the same way as a request which continues a context
+			context = []int{0}
+		case "assistant":
+			content := m.Content
+			if len(tools) > 0 {
+				var err error
+				if content, err = toolsContent(m); err != nil {
+					return "", err
+				}
+			}
+
+			sb.WriteString(content)
+		default:
+			return "", fmt.Errorf("unsupported message role %q", m.Role)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func ChatHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+
+	var req api.ChatRequest
+	uploaded, err := bindRequest(c, &req)
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// uploaded images go with the last message
+	if len(uploaded) > 0 {
+		if len(req.Messages) == 0 {
+			replyError(c, http.StatusBadRequest, errNoImageMessage)
+			return
+		}
+
+		last := &req.Messages[len(req.Messages)-1]
+		last.Images = append(last.Images, uploaded...)
+	}
+
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !checkOptions(c, req.Options) {
+		return
+	}
+
+	messages := req.Messages
+	sessionDuration := defaultSessionDuration
+	if req.KeepAlive != nil {
+		sessionDuration = req.KeepAlive.Duration
+	}
+
+	// endTurn finishes a session's turn with the messages to add to it, the generation ends it once it's started
+	endTurn := func(...api.Message) {}
+	started := false
+	defer func() {
+		if !started {
+			endTurn()
+		}
+	}()
+
+	if req.Session != "" {
+		sess, ok := getSession(req.Session, c.GetString("apiKey"))
+		if !ok {
+			replyError(c, http.StatusNotFound, fmt.Errorf("session '%s' not found", req.Session))
+			return
+		}
+
+		if req.Model == "" {
+			req.Model = sess.model
+		} else if req.Model != sess.model {
+			replyError(c, http.StatusBadRequest, fmt.Errorf("session '%s' is with %s", sess.id, sess.model))
+			return
+		}
+
+		history, err := sess.begin()
+		if err != nil {
+			replyError(c, http.StatusConflict, err)
+			return
+		}
+		endTurn = sess.end
+
+		messages = append(history, req.Messages...)
+
+		// request options override the session's
+		options := make(map[string]interface{})
+		for k, v := range sess.options {
+			options[k] = v
+		}
+		for k, v := range req.Options {
+			options[k] = v
+		}
+		req.Options = options
+
+		// the model stays loaded with the conversation cached for as long as the session
+		sessionDuration = sess.idle
+	}
+
+	auditModel(c, req.Model)
+	model, err := GetModel(req.Model)
+	if errors.Is(err, os.ErrNotExist) {
+		replyError(c, http.StatusNotFound, errModelNotPulled(req.Model))
+		return
+	} else if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !checkLicense(c, model) {
+		return
+	}
+
+	adapter, ok := requestAdapter(c, model, req.Adapter)
+	if !ok {
+		return
+	}
+
+	// render the prompt before queueing, a conversation the template can't render won't run
+	messages, images := chatImages(messages)
+	prompt, err := chatPrompt(model, messages, req.Tools)
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	grammar, err := requestGrammar(req.Format, req.Grammar, req.JSONSchema)
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Tools) > 0 {
+		if grammar != "" {
+			replyError(c, http.StatusBadRequest, errors.New("tools can't be used with format, grammar or json_schema"))
+			return
+		}
+
+		if grammar, err = toolsGrammar(req.Tools); err != nil {
+			replyError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	workDir := c.GetString("workDir")
+
+	id := req.ID
+	if id == "" {
+		id = generationID()
+	}
+
+	// responses are cached for the version of the adapter too
+	keyReq := req
+	if adapter != nil {
+		keyReq.Adapter = adapter.Digest
+	}
+
+	cacheKey, cacheable := chatCacheKey(model, keyReq)
+	cacheable = cacheable && len(req.Messages) > 0
+	if cacheable {
+		if cached, ok := responses.get(cacheKey); ok {
+			metrics.responseCacheHits.Add(1)
+			resp := cached.(api.ChatResponse)
+			resp.Model = req.Model
+			resp.ID = id
+			resp.CreatedAt = time.Now().UTC()
+			resp.TotalDuration = time.Since(checkpointStart)
+			resp.LoadDuration = 0
+			resp.Cached = true
+			replayResponse(c, resp)
+			return
+		}
+
+		metrics.responseCacheMisses.Add(1)
+	}
+
+	ctx, done, err := trackGeneration(c.Request.Context(), id)
+	if err != nil {
+		replyError(c, http.StatusConflict, err)
+		return
+	}
+
+	// a turn which fails adds nothing to the session
+	var turn []api.Message
+	started = true
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		defer done()
+		defer func() { endTurn(turn...) }()
+
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
+		}
+
+		sendError := func(err error) {
+			var lerr *limitError
+			if errors.As(err, &lerr) {
+				send(lerr)
+				return
+			}
+
+			if ctx.Err() != nil {
+				err = fmt.Errorf("generation stopped: %w", cancelCause(ctx))
+			}
+
+			send(errorResponse(0, err))
+		}
+
+		queued := func(position int, wait time.Duration) {
+			send(api.ChatResponse{
+				Model:         req.Model,
+				ID:            id,
+				CreatedAt:     time.Now().UTC(),
+				QueuePosition: position,
+				QueueWait:     wait,
+			})
+		}
+
+		runner, adapterPath, err := acquireAdapter(ctx, workDir, model, adapter, req.Options, sessionDuration, queued)
+		if err != nil {
+			sendError(err)
+			return
+		}
+		defer runner.release()
+
+		checkpointLoaded := time.Now()
+
+		// no messages loads the model
+		if len(req.Messages) == 0 {
+			send(api.ChatResponse{Model: req.Model, ID: id, CreatedAt: time.Now().UTC(), Done: true})
+			return
+		}
+
+		if err := checkPromptLimit(ctx, runner.llm, prompt, 0); err != nil {
+			sendError(err)
+			return
+		}
+
+		generationStarted(req.Model, id)
+
+		opts, err := runner.requestOptions(req.Options)
+		if err != nil {
+			sendError(err)
+			return
+		}
+
+		// a reply with tools is only parsed once it's complete, it's sent with the final response
+		var reply strings.Builder
+		var logprobs []api.TokenLogprob
+		var final api.Message
+		fn := func(r api.GenerateResponse) {
+			resp := api.ChatResponse{
+				Model:     req.Model,
+				ID:        id,
+				CreatedAt: time.Now().UTC(),
+				Done:      r.Done,
+				Metrics:   r.Metrics,
+			}
+
+			reply.WriteString(r.Response)
+			logprobs = append(logprobs, r.Logprobs...)
+			switch {
+			case len(req.Tools) > 0:
+				if !r.Done {
+					return
+				}
+
+				msg := toolsMessage(reply.String())
+				resp.Message = &msg
+				resp.Logprobs = logprobs
+				final = msg
+			case r.Response != "":
+				resp.Message = &api.Message{Role: "assistant", Content: r.Response}
+				resp.Logprobs = r.Logprobs
+			}
+
+			if r.Done && len(req.Tools) == 0 {
+				final = api.Message{Role: "assistant", Content: reply.String()}
+			}
+
+			if r.Done {
+				resp.TotalDuration = time.Since(checkpointStart)
+				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				resp.Options = opts.Map()
+				metrics.observeGeneration(r.EvalCount, r.EvalDuration)
+				auditTokens(c, r.Metrics)
+				generationFinished(req.Model, id, resp.Metrics)
+
+				if cacheable {
+					whole := resp
+					whole.Message = &final
+					whole.Logprobs = logprobs
+					responses.put(cacheKey, whole)
+				}
+			}
+
+			send(resp)
+		}
+
+		// the whole conversation is in the prompt, there's no context to continue from
+		if err := runner.llm.Predict(ctx, llm.PredictOpts{
+			Prompt:      prompt,
+			Grammar:     grammar,
+			Images:      images,
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			Options:     &opts,
+			Adapter:     adapterPath,
+		}, fn); err != nil {
+			sendError(err)
+			return
+		}
+
+		turn = append(append(turn, req.Messages...), final)
+	}()
+
+	streamResponse(c, ch)
+}
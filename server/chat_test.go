@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestChatPrompt(t *testing.T) {
+	m := Model{Template: "{{ if .First }}<<{{ .System }}>>{{ end }}[{{ .Prompt }}]"}
+	messages := []api.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello"},
+		{Role: "user", Content: "bye"},
+	}
+
+	s, err := chatPrompt(&m, messages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<<be brief>>[hi]hello[bye]"
+	if s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+
+	m.Messages = []api.Message{{Role: "user", Content: "ping"}, {Role: "assistant", Content: "pong"}}
+	s, err = chatPrompt(&m, messages[1:2], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = "<<>>[ping]pong[hi]"
+	if s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+
+	if _, err := chatPrompt(&m, []api.Message{{Role: "function", Content: "{}"}}, nil); err == nil {
+		t.Error("expected an error for an unsupported role")
+	}
+}
+
+func TestChatPromptTools(t *testing.T) {
+	m := Model{Template: "<<{{ .System }}>>[{{ .Prompt }}]"}
+	tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "weather"}}}
+	messages := []api.Message{
+		{Role: "user", Content: "weather in paris?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "weather", Arguments: json.RawMessage(`{"city":"paris"}`)}}}},
+		{Role: "tool", Content: "sunny"},
+	}
+
+	s, err := chatPrompt(&m, messages, tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	describe, err := toolsPrompt(tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<<" + describe + ">>[weather in paris?]" + `{"tool_calls":[{"name":"weather","arguments":{"city":"paris"}}]}` + "<<" + describe + ">>[Tool result: sunny]"
+	if s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+}
+
+func TestToolsMessage(t *testing.T) {
+	msg := toolsMessage(`{"tool_calls": [{"name": "weather", "arguments": {"city": "paris"}}]}`)
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Function.Name != "weather" {
+		t.Errorf("expected a call to weather, got %+v", msg)
+	}
+
+	msg = toolsMessage(`{"content": "hello"}`)
+	if msg.Content != "hello" || len(msg.ToolCalls) > 0 {
+		t.Errorf("expected a reply, got %+v", msg)
+	}
+
+	if _, err := toolsGrammar([]api.Tool{{Type: "retrieval"}}); err == nil {
+		t.Error("expected an error for a tool which isn't a function")
+	}
+}
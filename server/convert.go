@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// convertCheckpoint converts the hugging face checkpoint in dir to a gguf model in a temporary file in workDir,
+// returning its path. remove it once the model's layer is saved
+func convertCheckpoint(ctx context.Context, workDir, dir string, fn func(api.ProgressResponse)) (string, error) {
+	dst, err := os.CreateTemp(workDir, "convert-*.gguf")
+	if err != nil {
+		return "", err
+	}
+	dst.Close()
+
+	// the digest of the checkpoint's path is set so that the client shows the conversion's progress
+	digest, _ := GetSHA256Digest(strings.NewReader(dir))
+
+	status := "converting model to gguf"
+	fn(api.ProgressResponse{Status: status})
+	if err := llm.Convert(ctx, dir, dst.Name(), func(completed, total int) {
+		fn(api.ProgressResponse{Status: status, Digest: digest, Total: total, Completed: completed})
+	}); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+
+	return dst.Name(), nil
+}
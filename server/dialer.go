@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+type resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+var registryResolver resolver = net.DefaultResolver
+
+var resolvedAddrs sync.Map // map of networks and hosts to the addresses they last resolved to
+
+// registryTransport is shared by all requests to registries so they resolve and dial the same way
+var registryTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialContext
+	return t
+}()
+
+// ipNetwork returns the network used to resolve registry hosts, OLLAMA_REGISTRY_IP_VERSION set to 4 or 6
+// restricts registry connections to that address family, which avoids broken paths on dual-stack networks
+func ipNetwork() string {
+	switch v := os.Getenv("OLLAMA_REGISTRY_IP_VERSION"); v {
+	case "4":
+		return "ip4"
+	case "6":
+		return "ip6"
+	case "", "auto":
+		return "ip"
+	default:
+		log.Printf("invalid value for OLLAMA_REGISTRY_IP_VERSION: %q, using auto", v)
+		return "ip"
+	}
+}
+
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ipNet := ipNetwork()
+	switch ipNet {
+	case "ip4":
+		network = "tcp4"
+	case "ip6":
+		network = "tcp6"
+	}
+
+	ips, err := lookupHost(ctx, ipNet, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// lookupHost resolves host to addresses in the ip, ip4 or ip6 network, falling back to the addresses
+// it last resolved to if resolution fails
+func lookupHost(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if (network == "ip4" && ip.To4() == nil) || (network == "ip6" && ip.To4() != nil) {
+			return nil, &net.AddrError{Err: "address is not in the " + network + " network", Addr: host}
+		}
+
+		return []net.IP{ip}, nil
+	}
+
+	key := network + "/" + host
+	ips, err := registryResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		if cached, ok := resolvedAddrs.Load(key); ok {
+			log.Printf("couldn't resolve %s, using previously resolved addresses: %v", host, err)
+			return cached.([]net.IP), nil
+		}
+
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	resolvedAddrs.Store(key, ips)
+	return ips, nil
+}
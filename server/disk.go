@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type insufficientSpaceError struct {
+	need, have uint64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space, need %s have %s", humanize.Bytes(e.need), humanize.Bytes(e.have))
+}
+
+// checkFreeSpace returns an error if the blobs directory doesn't have room for the layers which still
+// need to be downloaded, layers which are already present or partly downloaded need less space
+func checkFreeSpace(layers []*Layer) error {
+	var need uint64
+	for _, layer := range layers {
+		found, err := findBlob(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(found); err == nil {
+			continue
+		}
+
+		// partial blobs are only ever written to ~/.ollama/models
+		fp, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		size := uint64(layer.Size)
+		if fi, err := os.Stat(fp + "-partial"); err == nil && uint64(fi.Size()) < size {
+			size -= uint64(fi.Size())
+		}
+
+		need += size
+	}
+
+	if need == 0 {
+		return nil
+	}
+
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	have, err := freeSpace(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// not knowing the free space shouldn't stop the pull
+		log.Printf("couldn't get free disk space for %s: %v", dir, err)
+		return nil
+	}
+
+	if need > have {
+		err := &insufficientSpaceError{need: need, have: have}
+		events.publish(api.Event{
+			Type:  eventDiskLow,
+			Error: err.Error(),
+			Data:  map[string]any{"dir": dir, "need": need, "have": have},
+			Text:  fmt.Sprintf("%s is low on disk space, need %s have %s", dir, humanize.Bytes(need), humanize.Bytes(have)),
+		})
+		return err
+	}
+
+	return nil
+}
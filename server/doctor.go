@@ -0,0 +1,480 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"github.com/pbnjay/memory"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/version"
+)
+
+const (
+	// defaultDoctorModel is the model whose registry the doctor checks if the request doesn't name one
+	defaultDoctorModel = "llama2"
+
+	// defaultDoctorSample is how many bytes the doctor downloads and writes to measure their throughput
+	defaultDoctorSample = 32 << 20
+
+	// maxDoctorSample is the largest sample a request can ask for, it's written to disk
+	maxDoctorSample = 1 << 30
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// doctor checks each step a pull takes, from resolving the registry to writing blobs, for a report users can
+// attach to bug reports
+type doctor struct {
+	mp      ModelPath
+	regOpts *RegistryOptions
+	sample  int64
+	send    func(api.DoctorCheck)
+
+	manifest *ManifestV2
+
+	// registryFailed skips the checks of the registry after one fails, they'd fail the same way
+	registryFailed bool
+}
+
+func DoctorHandler(c *gin.Context) {
+	var req api.DoctorRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Model == "" {
+		req.Model = defaultDoctorModel
+	}
+
+	if req.SampleSize <= 0 {
+		req.SampleSize = defaultDoctorSample
+	} else if req.SampleSize > maxDoctorSample {
+		req.SampleSize = maxDoctorSample
+	}
+
+	mp := ParseModelPath(req.Model)
+	if mp.ProtocolScheme == "http" && !req.Insecure {
+		replyError(c, http.StatusBadRequest, errors.New("insecure protocol http"))
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+
+		ctx := c.Request.Context()
+		d := &doctor{
+			mp:      mp,
+			regOpts: &RegistryOptions{Insecure: req.Insecure},
+			sample:  req.SampleSize,
+			send: func(check api.DoctorCheck) {
+				select {
+				case ch <- check:
+				case <-ctx.Done():
+				}
+			},
+		}
+
+		d.checks(ctx)
+	}()
+
+	streamResponse(c, ch)
+}
+
+func (d *doctor) checks(ctx context.Context) {
+	d.run(ctx, "system", false, d.checkSystem)
+	d.run(ctx, "dns", true, d.checkDNS)
+	d.run(ctx, "tls", true, d.checkTLS)
+	d.run(ctx, "auth", true, d.checkAuth)
+	d.run(ctx, "range", true, d.checkRange)
+	d.run(ctx, "download", true, d.checkDownload)
+	d.run(ctx, "integrity", true, d.checkIntegrity)
+	d.run(ctx, "blobs", false, d.checkBlobWrites)
+	if sharedBlobs != nil {
+		d.run(ctx, "shared_blobs", false, d.checkSharedBlobs)
+	} else {
+		d.send(api.DoctorCheck{Name: "shared_blobs", Status: api.HealthStatusSkipped, Message: "blobs aren't shared, OLLAMA_BLOB_STORE isn't set"})
+	}
+	d.run(ctx, "disk", false, func(context.Context) (string, error) { return checkDisk() })
+	d.run(ctx, "gpu", false, func(context.Context) (string, error) { return findGPUs() })
+	d.run(ctx, "runners", false, func(context.Context) (string, error) { return checkRunners() })
+}
+
+// run sends the result of check, a check of the registry is skipped once one has failed
+func (d *doctor) run(ctx context.Context, name string, registry bool, check func(context.Context) (string, error)) {
+	if registry && d.registryFailed {
+		d.send(api.DoctorCheck{Name: name, Status: api.HealthStatusSkipped, Message: "an earlier check of the registry failed"})
+		return
+	}
+
+	start := time.Now()
+	message, err := check(ctx)
+	result := api.DoctorCheck{Name: name, Status: api.HealthStatusOK, Message: message, Duration: time.Since(start)}
+	if err != nil {
+		result.Status, result.Message = api.HealthStatusFailing, err.Error()
+		d.registryFailed = d.registryFailed || registry
+	}
+
+	d.send(result)
+}
+
+func (d *doctor) checkSystem(context.Context) (string, error) {
+	parts := []string{
+		fmt.Sprintf("ollama %s on %s/%s", version.Version, runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("%d cpus, %s memory", runtime.NumCPU(), humanize.Bytes(memory.TotalMemory())),
+	}
+
+	if proxy := newTransportOptions(d.regOpts).proxyURL; proxy != "" {
+		parts = append(parts, "registry proxy "+proxy)
+	}
+
+	if mirrors := os.Getenv("OLLAMA_REGISTRY_MIRRORS"); mirrors != "" {
+		parts = append(parts, "registry mirrors "+mirrors)
+	}
+
+	if peers := os.Getenv("OLLAMA_REGISTRY_PEERS"); peers != "" {
+		parts = append(parts, "peers "+peers)
+	}
+
+	return strings.Join(parts, ", "), nil
+}
+
+func (d *doctor) checkDNS(ctx context.Context) (string, error) {
+	host := d.mp.BaseURL().Hostname()
+	if proxy := newTransportOptions(d.regOpts).proxyURL; proxy != "" {
+		return fmt.Sprintf("%s is resolved by the proxy", host), nil
+	}
+
+	ips, err := registryResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	return fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), nil
+}
+
+// checkTLS connects to the registry's api, with the transport pulls use
+func (d *doctor) checkTLS(ctx context.Context) (string, error) {
+	resp, err := makeRequest(ctx, http.MethodGet, d.mp.BaseURL().JoinPath("v2/"), nil, nil, d.regOpts)
+	if err != nil {
+		var uerr x509.UnknownAuthorityError
+		if errors.As(err, &uerr) {
+			return "", fmt.Errorf("%w, set OLLAMA_REGISTRY_CA_CERT to the certificate of the ca which signed it", err)
+		}
+
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.TLS == nil {
+		return fmt.Sprintf("connected to %s without tls, it responded with %s", resp.Request.URL.Host, resp.Status), nil
+	}
+
+	message := fmt.Sprintf("connected to %s with %s", resp.Request.URL.Host, tlsVersions[resp.TLS.Version])
+	if certs := resp.TLS.PeerCertificates; len(certs) > 0 {
+		message += fmt.Sprintf(", its certificate for %s is issued by %s", certs[0].Subject.CommonName, certs[0].Issuer.CommonName)
+	}
+
+	return fmt.Sprintf("%s, it responded with %s", message, resp.Status), nil
+}
+
+// checkAuth gets a token for the model's repository if the registry asks for one, and its manifest with it
+func (d *doctor) checkAuth(ctx context.Context) (string, error) {
+	manifestURL := d.mp.BaseURL().JoinPath("v2", d.mp.GetNamespaceRepository(), "manifests", d.mp.Tag)
+	headers := make(http.Header)
+	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+
+	resp, err := makeRequest(ctx, http.MethodGet, manifestURL, headers.Clone(), nil, d.regOpts)
+	if err != nil {
+		return "", err
+	}
+
+	var parts []string
+	if challenge := resp.Header.Get("www-authenticate"); resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(challenge, "Bearer ") {
+		resp.Body.Close()
+
+		start := time.Now()
+		if err := authenticate(ctx, challenge, d.regOpts); err != nil {
+			return "", fmt.Errorf("couldn't get a token: %w", err)
+		}
+
+		parts = append(parts, fmt.Sprintf("got a token from %s in %s", ParseAuthRedirectString(challenge).Realm, time.Since(start).Round(time.Millisecond)))
+
+		resp, err = makeRequest(ctx, http.MethodGet, manifestURL, headers.Clone(), nil, d.regOpts)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		parts = append(parts, "the registry didn't ask for a token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%s isn't in the registry", d.mp.GetShortTagname())
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		return "", registryError("pull", resp.StatusCode, body)
+	}
+
+	bts, err := readManifest(resp)
+	if err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(bts, &d.manifest); err != nil {
+		return "", err
+	}
+
+	if len(d.manifest.Layers) == 0 {
+		return "", fmt.Errorf("the manifest of %s has no layers", d.mp.GetShortTagname())
+	}
+
+	parts = append(parts, fmt.Sprintf("the manifest of %s has %d layers", d.mp.GetShortTagname(), len(d.manifest.Layers)))
+	return strings.Join(parts, ", "), nil
+}
+
+// largestLayer is the layer downloads spend the most time on
+func (d *doctor) largestLayer() *Layer {
+	largest := d.manifest.Layers[0]
+	for _, layer := range d.manifest.Layers {
+		if layer.Size > largest.Size {
+			largest = layer
+		}
+	}
+
+	return largest
+}
+
+// getBlob requests a blob from the sources downloads use, peers and mirrors before the registry
+func (d *doctor) getBlob(ctx context.Context, digest, byteRange string) (*http.Response, error) {
+	headers := make(http.Header)
+	if byteRange != "" {
+		headers.Set("Range", byteRange)
+	}
+
+	resp, err := makeMirroredRequest(ctx, d.mp, blobSources(d.mp.Registry), headers, d.regOpts, "v2", d.mp.GetNamespaceRepository(), "blobs", digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, registryError("download", resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+func (d *doctor) checkRange(ctx context.Context) (string, error) {
+	resp, err := d.getBlob(ctx, d.largestLayer().Digest, "bytes=0-1023")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("%s ignored the range request, interrupted downloads start over", resp.Request.URL.Host)
+	}
+
+	return fmt.Sprintf("%s answers range requests, interrupted downloads resume", resp.Request.URL.Host), nil
+}
+
+// checkDownload downloads the start of the largest layer as downloadBlob does, a chunk at a time with the
+// server's download connections and rate limit
+func (d *doctor) checkDownload(ctx context.Context) (string, error) {
+	layer := d.largestLayer()
+	n := d.sample
+	if int64(layer.Size) < n {
+		n = int64(layer.Size)
+	}
+
+	if err := downloadConnections.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer downloadConnections.release()
+
+	start := time.Now()
+	resp, err := d.getBlob(ctx, layer.Digest, fmt.Sprintf("bytes=0-%d", n-1))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	var limited string
+	if rate := envBytes("OLLAMA_MAX_DOWNLOAD_RATE", 0); rate > 0 {
+		downloadBucket.setRate(rate)
+		body = &rateLimitedReader{ctx: ctx, r: resp.Body, bucket: downloadBucket}
+		limited = fmt.Sprintf(", limited to %s/s by OLLAMA_MAX_DOWNLOAD_RATE", humanize.Bytes(rate))
+	}
+
+	var completed int64
+	for completed < n {
+		copied, err := io.CopyN(io.Discard, body, int64(chunkSize))
+		completed += copied
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("download failed after %s: %w", humanize.Bytes(uint64(completed)), err)
+		}
+	}
+
+	if completed < n {
+		return "", fmt.Errorf("%s sent %s of the %s asked for", resp.Request.URL.Host, humanize.Bytes(uint64(completed)), humanize.Bytes(uint64(n)))
+	}
+
+	return fmt.Sprintf("downloaded %s from %s at %s%s", humanize.Bytes(uint64(completed)), resp.Request.URL.Host, throughput(completed, time.Since(start)), limited), nil
+}
+
+// checkIntegrity downloads the smallest blob of the model whole and checks it against its digest
+func (d *doctor) checkIntegrity(ctx context.Context) (string, error) {
+	smallest := d.manifest.Config
+	for _, layer := range d.manifest.Layers {
+		if layer.Size < smallest.Size {
+			smallest = *layer
+		}
+	}
+
+	resp, err := d.getBlob(ctx, smallest.Digest, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(resp.Body, int64(smallest.Size)+1))
+	if err != nil {
+		return "", err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); n != int64(smallest.Size) || digest != smallest.Digest {
+		return "", fmt.Errorf("%w: %s from %s is %d bytes with the digest %s, want %d bytes with the digest %s", errDigestMismatch, smallest.MediaType, resp.Request.URL.Host, n, digest, smallest.Size, smallest.Digest)
+	}
+
+	return fmt.Sprintf("%s (%s) from %s matches its digest", smallest.MediaType, humanize.Bytes(uint64(n)), resp.Request.URL.Host), nil
+}
+
+// checkBlobWrites writes the sample to the blobs directory as downloads do, a chunk at a time and synced
+// before it's done
+func (d *doctor) checkBlobWrites(ctx context.Context) (string, error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return "", fmt.Errorf("%s isn't writable: %w", dir, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	start := time.Now()
+	chunk := make([]byte, chunkSize)
+	var written int64
+	for written < d.sample {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		n, err := f.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("wrote %s to %s at %s", humanize.Bytes(uint64(written)), dir, throughput(written, time.Since(start))), nil
+}
+
+// checkSharedBlobs writes the sample to the shared blob store and reads it back, as pulls share blobs through
+// it, then removes it
+func (d *doctor) checkSharedBlobs(ctx context.Context) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(zeroReader{ctx}, d.sample)); err != nil {
+		return "", err
+	}
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+
+	start := time.Now()
+	if err := sharedBlobs.Put(ctx, digest, io.LimitReader(zeroReader{ctx}, d.sample), d.sample); err != nil {
+		return "", fmt.Errorf("couldn't write to the shared blob store: %w", err)
+	}
+	defer sharedBlobs.Delete(context.Background(), digest)
+	wrote := time.Since(start)
+
+	start = time.Now()
+	r, err := sharedBlobs.Get(ctx, digest)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read from the shared blob store: %w", err)
+	}
+	defer r.Close()
+
+	h.Reset()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read from the shared blob store: %w", err)
+	}
+
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest || n != d.sample {
+		return "", fmt.Errorf("the shared blob store returned %s with digest %s, want %s with %s", humanize.Bytes(uint64(n)), got, humanize.Bytes(uint64(d.sample)), digest)
+	}
+
+	return fmt.Sprintf("wrote %s to the shared blob store at %s, read it at %s", humanize.Bytes(uint64(n)), throughput(n, wrote), throughput(n, time.Since(start))), nil
+}
+
+// zeroReader reads zeros until ctx is done
+type zeroReader struct {
+	ctx context.Context
+}
+
+func (z zeroReader) Read(p []byte) (int, error) {
+	if err := z.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// throughput is the rate of n bytes in d
+func throughput(n int64, d time.Duration) string {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+
+	return humanize.Bytes(uint64(float64(n)/d.Seconds())) + "/s"
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// doctorRegistry serves a model with a config and two layers, ranges says whether it answers range requests
+func doctorRegistry(t *testing.T, ranges bool) *url.URL {
+	t.Helper()
+
+	blobs := map[string][]byte{}
+	manifest := ManifestV2{SchemaVersion: 2}
+	for i, data := range [][]byte{[]byte("{}"), bytes.Repeat([]byte("weights"), 1<<16), []byte("{{ .Prompt }}")} {
+		digest, size := GetSHA256Digest(bytes.NewReader(data))
+		blobs[digest] = data
+
+		layer := Layer{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: int(size)}
+		if i == 0 {
+			manifest.Config = layer
+		} else {
+			manifest.Layers = append(manifest.Layers, &layer)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			json.NewEncoder(w).Encode(manifest)
+		default:
+			digest := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if !ranges {
+				r.Header.Del("Range")
+			}
+
+			http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blobs[digest]))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func runDoctor(t *testing.T, ranges bool) map[string]api.DoctorCheck {
+	t.Helper()
+
+	u := doctorRegistry(t, ranges)
+	checks := make(map[string]api.DoctorCheck)
+	d := &doctor{
+		mp:      ParseModelPath(u.Host + "/library/test:latest"),
+		regOpts: &RegistryOptions{Insecure: true},
+		sample:  1 << 20,
+		send:    func(check api.DoctorCheck) { checks[check.Name] = check },
+	}
+
+	d.checks(context.Background())
+	return checks
+}
+
+func TestDoctor(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	checks := runDoctor(t, true)
+	for _, name := range []string{"system", "dns", "tls", "auth", "range", "download", "integrity", "blobs"} {
+		if check := checks[name]; check.Status != api.HealthStatusOK {
+			t.Errorf("%s: got %s: %s", name, check.Status, check.Message)
+		}
+	}
+
+	// a registry which ignores ranges fails the range check, and the checks of the registry after it are skipped
+	checks = runDoctor(t, false)
+	if check := checks["range"]; check.Status != api.HealthStatusFailing {
+		t.Errorf("range: got %s: %s", check.Status, check.Message)
+	}
+
+	for _, name := range []string{"download", "integrity"} {
+		if check := checks[name]; check.Status != api.HealthStatusSkipped {
+			t.Errorf("%s: got %s: %s", name, check.Status, check.Message)
+		}
+	}
+
+	if check := checks["blobs"]; check.Status != api.HealthStatusOK {
+		t.Errorf("blobs: got %s: %s", check.Status, check.Message)
+	}
+
+	if check := checks["shared_blobs"]; check.Status != api.HealthStatusSkipped {
+		t.Errorf("shared_blobs: got %s: %s", check.Status, check.Message)
+	}
+}
+
+func TestDoctorSharedBlobs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	srv := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_S3_ENDPOINT", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	u, _ := url.Parse("s3://bucket/models/")
+	store, err := newS3BlobStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedBlobs = store
+	defer func() { sharedBlobs = nil }()
+
+	d := &doctor{sample: 1 << 20}
+	if _, err := d.checkSharedBlobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if digests, _ := store.List(context.Background()); len(digests) != 0 {
+		t.Errorf("expected the sample to be removed, got %v", digests)
+	}
+}
+
+func TestDoctorBlobWritesStop(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	// a client which has gone stops the write, however large the sample
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d := &doctor{sample: maxDoctorSample}
+	if _, err := d.checkBlobWrites(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+}
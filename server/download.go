@@ -1,26 +1,55 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmorganca/ollama/api"
 )
 
 type FileDownload struct {
+	ID        string // identifies this download of the blob across retries, resumes and restarts
 	Digest    string
 	FilePath  string
 	Total     int64
 	Completed int64
+
+	rate transferRate
+
+	// background is set while only background pulls want the blob, a foreground pull joining the download
+	// clears it
+	background atomic.Bool
+}
+
+// progress returns the current progress of the download with status and the layer's state
+func (f *FileDownload) progress(status, state string) api.ProgressResponse {
+	bps, eta := f.rate.estimate(f.Completed, f.Total)
+	return api.ProgressResponse{
+		Status:         status,
+		Digest:         f.Digest,
+		Total:          int(f.Total),
+		Completed:      int(f.Completed),
+		DownloadID:     f.ID,
+		BytesPerSecond: bps,
+		ETA:            eta,
+		State:          state,
+	}
 }
 
 var inProgress sync.Map // map of digests currently being downloaded to their current download progress
@@ -31,9 +60,25 @@ type downloadOpts struct {
 	regOpts *RegistryOptions
 	fn      func(api.ProgressResponse)
 	retry   int // track the number of retries on this download
+
+	// sourceURL, if set, is where to download the blob from instead of the registry
+	sourceURL *url.URL
+
+	// onComplete is called with the digest and path of the blob once it has been downloaded and verified
+	onComplete func(digest, path string) error
+	// ignoreHookErr logs errors returned by onComplete instead of failing the download
+	ignoreHookErr bool
 }
 
-const maxRetry = 3
+const (
+	// maxRetry is the default number of times a failed blob GET is retried, override it with OLLAMA_DOWNLOAD_RETRIES
+	maxRetry = 3
+
+	// HEAD requests carry no data worth resuming so they get a separate, smaller retry budget with a
+	// short timeout, override it with OLLAMA_HEAD_RETRIES
+	maxHeadRetry = 2
+	headTimeout  = 10 * time.Second
+)
 
 // downloadBlob downloads a blob from the registry and stores it in the blobs directory
 func downloadBlob(ctx context.Context, opts downloadOpts) error {
@@ -42,12 +87,18 @@ func downloadBlob(ctx context.Context, opts downloadOpts) error {
 		return err
 	}
 
-	if fi, _ := os.Stat(fp); fi != nil {
-		// we already have the file, so return
+	found, err := findBlob(opts.digest)
+	if err != nil {
+		return err
+	}
+
+	if fi, _ := os.Stat(found); fi != nil {
+		// we already have the file, or a model directory does, so return
 		opts.fn(api.ProgressResponse{
 			Digest:    opts.digest,
 			Total:     int(fi.Size()),
 			Completed: int(fi.Size()),
+			State:     api.ProgressStateComplete,
 		})
 
 		return nil
@@ -60,29 +111,128 @@ func downloadBlob(ctx context.Context, opts downloadOpts) error {
 		Completed: 0,
 	}
 
-	_, downloading := inProgress.LoadOrStore(opts.digest, fileDownload)
+	background := opts.regOpts != nil && opts.regOpts.Background
+	fileDownload.background.Store(background)
+
+	val, downloading := inProgress.LoadOrStore(opts.digest, fileDownload)
 	if downloading {
-		// this is another client requesting the server to download the same blob concurrently
-		return monitorDownload(ctx, opts, fileDownload)
+		// this is another client requesting the server to download the same blob concurrently, a foreground
+		// pull doesn't wait on a background download's limits
+		if f, ok := val.(*FileDownload); ok && !background {
+			f.background.Store(false)
+		}
+
+		if err := monitorDownload(ctx, opts, fileDownload); err != nil {
+			if errors.Is(err, errBackgroundPaused) {
+				return resumeBackgroundDownload(ctx, opts)
+			}
+
+			return err
+		}
+
+		return runCompleteHook(opts, fp)
 	}
 	if err := doDownload(ctx, opts, fileDownload); err != nil {
-		if errors.Is(err, errDownload) && opts.retry < maxRetry {
-			opts.retry++
+		if errors.Is(err, errBackgroundPaused) {
+			return resumeBackgroundDownload(ctx, opts)
+		}
+
+		if errors.Is(err, errDownload) && opts.retry < envInt("OLLAMA_DOWNLOAD_RETRIES", maxRetry) {
 			log.Print(err)
-			log.Printf("retrying download of %s", opts.digest)
+			log.Printf("retrying download of %s (download %s)", opts.digest, fileDownload.ID)
+
+			var after time.Duration
+			var ra *retryAfterError
+			if errors.As(err, &ra) {
+				after = ra.after
+			}
+
+			if err := sleepBackoff(ctx, opts.retry, after); err != nil {
+				return err
+			}
+
+			opts.retry++
 			return downloadBlob(ctx, opts)
 		}
+		sequentialFallbacks.Delete(opts.digest)
+		return downloadError(ctx, err, opts.digest, fileDownload.Completed)
+	}
+	sequentialFallbacks.Delete(opts.digest)
+	return runCompleteHook(opts, fp)
+}
+
+// resumeBackgroundDownload carries on with a paused background download once there have been no generations for
+// a while, it resumes from where it stopped unless another pull has finished the blob by then
+func resumeBackgroundDownload(ctx context.Context, opts downloadOpts) error {
+	if err := interactive.waitIdle(ctx, envDuration("OLLAMA_BACKGROUND_IDLE", defaultBackgroundIdle)); err != nil {
+		return err
+	}
+
+	return downloadBlob(ctx, opts)
+}
+
+// downloadError gives the error of a failed download of digest api.CodeDownloadFailed, with the offset it
+// failed at so clients know where pulling again resumes from. a cancelled download hasn't failed
+func downloadError(ctx context.Context, err error, digest string, offset int64) error {
+	var cerr *codedError
+	if ctx.Err() != nil || errors.As(err, &cerr) {
 		return err
 	}
+
+	return withCode(api.CodeDownloadFailed, err, map[string]any{"digest": digest, "offset": offset})
+}
+
+// runCompleteHook passes the downloaded blob at fp to the onComplete hook, if there is one, the blob
+// has already been verified before it was moved into place
+func runCompleteHook(opts downloadOpts, fp string) error {
+	if opts.onComplete == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(fp); err != nil {
+		// the download was cancelled before it finished
+		return nil
+	}
+
+	if err := opts.onComplete(opts.digest, fp); err != nil {
+		if opts.ignoreHookErr {
+			log.Printf("post-download hook for %s failed: %v", opts.digest, err)
+			return nil
+		}
+
+		return fmt.Errorf("post-download hook for %s: %w", opts.digest, err)
+	}
+
 	return nil
 }
 
+var sequentialFallbacks sync.Map // digests which have already reported falling back to a sequential download
+
+// notifySequentialFallback tells the client why a blob is being downloaded sequentially from the start,
+// this is only reported once per blob even if it falls back for more than one reason or across retries
+func notifySequentialFallback(opts downloadOpts, f *FileDownload, reason string) {
+	if _, reported := sequentialFallbacks.LoadOrStore(opts.digest, reason); reported {
+		return
+	}
+
+	log.Printf("download fallback: digest=%s download=%s registry=%s reason=%q", opts.digest, f.ID, opts.mp.Registry, reason)
+	opts.fn(api.ProgressResponse{Status: reason, DownloadID: f.ID})
+}
+
 var downloadMu sync.Mutex // mutex to check to resume a download while monitoring
 
 // monitorDownload monitors the download progress of a blob and resumes it if it is interrupted
 func monitorDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
 	tick := time.NewTicker(time.Second)
-	for range tick.C {
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// the client following this download has gone, the download itself carries on
+			return cancelCause(ctx)
+		case <-tick.C:
+		}
+
 		done, resume, err := func() (bool, bool, error) {
 			downloadMu.Lock()
 			defer downloadMu.Unlock()
@@ -95,6 +245,7 @@ func monitorDownload(ctx context.Context, opts downloadOpts, f *FileDownload) er
 						Digest:    f.Digest,
 						Total:     int(fi.Size()),
 						Completed: int(fi.Size()),
+						State:     api.ProgressStateComplete,
 					})
 					return true, false, nil
 				}
@@ -106,12 +257,7 @@ func monitorDownload(ctx context.Context, opts downloadOpts, f *FileDownload) er
 			if !ok {
 				return false, false, fmt.Errorf("invalid type for in progress download: %T", val)
 			}
-			opts.fn(api.ProgressResponse{
-				Status:    fmt.Sprintf("downloading %s", f.Digest),
-				Digest:    f.Digest,
-				Total:     int(f.Total),
-				Completed: int(f.Completed),
-			})
+			opts.fn(f.progress(fmt.Sprintf("downloading %s", f.Digest), api.ProgressStateDownloading))
 			return false, false, nil
 		}()
 		if err != nil {
@@ -125,19 +271,40 @@ func monitorDownload(ctx context.Context, opts downloadOpts, f *FileDownload) er
 			return doDownload(ctx, opts, f)
 		}
 	}
-	return nil
 }
 
 var (
 	chunkSize   = 1024 * 1024 // 1 MiB in bytes
 	errDownload = fmt.Errorf("download failed")
+
+	// errBackgroundPaused stops a background download while generations run, it lets go of its connection
+	// until they've stopped
+	errBackgroundPaused = errors.New("background download paused")
 )
 
 // doDownload downloads a blob from the registry and stores it in the blobs directory
 func doDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
+	activeDownloads.Add(1)
+	defer activeDownloads.Done()
 	defer inProgress.Delete(f.Digest)
 	var size int64
 
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	dc := &downloadControl{file: f, cancel: cancel}
+	downloadControls.Store(f.Digest, dc)
+	defer downloadControls.Delete(f.Digest)
+
+	if f.ID == "" {
+		id, err := downloadID(f.FilePath)
+		if err != nil {
+			return fmt.Errorf("download id: %w", err)
+		}
+
+		f.ID = id
+	}
+
 	fi, err := os.Stat(f.FilePath + "-partial")
 	switch {
 	case errors.Is(err, os.ErrNotExist):
@@ -155,13 +322,28 @@ func doDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
 		}
 	}
 
-	requestURL := opts.mp.BaseURL()
-	requestURL = requestURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", f.Digest)
-
 	headers := make(http.Header)
 	headers.Set("Range", fmt.Sprintf("bytes=%d-", size))
 
-	resp, err := makeRequest(ctx, "GET", requestURL, headers, nil, opts.regOpts)
+	quiet := envDuration("OLLAMA_BACKGROUND_IDLE", defaultBackgroundIdle)
+	if f.background.Load() && interactive.busy(quiet) {
+		opts.fn(f.progress(fmt.Sprintf("paused %s while generating", f.Digest), api.ProgressStatePaused))
+		return errBackgroundPaused
+	}
+
+	// the connection is held until the download stops, including while it's paused through the api
+	if err := downloadConnections.acquire(ctx); err != nil {
+		return err
+	}
+	defer downloadConnections.release()
+
+	var resp *http.Response
+	if opts.sourceURL != nil {
+		u := *opts.sourceURL
+		resp, err = makeRequest(ctx, http.MethodGet, &u, headers, nil, opts.regOpts)
+	} else {
+		resp, err = makeMirroredRequest(ctx, opts.mp, blobSources(opts.mp.Registry), headers, opts.regOpts, "v2", opts.mp.GetNamespaceRepository(), "blobs", f.Digest)
+	}
 	if err != nil {
 		log.Printf("couldn't download blob: %v", err)
 		return fmt.Errorf("%w: %w", errDownload, err)
@@ -170,7 +352,21 @@ func doDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
 
 	if resp.StatusCode >= http.StatusBadRequest {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("%w: on download registry responded with code %d: %v", errDownload, resp.StatusCode, string(body))
+		err := registryError("download", resp.StatusCode, body)
+		if !retryableStatus(resp.StatusCode) {
+			return err
+		}
+
+		return &retryAfterError{err: fmt.Errorf("%w: %w", errDownload, err), after: retryAfter(resp)}
+	}
+
+	if size > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the registry ignored the range request and is sending the whole blob, start over from the beginning
+		notifySequentialFallback(opts, f, "range not supported, downloading sequentially")
+		size = 0
+		if err := os.Truncate(f.FilePath+"-partial", size); err != nil {
+			return fmt.Errorf("truncate: %w", err)
+		}
 	}
 
 	err = os.MkdirAll(filepath.Dir(f.FilePath), 0o700)
@@ -178,7 +374,14 @@ func doDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
 		return fmt.Errorf("make blobs directory: %w", err)
 	}
 
-	remaining, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	remaining, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	sized := err == nil
+	if !sized {
+		// chunked transfer encoding, the blob is complete when the response body ends
+		notifySequentialFallback(opts, f, "content length unknown, downloading sequentially")
+		remaining = 1 // dummy value to indicate that we don't know the total size yet
+	}
+
 	f.Completed = size
 	f.Total = remaining + f.Completed
 
@@ -189,49 +392,189 @@ func doDownload(ctx context.Context, opts downloadOpts, f *FileDownload) error {
 		return fmt.Errorf("open file: %w", err)
 	}
 	defer out.Close()
+
+	// hash the blob as it is written so it can be verified before it is moved into place, a resumed
+	// download first hashes what was already downloaded
+	h := sha256.New()
+	if size > 0 {
+		partial, err := os.Open(f.FilePath + "-partial")
+		if err != nil {
+			return fmt.Errorf("open file: %w", err)
+		}
+
+		_, err = io.CopyN(h, partial, size)
+		partial.Close()
+		if err != nil {
+			return fmt.Errorf("hash partial file: %w", err)
+		}
+	}
+
+	// small writes are slow on network filesystems, optionally coalesce them into larger blocks
+	var w io.Writer = out
+	var bw *bufio.Writer
+	if blockSize := envBytes("OLLAMA_DOWNLOAD_WRITE_BLOCK_SIZE", 0); blockSize > 0 {
+		// hide the file's ReadFrom so the buffer isn't bypassed when it is empty
+		bw = bufio.NewWriterSize(struct{ io.Writer }{out}, int(blockSize))
+		w = bw
+		defer bw.Flush()
+	}
+
+	var body io.Reader = resp.Body
+	if rate := envBytes("OLLAMA_MAX_DOWNLOAD_RATE", 0); rate > 0 {
+		// the limit is shared by all downloads so concurrent pulls don't add up to more than it
+		downloadBucket.setRate(rate)
+		body = &rateLimitedReader{ctx: ctx, r: resp.Body, bucket: downloadBucket}
+	}
+
+	// a background download is limited further until a foreground pull joins it
+	backgroundBody := body
+	if rate := envBytes("OLLAMA_BACKGROUND_DOWNLOAD_RATE", defaultBackgroundDownloadRate); rate > 0 {
+		backgroundBucket.setRate(rate)
+		backgroundBody = &rateLimitedReader{ctx: ctx, r: body, bucket: backgroundBucket}
+	}
+
+	var eof bool
 outerLoop:
 	for {
 		select {
 		case <-ctx.Done():
 			// handle client request cancellation
 			inProgress.Delete(f.Digest)
-			return nil
+
+			// keep what was downloaded so the download resumes from here
+			if bw != nil {
+				bw.Flush()
+			}
+			out.Sync()
+
+			reason := cancelReasonOf(ctx)
+			log.Printf("download of %s stopped (download %s): %s", f.Digest, f.ID, reason)
+			resp := f.progress(fmt.Sprintf("download stopped: %s", reason), api.ProgressStateStopped)
+			resp.CancelReason = reason
+			opts.fn(resp)
+			return cancelCause(ctx)
 		default:
-			opts.fn(api.ProgressResponse{
-				Status:    fmt.Sprintf("downloading %s", f.Digest),
-				Digest:    f.Digest,
-				Total:     int(f.Total),
-				Completed: int(f.Completed),
-			})
-
-			if f.Completed >= f.Total {
+			f.rate.update(f.Completed)
+			opts.fn(f.progress(fmt.Sprintf("downloading %s", f.Digest), api.ProgressStateDownloading))
+
+			if (sized && f.Completed >= f.Total) || (!sized && eof) {
+				if bw != nil {
+					if err := bw.Flush(); err != nil {
+						return err
+					}
+				}
+
+				// the blob is on disk before it's moved into place, so a crash can't leave a truncated blob
+				// under its digest
+				if err := out.Sync(); err != nil {
+					return err
+				}
+
 				if err := out.Close(); err != nil {
 					return err
 				}
 
+				if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); digest != f.Digest {
+					// the data is corrupt, download it again from the start
+					if err := os.Remove(f.FilePath + "-partial"); err != nil {
+						log.Printf("couldn't remove file with digest mismatch '%s': %v", f.FilePath+"-partial", err)
+					}
+
+					return fmt.Errorf("%w: %w: want %s, got %s", errDownload, errDigestMismatch, f.Digest, digest)
+				}
+
 				if err := os.Rename(f.FilePath+"-partial", f.FilePath); err != nil {
-					opts.fn(api.ProgressResponse{
-						Status:    fmt.Sprintf("error renaming file: %v", err),
-						Digest:    f.Digest,
-						Total:     int(f.Total),
-						Completed: int(f.Completed),
-					})
+					opts.fn(f.progress(fmt.Sprintf("error renaming file: %v", err), api.ProgressStateStopped))
 					return err
 				}
 
+				if err := os.Remove(f.FilePath + "-partial.id"); err != nil {
+					log.Printf("couldn't remove download id: %v", err)
+				}
+
+				opts.fn(f.progress(fmt.Sprintf("downloaded %s", f.Digest), api.ProgressStateComplete))
 				break outerLoop
 			}
 		}
 
-		n, err := io.CopyN(out, resp.Body, int64(chunkSize))
+		background := f.background.Load()
+		if background && interactive.busy(quiet) {
+			// a background download makes way for generations, it closes its response and gives up its
+			// connection, then carries on from here with a range request once they've stopped for a while
+			if bw != nil {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+			}
+
+			if err := out.Sync(); err != nil {
+				return err
+			}
+
+			f.rate.reset()
+			opts.fn(f.progress(fmt.Sprintf("paused %s while generating", f.Digest), api.ProgressStatePaused))
+			return errBackgroundPaused
+		}
+
+		if dc.isPaused() {
+			// the speed while paused says nothing about the speed once resumed
+			f.rate.reset()
+			opts.fn(f.progress(fmt.Sprintf("paused %s", f.Digest), api.ProgressStatePaused))
+
+			dc.wait(ctx)
+			continue
+		}
+
+		r := body
+		if background {
+			r = backgroundBody
+		}
+
+		n, err := io.CopyN(io.MultiWriter(w, h), r, int64(chunkSize))
 		if err != nil && !errors.Is(err, io.EOF) {
 			return fmt.Errorf("%w: %w", errDownload, err)
 		}
 		f.Completed += n
+		metrics.downloadBytes.Add(n)
+
+		if errors.Is(err, io.EOF) {
+			eof = true
+			switch {
+			case !sized:
+				f.Total = f.Completed
+			case f.Completed < f.Total:
+				// the connection ended before the whole blob was sent
+				return fmt.Errorf("%w: %w", errDownload, io.ErrUnexpectedEOF)
+			}
+		} else if !sized {
+			// the total isn't known yet, keep it ahead of what has been downloaded so far
+			f.Total = f.Completed + 1
+		}
 
 		inProgress.Store(f.Digest, f)
 	}
 
-	log.Printf("success getting %s\n", f.Digest)
+	log.Printf("success getting %s (download %s)\n", f.Digest, f.ID)
 	return nil
 }
+
+// downloadID returns the id for the download of the blob at fp, the id is kept next to the partial
+// file so the download can be followed across retries, resumes and server restarts
+func downloadID(fp string) (string, error) {
+	idPath := fp + "-partial.id"
+	if bts, err := os.ReadFile(idPath); err == nil && len(bytes.TrimSpace(bts)) > 0 {
+		return string(bytes.TrimSpace(bts)), nil
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(b)
+	if err := os.WriteFile(idPath, []byte(id), 0o644); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
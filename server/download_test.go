@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type flakyResolver struct {
+	failures int
+	calls    int
+}
+
+func (r *flakyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.calls++
+	if r.calls <= r.failures {
+		return nil, &net.DNSError{Err: "temporary failure in name resolution", Name: host, IsTemporary: true}
+	}
+
+	return []net.IP{net.ParseIP("127.0.0.1")}, nil
+}
+
+func TestDownloadBlobRetriesDNSFailure(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &flakyResolver{failures: 1}
+	registryResolver, retryBackoff = r, time.Millisecond
+	defer func() {
+		registryResolver, retryBackoff = net.DefaultResolver, time.Second
+	}()
+
+	mp := ModelPath{
+		ProtocolScheme: "http",
+		Registry:       "dns-retry.test:" + u.Port(),
+		Namespace:      DefaultNamespace,
+		Repository:     "test",
+		Tag:            DefaultTag,
+	}
+
+	if err := downloadBlob(context.Background(), downloadOpts{
+		mp:      mp,
+		digest:  digest,
+		regOpts: &RegistryOptions{Insecure: true},
+		fn:      func(api.ProgressResponse) {},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.calls != 2 {
+		t.Errorf("got %d lookups, want 2", r.calls)
+	}
+
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, blob) {
+		t.Errorf("downloaded blob does not match")
+	}
+}
+
+func TestDownloadBlobDigestMismatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_DOWNLOAD_RETRIES", "0")
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(bytes.ToUpper(blob)))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := ModelPath{
+		ProtocolScheme: "http",
+		Registry:       u.Host,
+		Namespace:      DefaultNamespace,
+		Repository:     "test",
+		Tag:            DefaultTag,
+	}
+
+	err = downloadBlob(context.Background(), downloadOpts{
+		mp:      mp,
+		digest:  digest,
+		regOpts: &RegistryOptions{Insecure: true},
+		fn:      func(api.ProgressResponse) {},
+	})
+	if !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("got %v, want %v", err, errDigestMismatch)
+	}
+
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{fp, fp + "-partial"} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s should not exist: %v", p, err)
+		}
+	}
+}
+
+func TestDownloadBlobConcurrent(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	blob := bytes.Repeat([]byte("ollama"), 1024)
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := downloadOpts{
+		mp: ModelPath{
+			ProtocolScheme: "http",
+			Registry:       u.Host,
+			Namespace:      DefaultNamespace,
+			Repository:     "test",
+			Tag:            DefaultTag,
+		},
+		digest:  digest,
+		regOpts: &RegistryOptions{Insecure: true},
+		fn:      func(api.ProgressResponse) {},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- downloadBlob(context.Background(), opts)
+	}()
+
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+
+	if err := downloadBlob(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestDownloadLayersParallel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_MAX_PARALLEL_LAYERS", "4")
+	t.Setenv("OLLAMA_MAX_DOWNLOAD_CONNECTIONS", "2")
+
+	blobs := make(map[string][]byte)
+	var layers []*Layer
+	for _, s := range []string{"model", "template", "system", "license"} {
+		blob := bytes.Repeat([]byte(s), 1024)
+		digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+		blobs[digest] = blob
+		layers = append(layers, &Layer{Digest: digest, Size: len(blob)})
+	}
+
+	var active, most atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		blob := blobs[r.URL.Path[len("/v2/library/test/blobs/"):]]
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := ModelPath{
+		ProtocolScheme: "http",
+		Registry:       u.Host,
+		Namespace:      DefaultNamespace,
+		Repository:     "test",
+		Tag:            DefaultTag,
+	}
+
+	if err := downloadLayers(context.Background(), mp, layers, &RegistryOptions{Insecure: true}, sequenced(func(api.ProgressResponse) {})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the layers download at once, up to the connection budget
+	if n := most.Load(); n != 2 {
+		t.Errorf("got %d concurrent downloads, want 2", n)
+	}
+
+	for _, layer := range layers {
+		if err := verifyBlob(layer.Digest); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// writeTestKey writes a private key for signing token requests to ~/.ollama/id_ed25519
+func writeTestKey(t *testing.T) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home, _ := os.UserHomeDir()
+	if err := os.MkdirAll(filepath.Join(home, ".ollama"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(home, ".ollama", "id_ed25519"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadLayersShareToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_MAX_PARALLEL_LAYERS", "4")
+	writeTestKey(t)
+
+	blobs := make(map[string][]byte)
+	var layers []*Layer
+	for _, s := range []string{"model", "template", "system", "license"} {
+		blob := bytes.Repeat([]byte(s), 1024)
+		digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+		blobs[digest] = blob
+		layers = append(layers, &Layer{Digest: digest, Size: len(blob)})
+	}
+
+	var tokens atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens.Add(1)
+			json.NewEncoder(w).Encode(api.TokenResponse{Token: "secret"})
+			return
+		}
+
+		// every layer is refused at once, before any of them has a token
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			time.Sleep(10 * time.Millisecond)
+			w.Header().Set("www-authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:library/test:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		blob := blobs[r.URL.Path[len("/v2/library/test/blobs/"):]]
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := ModelPath{
+		ProtocolScheme: "http",
+		Registry:       u.Host,
+		Namespace:      DefaultNamespace,
+		Repository:     "test",
+		Tag:            DefaultTag,
+	}
+
+	if err := downloadLayers(context.Background(), mp, layers, &RegistryOptions{Insecure: true}, sequenced(func(api.ProgressResponse) {})); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := tokens.Load(); n < 1 || int(n) >= len(layers) {
+		t.Errorf("got %d token requests for %d layers refused at once", n, len(layers))
+	}
+
+	for _, layer := range layers {
+		if err := verifyBlob(layer.Digest); err != nil {
+			t.Error(err)
+		}
+	}
+}
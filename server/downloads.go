@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// downloadControl lets a running download be paused, resumed or cancelled through the api
+type downloadControl struct {
+	file   *FileDownload
+	cancel context.CancelCauseFunc
+
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed when a paused download is resumed
+}
+
+var downloadControls sync.Map // map of digests being downloaded to their controls
+
+func (dc *downloadControl) pause() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if !dc.paused {
+		dc.paused = true
+		dc.resumed = make(chan struct{})
+	}
+}
+
+func (dc *downloadControl) resume() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.paused {
+		dc.paused = false
+		close(dc.resumed)
+	}
+}
+
+func (dc *downloadControl) isPaused() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.paused
+}
+
+// wait blocks while the download is paused, it returns early if ctx is done
+func (dc *downloadControl) wait(ctx context.Context) {
+	dc.mu.Lock()
+	paused, resumed := dc.paused, dc.resumed
+	dc.mu.Unlock()
+
+	if paused {
+		select {
+		case <-ctx.Done():
+		case <-resumed:
+		}
+	}
+}
+
+func ListDownloadsHandler(c *gin.Context) {
+	downloads := []api.DownloadResponse{}
+	downloadControls.Range(func(_, v any) bool {
+		dc := v.(*downloadControl)
+		downloads = append(downloads, api.DownloadResponse{
+			Digest:     dc.file.Digest,
+			DownloadID: dc.file.ID,
+			Total:      int(dc.file.Total),
+			Completed:  int(dc.file.Completed),
+			Paused:     dc.isPaused(),
+		})
+		return true
+	})
+
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].Digest < downloads[j].Digest
+	})
+
+	c.JSON(http.StatusOK, api.ListDownloadsResponse{Downloads: downloads})
+}
+
+func PauseDownloadHandler(c *gin.Context) {
+	withDownloadControl(c, (*downloadControl).pause)
+}
+
+func ResumeDownloadHandler(c *gin.Context) {
+	withDownloadControl(c, (*downloadControl).resume)
+}
+
+func CancelDownloadHandler(c *gin.Context) {
+	withDownloadControl(c, func(dc *downloadControl) {
+		dc.cancel(cancelRequested)
+	})
+}
+
+func withDownloadControl(c *gin.Context, fn func(*downloadControl)) {
+	digest := c.Param("digest")
+	v, ok := downloadControls.Load(digest)
+	if !ok {
+		replyError(c, http.StatusNotFound, fmt.Errorf("download '%s' not found", digest))
+		return
+	}
+
+	fn(v.(*downloadControl))
+	c.JSON(http.StatusOK, nil)
+}
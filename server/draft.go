@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// draftLayer returns a layer for a Modelfile's DRAFT, the small model the runner drafts tokens with for the
+// model to check. the draft is a model which has been pulled or created, or a gguf file relative to path. a
+// file layer reads from the open file, close it once the layer is saved
+func draftLayer(path, name string) (*LayerReader, error) {
+	if mf, _, err := GetManifest(ParseModelPath(name)); err == nil {
+		for _, l := range mf.Layers {
+			if l.MediaType != "application/vnd.ollama.image.model" {
+				continue
+			}
+
+			// the draft shares the other model's blob
+			layer, err := GetLayerWithBufferFromLayer(l)
+			if err != nil {
+				return nil, err
+			}
+
+			layer.MediaType = "application/vnd.ollama.image.draft"
+			return layer, nil
+		}
+
+		return nil, fmt.Errorf("draft model %s has no weights", name)
+	}
+
+	fp, err := filenameWithPath(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, fmt.Errorf("draft model %s not found", name)
+	}
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if ggml.Name() != "gguf" {
+		f.Close()
+		return nil, fmt.Errorf("draft models must be gguf, %s is %s", name, ggml.Name())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	layer, err := CreateLayer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	layer.MediaType = "application/vnd.ollama.image.draft"
+	return layer, nil
+}
+
+// draftPath returns the weights of the draft model for a request, the request's draft_model if it has one or
+// the model's DRAFT if not. it's empty if there's neither
+func draftPath(model *Model, name string) (string, error) {
+	if name == "" {
+		return model.DraftPath, nil
+	}
+
+	draft, err := GetModel(name)
+	if err != nil {
+		return "", fmt.Errorf("draft model %s: %w", name, err)
+	}
+
+	return draft.ModelPath, nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDraftLayer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	writeTestModel(t, "draft:latest", []byte("draft weights"))
+
+	layer, err := draftLayer("", "draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, _ := GetSHA256Digest(strings.NewReader("draft weights"))
+	if layer.MediaType != "application/vnd.ollama.image.draft" || layer.Digest != digest {
+		t.Errorf("expected a draft layer for the draft model's weights, got %s %s", layer.MediaType, layer.Digest)
+	}
+
+	if _, err := draftLayer("", "missing"); err == nil {
+		t.Error("expected an error for a missing draft model")
+	}
+
+	// files must be gguf
+	fp := filepath.Join(t.TempDir(), "draft.bin")
+	if err := os.WriteFile(fp, []byte("not a model"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := draftLayer("", fp); err == nil {
+		t.Error("expected an error for a draft file which isn't gguf")
+	}
+}
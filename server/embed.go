@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// embedParallel is how many of a batch's prompts are embedded at once, runners which batch requests take as many
+// as they can batch, others OLLAMA_EMBED_PARALLEL
+func embedParallel(runner llm.LLM) int {
+	if b, ok := runner.(llm.Batcher); ok && b.NumParallel() > 0 {
+		return b.NumParallel()
+	}
+
+	n := envInt("OLLAMA_EMBED_PARALLEL", 1)
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// embedBatch embeds each of prompts with runner, parallel at a time, returning the embeddings in the same order as
+// prompts. fn is called as each one completes, the first error stops the rest
+func embedBatch(ctx context.Context, runner llm.LLM, prompts []string, parallel int, fn func(completed int)) ([][]float64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	embeddings := make([][]float64, len(prompts))
+	next := make(chan int)
+
+	var mu sync.Mutex
+	var completed int
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel && i < len(prompts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				embedding, err := runner.Embedding(ctx, prompts[i])
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					cancel()
+				} else {
+					embeddings[i] = embedding
+					completed++
+					fn(completed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range prompts {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return embeddings, nil
+}
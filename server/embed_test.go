@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeEmbedder struct {
+	fakeLLM
+}
+
+func (f *fakeEmbedder) Embedding(_ context.Context, prompt string) ([]float64, error) {
+	if prompt == "fail" {
+		return nil, errors.New("failed")
+	}
+
+	return []float64{float64(len(prompt))}, nil
+}
+
+func TestEmbedBatch(t *testing.T) {
+	var calls int
+	embeddings, err := embedBatch(context.Background(), &fakeEmbedder{}, []string{"a", "bbb", "cc", "dddd"}, 3, func(int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []float64{1, 3, 2, 4} {
+		if embeddings[i][0] != want {
+			t.Errorf("embedding %d: got %v, want %v", i, embeddings[i][0], want)
+		}
+	}
+
+	if calls != 4 {
+		t.Errorf("expected progress for each prompt, got %d", calls)
+	}
+
+	if _, err := embedBatch(context.Background(), &fakeEmbedder{}, []string{"a", "fail", "b"}, 2, func(int) {}); err == nil {
+		t.Error("expected an error")
+	}
+}
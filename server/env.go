@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// envInt returns the integer value of the environment variable key, or fallback if it is unset or invalid
+func envInt(key string, fallback int) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("invalid value for %s: %q, using %d", key, s, fallback)
+		return fallback
+	}
+
+	return n
+}
+
+// envBytes returns the size in bytes of the environment variable key, e.g. "4MB" or "4194304", or fallback if it is unset or invalid
+func envBytes(key string, fallback uint64) uint64 {
+	s := os.Getenv(key)
+	if s == "" {
+		return fallback
+	}
+
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		log.Printf("invalid value for %s: %q, using %d", key, s, fallback)
+		return fallback
+	}
+
+	return n
+}
+
+// envDuration returns the duration of the environment variable key, e.g. "30s", "5m" or "90d", or fallback if it is
+// unset or invalid
+func envDuration(key string, fallback time.Duration) time.Duration {
+	s := os.Getenv(key)
+	if s == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(s)
+	if days, derr := strconv.Atoi(strings.TrimSuffix(s, "d")); err != nil && strings.HasSuffix(s, "d") && derr == nil {
+		d, err = time.Duration(days)*24*time.Hour, nil
+	}
+	if err != nil || d < 0 {
+		log.Printf("invalid value for %s: %q, using %s", key, s, fallback)
+		return fallback
+	}
+
+	return d
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// codedError is an error with the api.ErrorCode clients see it as, and the details of what failed
+type codedError struct {
+	code    api.ErrorCode
+	details map[string]any
+	err     error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withCode gives err a code, and details such as the digest of a failed download, for its error response
+func withCode(code api.ErrorCode, err error, details map[string]any) error {
+	return &codedError{code: code, details: details, err: err}
+}
+
+// errModelNotFound is the error of a request for a model which isn't local
+func errModelNotFound(name string) error {
+	return withCode(api.CodeModelNotFound, fmt.Errorf("model '%s' not found", name), map[string]any{"model": name})
+}
+
+// errModelNotPulled is errModelNotFound for a request to run the model
+func errModelNotPulled(name string) error {
+	return withCode(api.CodeModelNotFound, fmt.Errorf("model '%s' not found, try pulling it first", name), map[string]any{"model": name})
+}
+
+// registryError is the error of a registry responding to op with status, an unauthorized response has
+// api.CodeRegistryUnauthorized so clients can tell it apart
+func registryError(op string, status int, body []byte) error {
+	err := fmt.Errorf("on %s registry responded with code %d: %s", op, status, body)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return withCode(api.CodeRegistryUnauthorized, err, nil)
+	}
+
+	return err
+}
+
+// statusCodes are the codes of errors without their own, by the status they're replied to with
+var statusCodes = map[int]api.ErrorCode{
+	http.StatusBadRequest:            api.CodeInvalidRequest,
+	http.StatusUnauthorized:          api.CodeUnauthorized,
+	http.StatusForbidden:             api.CodeForbidden,
+	http.StatusNotFound:              api.CodeNotFound,
+	http.StatusConflict:              api.CodeConflict,
+	http.StatusRequestEntityTooLarge: api.CodeLimitExceeded,
+	http.StatusTooManyRequests:       api.CodeTooManyRequests,
+	http.StatusServiceUnavailable:    api.CodeServerBusy,
+	http.StatusGatewayTimeout:        api.CodeTimeout,
+}
+
+// errorCode returns the code of err, replied to with status. errors in a stream have a status of 0
+func errorCode(status int, err error) (api.ErrorCode, map[string]any) {
+	var cerr *codedError
+	var lerr *limitError
+	var reason cancelReason
+	switch {
+	case errors.As(err, &cerr):
+		return cerr.code, cerr.details
+	case errors.As(err, &lerr):
+		status = lerr.code
+	case errors.Is(err, cancelRequestTimeout):
+		return api.CodeTimeout, nil
+	case errors.As(err, &reason):
+		return api.CodeCancelled, nil
+	case errors.Is(err, llm.ErrInsufficientMemory):
+		return api.CodeInsufficientMemory, nil
+	case errors.Is(err, errQueueFull):
+		return api.CodeServerBusy, nil
+	case errors.Is(err, errReadOnlyModel):
+		return api.CodeModelReadOnly, nil
+	}
+
+	if code, ok := statusCodes[status]; ok {
+		return code, nil
+	}
+
+	return api.CodeInternal, nil
+}
+
+// errorResponse is the body of an error replied to with status, {"error": message} with the error's code and
+// details
+func errorResponse(status int, err error) gin.H {
+	code, details := errorCode(status, err)
+	resp := gin.H{"error": err.Error(), "code": code}
+	if details != nil {
+		resp["details"] = details
+	}
+
+	return resp
+}
+
+// replyError replies to c with err and status
+func replyError(c *gin.Context, status int, err error) {
+	c.JSON(status, errorResponse(status, err))
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestErrorCodes(t *testing.T) {
+	cases := []struct {
+		status int
+		err    error
+		code   api.ErrorCode
+	}{
+		{http.StatusBadRequest, errors.New("bad"), api.CodeInvalidRequest},
+		{http.StatusNotFound, errModelNotFound("llama2"), api.CodeModelNotFound},
+		{http.StatusServiceUnavailable, errQueueFull, api.CodeServerBusy},
+		{0, fmt.Errorf("generation stopped: %w", cancelRequested), api.CodeCancelled},
+		{0, fmt.Errorf("generation stopped: %w", cancelRequestTimeout), api.CodeTimeout},
+		{0, &limitError{http.StatusRequestEntityTooLarge, "too long"}, api.CodeLimitExceeded},
+		{0, registryError("pull", http.StatusUnauthorized, nil), api.CodeRegistryUnauthorized},
+		{0, registryError("pull", http.StatusBadGateway, nil), api.CodeInternal},
+		{0, errors.New("something else"), api.CodeInternal},
+	}
+
+	for _, tt := range cases {
+		if code, _ := errorCode(tt.status, tt.err); code != tt.code {
+			t.Errorf("%v: got %s, want %s", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestDownloadErrorDetails(t *testing.T) {
+	err := downloadError(context.Background(), fmt.Errorf("%w: connection reset", errDownload), "sha256:abc", 4096)
+	if !errors.Is(err, errDownload) {
+		t.Errorf("expected the download error to be wrapped")
+	}
+
+	bts, err := json.Marshal(errorResponse(0, err))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client sees the same error, with the digest and offset to resume from
+	var resp api.StatusError
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Code != api.CodeDownloadFailed || resp.Details["digest"] != "sha256:abc" || resp.Details["offset"] != 4096.0 {
+		t.Errorf("got %s", bts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := downloadError(ctx, context.Canceled, "sha256:abc", 0); err != context.Canceled {
+		t.Errorf("expected a cancelled download not to fail, got %v", err)
+	}
+}
+
+func TestModelNotFoundResponse(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model": "missing"}`))
+	GenerateHandler(c)
+
+	var resp api.StatusError
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	resp.StatusCode = w.Code
+	if !errors.Is(resp, api.ErrModelNotFound) || resp.Code != api.CodeModelNotFound {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOpenAIModelNotFoundResponse(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model": "missing", "messages": [{"role": "user", "content": "hi"}]}`))
+	OpenAIChatCompletionsHandler(c)
+
+	var resp openAIErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same error as the native api
+	if w.Code != http.StatusNotFound || resp.Error.Code != api.CodeModelNotFound || resp.Error.Message != errModelNotFound("missing").Error() {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCreateModelBindError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/create", strings.NewReader(`{"name": `))
+	CreateModelHandler(c)
+
+	var resp api.StatusError
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusBadRequest || resp.Code != api.CodeInvalidRequest || resp.ErrorMessage == "" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const (
+	eventModelPulled          = "model.pulled"
+	eventModelPullFailed      = "model.pull_failed"
+	eventModelUpdateAvailable = "model.update_available"
+	eventModelLoaded          = "model.loaded"
+	eventModelUnloaded        = "model.unloaded"
+	eventGenerationStarted    = "generation.started"
+	eventGenerationFinished   = "generation.finished"
+	eventDiskLow              = "disk.low"
+	eventModelUnused          = "model.unused"
+)
+
+// eventBus sends events to each of its subscribers. a subscriber which falls behind misses events rather than
+// holding up the server
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan api.Event]struct{}
+	done        chan struct{} // closed when the server shuts down, to end the event streams
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan api.Event]struct{}), done: make(chan struct{})}
+}
+
+var events = newEventBus()
+
+func (b *eventBus) publish(e api.Event) {
+	e.Time = time.Now().UTC()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of events, call the returned func to stop receiving them
+func (b *eventBus) subscribe(size int) (chan api.Event, func()) {
+	ch := make(chan api.Event, size)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+// close ends the event streams so they don't hold up the server shutting down, webhooks still get events
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+}
+
+// startWebhooks posts every event to each of the comma separated urls in OLLAMA_WEBHOOKS
+func startWebhooks() {
+	for _, u := range strings.Split(os.Getenv("OLLAMA_WEBHOOKS"), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+
+		log.Printf("sending events to webhook %s", u)
+		ch, _ := events.subscribe(64)
+		go func(u string) {
+			client := http.Client{Timeout: 10 * time.Second}
+			for e := range ch {
+				if err := postWebhook(&client, u, e); err != nil {
+					log.Printf("webhook %s: %v", u, err)
+				}
+			}
+		}(u)
+	}
+}
+
+// postWebhook posts e to u, trying a few times if it fails
+func postWebhook(client *http.Client, u string, e api.Event) error {
+	bts, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for try := 1; ; try++ {
+		err = func() error {
+			resp, err := client.Post(u, "application/json", bytes.NewReader(bts))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+
+			if resp.StatusCode >= http.StatusBadRequest {
+				return fmt.Errorf("%s: %s", e.Type, resp.Status)
+			}
+
+			return nil
+		}()
+		if err == nil || try == 3 {
+			return err
+		}
+
+		time.Sleep(time.Duration(try) * time.Second)
+	}
+}
+
+func generationStarted(model, id string) {
+	events.publish(api.Event{Type: eventGenerationStarted, Model: model, ID: id, Text: fmt.Sprintf("%s started generating", model)})
+}
+
+func generationFinished(model, id string, m api.Metrics) {
+	recordTokens(model, m)
+	events.publish(api.Event{
+		Type:  eventGenerationFinished,
+		Model: model,
+		ID:    id,
+		Data: map[string]any{
+			"prompt_eval_count": m.PromptEvalCount,
+			"eval_count":        m.EvalCount,
+			"total_duration":    m.TotalDuration,
+		},
+		Text: fmt.Sprintf("%s generated %d tokens in %s", model, m.EvalCount, m.TotalDuration.Round(time.Millisecond)),
+	})
+}
+
+// EventsHandler streams events as they happen as server-sent events. types, a comma separated list, only
+// streams events of those types
+func EventsHandler(c *gin.Context) {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(c.Query("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+
+	ch, unsubscribe := events.subscribe(64)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-ch:
+			if len(types) > 0 && !types[e.Type] {
+				return true
+			}
+
+			bts, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("events: json.Marshal failed with %s", err)
+				return false
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, bts); err != nil {
+				return false
+			}
+
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-events.done:
+			return false
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestEventsHandler(t *testing.T) {
+	r := gin.New()
+	r.GET("/api/events", EventsHandler)
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/events?types=model.pulled", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the subscription is made before the headers are sent
+	events.publish(api.Event{Type: eventModelLoaded, Model: "skipped"})
+	events.publish(api.Event{Type: eventModelPulled, Model: "llama2", Text: "pulled llama2"})
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for len(lines) < 2 && scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) != 2 || lines[0] != "event: model.pulled" {
+		t.Fatalf("unexpected events %q", lines)
+	}
+
+	var e api.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Model != "llama2" || e.Time.IsZero() {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	var tries int
+	got := make(chan api.Event, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var e api.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		got <- e
+	}))
+	defer s.Close()
+
+	client := http.Client{Timeout: time.Second}
+	if err := postWebhook(&client, s.URL, api.Event{Type: eventDiskLow, Text: "low on disk space"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-got; e.Type != eventDiskLow || e.Text != "low on disk space" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestEventsEndOnShutdown(t *testing.T) {
+	old := events
+	events = newEventBus()
+	defer func() { events = old }()
+
+	r := gin.New()
+	r.GET("/api/events", EventsHandler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &http.Server{Handler: r}
+	s.RegisterOnShutdown(events.close)
+	go s.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// the stream ends rather than holding up shutdown until its timeout
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown waited for the event stream: %v", err)
+	}
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
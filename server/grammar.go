@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// jsonGrammar constrains output to a json object, the same as llama.cpp's grammars/json.gbnf
+const jsonGrammar = `root   ::= object
+value  ::= object | array | string | number | ("true" | "false" | "null") ws
+
+object ::=
+  "{" ws (
+            string ":" ws value
+    ("," ws string ":" ws value)*
+  )? "}" ws
+
+array  ::=
+  "[" ws (
+            value
+    ("," ws value)*
+  )? "]" ws
+
+string ::=
+  "\"" (
+    [^"\\] |
+    "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])
+  )* "\"" ws
+
+number ::= ("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+
+ws ::= ([ \t\n] ws)?
+`
+
+// requestGrammar returns the grammar to constrain a request's output to, from whichever of its format, grammar or
+// json schema is set. it's empty if none of them are
+func requestGrammar(format, grammar string, schema json.RawMessage) (string, error) {
+	var set []string
+	if format != "" {
+		set = append(set, "format")
+	}
+	if grammar != "" {
+		set = append(set, "grammar")
+	}
+	if len(schema) > 0 {
+		set = append(set, "json_schema")
+	}
+
+	if len(set) > 1 {
+		return "", fmt.Errorf("only one of format, grammar and json_schema can be set, got %s", strings.Join(set, " and "))
+	}
+
+	switch {
+	case format == "json":
+		return jsonGrammar, nil
+	case format != "":
+		return "", fmt.Errorf("unsupported format %q, the only format is json", format)
+	case len(schema) > 0:
+		return schemaGrammar(schema)
+	}
+
+	return grammar, nil
+}
+
+var grammarPrimitives = map[string]string{
+	"boolean": `("true" | "false") space`,
+	"number":  `("-"? ([0-9] | [1-9] [0-9]*)) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`,
+	"integer": `("-"? ([0-9] | [1-9] [0-9]*)) space`,
+	"string":  `"\"" ([^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]))* "\"" space`,
+	"null":    `"null" space`,
+}
+
+// a schema without a type matches any json value
+const grammarValue = `object | array | string | number | boolean | null`
+
+type jsonSchema struct {
+	Type       json.RawMessage   `json:"type"`
+	Properties json.RawMessage   `json:"properties"`
+	Items      json.RawMessage   `json:"items"`
+	Enum       []json.RawMessage `json:"enum"`
+	Const      json.RawMessage   `json:"const"`
+	OneOf      []json.RawMessage `json:"oneOf"`
+	AnyOf      []json.RawMessage `json:"anyOf"`
+}
+
+type grammarBuilder struct {
+	rules map[string]string
+}
+
+// schemaGrammar converts a json schema to a gbnf grammar, in the same way as llama.cpp's json-schema-to-grammar.py.
+// objects have each of their properties, in the order the schema lists them
+func schemaGrammar(schema json.RawMessage) (string, error) {
+	g := grammarBuilder{rules: map[string]string{"space": `" "?`}}
+	if _, err := g.visit(schema, "root"); err != nil {
+		return "", err
+	}
+
+	var names []string
+	for name := range g.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, g.rules[name])
+	}
+
+	return sb.String(), nil
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// add adds rule as name, returning the name it was added as. rules with the same name are numbered
+func (g *grammarBuilder) add(name, rule string) string {
+	name = invalidRuleChars.ReplaceAllString(name, "-")
+	key := name
+	for i := 0; ; i++ {
+		if i > 0 {
+			key = fmt.Sprintf("%s%d", name, i)
+		}
+
+		if existing, ok := g.rules[key]; !ok || existing == rule {
+			break
+		}
+	}
+
+	g.rules[key] = rule
+	return key
+}
+
+func (g *grammarBuilder) visit(raw json.RawMessage, name string) (string, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return "", fmt.Errorf("invalid json schema: %w", err)
+	}
+
+	ruleName := name
+	if ruleName == "" {
+		ruleName = "root"
+	}
+
+	switch {
+	case len(schema.OneOf) > 0 || len(schema.AnyOf) > 0:
+		var alts []string
+		for i, s := range append(schema.OneOf, schema.AnyOf...) {
+			alt, err := g.visit(s, fmt.Sprintf("%s-%d", name, i))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+
+		return g.add(ruleName, strings.Join(alts, " | ")), nil
+	case len(schema.Const) > 0:
+		lit, err := grammarLiteral(schema.Const)
+		if err != nil {
+			return "", err
+		}
+
+		return g.add(ruleName, lit), nil
+	case len(schema.Enum) > 0:
+		var alts []string
+		for _, v := range schema.Enum {
+			lit, err := grammarLiteral(v)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, lit)
+		}
+
+		return g.add(ruleName, strings.Join(alts, " | ")), nil
+	}
+
+	types, err := schemaTypes(schema.Type)
+	if err != nil {
+		return "", err
+	}
+
+	if len(types) > 1 {
+		var alts []string
+		for _, t := range types {
+			alt, err := g.visitType(schema, t, fmt.Sprintf("%s-%s", name, t))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+
+		return g.add(ruleName, strings.Join(alts, " | ")), nil
+	}
+
+	var t string
+	if len(types) == 1 {
+		t = types[0]
+	}
+
+	return g.visitType(schema, t, ruleName)
+}
+
+func (g *grammarBuilder) visitType(schema jsonSchema, t, name string) (string, error) {
+	switch t {
+	case "object":
+		if len(schema.Properties) == 0 {
+			break
+		}
+
+		keys, props, err := orderedProperties(schema.Properties)
+		if err != nil {
+			return "", err
+		}
+
+		rule := `"{" space`
+		for i, key := range keys {
+			prop, err := g.visit(props[key], fmt.Sprintf("%s-%s", name, key))
+			if err != nil {
+				return "", err
+			}
+
+			k, err := json.Marshal(key)
+			if err != nil {
+				return "", err
+			}
+
+			lit, err := grammarLiteral(k)
+			if err != nil {
+				return "", err
+			}
+
+			if i > 0 {
+				rule += ` "," space`
+			}
+			rule += fmt.Sprintf(` %s ":" space %s`, lit, prop)
+		}
+		rule += ` "}" space`
+
+		return g.add(name, rule), nil
+	case "array":
+		if len(schema.Items) == 0 {
+			break
+		}
+
+		item, err := g.visit(schema.Items, fmt.Sprintf("%s-item", name))
+		if err != nil {
+			return "", err
+		}
+
+		return g.add(name, fmt.Sprintf(`"[" space (%s ("," space %s)*)? "]" space`, item, item)), nil
+	case "":
+		g.addValue()
+		return g.add(name, grammarValue), nil
+	}
+
+	if t == "object" || t == "array" {
+		g.addValue()
+		return g.add(name, t), nil
+	}
+
+	rule, ok := grammarPrimitives[t]
+	if !ok {
+		return "", fmt.Errorf("unsupported json schema type %q", t)
+	}
+
+	g.rules[t] = rule
+	if name == "root" {
+		return g.add(name, t), nil
+	}
+
+	return t, nil
+}
+
+// addValue adds the rules for any json value, for schemas which don't say what they contain
+func (g *grammarBuilder) addValue() {
+	for t, rule := range grammarPrimitives {
+		g.rules[t] = rule
+	}
+
+	g.rules["object"] = `"{" space (string ":" space value ("," space string ":" space value)*)? "}" space`
+	g.rules["array"] = `"[" space (value ("," space value)*)? "]" space`
+	g.rules["value"] = grammarValue
+}
+
+// schemaTypes reads a schema's type, which is either a single type or a list of them
+func schemaTypes(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var t string
+	if err := json.Unmarshal(raw, &t); err == nil {
+		return []string{t}, nil
+	}
+
+	var ts []string
+	if err := json.Unmarshal(raw, &ts); err != nil {
+		return nil, errors.New("invalid json schema: type must be a string or a list of strings")
+	}
+
+	return ts, nil
+}
+
+// orderedProperties reads the properties of an object schema, keeping the order they are listed in
+func orderedProperties(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	props := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return nil, nil, fmt.Errorf("invalid json schema: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := d.Token(); err != nil {
+		return nil, nil, err
+	}
+
+	var keys []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, t.(string))
+
+		// skip the property's schema
+		var skip json.RawMessage
+		if err := d.Decode(&skip); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return keys, props, nil
+}
+
+// grammarLiteral returns a gbnf literal matching the json value v
+func grammarLiteral(v json.RawMessage) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, v); err != nil {
+		return "", err
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`, "\n", `\n`)
+	return fmt.Sprintf(`"%s" space`, r.Replace(b.String())), nil
+}
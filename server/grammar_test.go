@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSchemaGrammar(t *testing.T) {
+	g, err := schemaGrammar([]byte(`{"type": "object", "properties": {"name": {"type": "string"}, "size": {"enum": ["small", "large"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `root ::= "{" space "\"name\"" space ":" space string "," space "\"size\"" space ":" space root-size "}" space
+root-size ::= "\"small\"" space | "\"large\"" space
+space ::= " "?
+string ::= "\"" ([^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F]))* "\"" space
+`
+	if g != want {
+		t.Errorf("got\n%s\nwant\n%s", g, want)
+	}
+
+	if _, err := schemaGrammar([]byte(`{"type": "date"}`)); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
+
+func TestRequestGrammar(t *testing.T) {
+	if g, err := requestGrammar("json", "", nil); err != nil || g != jsonGrammar {
+		t.Errorf("expected the json grammar, got %q, %v", g, err)
+	}
+
+	if _, err := requestGrammar("yaml", "", nil); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+
+	if _, err := requestGrammar("json", `root ::= "a"`, nil); err == nil {
+		t.Error("expected an error for both a format and a grammar")
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// the server's limits keep one client from wedging a shared server, they're off unless they're set:
+//
+//	OLLAMA_MAX_PREDICT         the most tokens a request can generate
+//	OLLAMA_MAX_PROMPT_TOKENS   the most tokens a request's prompt can have
+//	OLLAMA_REQUEST_TIMEOUT     how long a generation can take, including waiting for the model
+//	OLLAMA_MAX_CLIENT_STREAMS  how many generations a client ip can run at once
+
+const cancelRequestTimeout cancelReason = "request timed out"
+
+// limitError is a request over one of the server's limits, it's replied to with code if nothing has been streamed
+// yet, and with an error response like other errors
+type limitError struct {
+	code    int
+	message string
+}
+
+func (e *limitError) Error() string {
+	return e.message
+}
+
+func (e *limitError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(errorResponse(e.code, e))
+}
+
+// checkPredictLimit returns a limitError if the request's options ask for more tokens than OLLAMA_MAX_PREDICT,
+// asking for as many tokens as the model generates counts as asking for more
+func checkPredictLimit(opts map[string]interface{}) error {
+	limit := envInt("OLLAMA_MAX_PREDICT", 0)
+	if limit <= 0 {
+		return nil
+	}
+
+	var n int
+	switch v := opts["num_predict"].(type) {
+	case float64:
+		n = int(v)
+	case int:
+		n = v
+	default:
+		return nil
+	}
+
+	if n < 0 || n > limit {
+		return &limitError{http.StatusRequestEntityTooLarge, fmt.Sprintf("num_predict %d is more than the server's limit of %d tokens", n, limit)}
+	}
+
+	return nil
+}
+
+// capPredict limits the tokens generated with opts to OLLAMA_MAX_PREDICT
+func capPredict(opts *api.Options) {
+	if limit := envInt("OLLAMA_MAX_PREDICT", 0); limit > 0 && (opts.NumPredict <= 0 || opts.NumPredict > limit) {
+		opts.NumPredict = limit
+	}
+}
+
+// checkPromptLimit returns a limitError if the prompt, following the context tokens of an earlier response, has
+// more tokens than OLLAMA_MAX_PROMPT_TOKENS
+func checkPromptLimit(ctx context.Context, runner llm.LLM, prompt string, contextTokens int) error {
+	limit := envInt("OLLAMA_MAX_PROMPT_TOKENS", 0)
+	if limit <= 0 {
+		return nil
+	}
+
+	// a token is at least a byte, so a short prompt doesn't need tokenizing. one more is left for the bos token
+	n := contextTokens + len(prompt) + 1
+	if n > limit {
+		tokens, err := runner.Encode(ctx, prompt)
+		if err != nil {
+			return err
+		}
+
+		n = contextTokens + len(tokens)
+	}
+
+	if n > limit {
+		return &limitError{http.StatusRequestEntityTooLarge, fmt.Sprintf("the prompt is %d tokens, more than the server's limit of %d", n, limit)}
+	}
+
+	return nil
+}
+
+// withRequestTimeout returns a context which is cancelled with cancelRequestTimeout once OLLAMA_REQUEST_TIMEOUT
+// has passed
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timeout := envDuration("OLLAMA_REQUEST_TIMEOUT", 0)
+	if timeout <= 0 {
+		return ctx, cancel
+	}
+
+	t := time.AfterFunc(timeout, func() { cancel(cancelRequestTimeout) })
+	return ctx, func(cause error) {
+		t.Stop()
+		cancel(cause)
+	}
+}
+
+// limitRequestTime is the middleware of the openai routes, whose generations aren't tracked, it cancels the
+// request's context once OLLAMA_REQUEST_TIMEOUT has passed
+func limitRequestTime(c *gin.Context) {
+	ctx, stop := withRequestTimeout(c.Request.Context())
+	defer stop(nil)
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// timedOut reports whether ctx was cancelled by OLLAMA_REQUEST_TIMEOUT
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), cancelRequestTimeout)
+}
+
+// trustProxies sets the proxies whose X-Forwarded-For and X-Real-IP headers give the client ip, from the comma
+// separated addresses or cidrs of OLLAMA_TRUSTED_PROXIES. by default none are trusted and the client ip is the
+// address the request came from, so clients can't pick their own ip for limits and the audit log
+func trustProxies(r *gin.Engine) error {
+	var proxies []string
+	for _, s := range strings.Split(os.Getenv("OLLAMA_TRUSTED_PROXIES"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			proxies = append(proxies, s)
+		}
+	}
+
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("OLLAMA_TRUSTED_PROXIES: %w", err)
+	}
+
+	return nil
+}
+
+// clientStreams counts the generations running for each client ip
+var clientStreams = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// limitClientStreams is the middleware of the generation routes, it replies with a 429 to a client which
+// already has OLLAMA_MAX_CLIENT_STREAMS generations running
+func limitClientStreams(c *gin.Context) {
+	limit := envInt("OLLAMA_MAX_CLIENT_STREAMS", 0)
+	if limit <= 0 {
+		c.Next()
+		return
+	}
+
+	ip := c.ClientIP()
+	clientStreams.Lock()
+	if clientStreams.m[ip] >= limit {
+		clientStreams.Unlock()
+
+		err := fmt.Errorf("too many requests from %s, at most %d can run at once", ip, limit)
+		if strings.HasPrefix(c.FullPath(), "/v1/") {
+			openAIAbort(c, http.StatusTooManyRequests, err)
+		} else {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, errorResponse(http.StatusTooManyRequests, err))
+		}
+		return
+	}
+
+	clientStreams.m[ip]++
+	clientStreams.Unlock()
+
+	defer func() {
+		clientStreams.Lock()
+		defer clientStreams.Unlock()
+
+		clientStreams.m[ip]--
+		if clientStreams.m[ip] == 0 {
+			delete(clientStreams.m, ip)
+		}
+	}()
+
+	c.Next()
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestPredictLimit(t *testing.T) {
+	if err := checkPredictLimit(map[string]interface{}{"num_predict": 100000.0}); err != nil {
+		t.Fatalf("expected no limit by default, got %v", err)
+	}
+
+	t.Setenv("OLLAMA_MAX_PREDICT", "512")
+	for n, over := range map[float64]bool{128: false, 512: false, 513: true, -1: true} {
+		var lerr *limitError
+		err := checkPredictLimit(map[string]interface{}{"num_predict": n})
+		if errors.As(err, &lerr) != over {
+			t.Errorf("num_predict %v: got %v", n, err)
+		} else if over && lerr.code != http.StatusRequestEntityTooLarge {
+			t.Errorf("num_predict %v: got %d", n, lerr.code)
+		}
+	}
+
+	// a model's own num_predict is capped rather than refused
+	for n, want := range map[int]int{-1: 512, 0: 512, 128: 128, 4096: 512} {
+		opts := api.Options{NumPredict: n}
+		capPredict(&opts)
+		if opts.NumPredict != want {
+			t.Errorf("num_predict %d: got %d, want %d", n, opts.NumPredict, want)
+		}
+	}
+}
+
+func TestClientStreamsLimit(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_CLIENT_STREAMS", "1")
+	gin.SetMode(gin.TestMode)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	r.POST("/api/generate", limitClientStreams, func(c *gin.Context) {
+		close(started)
+		<-finish
+	})
+
+	first := httptest.NewRecorder()
+	go r.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+
+	close(finish)
+	for i := 0; ; i++ {
+		clientStreams.Lock()
+		n := len(clientStreams.m)
+		clientStreams.Unlock()
+		if n == 0 {
+			break
+		} else if i == 100 {
+			t.Fatal("expected the first request to be counted out once it finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientStreamsIgnoreForwardedFor(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_CLIENT_STREAMS", "1")
+	gin.SetMode(gin.TestMode)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	r := gin.New()
+	if err := trustProxies(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r.POST("/api/generate", limitClientStreams, func(c *gin.Context) {
+		close(started)
+		<-finish
+	})
+	defer close(finish)
+
+	request := func(forwardedFor string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		return req
+	}
+
+	go r.ServeHTTP(httptest.NewRecorder(), request("10.0.0.1"))
+	<-started
+
+	// a client can't get around its limit by claiming to be someone else
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request("10.0.0.2"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Setenv("OLLAMA_REQUEST_TIMEOUT", "10ms")
+
+	ctx, done, err := trackGeneration(context.Background(), "timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the generation to time out")
+	}
+
+	if reason := cancelReasonOf(ctx); reason != string(cancelRequestTimeout) {
+		t.Errorf("got %q, want %q", reason, cancelRequestTimeout)
+	}
+}
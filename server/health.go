@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// defaultMinFreeDisk is the free space the blobs directory needs for the server to be ready, override it with
+// OLLAMA_MIN_FREE_DISK
+const defaultMinFreeDisk = 1 << 30
+
+// HealthHandler is the liveness probe, the server is alive for as long as it answers
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.HealthResponse{Status: api.HealthStatusOK})
+}
+
+// ReadyHandler is the readiness probe, the server is ready once every component requests need is working. it
+// replies with a 503 and the failing components if it isn't
+func ReadyHandler(c *gin.Context) {
+	resp := api.HealthResponse{
+		Status: api.HealthStatusOK,
+		Components: map[string]api.ComponentStatus{
+			"blobs":   componentStatus(checkBlobStore()),
+			"runners": componentStatus(checkRunners()),
+			"gpu":     componentStatus(checkGPU()),
+			"disk":    componentStatus(checkDisk()),
+		},
+	}
+
+	code := http.StatusOK
+	for _, s := range resp.Components {
+		if s.Status != api.HealthStatusOK {
+			resp.Status = api.HealthStatusFailing
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(code, resp)
+}
+
+// componentStatus is the status of a component from its check, message describes a working component
+func componentStatus(message string, err error) api.ComponentStatus {
+	if err != nil {
+		return api.ComponentStatus{Status: api.HealthStatusFailing, Message: err.Error()}
+	}
+
+	return api.ComponentStatus{Status: api.HealthStatusOK, Message: message}
+}
+
+// checkBlobStore writes a file to the blobs directory, pulls and creates fail if it isn't writable
+func checkBlobStore() (string, error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, ".ready-*")
+	if err != nil {
+		return "", fmt.Errorf("%s isn't writable: %w", dir, err)
+	}
+
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func checkRunners() (string, error) {
+	runners := llm.AvailableRunners()
+	if len(runners) == 0 {
+		return "", fmt.Errorf("ollama was built without a llama runner for %s", runtime.GOOS)
+	}
+
+	return strings.Join(runners, ", "), nil
+}
+
+// gpuCheckInterval is how long the result of checking the GPUs is kept, so frequent readiness probes don't
+// each run nvidia-smi
+const gpuCheckInterval = 30 * time.Second
+
+var gpuCheck struct {
+	sync.Mutex
+	at      time.Time
+	message string
+	err     error
+}
+
+// checkGPU returns the result of findGPUs, checking again once it's older than gpuCheckInterval
+func checkGPU() (string, error) {
+	gpuCheck.Lock()
+	defer gpuCheck.Unlock()
+
+	if gpuCheck.at.IsZero() || time.Since(gpuCheck.at) > gpuCheckInterval {
+		gpuCheck.message, gpuCheck.err = findGPUs()
+		gpuCheck.at = time.Now()
+	}
+
+	return gpuCheck.message, gpuCheck.err
+}
+
+// findGPUs finds the GPUs models are offloaded to. a server without GPUs is ready to run models on the CPU,
+// but not one whose nvidia driver is installed and doesn't find any
+func findGPUs() (string, error) {
+	if runtime.GOOS == "darwin" {
+		return "metal", nil
+	}
+
+	gpus, err := llm.GPUs()
+	if err != nil {
+		return "", err
+	}
+
+	if len(gpus) == 0 {
+		if _, err := exec.LookPath("nvidia-smi"); err == nil {
+			return "", fmt.Errorf("nvidia-smi didn't find any GPUs, the driver may not be loaded")
+		}
+
+		return "no GPUs, models run on the CPU", nil
+	}
+
+	names := make([]string, len(gpus))
+	for i, gpu := range gpus {
+		names[i] = gpu.Name
+	}
+
+	return strings.Join(names, ", "), nil
+}
+
+// checkDisk checks the blobs directory has room to pull models into
+func checkDisk() (string, error) {
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return "", err
+	}
+
+	have, err := freeSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get free disk space for %s: %w", dir, err)
+	}
+
+	need := envBytes("OLLAMA_MIN_FREE_DISK", defaultMinFreeDisk)
+	if have < need {
+		return "", fmt.Errorf("%s has %s free, it needs at least %s", dir, humanize.Bytes(have), humanize.Bytes(need))
+	}
+
+	return fmt.Sprintf("%s free", humanize.Bytes(have)), nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestReadyHandler(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	gin.SetMode(gin.TestMode)
+
+	ready := func() (int, api.HealthResponse) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/ready", nil)
+		ReadyHandler(c)
+
+		var resp api.HealthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code, resp
+	}
+
+	t.Setenv("OLLAMA_MIN_FREE_DISK", "0")
+	_, resp := ready()
+	for _, name := range []string{"blobs", "disk"} {
+		if s := resp.Components[name]; s.Status != api.HealthStatusOK {
+			t.Errorf("expected %s to be ok, got %+v", name, s)
+		}
+	}
+
+	// no disk has this much free
+	t.Setenv("OLLAMA_MIN_FREE_DISK", "1000PB")
+	code, resp := ready()
+	if code != http.StatusServiceUnavailable || resp.Status != api.HealthStatusFailing {
+		t.Errorf("expected the server not to be ready, got %d %s", code, resp.Status)
+	}
+
+	if s := resp.Components["disk"]; s.Status != api.HealthStatusFailing || s.Message == "" {
+		t.Errorf("expected the disk to be failing, got %+v", s)
+	}
+}
+
+func TestCheckGPUCached(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("nvidia-smi is faked with a shell script")
+	}
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho >> %s\necho '0, NVIDIA A100, 40960, 40000'\n", calls)
+	if err := os.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	gpuCheck.at = time.Time{}
+	defer func() { gpuCheck.at = time.Time{} }()
+
+	for i := 0; i < 3; i++ {
+		if message, err := checkGPU(); err != nil || message != "NVIDIA A100" {
+			t.Fatalf("got %q, %v, want the A100", message, err)
+		}
+	}
+
+	if bts, _ := os.ReadFile(calls); len(bts) != 1 {
+		t.Errorf("nvidia-smi ran %d times, want once", len(bts))
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+const huggingFaceScheme = "hf://"
+
+type huggingFaceFile struct {
+	Filename string `json:"rfilename"`
+	LFS      *struct {
+		SHA256 string `json:"sha256"`
+		Size   int    `json:"size"`
+	} `json:"lfs"`
+}
+
+type huggingFaceModel struct {
+	Siblings []huggingFaceFile `json:"siblings"`
+}
+
+// huggingFaceEndpoint returns the Hugging Face hub to use, HF_ENDPOINT points it at a mirror
+func huggingFaceEndpoint() (*url.URL, error) {
+	endpoint := os.Getenv("HF_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://huggingface.co"
+	}
+
+	return url.Parse(endpoint)
+}
+
+// pullHuggingFace pulls a GGUF file from a Hugging Face repository and creates a model for it. name is of
+// the form hf://owner/repository:quantization, where the quantization picks which of the repository's
+// GGUF files to use. It can be left out if there is only one
+func pullHuggingFace(ctx context.Context, name string, fn func(api.ProgressResponse)) error {
+	repo, quantization, _ := strings.Cut(strings.TrimPrefix(name, huggingFaceScheme), ":")
+	owner, repository, ok := strings.Cut(repo, "/")
+	if !ok || owner == "" || repository == "" || strings.Contains(repository, "/") {
+		return fmt.Errorf("invalid hugging face model %q, expected hf://owner/repository:quantization", name)
+	}
+
+	endpoint, err := huggingFaceEndpoint()
+	if err != nil {
+		return err
+	}
+
+	// gated repositories need an access token
+	regOpts := &RegistryOptions{Token: os.Getenv("HF_TOKEN")}
+
+	fn(api.ProgressResponse{Status: "resolving hugging face repository"})
+
+	file, err := resolveHuggingFaceFile(ctx, endpoint, repo, quantization, regOpts)
+	if err != nil {
+		return err
+	}
+
+	mp := ParseModelPath(name)
+
+	digest := "sha256:" + file.LFS.SHA256
+	if err := downloadBlob(ctx, downloadOpts{
+		mp:        mp,
+		digest:    digest,
+		regOpts:   regOpts,
+		fn:        fn,
+		sourceURL: endpoint.JoinPath(repo, "resolve", "main", file.Filename),
+	}); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "creating model layer"})
+
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		return err
+	}
+
+	config := ConfigV2{
+		ModelFormat:  ggml.Name(),
+		ModelFamily:  ggml.ModelFamily(),
+		ModelType:    ggml.ModelType(),
+		FileType:     ggml.FileType(),
+		Architecture: "amd64",
+		OS:           "linux",
+	}
+
+	// pass prompts straight through, a template can be added with a Modelfile which uses this model
+	template, err := CreateLayer(strings.NewReader("{{ .Prompt }}"))
+	if err != nil {
+		return err
+	}
+	template.MediaType = "application/vnd.ollama.image.template"
+
+	layers := []*Layer{
+		{MediaType: "application/vnd.ollama.image.model", Digest: digest, Size: file.LFS.Size},
+		&template.Layer,
+	}
+
+	var digests []string
+	for _, l := range layers {
+		digests = append(digests, l.Digest)
+	}
+
+	cfg, err := createConfigLayer(config, digests)
+	if err != nil {
+		return err
+	}
+
+	if err := SaveLayers([]*LayerReader{template, cfg}, fn, false); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest"})
+	if err := CreateManifest(mp.GetFullTagname(), cfg, layers, provenanceAnnotations(endpoint.JoinPath(repo).String(), digest, layers)); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "success"})
+	return nil
+}
+
+// resolveHuggingFaceFile finds the GGUF file in repo for quantization
+func resolveHuggingFaceFile(ctx context.Context, endpoint *url.URL, repo, quantization string, regOpts *RegistryOptions) (*huggingFaceFile, error) {
+	requestURL := endpoint.JoinPath("api", "models", repo)
+	requestURL.RawQuery = url.Values{"blobs": {"true"}}.Encode()
+
+	resp, err := makeRequest(ctx, http.MethodGet, requestURL, nil, nil, regOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("hugging face repository %s not found, set HF_TOKEN if it is private or gated", repo)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("on pull hugging face responded with code %d: %s", resp.StatusCode, body)
+	}
+
+	bts, err := readManifest(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var model huggingFaceModel
+	if err := json.Unmarshal(bts, &model); err != nil {
+		return nil, err
+	}
+
+	var available, matches []huggingFaceFile
+	for _, f := range model.Siblings {
+		if !strings.EqualFold(path.Ext(f.Filename), ".gguf") || f.LFS == nil {
+			continue
+		}
+
+		available = append(available, f)
+		if strings.Contains(strings.ToLower(f.Filename), strings.ToLower(quantization)) {
+			matches = append(matches, f)
+		}
+	}
+
+	switch {
+	case len(available) == 0:
+		return nil, fmt.Errorf("no gguf files found in hugging face repository %s", repo)
+	case len(matches) == 1:
+		return &matches[0], nil
+	}
+
+	var names []string
+	for _, f := range available {
+		names = append(names, f.Filename)
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no gguf file matches %q in %s, available files: %s", quantization, repo, strings.Join(names, ", "))
+	}
+
+	return nil, fmt.Errorf("choose a quantization for %s, available files: %s", repo, strings.Join(names, ", "))
+}
@@ -19,8 +19,11 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"golang.org/x/exp/slices"
 
 	"github.com/jmorganca/ollama/api"
@@ -37,6 +40,45 @@ type RegistryOptions struct {
 	Username string
 	Password string
 	Token    string
+
+	// WithReferrers also pulls the artifacts which refer to each layer through the OCI referrers api
+	WithReferrers bool
+
+	// Background downloads at a low priority, see bgpull.go
+	Background bool
+
+	// CACertFile, ClientCertFile, ClientKeyFile, InsecureSkipVerify and ProxyURL configure the connection to
+	// the registry, when unset they default to the OLLAMA_REGISTRY_* environment variables
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+	ProxyURL           string
+
+	// the layers of a pull are downloaded at once with the same options, mu guards Token and the fields below
+	// and authMu lets only one of them get a new token at a time
+	mu          sync.Mutex
+	authMu      sync.Mutex
+	challenge   string    // the bearer challenge Token was issued for
+	tokenExpiry time.Time // when Token expires, zero if it doesn't
+	issuedAt    time.Time // when Token was set
+}
+
+// bearer returns the token requests to the registry are sent with
+func (o *RegistryOptions) bearer() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.Token
+}
+
+// setToken replaces the token, challenge is what it was issued for and expiry when it expires, if it does
+func (o *RegistryOptions) setToken(token, challenge string, expiry time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.Token = token
+	o.challenge = challenge
+	o.tokenExpiry = expiry
+	o.issuedAt = time.Now()
 }
 
 type Model struct {
@@ -45,6 +87,8 @@ type Model struct {
 	ModelPath     string
 	OriginalModel string
 	AdapterPaths  []string
+	DraftPath     string
+	ProjectorPath string
 	Template      string
 	System        string
 	License       []string
@@ -52,6 +96,12 @@ type Model struct {
 	ConfigDigest  string
 	Options       map[string]interface{}
 	Embeddings    []vector.Embedding
+	Messages      []api.Message
+
+	// where the model came from, and the digests of its license layers
+	Source         string
+	Checkpoint     string
+	LicenseDigests []string
 }
 
 func (m *Model) Prompt(request api.GenerateRequest, embedding string) (string, error) {
@@ -98,6 +148,9 @@ type ManifestV2 struct {
 	MediaType     string   `json:"mediaType"`
 	Config        Layer    `json:"config"`
 	Layers        []*Layer `json:"layers"`
+
+	// Annotations hold the model's provenance, see provenanceAnnotations
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 type Layer struct {
@@ -139,7 +192,7 @@ func (m *ManifestV2) GetTotalSize() int {
 }
 
 func GetManifest(mp ModelPath) (*ManifestV2, string, error) {
-	fp, err := mp.GetManifestPath(false)
+	fp, _, err := mp.findManifestPath()
 	if err != nil {
 		return nil, "", err
 	}
@@ -165,6 +218,27 @@ func GetManifest(mp ModelPath) (*ManifestV2, string, error) {
 	return manifest, shaStr, nil
 }
 
+// GetConfig reads the config blob with digest
+func GetConfig(digest string) (*ConfigV2, error) {
+	r, err := localBlobs.Get(context.Background(), digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	bts, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ConfigV2
+	if err := json.Unmarshal(bts, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
 func GetModel(name string) (*Model, error) {
 	mp := ParseModelPath(name)
 	manifest, digest, err := GetManifest(mp)
@@ -179,10 +253,12 @@ func GetModel(name string) (*Model, error) {
 		ConfigDigest: manifest.Config.Digest,
 		Template:     "{{ .Prompt }}",
 		License:      []string{},
+		Source:       manifest.Annotations[annotationSource],
+		Checkpoint:   manifest.Annotations[annotationCheckpoint],
 	}
 
 	for _, layer := range manifest.Layers {
-		filename, err := GetBlobsPath(layer.Digest)
+		filename, err := findBlob(layer.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -203,6 +279,10 @@ func GetModel(name string) (*Model, error) {
 			}
 		case "application/vnd.ollama.image.adapter":
 			model.AdapterPaths = append(model.AdapterPaths, filename)
+		case "application/vnd.ollama.image.draft":
+			model.DraftPath = filename
+		case "application/vnd.ollama.image.projector":
+			model.ProjectorPath = filename
 		case "application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
 			if err != nil {
@@ -235,12 +315,22 @@ func GetModel(name string) (*Model, error) {
 			if err = json.NewDecoder(params).Decode(&model.Options); err != nil {
 				return nil, err
 			}
+		case "application/vnd.ollama.image.messages":
+			bts, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := json.Unmarshal(bts, &model.Messages); err != nil {
+				return nil, err
+			}
 		case "application/vnd.ollama.image.license":
 			bts, err := os.ReadFile(filename)
 			if err != nil {
 				return nil, err
 			}
 			model.License = append(model.License, string(bts))
+			model.LicenseDigests = append(model.LicenseDigests, layer.Digest)
 		}
 	}
 
@@ -267,7 +357,10 @@ func filenameWithPath(path, f string) (string, error) {
 	return f, nil
 }
 
-func CreateModel(ctx context.Context, workDir, name string, path string, fn func(resp api.ProgressResponse)) error {
+func CreateModel(ctx context.Context, workDir, name string, path string, quantize string, fn func(resp api.ProgressResponse)) error {
+	blobsMu.RLock()
+	defer blobsMu.RUnlock()
+
 	mp := ParseModelPath(name)
 
 	var manifest *ManifestV2
@@ -310,6 +403,8 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 	}
 
 	var layers []*LayerReader
+	var messages []api.Message
+	var sourceURL, checkpoint string
 	params := make(map[string][]string)
 	var sourceParams map[string]any
 	embed := EmbeddingParams{fn: fn}
@@ -342,6 +437,21 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 						return err
 					}
 				} else {
+					if llm.IsCheckpoint(modelFile) {
+						fn(api.ProgressResponse{Status: "hashing checkpoint"})
+						if checkpoint, err = checkpointDigest(modelFile); err != nil {
+							return err
+						}
+
+						converted, err := convertCheckpoint(ctx, workDir, modelFile, fn)
+						if err != nil {
+							return err
+						}
+						defer os.Remove(converted)
+
+						modelFile = converted
+					}
+
 					embed.model = modelFile
 					// create a model from this specified file
 					fn(api.ProgressResponse{Status: "creating model layer"})
@@ -370,11 +480,15 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 					}
 					l.MediaType = "application/vnd.ollama.image.model"
 					layers = append(layers, l)
+
+					if checkpoint == "" {
+						checkpoint = l.Digest
+					}
 				}
 			}
 
 			if mf != nil {
-				sourceBlobPath, err := GetBlobsPath(mf.Config.Digest)
+				sourceBlobPath, err := findBlob(mf.Config.Digest)
 				if err != nil {
 					return err
 				}
@@ -396,9 +510,12 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 				config.ModelFormat = source.ModelFormat
 				config.FileType = source.FileType
 
+				// a model created from another comes from where it did
+				sourceURL, checkpoint = baseProvenance(mf)
+
 				for _, l := range mf.Layers {
 					if l.MediaType == "application/vnd.ollama.image.params" {
-						sourceParamsBlobPath, err := GetBlobsPath(l.Digest)
+						sourceParamsBlobPath, err := findBlob(l.Digest)
 						if err != nil {
 							return err
 						}
@@ -451,6 +568,32 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 			}
 			l.MediaType = "application/vnd.ollama.image.adapter"
 			layers = append(layers, l)
+		case "draft":
+			fn(api.ProgressResponse{Status: fmt.Sprintf("creating model %s layer", c.Name)})
+
+			l, err := draftLayer(path, c.Args)
+			if err != nil {
+				return err
+			}
+
+			if f, ok := l.Reader.(*os.File); ok {
+				defer f.Close()
+			}
+
+			// a model has one draft, it replaces the one it's created from
+			layers = removeLayerFromLayers(layers, l.MediaType)
+			layers = append(layers, l)
+		case "projector":
+			fn(api.ProgressResponse{Status: fmt.Sprintf("creating model %s layer", c.Name)})
+
+			l, err := projectorLayer(path, c.Args)
+			if err != nil {
+				return err
+			}
+			defer l.Reader.(*os.File).Close()
+
+			layers = removeLayerFromLayers(layers, l.MediaType)
+			layers = append(layers, l)
 		case "license":
 			fn(api.ProgressResponse{Status: fmt.Sprintf("creating model %s layer", c.Name)})
 			mediaType := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
@@ -479,12 +622,60 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 				layer.MediaType = mediaType
 				layers = append(layers, layer)
 			}
+		case "source":
+			sourceURL = c.Args
+		case "message":
+			role, content, _ := strings.Cut(c.Args, " ")
+			messages = append(messages, api.Message{Role: role, Content: content})
 		default:
 			// runtime parameters, build a list of args for each parameter to allow multiple values to be specified (ex: multiple stop sequences)
 			params[c.Name] = append(params[c.Name], c.Args)
 		}
 	}
 
+	if quantize != "" {
+		i := -1
+		for j, l := range layers {
+			if l.MediaType == "application/vnd.ollama.image.model" {
+				i = j
+			}
+		}
+
+		if i < 0 {
+			return errors.New("no model to quantize, the modelfile needs a FROM command")
+		}
+
+		quantized, err := quantizeLayer(ctx, workDir, layers[i], quantize, fn)
+		if err != nil {
+			return err
+		}
+
+		f := quantized.Reader.(*os.File)
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		layers[i] = quantized
+		config.FileType = strings.ToUpper(quantize)
+	}
+
+	// the messages replace any the base model has, a model only has a single conversation to start from
+	if len(messages) > 0 {
+		fn(api.ProgressResponse{Status: "creating model messages layer"})
+
+		layers = removeLayerFromLayers(layers, "application/vnd.ollama.image.messages")
+		bts, err := json.Marshal(messages)
+		if err != nil {
+			return err
+		}
+
+		l, err := CreateLayer(bytes.NewReader(bts))
+		if err != nil {
+			return fmt.Errorf("failed to create layer: %v", err)
+		}
+		l.MediaType = "application/vnd.ollama.image.messages"
+		layers = append(layers, l)
+	}
+
 	// Create a single layer for the parameters
 	if len(params) > 0 {
 		fn(api.ProgressResponse{Status: "creating parameter layer"})
@@ -556,14 +747,14 @@ func CreateModel(ctx context.Context, workDir, name string, path string, fn func
 
 	// Create the manifest
 	fn(api.ProgressResponse{Status: "writing manifest"})
-	err = CreateManifest(name, cfg, manifestLayers)
+	err = CreateManifest(name, cfg, manifestLayers, provenanceAnnotations(sourceURL, checkpoint, manifestLayers))
 	if err != nil {
 		return err
 	}
 
 	if noprune == "" {
 		fn(api.ProgressResponse{Status: "removing any unused layers"})
-		err = deleteUnusedLayers(nil, deleteMap, false)
+		_, err = deleteUnusedLayers(nil, deleteMap, false)
 		if err != nil {
 			return err
 		}
@@ -594,9 +785,11 @@ func embeddingLayers(workDir string, e EmbeddingParams) ([]*LayerReader, error)
 			model = &Model{ModelPath: e.model}
 		}
 
-		if err := load(context.Background(), workDir, model, e.opts, defaultSessionDuration); err != nil {
+		runner, err := acquireModel(context.Background(), workDir, model, e.opts, defaultSessionDuration, nil)
+		if err != nil {
 			return nil, fmt.Errorf("load model to generate embeddings: %v", err)
 		}
+		defer runner.release()
 
 		// this will be used to check if we already have embeddings for a file
 		modelInfo, err := os.Stat(model.ModelPath)
@@ -657,7 +850,7 @@ func embeddingLayers(workDir string, e EmbeddingParams) ([]*LayerReader, error)
 						embeddings = append(embeddings, vector.Embedding{Data: d, Vector: existing[d]})
 						continue
 					}
-					embed, err := loaded.llm.Embedding(context.Background(), d)
+					embed, err := runner.llm.Embedding(context.Background(), d)
 					if err != nil {
 						log.Printf("failed to generate embedding for '%s' line %d: %v", filePath, i+1, err)
 						continue
@@ -689,7 +882,7 @@ func embeddingLayers(workDir string, e EmbeddingParams) ([]*LayerReader, error)
 
 // existingFileEmbeddings checks if we already have embeddings for a file and loads them into a look-up map
 func existingFileEmbeddings(digest string) (map[string][]float64, error) {
-	path, err := GetBlobsPath(digest)
+	path, err := findBlob(digest)
 	if err != nil {
 		return nil, fmt.Errorf("embeddings blobs path: %w", err)
 	}
@@ -722,36 +915,30 @@ func removeLayerFromLayers(layers []*LayerReader, mediaType string) []*LayerRead
 func SaveLayers(layers []*LayerReader, fn func(resp api.ProgressResponse), force bool) error {
 	// Write each of the layers to disk
 	for _, layer := range layers {
-		fp, err := GetBlobsPath(layer.Digest)
-		if err != nil {
-			return err
-		}
-
-		_, err = os.Stat(fp)
+		_, err := localBlobs.Stat(context.Background(), layer.Digest)
 		// note: embed layers are always written since their digest doesnt indicate anything about the contents
 		if os.IsNotExist(err) || force || layer.MediaType == "application/vnd.ollama.image.embed" {
 			fn(api.ProgressResponse{Status: fmt.Sprintf("writing layer %s", layer.Digest)})
 
-			out, err := os.Create(fp)
-			if err != nil {
-				log.Printf("couldn't create %s", fp)
-				return err
-			}
-			defer out.Close()
-
-			if _, err = io.Copy(out, layer.Reader); err != nil {
+			if err := localBlobs.Put(context.Background(), layer.Digest, layer.Reader, -1); err != nil {
+				log.Printf("couldn't write layer %s: %v", layer.Digest, err)
 				return err
 			}
-
 		} else {
 			fn(api.ProgressResponse{Status: fmt.Sprintf("using already created layer %s", layer.Digest)})
 		}
 	}
 
+	shared := make([]*Layer, len(layers))
+	for i, layer := range layers {
+		shared[i] = &layer.Layer
+	}
+
+	shareBlobsInBackground(shared)
 	return nil
 }
 
-func CreateManifest(name string, cfg *LayerReader, layers []*Layer) error {
+func CreateManifest(name string, cfg *LayerReader, layers []*Layer, annotations map[string]string) error {
 	mp := ParseModelPath(name)
 	manifest := ManifestV2{
 		SchemaVersion: 2,
@@ -761,7 +948,8 @@ func CreateManifest(name string, cfg *LayerReader, layers []*Layer) error {
 			Size:      cfg.Size,
 			Digest:    cfg.Digest,
 		},
-		Layers: layers,
+		Layers:      layers,
+		Annotations: annotations,
 	}
 
 	manifestJSON, err := json.Marshal(manifest)
@@ -777,7 +965,7 @@ func CreateManifest(name string, cfg *LayerReader, layers []*Layer) error {
 }
 
 func GetLayerWithBufferFromLayer(layer *Layer) (*LayerReader, error) {
-	fp, err := GetBlobsPath(layer.Digest)
+	fp, err := findBlob(layer.Digest)
 	if err != nil {
 		return nil, err
 	}
@@ -884,7 +1072,7 @@ func CreateLayer(f io.ReadSeeker) (*LayerReader, error) {
 
 func CopyModel(src, dest string) error {
 	srcModelPath := ParseModelPath(src)
-	srcPath, err := srcModelPath.GetManifestPath(false)
+	srcPath, _, err := srcModelPath.findManifestPath()
 	if err != nil {
 		return err
 	}
@@ -911,10 +1099,12 @@ func CopyModel(src, dest string) error {
 	return nil
 }
 
-func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]bool, dryRun bool) error {
+// deleteUnusedLayers removes the blobs in deleteMap which aren't used by any manifest other than
+// skipModelPath, it leaves only the unused blobs in deleteMap and returns the number of bytes they took up
+func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]bool, dryRun bool) (int64, error) {
 	fp, err := GetManifestPath()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	walkFunc := func(path string, info os.FileInfo, _ error) error {
@@ -938,71 +1128,153 @@ func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]bool, dry
 			return nil
 		}
 
+		var layers []string
 		for _, layer := range manifest.Layers {
-			delete(deleteMap, layer.Digest)
+			layers = append(layers, layer.Digest)
+		}
+		layers = append(layers, manifest.Config.Digest)
+
+		for _, digest := range layers {
+			delete(deleteMap, digest)
+
+			// keep any artifacts pulled for this blob through the referrers api
+			referrers, err := referrerDigests(digest)
+			if err != nil {
+				log.Printf("couldn't read referrers for '%s': %v", digest, err)
+				continue
+			}
+
+			for _, referrer := range referrers {
+				delete(deleteMap, referrer)
+			}
 		}
 
-		delete(deleteMap, manifest.Config.Digest)
 		return nil
 	}
 
 	if err := filepath.Walk(fp, walkFunc); err != nil {
-		return err
+		return 0, err
 	}
 
 	// only delete the files which are still in the deleteMap
+	var reclaimed int64
 	for k, v := range deleteMap {
 		if v {
-			fp, err := GetBlobsPath(k)
-			if err != nil {
-				log.Printf("couldn't get file path for '%s': %v", k, err)
-				continue
+			if size, err := localBlobs.Stat(context.Background(), k); err == nil {
+				reclaimed += size
 			}
+
 			if !dryRun {
-				if err := os.Remove(fp); err != nil {
-					log.Printf("couldn't remove file '%s': %v", fp, err)
+				if err := localBlobs.Delete(context.Background(), k); err != nil {
+					log.Printf("couldn't remove blob '%s': %v", k, err)
 					continue
 				}
+
+				if rp, err := GetReferrersPath(k); err == nil {
+					os.Remove(rp)
+				}
 			} else {
-				log.Printf("wanted to remove: %s", fp)
+				log.Printf("wanted to remove: %s", k)
 			}
 		}
 	}
 
-	return nil
+	return reclaimed, nil
 }
 
+// blobsMu is held for reading while blobs may be written which no manifest refers to yet, so they aren't
+// pruned before their manifest is written. It is only locked for writing with TryLock, which never waits,
+// so CreateModel can pull a model while holding it
+var blobsMu sync.RWMutex
+
+var errBlobsInUse = errors.New("a model is being pulled or created, try again once it has finished")
+
+// PruneLayers removes the blobs which aren't used by any model as the server starts. partial blobs are kept, so
+// pulls interrupted by a restart resume where they stopped
 func PruneLayers() error {
-	deleteMap := make(map[string]bool)
-	p, err := GetBlobsPath("")
+	_, _, err := pruneLayers(false, false)
+	return err
+}
+
+// PruneUnusedLayers removes the blobs which aren't used by any model while the server is running, it
+// returns the number of blobs removed and the bytes reclaimed
+func PruneUnusedLayers(dryRun bool) (int, int64, error) {
+	if !blobsMu.TryLock() {
+		return 0, 0, errBlobsInUse
+	}
+	defer blobsMu.Unlock()
+
+	return pruneLayers(dryRun, true)
+}
+
+func pruneLayers(dryRun, partials bool) (int, int64, error) {
+	// only local blobs are pruned, other servers sharing a blob store may use the blobs no model here does
+	blobs, err := localBlobs.List(context.Background())
 	if err != nil {
-		return err
+		log.Printf("couldn't list blobs: %v", err)
+		return 0, 0, err
 	}
 
-	blobs, err := os.ReadDir(p)
+	deleteMap := make(map[string]bool)
+	for _, digest := range blobs {
+		deleteMap[digest] = true
+	}
+
+	log.Printf("total blobs: %d", len(deleteMap))
+
+	reclaimed, err := deleteUnusedLayers(nil, deleteMap, dryRun)
 	if err != nil {
-		log.Printf("couldn't read dir '%s': %v", p, err)
-		return err
+		return 0, 0, err
 	}
 
-	for _, blob := range blobs {
-		name := blob.Name()
-		if runtime.GOOS == "windows" {
-			name = strings.ReplaceAll(name, "-", ":")
+	// nothing is being pulled while blobs are pruned, so partial blobs are left over from interrupted pulls
+	if partials {
+		size, err := removePartialBlobs(dryRun)
+		if err != nil {
+			return 0, 0, err
 		}
-		deleteMap[name] = true
+
+		reclaimed += size
 	}
+	log.Printf("total unused blobs removed: %d (%s)", len(deleteMap), humanize.Bytes(uint64(reclaimed)))
 
-	log.Printf("total blobs: %d", len(deleteMap))
+	return len(deleteMap), reclaimed, nil
+}
 
-	err = deleteUnusedLayers(nil, deleteMap, false)
+// removePartialBlobs removes the files of blobs which were never finished, returning the bytes they took
+func removePartialBlobs(dryRun bool) (int64, error) {
+	dir, err := GetBlobsPath("")
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	log.Printf("total unused blobs removed: %d", len(deleteMap))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
 
-	return nil
+	var reclaimed int64
+	for _, entry := range entries {
+		if entry.IsDir() || !isPartialBlob(entry.Name()) {
+			continue
+		}
+
+		if fi, err := entry.Info(); err == nil {
+			reclaimed += fi.Size()
+		}
+
+		fp := filepath.Join(dir, entry.Name())
+		if dryRun {
+			log.Printf("wanted to remove: %s", fp)
+			continue
+		}
+
+		if err := os.Remove(fp); err != nil {
+			log.Printf("couldn't remove file '%s': %v", fp, err)
+		}
+	}
+
+	return reclaimed, nil
 }
 
 func DeleteModel(name string) error {
@@ -1012,13 +1284,19 @@ func DeleteModel(name string) error {
 		return err
 	}
 
+	if _, readOnly, err := mp.findManifestPath(); err != nil {
+		return err
+	} else if readOnly {
+		return errReadOnlyModel
+	}
+
 	deleteMap := make(map[string]bool)
 	for _, layer := range manifest.Layers {
 		deleteMap[layer.Digest] = true
 	}
 	deleteMap[manifest.Config.Digest] = true
 
-	err = deleteUnusedLayers(&mp, deleteMap, false)
+	_, err = deleteUnusedLayers(&mp, deleteMap, false)
 	if err != nil {
 		return err
 	}
@@ -1097,6 +1375,22 @@ SYSTEM """{{ .System }}"""
 		modelFile += fmt.Sprintf("ADAPTER %s\n", l)
 	}
 
+	if mt.Model.DraftPath != "" {
+		modelFile += fmt.Sprintf("DRAFT %s\n", mt.Model.DraftPath)
+	}
+
+	if mt.Model.ProjectorPath != "" {
+		modelFile += fmt.Sprintf("PROJECTOR %s\n", mt.Model.ProjectorPath)
+	}
+
+	if mt.Model.Source != "" {
+		modelFile += fmt.Sprintf("SOURCE %s\n", mt.Model.Source)
+	}
+
+	for _, m := range mt.Model.Messages {
+		modelFile += fmt.Sprintf("MESSAGE %s \"\"\"%s\"\"\"\n", m.Role, m.Content)
+	}
+
 	tmpl, err := template.New("").Parse(modelFile)
 	if err != nil {
 		log.Printf("error parsing template: %q", err)
@@ -1143,6 +1437,7 @@ func PushModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 				Digest:    layer.Digest,
 				Total:     layer.Size,
 				Completed: layer.Size,
+				State:     api.ProgressStateComplete,
 			})
 			log.Printf("Layer %s already exists", layer.Digest)
 			continue
@@ -1167,6 +1462,7 @@ func PushModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 				Digest:    layer.Digest,
 				Total:     layer.Size,
 				Completed: layer.Size,
+				State:     api.ProgressStateComplete,
 			})
 			continue
 		}
@@ -1200,6 +1496,23 @@ func PushModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 }
 
 func PullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	if err := pullModel(ctx, name, regOpts, fn); err != nil {
+		events.publish(api.Event{Type: eventModelPullFailed, Model: name, Error: err.Error(), Text: fmt.Sprintf("pulling %s failed: %v", name, err)})
+		return err
+	}
+
+	events.publish(api.Event{Type: eventModelPulled, Model: name, Text: fmt.Sprintf("pulled %s", name)})
+	return nil
+}
+
+func pullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	blobsMu.RLock()
+	defer blobsMu.RUnlock()
+
+	if strings.HasPrefix(name, huggingFaceScheme) {
+		return pullHuggingFace(ctx, name, fn)
+	}
+
 	mp := ParseModelPath(name)
 
 	var manifest *ManifestV2
@@ -1238,23 +1551,40 @@ func PullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 	layers = append(layers, manifest.Layers...)
 	layers = append(layers, &manifest.Config)
 
+	if err := checkFreeSpace(layers); err != nil {
+		return err
+	}
+
+	reused, missing, err := splitLayers(layers)
+	if err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: fmt.Sprintf("reused %d layers, downloading %d", len(reused), len(missing))})
+	for _, layer := range reused {
+		fn(api.ProgressResponse{Digest: layer.Digest, Total: layer.Size, Completed: layer.Size, State: api.ProgressStateComplete})
+	}
+
+	if err := downloadLayers(ctx, mp, missing, regOpts, fn); err != nil {
+		return err
+	}
+
 	for _, layer := range layers {
-		if err := downloadBlob(
-			ctx,
-			downloadOpts{
-				mp:      mp,
-				digest:  layer.Digest,
-				regOpts: regOpts,
-				fn:      fn,
-			}); err != nil {
-			return err
-		}
 		delete(deleteMap, layer.Digest)
 	}
-	delete(deleteMap, manifest.Config.Digest)
 
+	if regOpts.WithReferrers {
+		fn(api.ProgressResponse{Status: "pulling referrers"})
+		for _, layer := range layers {
+			if err := pullReferrers(ctx, mp, layer.Digest, regOpts, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	// reused blobs were verified when they were downloaded
 	fn(api.ProgressResponse{Status: "verifying sha256 digest"})
-	for _, layer := range layers {
+	for _, layer := range missing {
 		if err := verifyBlob(layer.Digest); err != nil {
 			if errors.Is(err, errDigestMismatch) {
 				// something went wrong, delete the blob
@@ -1271,6 +1601,8 @@ func PullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 		}
 	}
 
+	shareBlobsInBackground(layers)
+
 	fn(api.ProgressResponse{Status: "writing manifest"})
 
 	manifestJSON, err := json.Marshal(manifest)
@@ -1291,7 +1623,7 @@ func PullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 
 	if noprune == "" {
 		fn(api.ProgressResponse{Status: "removing any unused layers"})
-		err = deleteUnusedLayers(nil, deleteMap, false)
+		_, err = deleteUnusedLayers(nil, deleteMap, false)
 		if err != nil {
 			return err
 		}
@@ -1302,35 +1634,120 @@ func PullModel(ctx context.Context, name string, regOpts *RegistryOptions, fn fu
 	return nil
 }
 
-func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *RegistryOptions) (*ManifestV2, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+// splitLayers splits layers into the ones with a blob of the right size already, which a pull reuses, and the
+// ones it downloads. a blob of the wrong size is removed so it's downloaded again
+func splitLayers(layers []*Layer) (reused, missing []*Layer, err error) {
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
 
+		size, err := localBlobs.Stat(context.Background(), layer.Digest)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			missing = append(missing, layer)
+		case err != nil:
+			return nil, nil, err
+		case layer.Size > 0 && size != int64(layer.Size):
+			log.Printf("blob %s is %d bytes, not %d, downloading it again", layer.Digest, size, layer.Size)
+			// a blob in a read only model directory is downloaded again over it
+			if err := localBlobs.Delete(context.Background(), layer.Digest); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, nil, err
+			}
+
+			missing = append(missing, layer)
+		default:
+			reused = append(reused, layer)
+		}
+	}
+
+	return reused, missing, nil
+}
+
+func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *RegistryOptions) (*ManifestV2, error) {
 	headers := make(http.Header)
 	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	resp, err := makeRequest(ctx, "GET", requestURL, headers, nil, regOpts)
-	if err != nil {
-		log.Printf("couldn't get manifest: %v", err)
-		return nil, err
+
+	var resp *http.Response
+	var err error
+	for try := 0; ; try++ {
+		resp, err = makeMirroredRequest(ctx, mp, registryMirrors(mp.Registry), headers, regOpts, "v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+		if err == nil && !(retryableStatus(resp.StatusCode) && try < maxRetry) {
+			break
+		}
+
+		var after time.Duration
+		if err != nil {
+			log.Printf("couldn't get manifest: %v", err)
+			if !retryable(err) || try >= maxRetry {
+				return nil, err
+			}
+		} else {
+			log.Printf("on pull registry responded with code %d, retrying", resp.StatusCode)
+			after = retryAfter(resp)
+			resp.Body.Close()
+		}
+
+		if err := sleepBackoff(ctx, try, after); err != nil {
+			return nil, err
+		}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= http.StatusBadRequest {
 		if resp.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("model not found")
+			return nil, withCode(api.CodeModelNotFound, errors.New("model not found"), map[string]any{"model": mp.GetShortTagname()})
 		}
 
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("on pull registry responded with code %d: %s", resp.StatusCode, body)
+		return nil, registryError("pull", resp.StatusCode, body)
+	}
+
+	bts, err := readManifest(resp)
+	if err != nil {
+		return nil, err
 	}
 
 	var m *ManifestV2
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+	if err := json.Unmarshal(bts, &m); err != nil {
 		return nil, err
 	}
 
+	if limit := maxManifestSize(); int64(m.Config.Size) > limit {
+		return nil, fmt.Errorf("%w: config is %s, the limit is %s", errManifestTooLarge, humanize.Bytes(uint64(m.Config.Size)), humanize.Bytes(uint64(limit)))
+	}
+
 	return m, err
 }
 
+var errManifestTooLarge = errors.New("manifest exceeds the maximum allowed size")
+
+// maxManifestSize is the most of a manifest, config or other small document from the registry which is held in memory
+func maxManifestSize() int64 {
+	return int64(envBytes("OLLAMA_MAX_MANIFEST_SIZE", 4*1024*1024))
+}
+
+// readManifest reads the body of a registry response which will be parsed in memory, refusing to buffer more than maxManifestSize
+func readManifest(resp *http.Response) ([]byte, error) {
+	limit := maxManifestSize()
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: response is %s, the limit is %s", errManifestTooLarge, humanize.Bytes(uint64(resp.ContentLength)), humanize.Bytes(uint64(limit)))
+	}
+
+	bts, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(bts)) > limit {
+		return nil, fmt.Errorf("%w: response is larger than %s", errManifestTooLarge, humanize.Bytes(uint64(limit)))
+	}
+
+	return bts, nil
+}
+
 func createConfigLayer(config ConfigV2, layers []string) (*LayerReader, error) {
 	config.RootFS = RootFS{
 		Type:    "layers",
@@ -1371,9 +1788,29 @@ func checkBlobExistence(ctx context.Context, mp ModelPath, digest string, regOpt
 	requestURL := mp.BaseURL()
 	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "blobs", digest)
 
+	var err error
+	for try := 0; try <= envInt("OLLAMA_HEAD_RETRIES", maxHeadRetry); try++ {
+		var exists bool
+		exists, err = headBlob(ctx, requestURL, regOpts)
+		if err == nil {
+			return exists, nil
+		}
+
+		log.Printf("couldn't check for blob: %v", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return false, err
+}
+
+func headBlob(ctx context.Context, requestURL *url.URL, regOpts *RegistryOptions) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, headTimeout)
+	defer cancel()
+
 	resp, err := makeRequest(ctx, "HEAD", requestURL, nil, nil, regOpts)
 	if err != nil {
-		log.Printf("couldn't check for blob: %v", err)
 		return false, err
 	}
 	defer resp.Body.Close()
@@ -1384,6 +1821,7 @@ func checkBlobExistence(ctx context.Context, mp ModelPath, digest string, regOpt
 
 func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.ReadSeeker, regOpts *RegistryOptions) (*http.Response, error) {
 	var status string
+	var unauthorized bool
 	for try := 0; try < MaxRetries; try++ {
 		resp, err := makeRequest(ctx, method, requestURL, headers, body, regOpts)
 		if err != nil {
@@ -1392,6 +1830,7 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 		}
 
 		status = resp.Status
+		unauthorized = resp.StatusCode == http.StatusUnauthorized
 
 		switch {
 		case resp.StatusCode == http.StatusUnauthorized:
@@ -1402,7 +1841,7 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 				return nil, err
 			}
 
-			regOpts.Token = token
+			regOpts.setToken(token, auth, time.Time{})
 			if body != nil {
 				if _, err := body.Seek(0, io.SeekStart); err != nil {
 					return nil, err
@@ -1412,13 +1851,19 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 			continue
 		case resp.StatusCode >= http.StatusBadRequest:
 			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("on upload registry responded with code %d: %s", resp.StatusCode, body)
+			return nil, registryError("upload", resp.StatusCode, body)
 		default:
 			return resp, nil
 		}
 	}
 
-	return nil, fmt.Errorf("max retry exceeded: %v", status)
+	err := fmt.Errorf("max retry exceeded: %v", status)
+	if unauthorized {
+		// each token the registry gave was refused
+		return nil, withCode(api.CodeRegistryUnauthorized, err, nil)
+	}
+
+	return nil, err
 }
 
 func makeRequest(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.Reader, regOpts *RegistryOptions) (*http.Response, error) {
@@ -1436,8 +1881,8 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 	}
 
 	if regOpts != nil {
-		if regOpts.Token != "" {
-			req.Header.Set("Authorization", "Bearer "+regOpts.Token)
+		if token := regOpts.bearer(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
 		} else if regOpts.Username != "" && regOpts.Password != "" {
 			req.SetBasicAuth(regOpts.Username, regOpts.Password)
 		}
@@ -1454,7 +1899,13 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 		req.ContentLength = contentLength
 	}
 
+	transport, err := registryTransportFor(regOpts)
+	if err != nil {
+		return nil, err
+	}
+
 	client := &http.Client{
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) >= 10 {
 				return fmt.Errorf("too many redirects")
@@ -1507,8 +1958,11 @@ func ParseAuthRedirectString(authStr string) AuthRedirect {
 
 var errDigestMismatch = fmt.Errorf("digest mismatch, file must be downloaded again")
 
+// errReadOnlyModel is the error of deleting a model which is in one of the read only OLLAMA_MODEL_DIRS
+var errReadOnlyModel = errors.New("the model is in a read only model directory")
+
 func verifyBlob(digest string) error {
-	fp, err := GetBlobsPath(digest)
+	fp, err := findBlob(digest)
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,58 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/jmorganca/ollama/api"
 )
 
+// testLayer is a layer of a model written by writeModel
+type testLayer struct {
+	mediaType, data string
+}
+
+// writeModel writes a model with each of layers, its config and a manifest with annotations, the way creating
+// it would
+func writeModel(t *testing.T, name string, layers []testLayer, annotations map[string]string) {
+	t.Helper()
+
+	var saved []*Layer
+	var digests []string
+	for _, l := range layers {
+		layer, err := CreateLayer(strings.NewReader(l.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer.MediaType = l.mediaType
+
+		if err := SaveLayers([]*LayerReader{layer}, func(api.ProgressResponse) {}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		saved = append(saved, &layer.Layer)
+		digests = append(digests, layer.Digest)
+	}
+
+	cfg, err := createConfigLayer(ConfigV2{}, digests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveLayers([]*LayerReader{cfg}, func(api.ProgressResponse) {}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateManifest(name, cfg, saved, annotations); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestModelPrompt(t *testing.T) {
 	var m Model
 	req := api.GenerateRequest{
@@ -21,3 +68,73 @@ func TestModelPrompt(t *testing.T) {
 		t.Errorf("got %q, want %q", s, want)
 	}
 }
+
+func TestSplitLayers(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	have := []byte("unchanged layer")
+	digest, size := GetSHA256Digest(bytes.NewReader(have))
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, have, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated, err := GetBlobsPath("sha256:truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(truncated, []byte("part"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := []*Layer{
+		{Digest: digest, Size: int(size)},
+		{Digest: "sha256:new", Size: 10},
+		{Digest: "sha256:truncated", Size: 10},
+		{Digest: digest, Size: int(size)},
+	}
+
+	reused, missing, err := splitLayers(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reused) != 1 || reused[0].Digest != digest {
+		t.Errorf("expected the blob on disk to be reused, got %v", reused)
+	}
+
+	if len(missing) != 2 || missing[0].Digest != "sha256:new" || missing[1].Digest != "sha256:truncated" {
+		t.Errorf("expected the new and truncated blobs to be downloaded, got %v", missing)
+	}
+
+	if _, err := os.Stat(truncated); !os.IsNotExist(err) {
+		t.Error("expected the truncated blob to be removed")
+	}
+}
+
+func TestPullHuggingFace(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var requested string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	t.Setenv("HF_ENDPOINT", srv.URL)
+
+	// an hf:// name is pulled from the hub rather than as a registry manifest
+	err := PullModel(context.Background(), "hf://TheBloke/Llama-2-7B-GGUF:q4_K_M", &RegistryOptions{}, func(api.ProgressResponse) {})
+	if err == nil || !strings.Contains(err.Error(), "hugging face repository") {
+		t.Errorf("got %v", err)
+	}
+
+	if requested != "/api/models/TheBloke/Llama-2-7B-GGUF" {
+		t.Errorf("requested %s", requested)
+	}
+}
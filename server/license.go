@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// licenseAck is the acknowledgement of a license, licenses are acknowledged by the digest of their layer so a
+// model whose license changes has to be acknowledged again
+type licenseAck struct {
+	AcknowledgedAt time.Time `json:"acknowledged_at"`
+	Client         string    `json:"client,omitempty"`
+}
+
+// licenseAcks are the acknowledged licenses, kept in ~/.ollama/licenses.json
+var licenseAcks = struct {
+	sync.Mutex
+	m map[string]licenseAck
+}{}
+
+// licenseAckRequired reports whether OLLAMA_REQUIRE_LICENSE_ACK is set, models with a license can then only be
+// used once it's been acknowledged
+func licenseAckRequired() bool {
+	required, _ := strconv.ParseBool(os.Getenv("OLLAMA_REQUIRE_LICENSE_ACK"))
+	return required
+}
+
+func licenseAcksPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "licenses.json"), nil
+}
+
+// loadLicenseAcks reads the acknowledged licenses the first time they're needed, licenseAcks must be locked. if
+// the file is corrupt no license is acknowledged, they have to be acknowledged again
+func loadLicenseAcks() error {
+	if licenseAcks.m != nil {
+		return nil
+	}
+
+	fp, err := licenseAcksPath()
+	if err != nil {
+		return err
+	}
+
+	var acks map[string]licenseAck
+	if err := readStateFile(fp, &acks); err != nil {
+		return err
+	}
+
+	if acks == nil {
+		acks = make(map[string]licenseAck)
+	}
+
+	licenseAcks.m = acks
+	return nil
+}
+
+// unacknowledgedLicenses returns the digests of the model's licenses which haven't been acknowledged
+func unacknowledgedLicenses(model *Model) ([]string, error) {
+	licenseAcks.Lock()
+	defer licenseAcks.Unlock()
+
+	if err := loadLicenseAcks(); err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	for _, digest := range model.LicenseDigests {
+		if _, ok := licenseAcks.m[digest]; !ok {
+			digests = append(digests, digest)
+		}
+	}
+
+	return digests, nil
+}
+
+// acknowledgeLicenses records the model's licenses as acknowledged by client
+func acknowledgeLicenses(model *Model, client string) (time.Time, error) {
+	licenseAcks.Lock()
+	defer licenseAcks.Unlock()
+
+	if err := loadLicenseAcks(); err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	acks := make(map[string]licenseAck, len(licenseAcks.m)+len(model.LicenseDigests))
+	for digest, ack := range licenseAcks.m {
+		acks[digest] = ack
+	}
+
+	for _, digest := range model.LicenseDigests {
+		if _, ok := acks[digest]; !ok {
+			acks[digest] = licenseAck{AcknowledgedAt: now, Client: client}
+		}
+	}
+
+	fp, err := licenseAcksPath()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := writeStateFile(fp, acks); err != nil {
+		return time.Time{}, err
+	}
+
+	licenseAcks.m = acks
+	return now, nil
+}
+
+// licenseError is the status and error of a request for the model if the server requires licenses to be
+// acknowledged and the model's hasn't been
+func licenseError(model *Model) (int, error) {
+	if !licenseAckRequired() || len(model.LicenseDigests) == 0 {
+		return http.StatusOK, nil
+	}
+
+	unacknowledged, err := unacknowledgedLicenses(model)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if len(unacknowledged) > 0 {
+		err := fmt.Errorf("the license of %s has to be acknowledged before it can be used, see 'ollama license %s'", model.ShortName, model.ShortName)
+		return http.StatusForbidden, withCode(api.CodeLicenseRequired, err, map[string]any{"model": model.ShortName, "licenses": unacknowledged})
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkLicense replies with the license error of the model, if it has one
+func checkLicense(c *gin.Context, model *Model) bool {
+	if code, err := licenseError(model); err != nil {
+		replyError(c, code, err)
+		return false
+	}
+
+	return true
+}
+
+// licenseHandler acknowledges the licenses of a model with POST /api/models/<name>/license
+func licenseHandler(c *gin.Context, name string) {
+	model, err := GetModel(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			replyError(c, http.StatusNotFound, errModelNotFound(name))
+		} else {
+			replyError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if len(model.LicenseDigests) == 0 {
+		replyError(c, http.StatusBadRequest, fmt.Errorf("model '%s' has no license", name))
+		return
+	}
+
+	at, err := acknowledgeLicenses(model, c.ClientIP())
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.LicenseResponse{Licenses: model.LicenseDigests, AcknowledgedAt: at})
+}
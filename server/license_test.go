@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeLicensedModel writes a model with a license layer and provenance annotations
+func writeLicensedModel(t *testing.T, name, license string) {
+	t.Helper()
+
+	digest, _ := GetSHA256Digest(strings.NewReader(license))
+	annotations := provenanceAnnotations("https://example.com/model", "sha256:abc", []*Layer{{MediaType: "application/vnd.ollama.image.license", Digest: digest}})
+	writeModel(t, name, []testLayer{
+		{"application/vnd.ollama.image.model", "model data"},
+		{"application/vnd.ollama.image.license", license},
+	}, annotations)
+}
+
+func TestLicenseAcknowledgement(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_REQUIRE_LICENSE_ACK", "1")
+	licenseAcks.m = nil
+	t.Cleanup(func() { licenseAcks.m = nil })
+
+	writeLicensedModel(t, "licensed", "you may use this model")
+
+	model, err := GetModel("licensed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if model.Source != "https://example.com/model" || model.Checkpoint != "sha256:abc" || len(model.LicenseDigests) != 1 {
+		t.Fatalf("unexpected provenance %q %q %v", model.Source, model.Checkpoint, model.LicenseDigests)
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader([]byte(`{"model": "licensed", "prompt": "hi"}`)))
+	GenerateHandler(c)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 before the license is acknowledged, got %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/models/licensed/license", nil)
+	licenseHandler(c, "licensed")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the license to be acknowledged, got %d: %s", w.Code, w.Body)
+	}
+
+	// acknowledgements are kept between restarts
+	licenseAcks.m = nil
+	if code, err := licenseError(model); err != nil {
+		t.Errorf("expected no license error once acknowledged, got %d: %v", code, err)
+	}
+
+	resp, err := GetModelInfo("licensed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Provenance == nil || !resp.Provenance.LicenseAcknowledged || resp.Provenance.Source != "https://example.com/model" {
+		t.Errorf("unexpected provenance %+v", resp.Provenance)
+	}
+
+	// a changed license has to be acknowledged again
+	writeLicensedModel(t, "licensed", "you may no longer use this model")
+	if model, err = GetModel("licensed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := licenseError(model); err == nil {
+		t.Error("expected a changed license to need acknowledging")
+	}
+
+	t.Setenv("OLLAMA_REQUIRE_LICENSE_ACK", "")
+	if _, err := licenseError(model); err != nil {
+		t.Errorf("expected no license error without OLLAMA_REQUIRE_LICENSE_ACK, got %v", err)
+	}
+}
+
+func TestLicenseAcksCorrupt(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_REQUIRE_LICENSE_ACK", "1")
+	licenseAcks.m = nil
+	t.Cleanup(func() { licenseAcks.m = nil })
+
+	writeLicensedModel(t, "licensed", "you may use this model")
+
+	model, err := GetModel("licensed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := licenseAcksPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, []byte(`{"sha256:`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the license needs acknowledging again rather than every request failing
+	if code, err := licenseError(model); code != http.StatusForbidden || err == nil {
+		t.Fatalf("expected a 403 for the unacknowledged license, got %d: %v", code, err)
+	}
+
+	if _, err := acknowledgeLicenses(model, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	licenseAcks.m = nil
+	if code, err := licenseError(model); err != nil {
+		t.Errorf("expected no license error once acknowledged again, got %d: %v", code, err)
+	}
+
+	if _, err := os.Stat(fp + ".corrupt"); err != nil {
+		t.Errorf("expected the corrupt file to be kept: %v", err)
+	}
+}
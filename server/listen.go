@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmorganca/ollama/npipe"
+)
+
+// Listen listens on each of addrs, which are host:port addresses, unix sockets written as unix:///path or windows
+// named pipes written as npipe:////./pipe/name. tcp listeners serve https when OLLAMA_TLS_CERT and OLLAMA_TLS_KEY
+// are set, or OLLAMA_TLS_SELF_SIGNED is, sockets and pipes are only reachable from this machine so they are left
+// as plain http
+func Listen(addrs []string) ([]net.Listener, error) {
+	config, err := tlsConfig(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var lns []net.Listener
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	for _, addr := range addrs {
+		if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+			ln, err := listenUnix(path)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			lns = append(lns, ln)
+			continue
+		}
+
+		if name, ok := npipe.Name(addr); ok {
+			ln, err := npipe.Listen(name)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			lns = append(lns, ln)
+			continue
+		}
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		if config != nil {
+			ln = tls.NewListener(ln, config)
+		}
+
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// listenUnix listens on the unix socket path, removing a socket left behind by a server which didn't exit cleanly
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the user and their group can connect
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// tlsConfig returns the tls config for tcp listeners, or nil if the server serves plain http
+func tlsConfig(addrs []string) (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("OLLAMA_TLS_CERT"), os.Getenv("OLLAMA_TLS_KEY")
+	switch {
+	case certFile != "" && keyFile != "":
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("OLLAMA_TLS_CERT and OLLAMA_TLS_KEY must both be set")
+	case os.Getenv("OLLAMA_TLS_SELF_SIGNED") != "":
+		var err error
+		certFile, keyFile, err = selfSignedCert(addrs)
+		if err != nil {
+			return nil, fmt.Errorf("self signed certificate: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("serving https with %s", certFile)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// selfSignedCert returns a certificate and key in ~/.ollama/tls, generating them if they don't exist or the
+// certificate has expired. the certificate is valid for localhost, this machine's hostname and the addresses
+// the server listens on
+func selfSignedCert(addrs []string) (string, string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(home, ".ollama", "tls")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Ollama"}, CommonName: "ollama"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if ip == nil && host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return "", "", err
+	}
+
+	log.Printf("generated a self signed certificate %s, sha256 fingerprint %x", certFile, sha256.Sum256(der))
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OLLAMA_TLS_SELF_SIGNED", "1")
+
+	socket := filepath.Join(t.TempDir(), "ollama.sock")
+	lns, err := Listen([]string{"127.0.0.1:0", "unix://" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	defer s.Close()
+
+	for _, ln := range lns {
+		go s.Serve(ln)
+	}
+
+	home, _ := os.UserHomeDir()
+	pem, err := os.ReadFile(filepath.Join(home, ".ollama", "tls", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		t.Fatal("invalid certificate")
+	}
+
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if fi, err := os.Stat(socket); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("expected a socket at %s", socket)
+	}
+
+	// a socket in use isn't replaced
+	if _, err := Listen([]string{"unix://" + socket}); err == nil {
+		t.Fatal("expected an error listening on a socket in use")
+	}
+}
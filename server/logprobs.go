@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// maxTopLogprobs is the most alternatives a request can have returned with each token
+const maxTopLogprobs = 20
+
+func checkLogprobs(logprobs bool, top int) error {
+	switch {
+	case top < 0 || top > maxTopLogprobs:
+		return errors.New("top_logprobs must be between 0 and 20")
+	case top > 0 && !logprobs:
+		return errors.New("top_logprobs needs logprobs to be set")
+	}
+
+	return nil
+}
+
+type openAITopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type openAITokenLogprob struct {
+	openAITopLogprob
+	TopLogprobs []openAITopLogprob `json:"top_logprobs"`
+}
+
+type openAIChatLogprobs struct {
+	Content []openAITokenLogprob `json:"content"`
+}
+
+// openAICompletionLogprobs are the logprobs of a completion, in the older shape of the completions api
+type openAICompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+func tokenBytes(token string) []int {
+	bytes := make([]int, len(token))
+	for i := range token {
+		bytes[i] = int(token[i])
+	}
+
+	return bytes
+}
+
+func openAIChatLogprobsOf(lps []api.TokenLogprob) *openAIChatLogprobs {
+	if lps == nil {
+		return nil
+	}
+
+	content := make([]openAITokenLogprob, len(lps))
+	for i, lp := range lps {
+		content[i] = openAITokenLogprob{
+			openAITopLogprob: openAITopLogprob{Token: lp.Token, Logprob: lp.Logprob, Bytes: tokenBytes(lp.Token)},
+			TopLogprobs:      []openAITopLogprob{},
+		}
+
+		for _, top := range lp.TopLogprobs {
+			content[i].TopLogprobs = append(content[i].TopLogprobs, openAITopLogprob{Token: top.Token, Logprob: top.Logprob, Bytes: tokenBytes(top.Token)})
+		}
+	}
+
+	return &openAIChatLogprobs{Content: content}
+}
+
+// openAICompletionLogprobsOf converts lps, offset is where the text they're the tokens of starts in the
+// completion
+func openAICompletionLogprobsOf(lps []api.TokenLogprob, offset int) *openAICompletionLogprobs {
+	if lps == nil {
+		return nil
+	}
+
+	var out openAICompletionLogprobs
+	for _, lp := range lps {
+		top := make(map[string]float64)
+		for _, t := range lp.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+
+		out.Tokens = append(out.Tokens, lp.Token)
+		out.TokenLogprobs = append(out.TokenLogprobs, lp.Logprob)
+		out.TopLogprobs = append(out.TopLogprobs, top)
+		out.TextOffset = append(out.TextOffset, offset)
+		offset += len(lp.Token)
+	}
+
+	return &out
+}
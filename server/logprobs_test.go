@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestCheckLogprobs(t *testing.T) {
+	cases := []struct {
+		logprobs bool
+		top      int
+		ok       bool
+	}{
+		{false, 0, true},
+		{true, 0, true},
+		{true, 20, true},
+		{true, 21, false},
+		{true, -1, false},
+		{false, 5, false},
+	}
+
+	for _, tt := range cases {
+		if err := checkLogprobs(tt.logprobs, tt.top); (err == nil) != tt.ok {
+			t.Errorf("logprobs %t top_logprobs %d: unexpected error %v", tt.logprobs, tt.top, err)
+		}
+	}
+}
+
+func TestOpenAICompletionLogprobs(t *testing.T) {
+	lps := []api.TokenLogprob{
+		{Token: "Hello", Logprob: -0.1, TopLogprobs: []api.TopLogprob{{Token: "Hello", Logprob: -0.1}, {Token: "Hi", Logprob: -2.5}}},
+		{Token: " world", Logprob: -0.3},
+	}
+
+	out := openAICompletionLogprobsOf(lps, 3)
+	if len(out.Tokens) != 2 || out.Tokens[1] != " world" || out.TokenLogprobs[0] != -0.1 {
+		t.Fatalf("unexpected logprobs %+v", out)
+	}
+
+	if out.TextOffset[0] != 3 || out.TextOffset[1] != 8 {
+		t.Errorf("expected offsets from the start of the completion, got %v", out.TextOffset)
+	}
+
+	if out.TopLogprobs[0]["Hi"] != -2.5 || len(out.TopLogprobs[1]) != 0 {
+		t.Errorf("unexpected top logprobs %v", out.TopLogprobs)
+	}
+
+	if openAICompletionLogprobsOf(nil, 0) != nil {
+		t.Error("expected no logprobs when none were asked for")
+	}
+}
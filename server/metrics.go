@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics are exported at /metrics in the prometheus text format
+
+var requestDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type routeKey struct {
+	method, route string
+}
+
+type requestKey struct {
+	routeKey
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // cumulative counts per bucket in requestDurationBuckets
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(requestDurationBuckets))
+	}
+
+	for i, le := range requestDurationBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+
+	// tokens generated and the time spent generating them, the rate of one over the other is the eval rate
+	tokensGenerated atomic.Int64
+	evalNanoseconds atomic.Int64
+	tokensPerSecond atomic.Uint64 // float64 bits of the eval rate of the last generation
+
+	downloadBytes atomic.Int64
+
+	responseCacheHits   atomic.Int64
+	responseCacheMisses atomic.Int64
+
+	modelLoads   atomic.Int64
+	modelUnloads atomic.Int64
+	modelCPU     atomic.Int64 // memory used by loaded models
+	modelGPU     atomic.Int64
+}
+
+var metrics = &serverMetrics{
+	requests:  make(map[requestKey]uint64),
+	durations: make(map[routeKey]*histogram),
+}
+
+// metricsMiddleware counts requests and their latency by route, the route is the pattern it matched so
+// model names and digests in paths don't create new series
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	key := routeKey{method: c.Request.Method, route: route}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.requests[requestKey{routeKey: key, status: c.Writer.Status()}]++
+
+	h, ok := metrics.durations[key]
+	if !ok {
+		h = &histogram{}
+		metrics.durations[key] = h
+	}
+	h.observe(time.Since(start).Seconds())
+}
+
+func (m *serverMetrics) observeGeneration(tokens int, d time.Duration) {
+	if tokens <= 0 || d <= 0 {
+		return
+	}
+
+	m.tokensGenerated.Add(int64(tokens))
+	m.evalNanoseconds.Add(int64(d))
+	m.tokensPerSecond.Store(math.Float64bits(float64(tokens) / d.Seconds()))
+}
+
+func (m *serverMetrics) modelLoaded(cpu, gpu int64) {
+	m.modelLoads.Add(1)
+	m.modelCPU.Add(cpu)
+	m.modelGPU.Add(gpu)
+}
+
+func (m *serverMetrics) modelUnloaded(cpu, gpu int64) {
+	m.modelUnloads.Add(1)
+	m.modelCPU.Add(-cpu)
+	m.modelGPU.Add(-gpu)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, samples ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s\n", name, s)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	var requests []string
+	for k, v := range m.requests {
+		requests = append(requests, fmt.Sprintf("{method=%q,route=%q,status=\"%d\"} %d", k.method, k.route, k.status, v))
+	}
+
+	var durations []string
+	for k, h := range m.durations {
+		labels := fmt.Sprintf("method=%q,route=%q", k.method, k.route)
+		for i, le := range requestDurationBuckets {
+			durations = append(durations, fmt.Sprintf("_bucket{%s,le=\"%s\"} %d", labels, formatFloat(le), h.counts[i]))
+		}
+
+		durations = append(durations,
+			fmt.Sprintf("_bucket{%s,le=\"+Inf\"} %d", labels, h.count),
+			fmt.Sprintf("_sum{%s} %s", labels, formatFloat(h.sum)),
+			fmt.Sprintf("_count{%s} %d", labels, h.count),
+		)
+	}
+	m.mu.Unlock()
+
+	// keep series in a stable order between scrapes
+	sort.Strings(requests)
+	sort.SliceStable(durations, func(i, j int) bool {
+		return labelsOf(durations[i]) < labelsOf(durations[j])
+	})
+
+	var active int
+	downloadControls.Range(func(_, _ any) bool {
+		active++
+		return true
+	})
+
+	writeMetric(w, "ollama_http_requests_total", "counter", "Number of HTTP requests by method, route and status.", requests...)
+	writeMetric(w, "ollama_http_request_duration_seconds", "histogram", "Latency of HTTP requests by method and route.", durations...)
+	writeMetric(w, "ollama_tokens_generated_total", "counter", "Number of tokens generated.", fmt.Sprintf(" %d", m.tokensGenerated.Load()))
+	writeMetric(w, "ollama_eval_seconds_total", "counter", "Time spent generating tokens.", fmt.Sprintf(" %s", formatFloat(time.Duration(m.evalNanoseconds.Load()).Seconds())))
+	writeMetric(w, "ollama_tokens_per_second", "gauge", "Tokens generated per second by the last generation.", fmt.Sprintf(" %s", formatFloat(math.Float64frombits(m.tokensPerSecond.Load()))))
+	writeMetric(w, "ollama_downloads_active", "gauge", "Number of blobs being downloaded.", fmt.Sprintf(" %d", active))
+	writeMetric(w, "ollama_download_bytes_total", "counter", "Bytes downloaded from registries.", fmt.Sprintf(" %d", m.downloadBytes.Load()))
+	writeMetric(w, "ollama_response_cache_hits_total", "counter", "Number of requests answered from the response cache.", fmt.Sprintf(" %d", m.responseCacheHits.Load()))
+	writeMetric(w, "ollama_response_cache_misses_total", "counter", "Number of cacheable requests which ran the model.", fmt.Sprintf(" %d", m.responseCacheMisses.Load()))
+	writeMetric(w, "ollama_model_loads_total", "counter", "Number of times a model was loaded.", fmt.Sprintf(" %d", m.modelLoads.Load()))
+	writeMetric(w, "ollama_model_unloads_total", "counter", "Number of times a model was unloaded.", fmt.Sprintf(" %d", m.modelUnloads.Load()))
+	writeMetric(w, "ollama_model_memory_bytes", "gauge", "Estimated memory used by loaded models by device.",
+		fmt.Sprintf("{device=\"cpu\"} %d", m.modelCPU.Load()),
+		fmt.Sprintf("{device=\"gpu\"} %d", m.modelGPU.Load()),
+	)
+}
+
+// labelsOf returns the labels of a histogram sample, without the le label, so samples from the same series sort together
+func labelsOf(sample string) string {
+	start, end := strings.Index(sample, "{"), strings.Index(sample, ",le=")
+	if end < 0 {
+		end = strings.Index(sample, "}")
+	}
+	return sample[start:end]
+}
+
+func MetricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	metrics.write(c.Writer)
+}
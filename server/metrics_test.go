@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetrics(t *testing.T) {
+	r := gin.New()
+	r.Use(metricsMiddleware)
+	r.GET("/api/tags", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/metrics", MetricsHandler)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		`ollama_http_requests_total{method="GET",route="/api/tags",status="200"} 1`,
+		`ollama_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`ollama_http_request_duration_seconds_bucket{method="GET",route="/api/tags",le="+Inf"} 1`,
+		`ollama_http_request_duration_seconds_count{method="GET",route="/api/tags"} 1`,
+		"# TYPE ollama_downloads_active gauge",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, w.Body.String())
+		}
+	}
+}
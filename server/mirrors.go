@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// registryMirrors returns the mirrors to try before registry. OLLAMA_REGISTRY_MIRRORS is a comma separated
+// list of mirror urls, an entry of the form registry=url mirrors only that registry, a bare url mirrors the
+// default registry
+func registryMirrors(registry string) []*url.URL {
+	var mirrors []*url.URL
+	for _, entry := range strings.Split(os.Getenv("OLLAMA_REGISTRY_MIRRORS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		mirrored, rawURL := DefaultRegistry, entry
+		if before, after, ok := strings.Cut(entry, "="); ok {
+			mirrored, rawURL = before, after
+		}
+
+		if mirrored != registry {
+			continue
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Printf("invalid registry mirror %q in OLLAMA_REGISTRY_MIRRORS", entry)
+			continue
+		}
+
+		mirrors = append(mirrors, u)
+	}
+
+	return mirrors
+}
+
+// makeMirroredRequest sends a GET for the path elements to each of mirrors in turn, falling back to mp's
+// registry if none of them can serve it, requests to the registry are re-authenticated if they are unauthorized
+func makeMirroredRequest(ctx context.Context, mp ModelPath, mirrors []*url.URL, headers http.Header, regOpts *RegistryOptions, elem ...string) (*http.Response, error) {
+	for _, mirror := range mirrors {
+		// registry credentials aren't sent to mirrors
+		resp, err := makeRequest(ctx, http.MethodGet, mirror.JoinPath(elem...), headers.Clone(), nil, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+
+			log.Printf("registry mirror %s failed, trying the next source: %v", mirror.Host, err)
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf("registry mirror %s responded with code %d, trying the next source", mirror.Host, resp.StatusCode)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	if err := refreshToken(ctx, regOpts); err != nil {
+		return nil, err
+	}
+
+	resp, err := makeRequest(ctx, http.MethodGet, mp.BaseURL().JoinPath(elem...), headers, nil, regOpts)
+	if err != nil || regOpts == nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("www-authenticate")
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return resp, nil
+	}
+
+	// the token is missing or has expired, get a new one and try again
+	resp.Body.Close()
+	if err := authenticate(ctx, challenge, regOpts); err != nil {
+		return nil, err
+	}
+
+	return makeRequest(ctx, http.MethodGet, mp.BaseURL().JoinPath(elem...), headers, nil, regOpts)
+}
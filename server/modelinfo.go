@@ -0,0 +1,45 @@
+package server
+
+import (
+	"os"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// arrays longer than this, such as the tokenizer's vocabulary, are too long to show and are left out
+const maxModelInfoArray = 32
+
+// modelInfo adds the key values and tensors of the model name's gguf file to resp
+func modelInfo(resp *api.ShowResponse, name string) error {
+	model, err := GetModel(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(model.ModelPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		return err
+	}
+
+	resp.ModelInfo = make(map[string]any)
+	for k, v := range ggml.KV() {
+		if a, ok := v.([]any); ok && len(a) > maxModelInfoArray {
+			v = nil
+		}
+
+		resp.ModelInfo[k] = v
+	}
+
+	for _, t := range ggml.Tensors() {
+		resp.Tensors = append(resp.Tensors, api.TensorInfo{Name: t.Name, Type: t.Type, Shape: t.Shape})
+	}
+
+	return nil
+}
@@ -64,6 +64,17 @@ func ParseModelPath(name string) ModelPath {
 		mp.Tag = tag
 	}
 
+	if mp.ProtocolScheme == "hf" {
+		// models pulled from hugging face are kept under the hub's host
+		if endpoint, err := huggingFaceEndpoint(); err == nil {
+			mp.ProtocolScheme, mp.Registry = endpoint.Scheme, endpoint.Host
+		}
+
+		mp.Namespace = strings.ToLower(mp.Namespace)
+		mp.Repository = strings.ToLower(mp.Repository)
+		mp.Tag = strings.ToLower(mp.Tag)
+	}
+
 	return mp
 }
 
@@ -144,3 +155,145 @@ func GetBlobsPath(digest string) (string, error) {
 
 	return path, nil
 }
+
+func GetReferrersPath(digest string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	if runtime.GOOS == "windows" {
+		digest = strings.ReplaceAll(digest, ":", "-")
+	}
+
+	path := filepath.Join(home, ".ollama", "models", "referrers", digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// modelDir is a read only directory of models set in OLLAMA_MODEL_DIRS, such as a shared mount of a team's
+// models. it has the same blobs and manifests directories as ~/.ollama/models. a directory for a namespace only
+// has the models of that namespace
+type modelDir struct {
+	namespace string
+	path      string
+}
+
+// modelDirs returns the directories in OLLAMA_MODEL_DIRS, a list like PATH of directories or namespace=directory.
+// models are looked up in ~/.ollama/models first, then in each directory in turn, and are always written to
+// ~/.ollama/models
+func modelDirs() []modelDir {
+	var dirs []modelDir
+	for _, entry := range filepath.SplitList(os.Getenv("OLLAMA_MODEL_DIRS")) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var dir modelDir
+		if namespace, path, ok := strings.Cut(entry, "="); ok {
+			dir = modelDir{namespace: namespace, path: path}
+		} else {
+			dir = modelDir{path: entry}
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+// findManifestPath returns the path of the model's manifest in ~/.ollama/models or else the first model
+// directory which has it, it's the path in ~/.ollama/models if none do. readOnly is set if the manifest is in
+// a model directory
+func (mp ModelPath) findManifestPath() (path string, readOnly bool, err error) {
+	fp, err := mp.GetManifestPath(false)
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, err := os.Stat(fp); err == nil {
+		return fp, false, nil
+	}
+
+	for _, dir := range modelDirs() {
+		if dir.namespace != "" && dir.namespace != mp.Namespace {
+			continue
+		}
+
+		path := filepath.Join(dir.path, "manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+		if _, err := os.Stat(path); err == nil {
+			return path, true, nil
+		}
+	}
+
+	return fp, false, nil
+}
+
+// findBlob returns the path of the blob in ~/.ollama/models or else the first model directory which has it, it's
+// the path in ~/.ollama/models if none do. blobs are found by their digest, so any directory's blob will do
+func findBlob(digest string) (string, error) {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(fp); err == nil {
+		return fp, nil
+	}
+
+	if runtime.GOOS == "windows" {
+		digest = strings.ReplaceAll(digest, ":", "-")
+	}
+
+	for _, dir := range modelDirs() {
+		path := filepath.Join(dir.path, "blobs", digest)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return fp, nil
+}
+
+// walkManifests calls fn with each model in ~/.ollama/models and the model directories, a model in several of
+// them is only walked where it's found first
+func walkManifests(fn func(mp ModelPath, info os.FileInfo) error) error {
+	fp, err := GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	dirs := []modelDir{{path: fp}}
+	for _, dir := range modelDirs() {
+		dirs = append(dirs, modelDir{namespace: dir.namespace, path: filepath.Join(dir.path, "manifests")})
+	}
+
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		walkFunc := func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+
+			dirname, file := filepath.Split(path)
+			dirname = strings.Trim(strings.TrimPrefix(dirname, dir.path), string(os.PathSeparator))
+			mp := ParseModelPath(strings.Join([]string{dirname, file}, ":"))
+			if seen[mp.GetFullTagname()] || (dir.namespace != "" && dir.namespace != mp.Namespace) {
+				return nil
+			}
+
+			seen[mp.GetFullTagname()] = true
+			return fn(mp, info)
+		}
+
+		if err := filepath.Walk(dir.path, walkFunc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,12 +1,17 @@
 package server
 
-import "testing"
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestParseModelPath(t *testing.T) {
 	tests := []struct {
-		name    string
-		arg    string
-		want    ModelPath
+		name string
+		arg  string
+		want ModelPath
 	}{
 		{
 			"full path https",
@@ -86,3 +91,65 @@ func TestParseModelPath(t *testing.T) {
 		})
 	}
 }
+
+func TestModelDirs(t *testing.T) {
+	// the shared models are written to a home of their own, then read from its models directory
+	shared := t.TempDir()
+	t.Setenv("HOME", shared)
+	writeTestModel(t, "shared:latest", []byte("shared weights"))
+	writeTestModel(t, "team/private:latest", []byte("team weights"))
+	writeTestModel(t, "local:latest", []byte("shadowed weights"))
+
+	t.Setenv("HOME", t.TempDir())
+	sharedDir := filepath.Join(shared, ".ollama", "models")
+	t.Setenv("OLLAMA_MODEL_DIRS", "other="+sharedDir+string(os.PathListSeparator)+sharedDir)
+	writeTestModel(t, "local:latest", []byte("local weights"))
+
+	model, err := GetModel("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bts, err := os.ReadFile(model.ModelPath); err != nil || string(bts) != "shared weights" {
+		t.Errorf("expected the shared model's weights, got %q: %v", bts, err)
+	}
+
+	// the local models are found first
+	model, err = GetModel("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bts, err := os.ReadFile(model.ModelPath); err != nil || string(bts) != "local weights" {
+		t.Errorf("expected the local model's weights, got %q: %v", bts, err)
+	}
+
+	models, err := listModels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly := make(map[string]bool)
+	for _, m := range models {
+		readOnly[m.Name] = m.ReadOnly
+	}
+
+	if len(models) != 3 || !readOnly["shared:latest"] || !readOnly["team/private:latest"] || readOnly["local:latest"] {
+		t.Errorf("unexpected models %+v", models)
+	}
+
+	if err := DeleteModel("shared"); !errors.Is(err, errReadOnlyModel) {
+		t.Errorf("expected a shared model not to be deleted, got %v", err)
+	}
+
+	// a directory for a namespace only has its models
+	t.Setenv("OLLAMA_MODEL_DIRS", "other="+sharedDir)
+	if _, err := GetModel("shared"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the shared model not to be found outside its namespace, got %v", err)
+	}
+
+	t.Setenv("OLLAMA_MODEL_DIRS", "team="+sharedDir)
+	if _, err := GetModel("team/private"); err != nil {
+		t.Errorf("expected the team's model to be found, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// statsSaveDelay is how long changes to the model stats wait to be written, so a busy server writes them once
+// every few seconds rather than on every request
+const statsSaveDelay = 10 * time.Second
+
+// modelStats are the stats of each model by its short name, kept in ~/.ollama/stats.json
+var modelStats = struct {
+	sync.Mutex
+	m      map[string]*api.ModelStats
+	saving *time.Timer // set while changes are waiting to be written
+}{}
+
+func modelStatsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "stats.json"), nil
+}
+
+// loadModelStats reads the stats the first time they're needed, modelStats must be locked
+func loadModelStats() error {
+	if modelStats.m != nil {
+		return nil
+	}
+
+	fp, err := modelStatsPath()
+	if err != nil {
+		return err
+	}
+
+	var stats map[string]*api.ModelStats
+	if err := readStateFile(fp, &stats); err != nil {
+		return err
+	}
+
+	if stats == nil {
+		stats = make(map[string]*api.ModelStats)
+	}
+
+	modelStats.m = stats
+	return nil
+}
+
+// saveModelStats writes the stats to disk, modelStats must be locked
+func saveModelStats() error {
+	fp, err := modelStatsPath()
+	if err != nil {
+		return err
+	}
+
+	return writeStateFile(fp, modelStats.m)
+}
+
+// updateModelStats changes the stats of the model with fn, they're written to disk after statsSaveDelay
+func updateModelStats(name string, fn func(*api.ModelStats)) {
+	modelStats.Lock()
+	defer modelStats.Unlock()
+
+	if err := loadModelStats(); err != nil {
+		log.Printf("couldn't read model stats: %v", err)
+		return
+	}
+
+	s, ok := modelStats.m[name]
+	if !ok {
+		s = &api.ModelStats{}
+		modelStats.m[name] = s
+	}
+
+	fn(s)
+
+	if modelStats.saving == nil {
+		modelStats.saving = time.AfterFunc(statsSaveDelay, flushModelStats)
+	}
+}
+
+// flushModelStats writes the stats now if they've changed, the server flushes them when it stops
+func flushModelStats() {
+	modelStats.Lock()
+	defer modelStats.Unlock()
+
+	if modelStats.saving == nil {
+		return
+	}
+
+	modelStats.saving.Stop()
+	modelStats.saving = nil
+	if err := saveModelStats(); err != nil {
+		log.Printf("couldn't save model stats: %v", err)
+	}
+}
+
+// markUsed counts a request to the model
+func markUsed(name string) {
+	updateModelStats(name, func(s *api.ModelStats) {
+		s.Requests++
+		s.LastUsedAt = time.Now().UTC()
+	})
+}
+
+func recordTokens(name string, m api.Metrics) {
+	updateModelStats(name, func(s *api.ModelStats) {
+		s.PromptTokens += m.PromptEvalCount
+		s.GeneratedTokens += m.EvalCount
+	})
+}
+
+func recordGPUTime(name string, d time.Duration) {
+	updateModelStats(name, func(s *api.ModelStats) {
+		s.GPUSeconds += d.Seconds()
+	})
+}
+
+// getModelStats returns a copy of the model's stats, or nil if it's never been used
+func getModelStats(name string) *api.ModelStats {
+	modelStats.Lock()
+	defer modelStats.Unlock()
+
+	if err := loadModelStats(); err != nil {
+		log.Printf("couldn't read model stats: %v", err)
+		return nil
+	}
+
+	s, ok := modelStats.m[name]
+	if !ok {
+		return nil
+	}
+
+	stats := *s
+	return &stats
+}
+
+// startModelPolicies unloads models idle for longer than OLLAMA_UNLOAD_IDLE, whatever their keep alive, and
+// warns about models which haven't been used for OLLAMA_WARN_UNUSED, e.g. 90d
+func startModelPolicies() {
+	if idle := envDuration("OLLAMA_UNLOAD_IDLE", 0); idle > 0 {
+		log.Printf("unloading models idle for more than %s", idle)
+		every := time.Minute
+		if idle < 4*every {
+			every = idle / 4
+		}
+
+		go func() {
+			for range time.Tick(every) {
+				unloadIdle(idle, time.Now())
+			}
+		}()
+	}
+
+	if unused := envDuration("OLLAMA_WARN_UNUSED", 0); unused > 0 {
+		log.Printf("warning about models unused for %s", unused)
+		go func() {
+			// a model is warned about once, and again if it's used and then goes unused again
+			warned := make(map[string]time.Time)
+			for ; ; time.Sleep(time.Hour) {
+				models, err := listModels()
+				if err != nil {
+					log.Printf("couldn't list models: %v", err)
+					continue
+				}
+
+				for _, m := range unusedModels(models, unused, time.Now()) {
+					since := m.ModifiedAt
+					if m.LastUsedAt != nil {
+						since = *m.LastUsedAt
+					}
+
+					if t, ok := warned[m.Name]; ok && t.Equal(since) {
+						continue
+					}
+
+					warned[m.Name] = since
+					text := fmt.Sprintf("%s hasn't been used since %s, deleting it would free %s", m.Name, since.Format("2006-01-02"), humanize.Bytes(uint64(m.Size)))
+					log.Print(text)
+					events.publish(api.Event{
+						Type:  eventModelUnused,
+						Model: m.Name,
+						Data:  map[string]any{"last_used_at": m.LastUsedAt, "size": m.Size},
+						Text:  text,
+					})
+				}
+			}
+		}()
+	}
+}
+
+// unloadIdle unloads the models which have had no requests for longer than idle
+func unloadIdle(idle time.Duration, now time.Time) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	for _, r := range loaded.runners {
+		if r.refs == 0 && now.Sub(r.lastUsed) > idle {
+			log.Printf("unloading %s, it's been idle for %s", r.model.ShortName, now.Sub(r.lastUsed).Round(time.Second))
+			unload(r)
+		}
+	}
+}
+
+// unusedModels returns the models which haven't been used for unused, a model which has never been used counts
+// from when it was pulled or created
+func unusedModels(models []api.ModelResponse, unused time.Duration, now time.Time) []api.ModelResponse {
+	var stale []api.ModelResponse
+	for _, m := range models {
+		since := m.ModifiedAt
+		if m.LastUsedAt != nil {
+			since = *m.LastUsedAt
+		}
+
+		if now.Sub(since) > unused {
+			stale = append(stale, m)
+		}
+	}
+
+	return stale
+}
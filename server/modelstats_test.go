@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestModelStats(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	modelStats.Lock()
+	saved := modelStats.m
+	modelStats.m = nil
+	modelStats.Unlock()
+	defer func() {
+		modelStats.Lock()
+		modelStats.m = saved
+		modelStats.Unlock()
+	}()
+
+	markUsed("llama2")
+	markUsed("llama2")
+	recordTokens("llama2", api.Metrics{PromptEvalCount: 10, EvalCount: 32})
+	recordGPUTime("llama2", 1500*time.Millisecond)
+	flushModelStats()
+
+	// the stats are read back from disk as they were
+	modelStats.Lock()
+	modelStats.m = nil
+	modelStats.Unlock()
+
+	s := getModelStats("llama2")
+	if s == nil {
+		t.Fatal("expected stats for llama2")
+	}
+
+	if s.Requests != 2 || s.PromptTokens != 10 || s.GeneratedTokens != 32 || s.GPUSeconds != 1.5 || s.LastUsedAt.IsZero() {
+		t.Errorf("got %+v", s)
+	}
+
+	if getModelStats("mistral") != nil {
+		t.Error("expected no stats for a model which hasn't been used")
+	}
+}
+
+func TestUnloadIdle(t *testing.T) {
+	now := time.Now()
+	idle := &runner{key: "idle", llm: &fakeLLM{}, model: &Model{ShortName: "idle"}, lastUsed: now.Add(-time.Hour)}
+	busy := &runner{key: "busy", llm: &fakeLLM{}, model: &Model{ShortName: "busy"}, lastUsed: now.Add(-time.Hour), refs: 1}
+	recent := &runner{key: "recent", llm: &fakeLLM{}, model: &Model{ShortName: "recent"}, lastUsed: now}
+
+	saved := loaded.runners
+	loaded.runners = map[string]*runner{idle.key: idle, busy.key: busy, recent.key: recent}
+	defer func() { loaded.runners = saved }()
+
+	unloadIdle(30*time.Minute, now)
+
+	if _, ok := loaded.runners["idle"]; ok || !idle.llm.(*fakeLLM).closed {
+		t.Error("expected the idle model to be unloaded")
+	}
+
+	for _, key := range []string{"busy", "recent"} {
+		if _, ok := loaded.runners[key]; !ok {
+			t.Errorf("expected %s to stay loaded", key)
+		}
+	}
+}
+
+func TestUnusedModels(t *testing.T) {
+	now := time.Now()
+	old, recent := now.AddDate(0, 0, -100), now.AddDate(0, 0, -10)
+	models := []api.ModelResponse{
+		{Name: "never-used", ModifiedAt: old},
+		{Name: "used-long-ago", ModifiedAt: old, LastUsedAt: &old},
+		{Name: "used-recently", ModifiedAt: old, LastUsedAt: &recent},
+		{Name: "pulled-recently", ModifiedAt: recent},
+	}
+
+	var names []string
+	for _, m := range unusedModels(models, 90*24*time.Hour, now) {
+		names = append(names, m.Name)
+	}
+
+	if len(names) != 2 || names[0] != "never-used" || names[1] != "used-long-ago" {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestModelStatsCorrupt(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	modelStats.Lock()
+	saved := modelStats.m
+	modelStats.m = nil
+	modelStats.Unlock()
+	defer func() {
+		modelStats.Lock()
+		modelStats.m = saved
+		modelStats.Unlock()
+	}()
+
+	// a file truncated by a crash is moved aside and counting starts over
+	fp, err := modelStatsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, []byte(`{"llama2": {"requests": 3`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	markUsed("llama2")
+	flushModelStats()
+
+	if s := getModelStats("llama2"); s == nil || s.Requests != 1 {
+		t.Errorf("got %+v", s)
+	}
+
+	if _, err := os.Stat(fp + ".corrupt"); err != nil {
+		t.Errorf("expected the corrupt file to be kept: %v", err)
+	}
+
+	// the new file is written whole, without leaving temp files behind
+	bts, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats map[string]*api.ModelStats
+	if err := json.Unmarshal(bts, &stats); err != nil || stats["llama2"] == nil {
+		t.Errorf("got %s, %v", bts, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("expected stats.json and stats.json.corrupt, got %v", entries)
+	}
+}
@@ -0,0 +1,616 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// the /v1 endpoints accept and return the same shapes as the openai api, so existing openai clients can
+// point their base url at ollama. requests are translated to the same paths /api/generate and
+// /api/embeddings use
+
+type openAIError struct {
+	Message string        `json:"message"`
+	Type    string        `json:"type"`
+	Code    api.ErrorCode `json:"code,omitempty"`
+}
+
+type openAIErrorResponse struct {
+	Error openAIError `json:"error"`
+}
+
+// openAIStrings is a string or a list of strings, openai accepts either for stop, prompt and input
+type openAIStrings []string
+
+func (s *openAIStrings) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*s = openAIStrings{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return errors.New("expected a string or a list of strings")
+	}
+
+	*s = many
+	return nil
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAISampling are the sampling parameters shared by chat completions and completions
+type openAISampling struct {
+	MaxTokens        *int          `json:"max_tokens"`
+	Temperature      *float64      `json:"temperature"`
+	TopP             *float64      `json:"top_p"`
+	FrequencyPenalty *float64      `json:"frequency_penalty"`
+	PresencePenalty  *float64      `json:"presence_penalty"`
+	Seed             *int          `json:"seed"`
+	Stop             openAIStrings `json:"stop"`
+}
+
+// options returns the sampling parameters as model options, only the ones which are set override the model's
+func (s openAISampling) options() map[string]interface{} {
+	// options are decoded as if they came from json, so numbers are float64s
+	opts := make(map[string]interface{})
+	if s.MaxTokens != nil {
+		opts["num_predict"] = float64(*s.MaxTokens)
+	}
+
+	if s.Temperature != nil {
+		opts["temperature"] = *s.Temperature
+	}
+
+	if s.TopP != nil {
+		opts["top_p"] = *s.TopP
+	}
+
+	if s.FrequencyPenalty != nil {
+		opts["frequency_penalty"] = *s.FrequencyPenalty
+	}
+
+	if s.PresencePenalty != nil {
+		opts["presence_penalty"] = *s.PresencePenalty
+	}
+
+	if s.Seed != nil {
+		opts["seed"] = float64(*s.Seed)
+	}
+
+	if len(s.Stop) > 0 {
+		stop := make([]interface{}, len(s.Stop))
+		for i, v := range s.Stop {
+			stop[i] = v
+		}
+		opts["stop"] = stop
+	}
+
+	return opts
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Logprobs    bool            `json:"logprobs"`
+	TopLogprobs int             `json:"top_logprobs"`
+	openAISampling
+}
+
+type openAICompletionRequest struct {
+	Model  string        `json:"model"`
+	Prompt openAIStrings `json:"prompt"`
+	Stream bool          `json:"stream"`
+
+	// Logprobs is how many of the most likely tokens to return with each token's logprob
+	Logprobs *int `json:"logprobs"`
+	openAISampling
+}
+
+type openAIEmbeddingRequest struct {
+	Model string        `json:"model"`
+	Input openAIStrings `json:"input"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChatChoice struct {
+	Index        int                 `json:"index"`
+	Message      *openAIMessage      `json:"message,omitempty"`
+	Delta        *openAIMessage      `json:"delta,omitempty"`
+	Logprobs     *openAIChatLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+type openAIChatCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []openAIChatChoice `json:"choices"`
+	Usage   *openAIUsage       `json:"usage,omitempty"`
+}
+
+type openAICompletionChoice struct {
+	Index        int                       `json:"index"`
+	Text         string                    `json:"text"`
+	Logprobs     *openAICompletionLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string                   `json:"finish_reason"`
+}
+
+type openAICompletion struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []openAICompletionChoice `json:"choices"`
+	Usage   *openAIUsage             `json:"usage,omitempty"`
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIList[T any] struct {
+	Object string `json:"object"`
+	Data   []T    `json:"data"`
+}
+
+type openAIEmbedding struct {
+	Object    string    `json:"object"`
+	Embedding []float64 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type openAIEmbeddingList struct {
+	openAIList[openAIEmbedding]
+	Model string      `json:"model"`
+	Usage openAIUsage `json:"usage"`
+}
+
+func openAIAbort(c *gin.Context, status int, err error) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "api_error"
+	}
+
+	code, _ := errorCode(status, err)
+	c.AbortWithStatusJSON(status, openAIErrorResponse{Error: openAIError{Message: err.Error(), Type: errType, Code: code}})
+}
+
+// openAILoad waits for a turn on the model name and loads it with opts, replying with an error if it can't.
+// the caller releases the runner once it's done
+func openAILoad(c *gin.Context, name string, opts map[string]interface{}) (*Model, *runnerRef, bool) {
+	if name == "" {
+		openAIAbort(c, http.StatusBadRequest, errors.New("model is required"))
+		return nil, nil, false
+	}
+
+	if err := api.ValidateOptions(opts); err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return nil, nil, false
+	}
+
+	var lerr *limitError
+	if errors.As(checkPredictLimit(opts), &lerr) {
+		openAIAbort(c, lerr.code, lerr)
+		return nil, nil, false
+	}
+
+	auditModel(c, name)
+	model, err := GetModel(name)
+	if err != nil {
+		openAIAbort(c, http.StatusNotFound, errModelNotFound(name))
+		return nil, nil, false
+	}
+
+	if code, err := licenseError(model); err != nil {
+		openAIAbort(c, code, err)
+		return nil, nil, false
+	}
+
+	runner, err := acquireModel(c.Request.Context(), c.GetString("workDir"), model, opts, defaultSessionDuration, nil)
+	if errors.Is(err, errQueueFull) {
+		openAIAbort(c, http.StatusServiceUnavailable, err)
+		return nil, nil, false
+	} else if err != nil && timedOut(c.Request.Context()) {
+		openAIAbort(c, http.StatusGatewayTimeout, cancelRequestTimeout)
+		return nil, nil, false
+	} else if err != nil {
+		openAIAbort(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	return model, runner, true
+}
+
+func openAIID(prefix string) string {
+	return fmt.Sprintf("%s-%x", prefix, rand.Int63())
+}
+
+// finishReason is why a model loaded with opts stopped generating r
+func finishReason(opts api.Options, r api.GenerateResponse) *string {
+	reason := "stop"
+	if n := opts.NumPredict; n > 0 && r.EvalCount >= n {
+		reason = "length"
+	}
+	return &reason
+}
+
+func usage(r api.GenerateResponse) *openAIUsage {
+	return &openAIUsage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+// openAIPromptLimit replies with an error if prompt is over OLLAMA_MAX_PROMPT_TOKENS
+func openAIPromptLimit(c *gin.Context, runner *runnerRef, prompt string) bool {
+	err := checkPromptLimit(c.Request.Context(), runner.llm, prompt, 0)
+	var lerr *limitError
+	if errors.As(err, &lerr) {
+		openAIAbort(c, lerr.code, lerr)
+		return false
+	} else if err != nil {
+		openAIAbort(c, http.StatusInternalServerError, err)
+		return false
+	}
+
+	return true
+}
+
+// openAIPredict runs predict on runner. if streaming, chunk is called for each response and sent as a server-sent
+// event, otherwise the reply is final, called with the whole response and all its logprobs once the model is done
+func openAIPredict(c *gin.Context, runner *runnerRef, predict llm.PredictOpts, stream bool, chunk func(api.GenerateResponse) any, final func(string, api.GenerateResponse) any) {
+	ctx := c.Request.Context()
+
+	generationStarted(runner.model.ShortName, "")
+	interactive.begin()
+	defer interactive.end()
+
+	onResponse := func(r api.GenerateResponse) {
+		if r.Done {
+			metrics.observeGeneration(r.EvalCount, r.EvalDuration)
+			auditTokens(c, r.Metrics)
+			generationFinished(runner.model.ShortName, "", r.Metrics)
+		}
+	}
+
+	if !stream {
+		var sb strings.Builder
+		var logprobs []api.TokenLogprob
+		var last api.GenerateResponse
+		if err := runner.llm.Predict(ctx, predict, func(r api.GenerateResponse) {
+			onResponse(r)
+			sb.WriteString(r.Response)
+			logprobs = append(logprobs, r.Logprobs...)
+			last = r
+		}); err != nil && timedOut(ctx) {
+			openAIAbort(c, http.StatusGatewayTimeout, cancelRequestTimeout)
+			return
+		} else if err != nil {
+			openAIAbort(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		if predict.Logprobs {
+			last.Logprobs = append([]api.TokenLogprob{}, logprobs...)
+		}
+
+		c.JSON(http.StatusOK, final(sb.String(), last))
+		return
+	}
+
+	ch := make(chan any)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+
+		// once the client has gone nothing is reading the stream, don't block on it
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+			}
+		}
+
+		if err := runner.llm.Predict(ctx, predict, func(r api.GenerateResponse) {
+			onResponse(r)
+			send(chunk(r))
+		}); err != nil {
+			if timedOut(ctx) {
+				err = cancelRequestTimeout
+			}
+
+			code, _ := errorCode(0, err)
+			send(openAIErrorResponse{Error: openAIError{Message: err.Error(), Type: "api_error", Code: code}})
+		}
+	}()
+
+	streamEvents(c, ch)
+
+	// the stream ends early if the client goes, runner is only released once the model has stopped
+	<-done
+}
+
+// streamEvents writes each value from ch as a server-sent event, ending with data: [DONE] as openai clients expect
+func streamEvents(c *gin.Context, ch chan any) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Stream(func(w io.Writer) bool {
+		val, ok := <-ch
+		if !ok {
+			if _, err := io.WriteString(w, "data: [DONE]\n\n"); err != nil {
+				log.Printf("streamEvents: w.Write failed with %s", err)
+			}
+			return false
+		}
+
+		bts, err := json.Marshal(val)
+		if err != nil {
+			log.Printf("streamEvents: json.Marshal failed with %s", err)
+			return false
+		}
+
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", bts); err != nil {
+			log.Printf("streamEvents: w.Write failed with %s", err)
+			return false
+		}
+
+		return true
+	})
+}
+
+func OpenAIChatCompletionsHandler(c *gin.Context) {
+	var req openAIChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		openAIAbort(c, http.StatusBadRequest, errors.New("messages are required"))
+		return
+	}
+
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	model, runner, ok := openAILoad(c, req.Model, req.options())
+	if !ok {
+		return
+	}
+	defer runner.release()
+
+	var messages []api.Message
+	for _, m := range req.Messages {
+		messages = append(messages, api.Message{Role: m.Role, Content: m.Content})
+	}
+
+	prompt, err := chatPrompt(model, messages, nil)
+	if err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !openAIPromptLimit(c, runner, prompt) {
+		return
+	}
+
+	opts, err := runner.requestOptions(req.options())
+	if err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	id, created := openAIID("chatcmpl"), time.Now().Unix()
+	predict := llm.PredictOpts{Prompt: prompt, Logprobs: req.Logprobs, TopLogprobs: req.TopLogprobs, Options: &opts}
+	openAIPredict(c, runner, predict, req.Stream,
+		func(r api.GenerateResponse) any {
+			choice := openAIChatChoice{
+				Delta:    &openAIMessage{Role: "assistant", Content: r.Response},
+				Logprobs: openAIChatLogprobsOf(r.Logprobs),
+			}
+			if r.Done {
+				choice.FinishReason = finishReason(opts, r)
+			}
+
+			return openAIChatCompletion{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openAIChatChoice{choice},
+			}
+		},
+		func(content string, r api.GenerateResponse) any {
+			return openAIChatCompletion{
+				ID:      id,
+				Object:  "chat.completion",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openAIChatChoice{{
+					Message:      &openAIMessage{Role: "assistant", Content: content},
+					Logprobs:     openAIChatLogprobsOf(r.Logprobs),
+					FinishReason: finishReason(opts, r),
+				}},
+				Usage: usage(r),
+			}
+		},
+	)
+}
+
+func OpenAICompletionsHandler(c *gin.Context) {
+	var req openAICompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Prompt) != 1 {
+		openAIAbort(c, http.StatusBadRequest, errors.New("prompt must be a single string"))
+		return
+	}
+
+	predict := llm.PredictOpts{Prompt: req.Prompt[0]}
+	if req.Logprobs != nil {
+		predict.Logprobs, predict.TopLogprobs = true, *req.Logprobs
+		if err := checkLogprobs(true, *req.Logprobs); err != nil {
+			openAIAbort(c, http.StatusBadRequest, errors.New("logprobs must be between 0 and 20"))
+			return
+		}
+	}
+
+	_, runner, ok := openAILoad(c, req.Model, req.options())
+	if !ok {
+		return
+	}
+	defer runner.release()
+
+	opts, err := runner.requestOptions(req.options())
+	if err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+	predict.Options = &opts
+
+	if !openAIPromptLimit(c, runner, predict.Prompt) {
+		return
+	}
+
+	// completions are raw text, the prompt is passed to the model without its template
+	id, created := openAIID("cmpl"), time.Now().Unix()
+
+	// offsets of streamed tokens count from the start of the completion
+	var offset int
+	openAIPredict(c, runner, predict, req.Stream,
+		func(r api.GenerateResponse) any {
+			choice := openAICompletionChoice{Text: r.Response, Logprobs: openAICompletionLogprobsOf(r.Logprobs, offset)}
+			offset += len(r.Response)
+			if r.Done {
+				choice.FinishReason = finishReason(opts, r)
+			}
+
+			return openAICompletion{
+				ID:      id,
+				Object:  "text_completion",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openAICompletionChoice{choice},
+			}
+		},
+		func(text string, r api.GenerateResponse) any {
+			return openAICompletion{
+				ID:      id,
+				Object:  "text_completion",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openAICompletionChoice{{
+					Text:         text,
+					Logprobs:     openAICompletionLogprobsOf(r.Logprobs, 0),
+					FinishReason: finishReason(opts, r),
+				}},
+				Usage: usage(r),
+			}
+		},
+	)
+}
+
+func OpenAIEmbeddingsHandler(c *gin.Context) {
+	var req openAIEmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openAIAbort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Input) == 0 {
+		openAIAbort(c, http.StatusBadRequest, errors.New("input is required"))
+		return
+	}
+
+	_, runner, ok := openAILoad(c, req.Model, nil)
+	if !ok {
+		return
+	}
+	defer runner.release()
+
+	if !runner.options.EmbeddingOnly {
+		openAIAbort(c, http.StatusBadRequest, errors.New("embedding option must be set to true"))
+		return
+	}
+
+	resp := openAIEmbeddingList{
+		openAIList: openAIList[openAIEmbedding]{Object: "list"},
+		Model:      req.Model,
+	}
+
+	for i, input := range req.Input {
+		embedding, err := runner.llm.Embedding(c.Request.Context(), input)
+		if err != nil {
+			log.Printf("embedding generation failed: %v", err)
+			openAIAbort(c, http.StatusInternalServerError, errors.New("failed to generate embedding"))
+			return
+		}
+
+		tokens, err := runner.llm.Encode(c.Request.Context(), input)
+		if err != nil {
+			openAIAbort(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp.Data = append(resp.Data, openAIEmbedding{Object: "embedding", Embedding: embedding, Index: i})
+		resp.Usage.PromptTokens += len(tokens)
+		resp.Usage.TotalTokens += len(tokens)
+	}
+
+	auditTokens(c, api.Metrics{PromptEvalCount: resp.Usage.PromptTokens})
+	c.JSON(http.StatusOK, resp)
+}
+
+func OpenAIModelsHandler(c *gin.Context) {
+	models, err := listModels()
+	if err != nil {
+		openAIAbort(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := openAIList[openAIModel]{Object: "list", Data: []openAIModel{}}
+	for _, m := range models {
+		resp.Data = append(resp.Data, openAIModel{
+			ID:      m.Name,
+			Object:  "model",
+			Created: m.ModifiedAt.Unix(),
+			OwnedBy: ParseModelPath(m.Name).Namespace,
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// loadOptions are the options of a request which the model has to be loaded with, the sampling options are
+// set for each prediction so requests which only differ in them share the loaded model
+func loadOptions(opts map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	for k, v := range opts {
+		if !api.IsPredictOption(k) {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
+// requestOptions are the options a request generates with, the runner's options with the request's on top
+func (r *runner) requestOptions(opts map[string]interface{}) (api.Options, error) {
+	merged := r.options
+	if err := merged.FromMap(opts); err != nil {
+		return api.Options{}, err
+	}
+
+	capPredict(&merged)
+	return merged, nil
+}
+
+// checkOptions replies with each of the request's options which can't be used, if there are any
+func checkOptions(c *gin.Context, opts map[string]interface{}) bool {
+	var lerr *limitError
+	if errors.As(checkPredictLimit(opts), &lerr) {
+		replyError(c, lerr.code, lerr)
+		return false
+	}
+
+	err := api.ValidateOptions(opts)
+	if err == nil {
+		return true
+	}
+
+	var oerr *api.OptionsError
+	if errors.As(err, &oerr) {
+		resp := errorResponse(http.StatusBadRequest, err)
+		resp["options"] = oerr.Errors
+		c.JSON(http.StatusBadRequest, resp)
+		return false
+	}
+
+	replyError(c, http.StatusBadRequest, err)
+	return false
+}
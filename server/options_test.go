@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckOptions(t *testing.T) {
+	var opts map[string]interface{}
+	json.Unmarshal([]byte(`{"temperature": 0.2, "top_p": 1.5, "temprature": 1, "num_ctx": 10.5, "stop": ["a", 1], "mirostat": 2}`), &opts)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	if checkOptions(c, opts) {
+		t.Fatal("expected the options to be rejected")
+	}
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	var resp struct {
+		Error   string `json:"error"`
+		Options []struct {
+			Option string `json:"option"`
+			Reason string `json:"reason"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"num_ctx":    "must be a whole number",
+		"stop":       "must be a list of strings",
+		"temprature": "is not a known option",
+		"top_p":      "must be between 0 and 1",
+	}
+	if len(resp.Options) != len(expected) {
+		t.Fatalf("expected %d invalid options, got %+v", len(expected), resp.Options)
+	}
+
+	for _, o := range resp.Options {
+		if expected[o.Option] != o.Reason {
+			t.Errorf("%s: expected %q, got %q", o.Option, expected[o.Option], o.Reason)
+		}
+	}
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	if !checkOptions(c, map[string]interface{}{"temperature": 0.0, "num_predict": -2.0, "penalize_newline": false}) {
+		t.Error("expected valid options to be accepted")
+	}
+}
+
+func TestSchedKeySamplingOptions(t *testing.T) {
+	model := &Model{Digest: "sha256:abc"}
+
+	a, _ := schedKey(model, map[string]interface{}{"temperature": 0.1, "num_ctx": 4096.0})
+	b, _ := schedKey(model, map[string]interface{}{"temperature": 0.9, "stop": []interface{}{"\n"}, "num_ctx": 4096.0})
+	if a != b {
+		t.Errorf("expected requests which only differ in sampling options to share a model, got %q and %q", a, b)
+	}
+
+	d, _ := schedKey(model, map[string]interface{}{"num_ctx": 8192.0})
+	if a == d {
+		t.Error("expected a different context size to load the model again")
+	}
+}
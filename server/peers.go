@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registryPeers returns the other ollama servers to try for blobs before any mirror or registry,
+// configured with OLLAMA_REGISTRY_PEERS as a comma separated list of urls
+func registryPeers() []*url.URL {
+	var peers []*url.URL
+	for _, entry := range strings.Split(os.Getenv("OLLAMA_REGISTRY_PEERS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Printf("invalid registry peer %q in OLLAMA_REGISTRY_PEERS", entry)
+			continue
+		}
+
+		peers = append(peers, u)
+	}
+
+	return peers
+}
+
+// blobSources returns where to try downloading blobs from before registry, blobs are addressed by
+// digest and verified once downloaded, so any peer which has one can serve it
+func blobSources(registry string) []*url.URL {
+	return append(registryPeers(), registryMirrors(registry)...)
+}
+
+// shareBlobsEnabled reports whether OLLAMA_SHARE_BLOBS is set, the blobs are then served to other servers without an api
+// key. a value which isn't a bool is an error rather than sharing them
+func shareBlobsEnabled() (bool, error) {
+	s := os.Getenv("OLLAMA_SHARE_BLOBS")
+	if s == "" {
+		return false, nil
+	}
+
+	share, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for OLLAMA_SHARE_BLOBS: %q, expected true or false", s)
+	}
+
+	return share, nil
+}
+
+var blobDigestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// SharedBlobHandler serves the blobs of local models to other ollama servers on the same network, it only
+// answers blob requests of the registry api and ignores the repository since blobs are shared between models
+func SharedBlobHandler(c *gin.Context) {
+	parts := strings.Split(strings.Trim(c.Param("path"), "/"), "/")
+	if len(parts) < 3 || parts[len(parts)-2] != "blobs" || !blobDigestPattern.MatchString(parts[len(parts)-1]) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	fp, err := findBlob(parts[len(parts)-1])
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := os.Stat(fp); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	// ServeFile handles range requests so peers can resume interrupted downloads
+	http.ServeFile(c.Writer, c.Request, fp)
+}
@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestShareBlobsEnabled(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{"", false, false},
+		{"1", true, false},
+		{"true", true, false},
+		{"0", false, false},
+		{"false", false, false},
+		{"yes", false, true},
+	}
+
+	for _, tt := range cases {
+		t.Setenv("OLLAMA_SHARE_BLOBS", tt.value)
+		got, err := shareBlobsEnabled()
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("OLLAMA_SHARE_BLOBS=%q: got %t, %v", tt.value, got, err)
+		}
+	}
+}
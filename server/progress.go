@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// rateWindow is how often the speed of a transfer is sampled
+const rateWindow = time.Second
+
+// transferRate estimates the speed of a transfer from how far it has got over time
+type transferRate struct {
+	mu    sync.Mutex
+	start time.Time // start of the current sample
+	bytes int64     // bytes completed at the start of the current sample
+	rate  float64   // smoothed bytes per second
+}
+
+// update records that completed bytes of the transfer are done
+func (t *transferRate) update(completed int64) {
+	t.updateAt(completed, time.Now())
+}
+
+func (t *transferRate) updateAt(completed int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.start.IsZero() || completed < t.bytes:
+		// the first update, or the transfer started over
+		t.start, t.bytes = now, completed
+	case now.Sub(t.start) >= rateWindow:
+		sample := float64(completed-t.bytes) / now.Sub(t.start).Seconds()
+		if t.rate == 0 {
+			t.rate = sample
+		} else {
+			// smooth out bursts so the estimate doesn't jump around
+			t.rate = 0.3*sample + 0.7*t.rate
+		}
+
+		t.start, t.bytes = now, completed
+	}
+}
+
+// reset forgets the measured speed, e.g. while a transfer is paused
+func (t *transferRate) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.start, t.bytes, t.rate = time.Time{}, 0, 0
+}
+
+// estimate returns the bytes per second of the transfer and the time left until completed reaches total
+func (t *transferRate) estimate(completed, total int64) (int64, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.rate <= 0 {
+		return 0, 0
+	}
+
+	var eta time.Duration
+	if total > completed {
+		eta = time.Duration(float64(total-completed) / t.rate * float64(time.Second))
+	}
+
+	return int64(t.rate), eta
+}
+
+// sequenced numbers each progress response passed to fn in the order they are sent
+func sequenced(fn func(api.ProgressResponse)) func(api.ProgressResponse) {
+	var mu sync.Mutex
+	var seq int
+	return func(r api.ProgressResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		seq++
+		r.Seq = seq
+		fn(r)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestTransferRate(t *testing.T) {
+	// a step updates the rate with completed bytes at its time, or resets it
+	type step struct {
+		at        time.Duration
+		completed int64
+		reset     bool
+	}
+
+	cases := []struct {
+		name      string
+		steps     []step
+		completed int64
+		total     int64
+		wantRate  int64
+		wantETA   time.Duration
+	}{
+		{"no updates", nil, 0, 1000, 0, 0},
+		{"before the first window", []step{{0, 0, false}, {500 * time.Millisecond, 500, false}}, 500, 1000, 0, 0},
+		{"one window", []step{{0, 0, false}, {time.Second, 1000, false}}, 1000, 3000, 1000, 2 * time.Second},
+		{"smoothed", []step{{0, 0, false}, {time.Second, 1000, false}, {2 * time.Second, 3000, false}}, 3000, 4300, 1300, time.Second},
+		{"burst within a window", []step{{0, 0, false}, {time.Second, 1000, false}, {1500 * time.Millisecond, 9000, false}}, 9000, 10000, 1000, time.Second},
+		{"started over", []step{{0, 0, false}, {time.Second, 1000, false}, {1500 * time.Millisecond, 100, false}, {2500 * time.Millisecond, 600, false}}, 600, 2300, 850, 2 * time.Second},
+		{"reset after a pause", []step{{0, 0, false}, {time.Second, 1000, false}, {reset: true}}, 1000, 2000, 0, 0},
+		{"resumed after a pause", []step{{0, 0, false}, {time.Second, 4000, false}, {reset: true}, {10 * time.Second, 4000, false}, {11 * time.Second, 4500, false}}, 4500, 5500, 500, 2 * time.Second},
+		{"completed", []step{{0, 0, false}, {time.Second, 1000, false}}, 1000, 1000, 1000, 0},
+		{"completed past the total", []step{{0, 0, false}, {time.Second, 1000, false}}, 1200, 1000, 1000, 0},
+	}
+
+	start := time.Now()
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var r transferRate
+			for _, s := range tt.steps {
+				if s.reset {
+					r.reset()
+				} else {
+					r.updateAt(s.completed, start.Add(s.at))
+				}
+			}
+
+			rate, eta := r.estimate(tt.completed, tt.total)
+			if rate != tt.wantRate || eta != tt.wantETA {
+				t.Errorf("got %d B/s and %s left, want %d B/s and %s", rate, eta, tt.wantRate, tt.wantETA)
+			}
+		})
+	}
+}
+
+func TestSequenced(t *testing.T) {
+	var seqs []int
+	fn := sequenced(func(r api.ProgressResponse) { seqs = append(seqs, r.Seq) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(api.ProgressResponse{Status: "pulling"})
+		}()
+	}
+	wg.Wait()
+
+	// responses are numbered in the order they're sent, whichever goroutine sends them
+	for i, seq := range seqs {
+		if seq != i+1 {
+			t.Fatalf("got sequence numbers %v", seqs)
+		}
+	}
+
+	if len(seqs) != 100 {
+		t.Errorf("got %d responses, want 100", len(seqs))
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the annotations of a manifest with where the model came from. the source is the url of its upstream repository,
+// the checkpoint the digest of the weights it was created from and the licenses the digests of its license layers
+const (
+	annotationSource     = "org.opencontainers.image.source"
+	annotationCheckpoint = "ai.ollama.checkpoint"
+	annotationLicenses   = "ai.ollama.licenses"
+)
+
+// provenanceAnnotations returns the annotations of a manifest with layers, or nil if there's nothing to annotate
+func provenanceAnnotations(source, checkpoint string, layers []*Layer) map[string]string {
+	annotations := make(map[string]string)
+	if source != "" {
+		annotations[annotationSource] = source
+	}
+
+	if checkpoint != "" {
+		annotations[annotationCheckpoint] = checkpoint
+	}
+
+	var licenses []string
+	for _, layer := range layers {
+		if layer.MediaType == "application/vnd.ollama.image.license" {
+			licenses = append(licenses, layer.Digest)
+		}
+	}
+
+	if len(licenses) > 0 {
+		annotations[annotationLicenses] = strings.Join(licenses, ",")
+	}
+
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	return annotations
+}
+
+// baseProvenance is the source and checkpoint of a model created from mf. models from before they were annotated
+// were created from the weights of their model layer
+func baseProvenance(mf *ManifestV2) (string, string) {
+	source, checkpoint := mf.Annotations[annotationSource], mf.Annotations[annotationCheckpoint]
+	if checkpoint == "" {
+		for _, layer := range mf.Layers {
+			if layer.MediaType == "application/vnd.ollama.image.model" {
+				checkpoint = layer.Digest
+			}
+		}
+	}
+
+	return source, checkpoint
+}
+
+// checkpointDigest is the digest of a checkpoint directory, over the names and contents of its files in order
+func checkpointDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const (
+	// defaultDownloadConnections is how many blobs the server downloads at once across every pull, override it
+	// with OLLAMA_MAX_DOWNLOAD_CONNECTIONS
+	defaultDownloadConnections = 8
+
+	// defaultParallelLayers is how many layers of a model a pull downloads at once, override it with
+	// OLLAMA_MAX_PARALLEL_LAYERS
+	defaultParallelLayers = 4
+)
+
+// connectionBudget limits the connections open to registries for downloads, it's shared by every pull so
+// pulling several models at once doesn't open more than the limit
+type connectionBudget struct {
+	mu       sync.Mutex
+	active   int
+	released chan struct{} // closed when a connection is released, for waiters to try again
+}
+
+var downloadConnections = &connectionBudget{}
+
+// acquire waits for a connection to be free, the limit is read each time so it can be changed while waiting
+func (b *connectionBudget) acquire(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		limit := envInt("OLLAMA_MAX_DOWNLOAD_CONNECTIONS", defaultDownloadConnections)
+		if limit <= 0 || b.active < limit {
+			b.active++
+			b.mu.Unlock()
+			return nil
+		}
+
+		if b.released == nil {
+			b.released = make(chan struct{})
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-released:
+		}
+	}
+}
+
+func (b *connectionBudget) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active--
+	if b.released != nil {
+		close(b.released)
+		b.released = nil
+	}
+}
+
+// downloadLayers downloads the missing layers of a model, several at once. the largest layers start first so
+// the small ones, such as templates and adapters, download alongside them rather than after. the first layer
+// to fail stops the others
+func downloadLayers(ctx context.Context, mp ModelPath, layers []*Layer, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	layers = append([]*Layer(nil), layers...)
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].Size > layers[j].Size
+	})
+
+	parallel := envInt("OLLAMA_MAX_PARALLEL_LAYERS", defaultParallelLayers)
+	if regOpts.Background {
+		parallel = envInt("OLLAMA_BACKGROUND_PARALLEL_LAYERS", defaultBackgroundParallelLayers)
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, parallel)
+
+	for _, layer := range layers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(layer *Layer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := downloadLayer(ctx, mp, layer, regOpts, fn); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel(err)
+				})
+			}
+		}(layer)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return context.Cause(ctx)
+}
+
+// downloadLayer fetches a layer from a peer which has it, or else downloads it from the registry
+func downloadLayer(ctx context.Context, mp ModelPath, layer *Layer, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	if ok, err := fetchSharedBlob(ctx, layer, fn); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	return downloadBlob(ctx, downloadOpts{
+		mp:      mp,
+		digest:  layer.Digest,
+		regOpts: regOpts,
+		fn:      fn,
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// quantizeLayer quantizes the model weights in layer to fileType, returning a layer for the quantized weights.
+// the quantized weights are written to a temporary file in workDir, remove it once the layer is saved
+func quantizeLayer(ctx context.Context, workDir string, layer *LayerReader, fileType string, fn func(api.ProgressResponse)) (*LayerReader, error) {
+	// weights which are already in the blob store are read from there, newly added ones from their file
+	src, err := findBlob(layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := layer.Reader.(*os.File); ok {
+		src = f.Name()
+	}
+
+	dst, err := os.CreateTemp(workDir, "quantize-*.gguf")
+	if err != nil {
+		return nil, err
+	}
+	dst.Close()
+
+	status := fmt.Sprintf("quantizing model to %s", strings.ToUpper(fileType))
+	fn(api.ProgressResponse{Status: status})
+	if err := llm.Quantize(ctx, workDir, src, dst.Name(), fileType, func(completed, total int) {
+		fn(api.ProgressResponse{Status: status, Digest: layer.Digest, Total: total, Completed: completed})
+	}); err != nil {
+		os.Remove(dst.Name())
+		return nil, err
+	}
+
+	f, err := os.Open(dst.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	quantized, err := CreateLayer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	quantized.MediaType = layer.MediaType
+	return quantized, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of bytes read across every reader sharing it, it holds at most one
+// second's worth of tokens so an idle period doesn't allow a long burst afterwards
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+var downloadBucket = &tokenBucket{}
+
+func (b *tokenBucket) setRate(rate uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+}
+
+// take removes n tokens from the bucket and waits until the bucket is no longer in debt
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.tokens -= float64(n)
+	b.last = now
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-t.C:
+		return nil
+	}
+}
+
+type rateLimitedReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if err := r.bucket.take(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// Referrer describes an artifact (e.g. an SBOM or signature) which the registry reports as
+// referring to a blob through the OCI referrers API
+type Referrer struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType,omitempty"`
+	Digest       string `json:"digest"`
+	Size         int    `json:"size"`
+}
+
+type referrersIndex struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	MediaType     string     `json:"mediaType"`
+	Manifests     []Referrer `json:"manifests"`
+}
+
+// pullReferrers downloads the artifacts referring to the subject digest and records them so they
+// are kept for as long as the subject blob is
+func pullReferrers(ctx context.Context, mp ModelPath, subject string, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "referrers", subject)
+
+	headers := make(http.Header)
+	headers.Set("Accept", "application/vnd.oci.image.index.v1+json")
+	resp, err := makeRequest(ctx, "GET", requestURL, headers, nil, regOpts)
+	if err != nil {
+		log.Printf("couldn't get referrers: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// the registry doesn't support the referrers api or there is nothing referring to this blob
+		return nil
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		return registryError("referrers", resp.StatusCode, body)
+	}
+
+	bts, err := readManifest(resp)
+	if err != nil {
+		return err
+	}
+
+	var index referrersIndex
+	if err := json.Unmarshal(bts, &index); err != nil {
+		return err
+	}
+
+	if len(index.Manifests) == 0 {
+		return nil
+	}
+
+	for _, r := range index.Manifests {
+		fn(api.ProgressResponse{Status: fmt.Sprintf("pulling referrer %s", r.Digest)})
+
+		manifest, err := pullReferrerManifest(ctx, mp, r, regOpts)
+		if err != nil {
+			return err
+		}
+
+		var layers []*Layer
+		layers = append(layers, manifest.Layers...)
+		if manifest.Config.Digest != "" {
+			layers = append(layers, &manifest.Config)
+		}
+
+		for _, layer := range layers {
+			if err := downloadBlob(ctx, downloadOpts{
+				mp:      mp,
+				digest:  layer.Digest,
+				regOpts: regOpts,
+				fn:      fn,
+			}); err != nil {
+				return err
+			}
+
+			if err := verifyBlob(layer.Digest); err != nil {
+				return err
+			}
+		}
+	}
+
+	fp, err := GetReferrersPath(subject)
+	if err != nil {
+		return err
+	}
+
+	bts, err = json.Marshal(index.Manifests)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fp, bts, 0o644)
+}
+
+// pullReferrerManifest fetches the manifest of a referrer and stores it in the blobs directory
+func pullReferrerManifest(ctx context.Context, mp ModelPath, r Referrer, regOpts *RegistryOptions) (*ManifestV2, error) {
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", r.Digest)
+
+	headers := make(http.Header)
+	headers.Set("Accept", r.MediaType)
+	resp, err := makeRequest(ctx, "GET", requestURL, headers, nil, regOpts)
+	if err != nil {
+		log.Printf("couldn't get referrer manifest: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, registryError("referrer manifest", resp.StatusCode, body)
+	}
+
+	bts, err := readManifest(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if digest, _ := GetSHA256Digest(bytes.NewReader(bts)); digest != r.Digest {
+		return nil, fmt.Errorf("%w: want %s, got %s", errDigestMismatch, r.Digest, digest)
+	}
+
+	var m ManifestV2
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return nil, err
+	}
+
+	if err := localBlobs.Put(ctx, r.Digest, bytes.NewReader(bts), int64(len(bts))); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// referrerDigests returns the digests of every blob stored for the artifacts referring to subject
+func referrerDigests(subject string) ([]string, error) {
+	fp, err := GetReferrersPath(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var referrers []Referrer
+	if err := json.Unmarshal(bts, &referrers); err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	for _, r := range referrers {
+		digests = append(digests, r.Digest)
+
+		blob, err := findBlob(r.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		bts, err := os.ReadFile(blob)
+		if err != nil {
+			// the referrer manifest is missing, there's nothing else to keep for it
+			continue
+		}
+
+		var m ManifestV2
+		if err := json.Unmarshal(bts, &m); err != nil {
+			continue
+		}
+
+		for _, layer := range m.Layers {
+			digests = append(digests, layer.Digest)
+		}
+
+		if m.Config.Digest != "" {
+			digests = append(digests, m.Config.Digest)
+		}
+	}
+
+	return digests, nil
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// residency describes the loaded models for /api/ps. it has its own lock so listing loaded models doesn't wait
+// for loaded.mu
+var residency struct {
+	mu     sync.Mutex
+	models map[string]*api.ProcessModelResponse // by runner key
+}
+
+// markLoaded records that r is loaded, it is up to the caller to lock loaded.mu
+func markLoaded(r *runner) {
+	cpu, gpu := r.llm.Memory()
+	metrics.modelLoaded(cpu, gpu)
+	events.publish(api.Event{
+		Type:  eventModelLoaded,
+		Model: r.model.ShortName,
+		Data:  map[string]any{"size_cpu": cpu, "size_gpu": gpu},
+		Text:  fmt.Sprintf("loaded %s", r.model.ShortName),
+	})
+
+	residency.mu.Lock()
+	defer residency.mu.Unlock()
+	if residency.models == nil {
+		residency.models = make(map[string]*api.ProcessModelResponse)
+	}
+
+	residency.models[r.key] = &api.ProcessModelResponse{
+		Name:    r.model.ShortName,
+		Digest:  r.model.Digest,
+		Size:    cpu + gpu,
+		SizeCPU: cpu,
+		SizeGPU: gpu,
+	}
+}
+
+// unload stops r, it is up to the caller to lock loaded.mu
+func unload(r *runner) {
+	if loaded.runners[r.key] != r {
+		return
+	}
+
+	r.llm.Close()
+	delete(loaded.runners, r.key)
+	if r.expireTimer != nil {
+		r.expireTimer.Stop()
+	}
+
+	metrics.modelUnloaded(r.llm.Memory())
+	events.publish(api.Event{Type: eventModelUnloaded, Model: r.model.ShortName, Text: fmt.Sprintf("unloaded %s", r.model.ShortName)})
+
+	residency.mu.Lock()
+	defer residency.mu.Unlock()
+	delete(residency.models, r.key)
+}
+
+// resetExpiry keeps r in memory for d from now, a negative d keeps it loaded until it is unloaded or evicted.
+// it is up to the caller to lock loaded.mu
+func resetExpiry(r *runner, d time.Duration) {
+	if d < 0 {
+		r.expireAt = time.Time{}
+		if r.expireTimer != nil {
+			r.expireTimer.Stop()
+		}
+	} else {
+		r.expireAt = time.Now().Add(d)
+		if r.expireTimer == nil {
+			r.expireTimer = time.AfterFunc(d, func() { expire(r) })
+		} else {
+			r.expireTimer.Reset(d)
+		}
+	}
+
+	residency.mu.Lock()
+	defer residency.mu.Unlock()
+	if m, ok := residency.models[r.key]; ok {
+		m.ExpiresAt = nil
+		if !r.expireAt.IsZero() {
+			expiresAt := r.expireAt
+			m.ExpiresAt = &expiresAt
+		}
+	}
+}
+
+func expire(r *runner) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	if r.expireAt.IsZero() || time.Now().Before(r.expireAt) {
+		return
+	}
+
+	if r.refs > 0 {
+		// the model is reset to expire again once its requests are done
+		return
+	}
+
+	unload(r)
+}
+
+func ProcessHandler(c *gin.Context) {
+	resp := api.ProcessResponse{Models: []api.ProcessModelResponse{}}
+
+	residency.mu.Lock()
+	for _, m := range residency.models {
+		resp.Models = append(resp.Models, *m)
+	}
+	residency.mu.Unlock()
+
+	sort.Slice(resp.Models, func(i, j int) bool {
+		return resp.Models[i].Name < resp.Models[j].Name
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// GPUsHandler lists the GPUs models can be offloaded to and their free VRAM
+func GPUsHandler(c *gin.Context) {
+	gpus, err := llm.GPUs()
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := api.GPUsResponse{GPUs: []api.GPU{}}
+	resp.GPUs = append(resp.GPUs, gpus...)
+	c.JSON(http.StatusOK, resp)
+}
+
+// ModelResidencyHandler loads a model into memory with POST /api/models/<name>/load, or unloads it with
+// POST /api/models/<name>/unload. POST /api/models/<name>/license acknowledges the model's license. names can
+// have slashes so the path is matched with a wildcard
+func ModelResidencyHandler(c *gin.Context) {
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		replyError(c, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	name, action := path[:i], path[i+1:]
+	switch action {
+	case "load":
+		loadModelHandler(c, name)
+	case "unload":
+		unloadModelHandler(c, name)
+	case "license":
+		licenseHandler(c, name)
+	default:
+		replyError(c, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func loadModelHandler(c *gin.Context, name string) {
+	var req api.LoadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			replyError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	model, err := GetModel(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			replyError(c, http.StatusNotFound, errModelNotFound(name))
+		} else {
+			replyError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if !checkLicense(c, model) {
+		return
+	}
+
+	sessionDuration := defaultSessionDuration
+	if req.KeepAlive != nil {
+		sessionDuration = req.KeepAlive.Duration
+	}
+
+	runner, err := acquireModel(c.Request.Context(), c.GetString("workDir"), model, req.Options, sessionDuration, nil)
+	if errors.Is(err, errQueueFull) {
+		replyError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	runner.release()
+	c.Status(http.StatusOK)
+}
+
+func unloadModelHandler(c *gin.Context, name string) {
+	model, err := GetModel(name)
+	if err != nil {
+		replyError(c, http.StatusNotFound, fmt.Errorf("model '%s' is not loaded", name))
+		return
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	for first := true; ; first = false {
+		// the model may be loaded more than once with different options
+		var runners []*runner
+		busy := false
+		for _, r := range loaded.runners {
+			if r.model.Digest == model.Digest {
+				runners = append(runners, r)
+				busy = busy || r.refs > 0
+			}
+		}
+
+		if len(runners) == 0 {
+			if first {
+				replyError(c, http.StatusNotFound, fmt.Errorf("model '%s' is not loaded", name))
+				return
+			}
+			break
+		}
+
+		if !busy {
+			for _, r := range runners {
+				unload(r)
+			}
+			break
+		}
+
+		// requests running on the model finish first
+		idle := loaded.idle
+		loaded.mu.Unlock()
+		select {
+		case <-idle:
+		case <-c.Request.Context().Done():
+			loaded.mu.Lock()
+			replyError(c, http.StatusServiceUnavailable, c.Request.Context().Err())
+			return
+		}
+		loaded.mu.Lock()
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// FlushPromptCacheHandler forgets the prompts cached by the loaded models, or by one model if the request names
+// it, their next prompts are evaluated in full
+func FlushPromptCacheHandler(c *gin.Context) {
+	var req api.FlushPromptCacheRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			replyError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	var name string
+	if req.Model != "" {
+		model, err := GetModel(req.Model)
+		if err != nil {
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Model))
+			return
+		}
+
+		name = model.Name
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	resp := api.FlushPromptCacheResponse{Models: []string{}}
+	for _, r := range loaded.runners {
+		if name != "" && r.model.Name != name {
+			continue
+		}
+
+		if pc, ok := r.llm.(llm.PromptCacher); ok {
+			pc.FlushPromptCache()
+			resp.Models = append(resp.Models, r.model.ShortName)
+		}
+	}
+
+	sort.Strings(resp.Models)
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const defaultResponseCacheTTL = time.Hour
+
+// responseCache keeps the final responses of deterministic requests, so a request which is made again is answered
+// without running the model. it's off unless OLLAMA_RESPONSE_CACHE_SIZE is set, e.g. "256MB", and entries expire
+// after OLLAMA_RESPONSE_CACHE_TTL
+type responseCache struct {
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+}
+
+type cachedResponse struct {
+	key      string
+	response any
+	size     int64
+	expires  time.Time
+}
+
+var responses = &responseCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+func responseCacheSize() int64 {
+	return int64(envBytes("OLLAMA_RESPONSE_CACHE_SIZE", 0))
+}
+
+// get returns the response cached for key, if it hasn't expired
+func (rc *responseCache) get(key string) (any, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	e, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	cached := e.Value.(*cachedResponse)
+	if time.Now().After(cached.expires) {
+		rc.remove(e)
+		return nil, false
+	}
+
+	rc.lru.MoveToFront(e)
+	return cached.response, true
+}
+
+// put caches response for key, evicting the least recently used responses until the cache fits in its size.
+// a response bigger than the whole cache isn't kept
+func (rc *responseCache) put(key string, response any) {
+	limit := responseCacheSize()
+	bts, err := json.Marshal(response)
+	if err != nil || int64(len(bts)) > limit {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if e, ok := rc.entries[key]; ok {
+		rc.remove(e)
+	}
+
+	cached := &cachedResponse{
+		key:      key,
+		response: response,
+		size:     int64(len(bts)),
+		expires:  time.Now().Add(envDuration("OLLAMA_RESPONSE_CACHE_TTL", defaultResponseCacheTTL)),
+	}
+	rc.entries[key] = rc.lru.PushFront(cached)
+	rc.size += cached.size
+
+	for rc.size > limit {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+func (rc *responseCache) remove(e *list.Element) {
+	cached := rc.lru.Remove(e).(*cachedResponse)
+	delete(rc.entries, cached.key)
+	rc.size -= cached.size
+}
+
+// deterministic reports whether a request with opts gives the same response each time, which is when it
+// samples with a temperature of 0 or a fixed seed
+func deterministic(model *Model, opts map[string]interface{}) bool {
+	merged := api.DefaultOptions()
+	if err := merged.FromMap(model.Options); err != nil {
+		return false
+	}
+
+	if err := merged.FromMap(opts); err != nil {
+		return false
+	}
+
+	return merged.Temperature == 0 || merged.Seed != -1
+}
+
+// responseCacheKey returns the key of a request to the model, or false if the request can't be cached. req is
+// hashed with the fields which don't change the response, like its id, cleared by the caller
+func responseCacheKey(endpoint string, model *Model, req any, opts map[string]interface{}, noCache bool) (string, bool) {
+	if noCache || responseCacheSize() <= 0 || !deterministic(model, opts) {
+		return "", false
+	}
+
+	bts, err := json.Marshal(struct {
+		Endpoint string                 `json:"endpoint"`
+		Digest   string                 `json:"digest"`
+		Request  any                    `json:"request"`
+		Options  map[string]interface{} `json:"options"`
+	}{endpoint, model.Digest, req, opts})
+	if err != nil {
+		return "", false
+	}
+
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// generateCacheKey is the response cache key of a generate request
+func generateCacheKey(model *Model, req api.GenerateRequest) (string, bool) {
+	opts := req.Options
+	req.ID, req.KeepAlive, req.Options = "", nil, nil
+	return responseCacheKey("generate", model, req, opts, req.NoCache)
+}
+
+// chatCacheKey is the response cache key of a chat request. chats in a session aren't cached, the session's
+// conversation has to continue from the model's reply
+func chatCacheKey(model *Model, req api.ChatRequest) (string, bool) {
+	if req.Session != "" {
+		return "", false
+	}
+
+	opts := req.Options
+	req.ID, req.KeepAlive, req.Options = "", nil, nil
+	return responseCacheKey("chat", model, req, opts, req.NoCache)
+}
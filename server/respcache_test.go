@@ -0,0 +1,98 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	model := &Model{Digest: "sha256:abc"}
+	req := api.GenerateRequest{Model: "m", Prompt: "hi", Options: map[string]interface{}{"temperature": 0.0}}
+
+	if _, ok := generateCacheKey(model, req); ok {
+		t.Fatal("expected no caching without OLLAMA_RESPONSE_CACHE_SIZE")
+	}
+
+	t.Setenv("OLLAMA_RESPONSE_CACHE_SIZE", "1MB")
+	key, ok := generateCacheKey(model, req)
+	if !ok {
+		t.Fatal("expected a request with a temperature of 0 to be cached")
+	}
+
+	other := req
+	other.ID = "abc"
+	if k, _ := generateCacheKey(model, other); k != key {
+		t.Error("expected the id not to change the key")
+	}
+
+	other = req
+	other.Prompt = "bye"
+	if k, _ := generateCacheKey(model, other); k == key {
+		t.Error("expected the prompt to change the key")
+	}
+
+	other = req
+	other.NoCache = true
+	if _, ok := generateCacheKey(model, other); ok {
+		t.Error("expected no_cache to bypass the cache")
+	}
+
+	other = req
+	other.Options = map[string]interface{}{"temperature": 0.8}
+	if _, ok := generateCacheKey(model, other); ok {
+		t.Error("expected sampling without a seed not to be cached")
+	}
+
+	other.Options["seed"] = 42.0
+	if _, ok := generateCacheKey(model, other); !ok {
+		t.Error("expected sampling with a seed to be cached")
+	}
+
+	if _, ok := chatCacheKey(model, api.ChatRequest{Session: "s", Options: req.Options}); ok {
+		t.Error("expected session chats not to be cached")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	resp := api.GenerateResponse{Response: "hello", Done: true}
+	bts, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two responses fit in the cache, three don't
+	t.Setenv("OLLAMA_RESPONSE_CACHE_SIZE", strconv.Itoa(len(bts)*5/2))
+	rc := &responseCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+	rc.put("a", resp)
+	rc.put("b", resp)
+	if _, ok := rc.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	rc.put("c", resp)
+	if _, ok := rc.get("b"); ok {
+		t.Error("expected the least recently used response to be evicted")
+	}
+
+	if _, ok := rc.get("a"); !ok {
+		t.Error("expected a to still be cached")
+	}
+
+	rc.put("big", api.GenerateResponse{Response: string(make([]byte, len(bts)*3))})
+	if _, ok := rc.get("big"); ok {
+		t.Error("expected a response bigger than the cache not to be kept")
+	}
+
+	t.Setenv("OLLAMA_RESPONSE_CACHE_TTL", "1ms")
+	rc.put("d", resp)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := rc.get("d"); ok {
+		t.Error("expected an expired response to be gone")
+	}
+}
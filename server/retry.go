@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var retryBackoff = time.Second
+
+const (
+	maxBackoff    = 30 * time.Second
+	maxRetryAfter = 5 * time.Minute
+)
+
+// backoff returns how long to wait before retry number try, the wait doubles with each try up to maxBackoff
+// and is jittered so clients which failed together don't all retry together
+func backoff(try int) time.Duration {
+	d := retryBackoff << try
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepBackoff waits before the next retry, for at least as long as the registry asked with retryAfter
+func sleepBackoff(ctx context.Context, try int, retryAfter time.Duration) error {
+	d := backoff(try)
+	if retryAfter > d {
+		d = retryAfter
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryable reports whether err is a transient failure which is worth retrying
+func retryable(err error) bool {
+	// name resolution often fails briefly on flaky networks or while a vpn reconnects
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryableStatus reports whether a request which got status code might succeed if it is tried again,
+// other error codes such as unauthorized or not found won't change by retrying
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryAfterError is a retryable error the registry responded with, after is how long it asked to wait
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// retryAfter returns how long the Retry-After header of resp asks to wait, it is zero if the header is missing
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if seconds, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+
+	switch {
+	case d < 0:
+		return 0
+	case d > maxRetryAfter:
+		return maxRetryAfter
+	}
+
+	return d
+}
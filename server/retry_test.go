@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":          0,
+		"120":       2 * time.Minute,
+		"-5":        0,
+		"86400":     maxRetryAfter,
+		"not-a-num": 0,
+	}
+
+	for header, want := range cases {
+		resp := &http.Response{Header: make(http.Header)}
+		if header != "" {
+			resp.Header.Set("Retry-After", header)
+		}
+
+		if got := retryAfter(resp); got != want {
+			t.Errorf("Retry-After %q: got %s, want %s", header, got, want)
+		}
+	}
+}
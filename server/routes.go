@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,12 +11,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -42,193 +40,373 @@ func init() {
 	gin.SetMode(mode)
 }
 
-var loaded struct {
-	mu sync.Mutex
-
-	llm        llm.LLM
-	Embeddings []vector.Embedding
-
-	expireAt    time.Time
-	expireTimer *time.Timer
-
-	digest  string
-	options api.Options
-}
-
 var defaultSessionDuration = 5 * time.Minute
 
-// load a model into memory if it is not already loaded, it is up to the caller to lock loaded.mu before calling this function
-func load(ctx context.Context, workDir string, model *Model, reqOpts map[string]interface{}, sessionDuration time.Duration) error {
+// newLLM starts a runner, tests replace it to load models without a subprocess
+var newLLM = llm.New
+
+// load returns the runner for model with reqOpts, loading it if it is not already loaded and unloading the least
+// recently used models to make room for it. key is the schedKey of the request.
+// it is up to the caller to lock loaded.mu before calling this function, it's unlocked while the model loads so
+// requests for other models, /api/ps and expiring models don't wait for it
+func load(ctx context.Context, workDir string, model *Model, reqOpts map[string]interface{}, key string) (*runner, error) {
 	opts := api.DefaultOptions()
+	opts.NumPromptCache = envInt("OLLAMA_PROMPT_CACHE", opts.NumPromptCache)
 	if err := opts.FromMap(model.Options); err != nil {
 		log.Printf("could not load model options: %v", err)
-		return err
+		return nil, err
 	}
 
-	if err := opts.FromMap(reqOpts); err != nil {
+	if err := opts.FromMap(loadOptions(reqOpts)); err != nil {
 		log.Printf("could not merge model options: %v", err)
-		return err
+		return nil, err
 	}
 
-	// check if the loaded model is still running in a subprocess, in case something unexpected happened
-	if loaded.llm != nil {
-		if err := loaded.llm.Ping(ctx); err != nil {
+	size := estimateSize(model)
+	for {
+		// check if the loaded model is still running in a subprocess, in case something unexpected happened
+		if r, ok := loaded.runners[key]; ok {
+			if err := r.llm.Ping(ctx); err == nil {
+				return r, nil
+			}
+
 			log.Print("loaded llm process not responding, closing now")
 			// the subprocess is no longer running, so close it
-			loaded.llm.Close()
-			loaded.llm = nil
-			loaded.digest = ""
+			unload(r)
 		}
-	}
 
-	if model.Digest != loaded.digest || !reflect.DeepEqual(loaded.options, opts) {
-		if loaded.llm != nil {
-			log.Println("changing loaded model")
-			loaded.llm.Close()
-			loaded.llm = nil
-			loaded.digest = ""
+		// another request is loading the model, use it once it's loaded
+		if loading, ok := loaded.loading[key]; ok {
+			loaded.mu.Unlock()
+			select {
+			case <-loading:
+			case <-ctx.Done():
+				loaded.mu.Lock()
+				return nil, ctx.Err()
+			}
+			loaded.mu.Lock()
+			continue
 		}
 
-		if model.Embeddings != nil && len(model.Embeddings) > 0 {
-			opts.EmbeddingOnly = true // this is requried to generate embeddings, completions will still work
-			loaded.Embeddings = model.Embeddings
+		if err := reserve(ctx, size); err != nil {
+			return nil, err
 		}
 
-		llmModel, err := llm.New(workDir, model.ModelPath, model.AdapterPaths, opts)
-		if err != nil {
-			return err
+		// another request may have loaded the model, or started to, while waiting for room
+		if _, ok := loaded.runners[key]; !ok && loaded.loading[key] == nil {
+			break
 		}
+	}
 
-		// set cache values before modifying opts
-		loaded.llm = llmModel
-		loaded.digest = model.Digest
-		loaded.options = opts
+	// the model's memory stays reserved while it loads
+	loading := make(chan struct{})
+	loaded.loading[key] = loading
+	loaded.reserved += size
 
-		if opts.NumKeep < 0 {
-			promptWithSystem, err := model.Prompt(api.GenerateRequest{}, "")
-			if err != nil {
-				return err
-			}
+	loaded.mu.Unlock()
+	r, err := start(ctx, workDir, model, opts, key, size)
+	loaded.mu.Lock()
 
-			promptNoSystem, err := model.Prompt(api.GenerateRequest{Context: []int{0}}, "")
-			if err != nil {
-				return err
-			}
+	delete(loaded.loading, key)
+	loaded.reserved -= size
+	close(loading)
+	notifyIdle()
+	if err != nil {
+		return nil, err
+	}
 
-			tokensWithSystem, err := llmModel.Encode(ctx, promptWithSystem)
-			if err != nil {
-				return err
-			}
+	loaded.runners[key] = r
+	markLoaded(r)
+	return r, nil
+}
 
-			tokensNoSystem, err := llmModel.Encode(ctx, promptNoSystem)
-			if err != nil {
-				return err
-			}
+// start loads model with opts in a new runner, without loaded.mu locked
+func start(ctx context.Context, workDir string, model *Model, opts api.Options, key string, size int64) (*runner, error) {
+	r := &runner{key: key, model: model, size: size}
+	if model.Embeddings != nil && len(model.Embeddings) > 0 {
+		opts.EmbeddingOnly = true // this is requried to generate embeddings, completions will still work
+		r.embeddings = model.Embeddings
+	}
+
+	draft, err := draftPath(model, opts.DraftModel)
+	if err != nil {
+		return nil, err
+	}
+
+	llmModel, err := newLLM(workDir, model.ModelPath, model.AdapterPaths, swappableAdapters(model), model.ProjectorPath, draft, opts)
+	if err != nil {
+		return nil, err
+	}
 
-			opts.NumKeep = len(tokensWithSystem) - len(tokensNoSystem)
+	r.llm = llmModel
+	r.options = opts
+	if cpu, gpu := llmModel.Memory(); cpu+gpu > 0 {
+		r.size = cpu + gpu
+	}
 
-			llmModel.SetOptions(opts)
+	if opts.NumKeep < 0 {
+		numKeep, err := systemTokens(ctx, model, llmModel)
+		if err != nil {
+			llmModel.Close()
+			return nil, err
 		}
+
+		opts.NumKeep = numKeep
+
+		llmModel.SetOptions(opts)
+		r.options = opts
 	}
 
-	loaded.expireAt = time.Now().Add(sessionDuration)
+	return r, nil
+}
 
-	if loaded.expireTimer == nil {
-		loaded.expireTimer = time.AfterFunc(sessionDuration, func() {
-			loaded.mu.Lock()
-			defer loaded.mu.Unlock()
+// systemTokens is how many tokens the model's system prompt takes, they're kept when the context is full
+func systemTokens(ctx context.Context, model *Model, llmModel llm.LLM) (int, error) {
+	promptWithSystem, err := model.Prompt(api.GenerateRequest{}, "")
+	if err != nil {
+		return 0, err
+	}
 
-			if time.Now().Before(loaded.expireAt) {
-				return
-			}
+	promptNoSystem, err := model.Prompt(api.GenerateRequest{Context: []int{0}}, "")
+	if err != nil {
+		return 0, err
+	}
 
-			if loaded.llm == nil {
-				return
-			}
+	tokensWithSystem, err := llmModel.Encode(ctx, promptWithSystem)
+	if err != nil {
+		return 0, err
+	}
 
-			loaded.llm.Close()
-			loaded.llm = nil
-			loaded.digest = ""
-		})
+	tokensNoSystem, err := llmModel.Encode(ctx, promptNoSystem)
+	if err != nil {
+		return 0, err
 	}
 
-	loaded.expireTimer.Reset(sessionDuration)
-	return nil
+	return len(tokensWithSystem) - len(tokensNoSystem), nil
 }
 
 func GenerateHandler(c *gin.Context) {
-	loaded.mu.Lock()
-	defer loaded.mu.Unlock()
-
 	checkpointStart := time.Now()
 
 	var req api.GenerateRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	uploaded, err := bindRequest(c, &req)
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+	req.Images = append(req.Images, uploaded...)
+
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	if !checkOptions(c, req.Options) {
+		return
+	}
+
+	auditModel(c, req.Model)
 	model, err := GetModel(req.Model)
+	if errors.Is(err, os.ErrNotExist) {
+		replyError(c, http.StatusNotFound, errModelNotPulled(req.Model))
+		return
+	} else if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !checkLicense(c, model) {
+		return
+	}
+
+	adapter, ok := requestAdapter(c, model, req.Adapter)
+	if !ok {
+		return
+	}
+
+	grammar, err := requestGrammar(req.Format, req.Grammar, req.JSONSchema)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	workDir := c.GetString("workDir")
 
-	// TODO: set this duration from the request if specified
 	sessionDuration := defaultSessionDuration
-	if err := load(c.Request.Context(), workDir, model, req.Options, sessionDuration); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if req.KeepAlive != nil {
+		sessionDuration = req.KeepAlive.Duration
 	}
 
-	checkpointLoaded := time.Now()
+	id := req.ID
+	if id == "" {
+		id = generationID()
+	}
 
-	embedding := ""
-	if model.Embeddings != nil && len(model.Embeddings) > 0 {
-		promptEmbed, err := loaded.llm.Embedding(c.Request.Context(), req.Prompt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// an empty request loads the model
+	loadOnly := req.Prompt == "" && req.Template == "" && req.System == "" && len(req.Images) == 0
+
+	// a deterministic request which was made before gets the same response without running the model
+	// responses are cached for the version of the adapter too
+	keyReq := req
+	if adapter != nil {
+		keyReq.Adapter = adapter.Digest
+	}
+
+	cacheKey, cacheable := generateCacheKey(model, keyReq)
+	cacheable = cacheable && !loadOnly
+	if cacheable {
+		if cached, ok := responses.get(cacheKey); ok {
+			metrics.responseCacheHits.Add(1)
+			resp := cached.(api.GenerateResponse)
+			resp.Model = req.Model
+			resp.ID = id
+			resp.CreatedAt = time.Now().UTC()
+			resp.TotalDuration = time.Since(checkpointStart)
+			resp.LoadDuration = 0
+			resp.Cached = true
+			replayResponse(c, resp)
 			return
 		}
-		// TODO: set embed_top from specified parameters in modelfile
-		embed_top := 3
-		topK := vector.TopK(embed_top, mat.NewVecDense(len(promptEmbed), promptEmbed), loaded.Embeddings)
-		for _, e := range topK {
-			embedding = fmt.Sprintf("%s %s", embedding, e.Embedding.Data)
-		}
+
+		metrics.responseCacheMisses.Add(1)
 	}
 
-	prompt, err := model.Prompt(req, embedding)
+	// generation stops as soon as the client goes or the request is cancelled with its id, freeing the model
+	ctx, done, err := trackGeneration(c.Request.Context(), id)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		replyError(c, http.StatusConflict, err)
 		return
 	}
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(r api.GenerateResponse) {
-			loaded.expireAt = time.Now().Add(sessionDuration)
-			loaded.expireTimer.Reset(sessionDuration)
+		defer done()
+
+		// once the client has gone nothing is reading the stream, don't block on it
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
+		}
+
+		// a cancelled request tells the client why it stopped
+		sendError := func(err error) {
+			var lerr *limitError
+			if errors.As(err, &lerr) {
+				send(lerr)
+				return
+			}
+
+			if ctx.Err() != nil {
+				err = fmt.Errorf("generation stopped: %w", cancelCause(ctx))
+			}
+
+			send(errorResponse(0, err))
+		}
+
+		// the request waits its turn in the model's queue, tell the client where it is while it does
+		queued := func(position int, wait time.Duration) {
+			send(api.GenerateResponse{
+				Model:         req.Model,
+				ID:            id,
+				CreatedAt:     time.Now().UTC(),
+				QueuePosition: position,
+				QueueWait:     wait,
+			})
+		}
+
+		runner, adapterPath, err := acquireAdapter(ctx, workDir, model, adapter, req.Options, sessionDuration, queued)
+		if err != nil {
+			sendError(err)
+			return
+		}
+		defer runner.release()
 
+		checkpointLoaded := time.Now()
+		generationStarted(req.Model, id)
+
+		opts, err := runner.requestOptions(req.Options)
+		if err != nil {
+			sendError(err)
+			return
+		}
+
+		embedding := ""
+		if model.Embeddings != nil && len(model.Embeddings) > 0 {
+			promptEmbed, err := runner.llm.Embedding(ctx, req.Prompt)
+			if err != nil {
+				sendError(err)
+				return
+			}
+			// TODO: set embed_top from specified parameters in modelfile
+			embed_top := 3
+			topK := vector.TopK(embed_top, mat.NewVecDense(len(promptEmbed), promptEmbed), runner.embeddings)
+			for _, e := range topK {
+				embedding = fmt.Sprintf("%s %s", embedding, e.Embedding.Data)
+			}
+		}
+
+		// the images go before the prompt, in the user's part of the template
+		tagged := req
+		tagged.Prompt = imagePrompt(req.Prompt, 0, len(req.Images))
+		prompt, err := model.Prompt(tagged, embedding)
+		if err != nil {
+			sendError(err)
+			return
+		}
+
+		if err := checkPromptLimit(ctx, runner.llm, prompt, len(req.Context)); err != nil {
+			sendError(err)
+			return
+		}
+
+		// the cache keeps the whole response, the final response with all the text before it
+		var response strings.Builder
+		var logprobs []api.TokenLogprob
+		fn := func(r api.GenerateResponse) {
 			r.Model = req.Model
+			r.ID = id
 			r.CreatedAt = time.Now().UTC()
+			if cacheable {
+				response.WriteString(r.Response)
+				logprobs = append(logprobs, r.Logprobs...)
+			}
+
 			if r.Done {
 				r.TotalDuration = time.Since(checkpointStart)
 				r.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				r.Options = opts.Map()
+				metrics.observeGeneration(r.EvalCount, r.EvalDuration)
+				auditTokens(c, r.Metrics)
+				generationFinished(req.Model, id, r.Metrics)
+
+				if cacheable {
+					whole := r
+					whole.Response = response.String()
+					whole.Logprobs = logprobs
+					responses.put(cacheKey, whole)
+				}
 			}
 
-			ch <- r
+			send(r)
 		}
 
-		// an empty request loads the model
-		if req.Prompt == "" && req.Template == "" && req.System == "" {
-			ch <- api.GenerateResponse{Model: req.Model, Done: true}
+		if loadOnly {
+			send(api.GenerateResponse{Model: req.Model, ID: id, Done: true})
 		} else {
-			if err := loaded.llm.Predict(c.Request.Context(), req.Context, prompt, fn); err != nil {
-				ch <- gin.H{"error": err.Error()}
+			if err := runner.llm.Predict(ctx, llm.PredictOpts{
+				Prompt:      prompt,
+				Context:     req.Context,
+				Grammar:     grammar,
+				Images:      req.Images,
+				Logprobs:    req.Logprobs,
+				TopLogprobs: req.TopLogprobs,
+				Options:     &opts,
+				Adapter:     adapterPath,
+			}, fn); err != nil {
+				sendError(err)
 			}
 		}
 	}()
@@ -237,36 +415,84 @@ func GenerateHandler(c *gin.Context) {
 }
 
 func EmbeddingHandler(c *gin.Context) {
-	loaded.mu.Lock()
-	defer loaded.mu.Unlock()
-
 	var req api.EmbeddingRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Prompt != "" && len(req.Prompts) > 0 {
+		replyError(c, http.StatusBadRequest, errors.New("only one of prompt and prompts can be set"))
 		return
 	}
 
+	if !checkOptions(c, req.Options) {
+		return
+	}
+
+	auditModel(c, req.Model)
 	model, err := GetModel(req.Model)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if errors.Is(err, os.ErrNotExist) {
+		replyError(c, http.StatusNotFound, errModelNotPulled(req.Model))
+		return
+	} else if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !checkLicense(c, model) {
 		return
 	}
 
 	workDir := c.GetString("workDir")
-	if err := load(c.Request.Context(), workDir, model, req.Options, 5*time.Minute); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	runner, err := acquireModel(c.Request.Context(), workDir, model, req.Options, defaultSessionDuration, nil)
+	if errors.Is(err, errQueueFull) {
+		replyError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
+	defer runner.release()
 
-	if !loaded.options.EmbeddingOnly {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "embedding option must be set to true"})
+	if !runner.options.EmbeddingOnly {
+		replyError(c, http.StatusBadRequest, errors.New("embedding option must be set to true"))
 		return
 	}
 
-	embedding, err := loaded.llm.Embedding(c.Request.Context(), req.Prompt)
+	if len(req.Prompts) > 0 {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+
+			send := func(v any) {
+				select {
+				case ch <- v:
+				case <-c.Request.Context().Done():
+				}
+			}
+
+			total := len(req.Prompts)
+			embeddings, err := embedBatch(c.Request.Context(), runner.llm, req.Prompts, embedParallel(runner.llm), func(completed int) {
+				send(api.EmbeddingResponse{Total: total, Completed: completed})
+			})
+			if err != nil {
+				log.Printf("embedding generation failed: %v", err)
+				send(errorResponse(0, errors.New("failed to generate embeddings")))
+				return
+			}
+
+			send(api.EmbeddingResponse{Embeddings: embeddings, Total: total, Completed: total})
+		}()
+
+		streamResponse(c, ch)
+		return
+	}
+
+	embedding, err := runner.llm.Embedding(c.Request.Context(), req.Prompt)
 	if err != nil {
 		log.Printf("embedding generation failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
+		replyError(c, http.StatusInternalServerError, errors.New("failed to generate embedding"))
 		return
 	}
 
@@ -279,29 +505,96 @@ func EmbeddingHandler(c *gin.Context) {
 func PullModelHandler(c *gin.Context) {
 	var req api.PullRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Background || req.After != "" {
+		queueBackgroundPullHandler(c, req)
 		return
 	}
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
+
+		ctx, cancel := withCancelReason(c.Request.Context(), cancelClientDisconnected)
+		defer cancel(nil)
+
+		// once the client has gone nothing is reading the stream, don't block on it
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
 		}
 
+		fn := sequenced(func(r api.ProgressResponse) {
+			send(r)
+		})
+
 		regOpts := &RegistryOptions{
-			Insecure: req.Insecure,
-			Username: req.Username,
-			Password: req.Password,
+			Insecure:      req.Insecure,
+			Username:      req.Username,
+			Password:      req.Password,
+			WithReferrers: req.WithReferrers,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
-
 		if err := PullModel(ctx, req.Name, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			send(errorResponse(0, err))
+		}
+	}()
+
+	streamResponse(c, ch)
+}
+
+func VerifyModelHandler(c *gin.Context) {
+	var req api.VerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+
+		send := func(v any) {
+			select {
+			case ch <- v:
+			case <-c.Request.Context().Done():
+			}
 		}
+
+		fn := sequenced(func(r api.ProgressResponse) {
+			send(r)
+		})
+
+		if req.Repair {
+			regOpts := &RegistryOptions{
+				Insecure: req.Insecure,
+				Username: req.Username,
+				Password: req.Password,
+			}
+
+			if err := RepairModel(c.Request.Context(), req.Name, regOpts, fn); err != nil {
+				send(errorResponse(0, err))
+			}
+			return
+		}
+
+		corrupted, err := VerifyModel(c.Request.Context(), req.Name, fn)
+		if err != nil {
+			send(errorResponse(0, err))
+			return
+		}
+
+		if len(corrupted) > 0 {
+			send(errorResponse(0, corruptedError(req.Name, corrupted)))
+			return
+		}
+
+		fn(api.ProgressResponse{Status: "success"})
 	}()
 
 	streamResponse(c, ch)
@@ -310,16 +603,16 @@ func PullModelHandler(c *gin.Context) {
 func PushModelHandler(c *gin.Context) {
 	var req api.PushRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(r api.ProgressResponse) {
+		fn := sequenced(func(r api.ProgressResponse) {
 			ch <- r
-		}
+		})
 
 		regOpts := &RegistryOptions{
 			Insecure: req.Insecure,
@@ -329,7 +622,7 @@ func PushModelHandler(c *gin.Context) {
 
 		ctx := context.Background()
 		if err := PushModel(ctx, req.Name, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- errorResponse(0, err)
 		}
 	}()
 
@@ -339,7 +632,7 @@ func PushModelHandler(c *gin.Context) {
 func CreateModelHandler(c *gin.Context) {
 	var req api.CreateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -348,15 +641,15 @@ func CreateModelHandler(c *gin.Context) {
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		fn := func(resp api.ProgressResponse) {
+		fn := sequenced(func(resp api.ProgressResponse) {
 			ch <- resp
-		}
+		})
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := CreateModel(ctx, workDir, req.Name, req.Path, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		if err := CreateModel(ctx, workDir, req.Name, req.Path, req.Quantize, fn); err != nil {
+			ch <- errorResponse(0, err)
 		}
 	}()
 
@@ -366,34 +659,100 @@ func CreateModelHandler(c *gin.Context) {
 func DeleteModelHandler(c *gin.Context) {
 	var req api.DeleteRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	if err := DeleteModel(req.Name); err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Name)})
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Name))
+		} else if errors.Is(err, errReadOnlyModel) {
+			replyError(c, http.StatusForbidden, withCode(api.CodeModelReadOnly, fmt.Errorf("model '%s' is in a read only model directory, it can't be deleted", req.Name), map[string]any{"model": req.Name}))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			replyError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
 	c.JSON(http.StatusOK, nil)
 }
 
+func ExportModelHandler(c *gin.Context) {
+	var req api.ExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, _, err := GetManifest(ParseModelPath(req.Name)); err != nil {
+		if os.IsNotExist(err) {
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Name))
+		} else {
+			replyError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.Header("Content-Type", "application/x-tar")
+	c.Status(http.StatusOK)
+	if err := ExportModel(req.Name, c.Writer); err != nil {
+		// the archive has already started, all that can be done is to cut it short
+		log.Printf("export %s: %v", req.Name, err)
+	}
+}
+
+func ImportModelHandler(c *gin.Context) {
+	names, err := ImportModel(c.Request.Body)
+	if err != nil {
+		if errors.Is(err, errInvalidArchive) || errors.Is(err, errManifestTooLarge) {
+			replyError(c, http.StatusBadRequest, err)
+		} else {
+			replyError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ImportResponse{Models: names})
+}
+
+func PruneHandler(c *gin.Context) {
+	var req api.PruneRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	removed, reclaimed, err := PruneUnusedLayers(req.DryRun)
+	if err != nil {
+		if errors.Is(err, errBlobsInUse) {
+			replyError(c, http.StatusConflict, err)
+		} else {
+			replyError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, api.PruneResponse{Removed: removed, Reclaimed: reclaimed})
+}
+
 func ShowModelHandler(c *gin.Context) {
 	var req api.ShowRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if c.Request.Method == http.MethodGet {
+		req.Name = c.Query("name")
+		req.Verbose, _ = strconv.ParseBool(c.Query("verbose"))
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	resp, err := GetModelInfo(req.Name)
+	if err == nil && req.Verbose {
+		err = modelInfo(resp, req.Name)
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Name)})
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Name))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			replyError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
@@ -411,6 +770,22 @@ func GetModelInfo(name string) (*api.ShowResponse, error) {
 		License:  strings.Join(model.License, "\n"),
 		System:   model.System,
 		Template: model.Template,
+		Messages: model.Messages,
+		Stats:    getModelStats(model.ShortName),
+	}
+
+	if model.Source != "" || model.Checkpoint != "" || len(model.LicenseDigests) > 0 {
+		unacknowledged, err := unacknowledgedLicenses(model)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Provenance = &api.Provenance{
+			Source:              model.Source,
+			Checkpoint:          model.Checkpoint,
+			Licenses:            model.LicenseDigests,
+			LicenseAcknowledged: len(model.LicenseDigests) > 0 && len(unacknowledged) == 0,
+		}
 	}
 
 	mf, err := ShowModelfile(model)
@@ -453,69 +828,144 @@ func GetModelInfo(name string) (*api.ShowResponse, error) {
 }
 
 func ListModelsHandler(c *gin.Context) {
-	var models []api.ModelResponse
-	fp, err := GetManifestPath()
+	models, err := listModels()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		replyError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	walkFunc := func(path string, info os.FileInfo, _ error) error {
-		if !info.IsDir() {
-			dir, file := filepath.Split(path)
-			dir = strings.Trim(strings.TrimPrefix(dir, fp), string(os.PathSeparator))
-			tag := strings.Join([]string{dir, file}, ":")
+	models, total, err := filterModels(models, c.Request.URL.Query())
+	if err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
 
-			mp := ParseModelPath(tag)
-			manifest, digest, err := GetManifest(mp)
-			if err != nil {
-				log.Printf("skipping file: %s", fp)
-				return nil
+	c.JSON(http.StatusOK, api.ListResponse{Models: models, Total: total})
+}
+
+// listModels returns every model with a manifest on disk, including those in the model directories
+func listModels() ([]api.ModelResponse, error) {
+	var models []api.ModelResponse
+	walkFunc := func(mp ModelPath, info os.FileInfo) error {
+		manifest, digest, err := GetManifest(mp)
+		if err != nil {
+			log.Printf("skipping model: %s", mp.GetShortTagname())
+			return nil
+		}
+
+		_, readOnly, err := mp.findManifestPath()
+		if err != nil {
+			return err
+		}
+
+		var layers []string
+		for _, l := range manifest.Layers {
+			layers = append(layers, l.Digest)
+		}
+
+		var details api.ModelDetails
+		if config, err := GetConfig(manifest.Config.Digest); err != nil {
+			log.Printf("couldn't read the config of %s: %v", mp.GetShortTagname(), err)
+		} else {
+			details = api.ModelDetails{
+				Format:            config.ModelFormat,
+				Family:            config.ModelFamily,
+				ParameterSize:     config.ModelType,
+				QuantizationLevel: config.FileType,
 			}
+		}
 
-			models = append(models, api.ModelResponse{
-				Name:       mp.GetShortTagname(),
-				Size:       manifest.GetTotalSize(),
-				Digest:     digest,
-				ModifiedAt: info.ModTime(),
-			})
+		stats := getModelStats(mp.GetShortTagname())
+		var lastUsedAt *time.Time
+		if stats != nil {
+			lastUsedAt = &stats.LastUsedAt
 		}
 
+		models = append(models, api.ModelResponse{
+			Name:       mp.GetShortTagname(),
+			Size:       manifest.GetTotalSize(),
+			Digest:     digest,
+			ModifiedAt: info.ModTime(),
+			Details:    details,
+			LastUsedAt: lastUsedAt,
+			Stats:      stats,
+			Layers:     layers,
+
+			UpdateAvailable: updateAvailable(mp.GetShortTagname(), digest),
+			ReadOnly:        readOnly,
+		})
+
 		return nil
 	}
 
-	if err := filepath.Walk(fp, walkFunc); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if err := walkManifests(walkFunc); err != nil {
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+	return models, nil
 }
 
 func CopyModelHandler(c *gin.Context) {
 	var req api.CopyRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		replyError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	if err := CopyModel(req.Source, req.Destination); err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Source)})
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Source))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			replyError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
 }
 
+func TagModelHandler(c *gin.Context) {
+	var req api.TagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, _, err := GetManifest(ParseModelPath(req.Source)); err != nil {
+		replyError(c, http.StatusNotFound, errModelNotFound(req.Source))
+		return
+	}
+
+	if _, err := TagModel(req.Source, req.Tags); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := tagResponse(req.Source)
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func SharedModelsHandler(c *gin.Context) {
+	resp, err := tagResponse(c.Query("name"))
+	if err != nil {
+		replyError(c, http.StatusNotFound, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 var defaultAllowOrigins = []string{
 	"localhost",
 	"127.0.0.1",
 	"0.0.0.0",
 }
 
-func Serve(ln net.Listener, allowOrigins []string) error {
+// Serve serves the api on each of lns until one of them fails
+func Serve(lns []net.Listener, allowOrigins []string) error {
 	config := cors.DefaultConfig()
 	config.AllowWildcard = true
 
@@ -535,8 +985,37 @@ func Serve(ln net.Listener, allowOrigins []string) error {
 	}
 	defer os.RemoveAll(workDir)
 
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	share, err := shareBlobsEnabled()
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAuditLog()
+	if err != nil {
+		return err
+	}
+
+	if err := openSharedBlobs(); err != nil {
+		return err
+	}
+
+	startWebhooks()
+	startUpdateChecker()
+	startBackgroundPulls()
+	startModelPolicies()
+
 	r := gin.Default()
+	if err := trustProxies(r); err != nil {
+		return err
+	}
+
 	r.Use(
+		metricsMiddleware,
 		cors.New(config),
 		func(c *gin.Context) {
 			c.Set("workDir", workDir)
@@ -544,14 +1023,60 @@ func Serve(ln net.Listener, allowOrigins []string) error {
 		},
 	)
 
+	// requests are audited before their key is checked, so rejected ones are logged too
+	if audit != nil {
+		log.Printf("auditing requests to %s", audit.path)
+		r.Use(audit.middleware)
+	}
+
+	if len(keys) > 0 {
+		log.Printf("api keys are required, %d configured", len(keys))
+		r.Use(apiKeyMiddleware(keys))
+	}
+
 	r.POST("/api/pull", PullModelHandler)
-	r.POST("/api/generate", GenerateHandler)
+	r.POST("/api/generate", limitClientStreams, GenerateHandler)
+	r.POST("/api/generate/:id/cancel", CancelGenerateHandler)
+	r.POST("/api/chat", limitClientStreams, ChatHandler)
+	r.POST("/api/sessions", CreateSessionHandler)
+	r.GET("/api/sessions", ListSessionsHandler)
+	r.GET("/api/sessions/:id", GetSessionHandler)
+	r.DELETE("/api/sessions/:id", DeleteSessionHandler)
 	r.POST("/api/embeddings", EmbeddingHandler)
+	r.POST("/api/tokenize", TokenizeHandler)
+	r.POST("/api/detokenize", DetokenizeHandler)
 	r.POST("/api/create", CreateModelHandler)
 	r.POST("/api/push", PushModelHandler)
 	r.POST("/api/copy", CopyModelHandler)
 	r.DELETE("/api/delete", DeleteModelHandler)
+	r.DELETE("/api/blobs/unused", PruneHandler)
+	r.DELETE("/api/cache", FlushPromptCacheHandler)
+	r.POST("/api/export", ExportModelHandler)
+	r.POST("/api/import", ImportModelHandler)
+	r.POST("/api/verify", VerifyModelHandler)
+	r.POST("/api/check", CheckUpdatesHandler)
+	r.POST("/api/doctor", DoctorHandler)
+	r.POST("/api/tag", TagModelHandler)
+	r.GET("/api/tag", SharedModelsHandler)
 	r.POST("/api/show", ShowModelHandler)
+	r.GET("/api/show", ShowModelHandler)
+	r.GET("/api/usage", UsageHandler)
+	r.GET("/api/events", EventsHandler)
+	r.DELETE("/api/pulls/:id", CancelBackgroundPullHandler)
+	r.POST("/api/downloads/:digest/pause", PauseDownloadHandler)
+	r.POST("/api/downloads/:digest/resume", ResumeDownloadHandler)
+	r.POST("/api/downloads/:digest/cancel", CancelDownloadHandler)
+	r.POST("/api/models/*path", ModelResidencyHandler)
+
+	// openai compatible endpoints
+	r.POST("/v1/chat/completions", limitClientStreams, limitRequestTime, OpenAIChatCompletionsHandler)
+	r.POST("/v1/completions", limitClientStreams, limitRequestTime, OpenAICompletionsHandler)
+	r.POST("/v1/embeddings", OpenAIEmbeddingsHandler)
+
+	if share {
+		r.GET("/v2/*path", SharedBlobHandler)
+		r.HEAD("/v2/*path", SharedBlobHandler)
+	}
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
@@ -559,23 +1084,32 @@ func Serve(ln net.Listener, allowOrigins []string) error {
 		})
 
 		r.Handle(method, "/api/tags", ListModelsHandler)
+		r.Handle(method, "/api/downloads", ListDownloadsHandler)
+		r.Handle(method, "/api/pulls", ListBackgroundPullsHandler)
+		r.Handle(method, "/v1/models", OpenAIModelsHandler)
+		r.Handle(method, "/metrics", MetricsHandler)
+		r.Handle(method, "/api/ps", ProcessHandler)
+		r.Handle(method, "/api/gpus", GPUsHandler)
+		r.Handle(method, "/api/health", HealthHandler)
+		r.Handle(method, "/api/ready", ReadyHandler)
 	}
 
-	log.Printf("Listening on %s", ln.Addr())
 	s := &http.Server{
 		Handler: r,
 	}
 
-	// listen for a ctrl+c and stop any loaded llm
+	// event streams only end when the client goes, so shutdown ends them rather than waiting
+	s.RegisterOnShutdown(events.close)
+
+	// listen for a ctrl+c or SIGTERM and shut down once requests have finished
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
 	go func() {
 		<-signals
-		if loaded.llm != nil {
-			loaded.llm.Close()
-		}
-		os.RemoveAll(workDir)
-		os.Exit(0)
+		go exitOnSecondSignal(signals)
+		shutdown(s)
+		close(stopped)
 	}()
 
 	if runtime.GOOS == "linux" {
@@ -585,17 +1119,45 @@ func Serve(ln net.Listener, allowOrigins []string) error {
 		}
 	}
 
-	return s.Serve(ln)
+	errCh := make(chan error, len(lns))
+	for _, ln := range lns {
+		log.Printf("Listening on %s", ln.Addr())
+		go func(ln net.Listener) {
+			errCh <- s.Serve(ln)
+		}(ln)
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	<-stopped
+	return nil
+}
+
+// replayResponse streams resp as the only response of a request
+func replayResponse(c *gin.Context, resp any) {
+	ch := make(chan any, 1)
+	ch <- resp
+	close(ch)
+	streamResponse(c, ch)
 }
 
 func streamResponse(c *gin.Context, ch chan any) {
 	c.Header("Content-Type", "application/x-ndjson")
+	first := true
 	c.Stream(func(w io.Writer) bool {
 		val, ok := <-ch
 		if !ok {
 			return false
 		}
 
+		// a request over a limit is replied to with the limit's code, unless the stream has already started
+		if lerr, ok := val.(*limitError); ok && first {
+			c.Status(lerr.code)
+		}
+		first = false
+
 		bts, err := json.Marshal(val)
 		if err != nil {
 			log.Printf("streamResponse: json.Marshal failed with %s", err)
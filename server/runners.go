@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pbnjay/memory"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+	"github.com/jmorganca/ollama/vector"
+)
+
+// runner is a model loaded in memory, requests for the same model with the same load options share it
+type runner struct {
+	key string // the schedKey of requests which use the runner
+
+	llm        llm.LLM
+	embeddings []vector.Embedding
+
+	model   *Model
+	options api.Options
+	size    int64 // estimated memory used by the model
+
+	refs     int // requests using the runner
+	lastUsed time.Time
+
+	expireAt    time.Time
+	expireTimer *time.Timer
+}
+
+// runnerCache holds the loaded models. models stay loaded until they expire or are evicted because loading
+// another would use more memory than the budget
+type runnerCache struct {
+	mu sync.Mutex
+
+	runners map[string]*runner
+	idle    chan struct{} // closed and replaced whenever a runner's last request is done, or a model loads
+
+	// models being loaded by key, each channel is closed once its model is loaded or failed to load. their
+	// estimated size is reserved from the budget until then
+	loading  map[string]chan struct{}
+	reserved int64
+}
+
+var loaded = &runnerCache{
+	runners: make(map[string]*runner),
+	idle:    make(chan struct{}),
+	loading: make(map[string]chan struct{}),
+}
+
+var (
+	defaultBudget     int64
+	defaultBudgetOnce sync.Once
+)
+
+// memoryBudget is how much memory loaded models can use together, override it with OLLAMA_MAX_MEMORY. by
+// default it's the system memory and the memory of any nvidia gpus
+func memoryBudget() int64 {
+	defaultBudgetOnce.Do(func() {
+		defaultBudget = int64(memory.TotalMemory())
+		if vram, err := llm.CheckVRAM(); err == nil {
+			defaultBudget += int64(vram) * 1024 * 1024
+		}
+	})
+
+	return int64(envBytes("OLLAMA_MAX_MEMORY", uint64(defaultBudget)))
+}
+
+// estimateSize guesses the memory model will use once loaded from the size of its weights
+func estimateSize(model *Model) int64 {
+	fi, err := os.Stat(model.ModelPath)
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+// reserve unloads the least recently used idle models until size more bytes fit in the memory budget. if the
+// models using the memory are busy or still loading it waits for them, unlocking loaded.mu while it does. it is
+// up to the caller to lock loaded.mu
+func reserve(ctx context.Context, size int64) error {
+	budget := memoryBudget()
+	for {
+		used := loaded.reserved
+		var lru *runner
+		for _, r := range loaded.runners {
+			used += r.size
+			if r.refs == 0 && (lru == nil || r.lastUsed.Before(lru.lastUsed)) {
+				lru = r
+			}
+		}
+
+		// a model bigger than the budget still loads once nothing else is
+		if used+size <= budget || len(loaded.runners)+len(loaded.loading) == 0 {
+			return nil
+		}
+
+		if lru != nil {
+			log.Printf("unloading %s to make room for another model", lru.model.ShortName)
+			unload(lru)
+			continue
+		}
+
+		// every loaded model is busy, wait for one of them to finish or a load to end
+		idle := loaded.idle
+		loaded.mu.Unlock()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			loaded.mu.Lock()
+			return ctx.Err()
+		}
+		loaded.mu.Lock()
+	}
+}
+
+// notifyIdle wakes requests waiting for a runner to finish, it is up to the caller to lock loaded.mu
+func notifyIdle() {
+	close(loaded.idle)
+	loaded.idle = make(chan struct{})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+type fakeLLM struct {
+	size    int64
+	closed  bool
+	flushed bool
+}
+
+func (f *fakeLLM) Predict(context.Context, llm.PredictOpts, func(api.GenerateResponse)) error {
+	return nil
+}
+
+func (f *fakeLLM) Embedding(context.Context, string) ([]float64, error) { return nil, nil }
+func (f *fakeLLM) Encode(context.Context, string) ([]int, error)        { return nil, nil }
+func (f *fakeLLM) Decode(context.Context, []int) (string, error)        { return "", nil }
+func (f *fakeLLM) SetOptions(api.Options)                               {}
+func (f *fakeLLM) Close()                                               { f.closed = true }
+func (f *fakeLLM) Ping(context.Context) error                           { return nil }
+func (f *fakeLLM) Memory() (cpu, gpu int64)                             { return f.size, 0 }
+func (f *fakeLLM) FlushPromptCache()                                    { f.flushed = true }
+
+func TestReserve(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_MEMORY", "100")
+
+	older := &runner{key: "older", llm: &fakeLLM{size: 40}, model: &Model{ShortName: "older"}, size: 40, lastUsed: time.Now().Add(-time.Minute)}
+	newer := &runner{key: "newer", llm: &fakeLLM{size: 40}, model: &Model{ShortName: "newer"}, size: 40, lastUsed: time.Now()}
+
+	saved := loaded.runners
+	loaded.runners = map[string]*runner{older.key: older, newer.key: newer}
+	defer func() { loaded.runners = saved }()
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	// both fit alongside a model this small
+	if err := reserve(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.runners) != 2 {
+		t.Fatalf("expected 2 loaded models, got %d", len(loaded.runners))
+	}
+
+	// the least recently used model makes room
+	if err := reserve(context.Background(), 40); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := loaded.runners["older"]; ok || !older.llm.(*fakeLLM).closed {
+		t.Error("expected least recently used model to be unloaded")
+	}
+
+	if _, ok := loaded.runners["newer"]; !ok {
+		t.Error("expected most recently used model to stay loaded")
+	}
+
+	// a busy model isn't unloaded, the load waits for it instead
+	newer.refs = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := reserve(ctx, 80); err == nil {
+		t.Error("expected reserve to wait for the busy model")
+	}
+
+	if _, ok := loaded.runners["newer"]; !ok {
+		t.Error("busy model was unloaded")
+	}
+}
+
+func TestFlushPromptCache(t *testing.T) {
+	a := &runner{key: "a", llm: &fakeLLM{}, model: &Model{Name: "a", ShortName: "a"}}
+	b := &runner{key: "b", llm: &fakeLLM{}, model: &Model{Name: "b", ShortName: "b"}}
+
+	saved := loaded.runners
+	loaded.runners = map[string]*runner{a.key: a, b.key: b}
+	defer func() { loaded.runners = saved }()
+
+	r := gin.New()
+	r.DELETE("/api/cache", FlushPromptCacheHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/cache", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if !a.llm.(*fakeLLM).flushed || !b.llm.(*fakeLLM).flushed {
+		t.Error("expected every loaded model's cache to be flushed")
+	}
+
+	if !strings.Contains(w.Body.String(), `"models":["a","b"]`) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+}
+
+func TestLoadUnlocked(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_MEMORY", "100")
+
+	starting := make(chan string, 2)
+	started := make(chan struct{})
+	saved := newLLM
+	newLLM = func(_, model string, _, _ []string, _, _ string, _ api.Options) (llm.LLM, error) {
+		starting <- model
+		<-started
+		return &fakeLLM{size: 10}, nil
+	}
+	defer func() { newLLM = saved }()
+
+	savedRunners := loaded.runners
+	loaded.runners = make(map[string]*runner)
+	defer func() { loaded.runners = savedRunners }()
+
+	model := &Model{Name: "a", ShortName: "a", ModelPath: "a"}
+	runners := make(chan *runner, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+
+			r, err := load(context.Background(), t.TempDir(), model, nil, "a")
+			if err != nil {
+				t.Error(err)
+			}
+			runners <- r
+		}()
+	}
+
+	<-starting
+
+	// the lock is free while the model loads, and the second request waits for the first's model
+	loaded.mu.Lock()
+	if _, ok := loaded.loading["a"]; !ok || len(loaded.runners) != 0 {
+		t.Error("expected the model to be loading")
+	}
+	loaded.mu.Unlock()
+
+	close(started)
+	first, second := <-runners, <-runners
+	if first != second || loaded.runners["a"] != first {
+		t.Error("expected both requests to share one runner")
+	}
+
+	select {
+	case <-starting:
+		t.Error("expected the model to be loaded once")
+	default:
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	if len(loaded.loading) != 0 || loaded.reserved != 0 {
+		t.Errorf("expected nothing loading, got %d with %d bytes reserved", len(loaded.loading), loaded.reserved)
+	}
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3BlobStore keeps blobs in an S3 bucket, or anything with the same api such as MinIO. requests are signed
+// with AWS signature version 4 and use path style urls, which every S3 compatible store supports
+type s3BlobStore struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// newS3BlobStore returns the store for u, s3://bucket/prefix. the endpoint is OLLAMA_S3_ENDPOINT or AWS's for
+// AWS_REGION, and credentials are AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func newS3BlobStore(u *url.URL) (*s3BlobStore, error) {
+	if u.Host == "" {
+		return nil, errors.New("s3 blob store needs a bucket, such as s3://bucket/prefix")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("OLLAMA_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	eu, err := url.Parse(endpoint)
+	if err != nil || eu.Scheme == "" || eu.Host == "" {
+		return nil, fmt.Errorf("invalid OLLAMA_S3_ENDPOINT %q", endpoint)
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3BlobStore{
+		endpoint:     eu,
+		bucket:       u.Host,
+		prefix:       prefix,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}, nil
+}
+
+// key is the object of a blob, named like the blob's file so it's valid on any store
+func (s *s3BlobStore) key(digest string) string {
+	return s.prefix + strings.ReplaceAll(digest, ":", "-")
+}
+
+func (s *s3BlobStore) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := s.endpoint.JoinPath(s.bucket, key)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the headers of a signature version 4 request. payloads aren't hashed unless the request already
+// has their x-amz-content-sha256, blobs are verified against their digest instead
+func (s *s3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := req.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	if s.accessKey == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Error is the error of a response which isn't a success, it wraps os.ErrNotExist for missing objects
+func s3Error(resp *http.Response, digest string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", digest, os.ErrNotExist)
+	}
+
+	return fmt.Errorf("s3 responded with code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(digest), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp, digest)
+	}
+
+	return resp.Body, nil
+}
+
+// s3MaxPutSize is the largest object S3 takes in a single PUT, larger blobs and blobs of unknown size are
+// uploaded in parts of at least s3PartSize
+var (
+	s3MaxPutSize int64 = 5 << 30
+	s3PartSize   int64 = 64 << 20
+)
+
+// s3MaxParts is the most parts S3 takes for an object
+const s3MaxParts = 10000
+
+func (s *s3BlobStore) Put(ctx context.Context, digest string, r io.Reader, size int64) error {
+	if size < 0 || size > s3MaxPutSize {
+		return s.putMultipart(ctx, digest, r, size)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.key(digest), nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, digest)
+	}
+
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads the blob in parts, an upload which fails is aborted so S3 doesn't keep its parts
+func (s *s3BlobStore) putMultipart(ctx context.Context, digest string, r io.Reader, size int64) error {
+	key := s.key(digest)
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, digest)
+	}
+
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return err
+	}
+
+	if err := s.uploadParts(ctx, key, digest, upload.UploadID, r, size); err != nil {
+		// the upload's context may be done, it's aborted regardless
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if resp, err := s.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {upload.UploadID}}, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) uploadParts(ctx context.Context, key, digest, id string, r io.Reader, size int64) error {
+	partSize := s3PartSize
+	if size/s3MaxParts >= partSize {
+		partSize = size/s3MaxParts + 1
+	}
+
+	var parts []s3Part
+	var total int64
+	buf := make([]byte, partSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) && len(parts) > 0 {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		if len(parts) == s3MaxParts {
+			return fmt.Errorf("blob %s has more than %d parts", digest, s3MaxParts)
+		}
+
+		number := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}
+		resp, perr := s.do(ctx, http.MethodPut, key, query, bytes.NewReader(buf[:n]), int64(n))
+		if perr != nil {
+			return perr
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return s3Error(resp, digest)
+		}
+		resp.Body.Close()
+
+		parts = append(parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		total += int64(n)
+		if err != nil {
+			// the last part was shorter than the rest
+			break
+		}
+	}
+
+	if size >= 0 && total != size {
+		return fmt.Errorf("blob %s is %d bytes, expected %d", digest, total, size)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {id}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, digest)
+	}
+
+	// completing an upload can fail after S3 has replied ok, the error is then the body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 couldn't complete the upload of %s: %s: %s", digest, result.Code, result.Message)
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, digest string) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(digest), nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp, digest)
+	}
+
+	return resp.ContentLength, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, digest string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(digest), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, digest)
+	}
+
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3BlobStore) List(ctx context.Context) ([]string, error) {
+	var digests []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp, "bucket "+s.bucket)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+
+			digests = append(digests, strings.Replace(name, "-", ":", 1))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return digests, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// requests which use a model wait their turn in that model's queue. requests for different models run at the
+// same time if the models fit in memory together, otherwise a request waits in load for memory to be freed.
+// OLLAMA_NUM_PARALLEL requests can run on a model at once if it fits in memory
+
+var errQueueFull = errors.New("server busy, too many requests waiting")
+
+// maxQueue is how many requests can wait to run, override it with OLLAMA_MAX_QUEUE
+const maxQueue = 512
+
+type schedRequest struct {
+	key      string
+	enqueued time.Time
+	ready    chan struct{} // closed once the request can run
+	position chan int      // the request's latest place in the queue while it waits
+	last     int
+}
+
+type scheduler struct {
+	mu     sync.Mutex
+	queues map[string][]*schedRequest // requests waiting by the model they need loaded
+	queued int
+
+	active   map[string]int // requests running by model
+	parallel map[string]int // requests which can run at once by model, 1 until the model is loaded
+
+	busyTime time.Duration // smoothed time requests run for, to estimate waits
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		queues:   make(map[string][]*schedRequest),
+		active:   make(map[string]int),
+		parallel: make(map[string]int),
+	}
+}
+
+var sched = newScheduler()
+
+// schedKey identifies the model a request needs loaded. requests with different load options need the model
+// loaded again so they queue separately
+func schedKey(model *Model, opts map[string]interface{}) (string, error) {
+	bts, err := json.Marshal(loadOptions(opts))
+	if err != nil {
+		return "", err
+	}
+
+	id := model.Digest
+	if id == "" {
+		id = model.ModelPath
+	}
+
+	return fmt.Sprintf("%s %s", id, bts), nil
+}
+
+// acquire waits for the request's turn to run on the model for key, calling queued with its place in the queue
+// whenever it changes. release must be called once the request is done
+func (s *scheduler) acquire(ctx context.Context, key string, queued func(position int, wait time.Duration)) (release func(), err error) {
+	s.mu.Lock()
+	if s.queued >= envInt("OLLAMA_MAX_QUEUE", maxQueue) {
+		s.mu.Unlock()
+		return nil, errQueueFull
+	}
+
+	r := &schedRequest{key: key, enqueued: time.Now(), ready: make(chan struct{}), position: make(chan int, 1)}
+	s.queues[key] = append(s.queues[key], r)
+	s.queued++
+	s.dispatch()
+	s.mu.Unlock()
+
+	for {
+		select {
+		case <-r.ready:
+			start := time.Now()
+			var once sync.Once
+			return func() {
+				once.Do(func() { s.release(key, time.Since(start)) })
+			}, nil
+		case position := <-r.position:
+			if queued != nil {
+				queued(position, s.estimate(key, position))
+			}
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			select {
+			case <-r.ready:
+				// the request's turn came as it was cancelled
+				s.releaseLocked(key, 0)
+			default:
+				s.remove(r)
+				s.dispatch()
+			}
+
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+func (s *scheduler) release(key string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(key, d)
+}
+
+func (s *scheduler) releaseLocked(key string, d time.Duration) {
+	s.active[key]--
+	if s.active[key] <= 0 {
+		delete(s.active, key)
+		if len(s.queues[key]) == 0 {
+			// the model may be unloaded before it is used again
+			delete(s.parallel, key)
+		}
+	}
+
+	if d > 0 {
+		if s.busyTime == 0 {
+			s.busyTime = d
+		} else {
+			s.busyTime = (s.busyTime*7 + d*3) / 10
+		}
+	}
+
+	s.dispatch()
+}
+
+func (s *scheduler) remove(r *schedRequest) {
+	q := s.queues[r.key]
+	for i := range q {
+		if q[i] == r {
+			s.queues[r.key] = append(q[:i], q[i+1:]...)
+			s.queued--
+			break
+		}
+	}
+
+	if len(s.queues[r.key]) == 0 {
+		delete(s.queues, r.key)
+	}
+}
+
+// setParallel sets how many requests can run at once on the model for key, once it is loaded
+func (s *scheduler) setParallel(key string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[key]; ok && n > s.parallel[key] {
+		s.parallel[key] = n
+		s.dispatch()
+	}
+}
+
+// dispatch starts waiting requests which can run and tells the rest where they are in their model's queue, it
+// is up to the caller to lock s.mu
+func (s *scheduler) dispatch() {
+	for key := range s.queues {
+		parallel := s.parallel[key]
+		if parallel < 1 {
+			parallel = 1
+		}
+
+		for len(s.queues[key]) > 0 && s.active[key] < parallel {
+			r := s.queues[key][0]
+			s.remove(r)
+			s.active[key]++
+			close(r.ready)
+		}
+
+		for i, r := range s.queues[key] {
+			if r.last == i+1 {
+				continue
+			}
+
+			r.last = i + 1
+			select {
+			case <-r.position:
+			default:
+			}
+			r.position <- r.last
+		}
+	}
+}
+
+// estimate guesses how long a request at position in the queue for key has to wait
+func (s *scheduler) estimate(key string, position int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busyTime == 0 {
+		return 0
+	}
+
+	parallel := s.parallel[key]
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	ahead := position - 1 + s.active[key]
+	return s.busyTime * time.Duration((ahead+parallel-1)/parallel)
+}
+
+// numParallel is how many requests can run at once on runner. models split between the cpu and gpu don't have
+// memory to spare for more, and runners which batch requests themselves can limit it further
+func numParallel(runner llm.LLM) int {
+	n := envInt("OLLAMA_NUM_PARALLEL", 1)
+	if n < 1 {
+		n = 1
+	}
+
+	if cpu, gpu := runner.Memory(); cpu > 0 && gpu > 0 {
+		return 1
+	}
+
+	if b, ok := runner.(llm.Batcher); ok && b.NumParallel() < n {
+		n = b.NumParallel()
+	}
+
+	return n
+}
+
+// runnerRef is a turn to use a loaded model, taken with acquireModel
+type runnerRef struct {
+	*runner
+
+	// release must be called once the request is done with the model
+	release func()
+}
+
+// acquireModel waits for a turn to run on model and loads it with opts, queued is called with the request's place
+// in the queue while it waits. once the turn is released the model stays loaded for sessionDuration
+func acquireModel(ctx context.Context, workDir string, model *Model, opts map[string]interface{}, sessionDuration time.Duration, queued func(int, time.Duration)) (*runnerRef, error) {
+	key, err := schedKey(model, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := sched.acquire(ctx, key, queued)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded.mu.Lock()
+	r, err := load(ctx, workDir, model, opts, key)
+	if err != nil {
+		loaded.mu.Unlock()
+		done()
+		return nil, err
+	}
+
+	r.refs++
+	r.lastUsed = time.Now()
+	resetExpiry(r, sessionDuration)
+	loaded.mu.Unlock()
+
+	markUsed(model.ShortName)
+	start := time.Now()
+
+	var once sync.Once
+	ref := &runnerRef{runner: r, release: func() {
+		once.Do(func() {
+			if _, gpu := r.llm.Memory(); gpu > 0 {
+				recordGPUTime(model.ShortName, time.Since(start))
+			}
+
+			done()
+
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+
+			// the model stays loaded for sessionDuration after its last request
+			r.refs--
+			r.lastUsed = time.Now()
+			resetExpiry(r, sessionDuration)
+			if r.refs == 0 {
+				notifyIdle()
+			}
+		})
+	}}
+
+	sched.setParallel(key, numParallel(r.llm))
+	return ref, nil
+}
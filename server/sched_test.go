@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerQueue(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	releaseA, err := s.acquire(ctx, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.setParallel("a", 2)
+
+	// a second request for the loaded model runs alongside the first
+	releaseA2, err := s.acquire(ctx, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := make(chan int, 8)
+	acquired := make(chan func())
+	go func() {
+		release, err := s.acquire(ctx, "a", func(position int, _ time.Duration) {
+			positions <- position
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	if position := <-positions; position != 1 {
+		t.Errorf("expected position 1, got %d", position)
+	}
+
+	// requests for another model don't wait behind the first model's queue
+	releaseB, err := s.acquire(ctx, "b", func(int, time.Duration) {
+		t.Error("request for another model was queued")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB()
+
+	select {
+	case <-acquired:
+		t.Fatal("request ran while the model was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseA()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("request didn't run once the model was free")
+	}
+
+	releaseA2()
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler()
+
+	release, err := s.acquire(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.acquire(ctx, "a", nil); err == nil {
+		t.Fatal("expected cancelled request to fail")
+	}
+
+	if s.queued != 0 || len(s.queues) != 0 {
+		t.Errorf("cancelled request is still queued")
+	}
+}
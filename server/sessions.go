@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// defaultSessionIdle is how long a session is kept without being used, unless it's created with its own timeout
+const defaultSessionIdle = 30 * time.Minute
+
+var errSessionBusy = errors.New("session is already chatting, wait for its reply")
+
+// session is a conversation kept on the server. each chat in it continues from its history, and the model stays
+// loaded with the conversation in its prompt cache while the session is used
+type session struct {
+	mu sync.Mutex
+
+	id      string
+	owner   string // the apiKey of the request which created the session, only its key can use it
+	model   string
+	options map[string]interface{}
+	idle    time.Duration
+
+	messages  []api.Message
+	createdAt time.Time
+	expiresAt time.Time
+	timer     *time.Timer
+
+	// busy is set while a chat is running, the next turn needs its reply
+	busy bool
+}
+
+var sessions = struct {
+	mu sync.Mutex
+	m  map[string]*session
+}{m: make(map[string]*session)}
+
+func sessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "sess-" + hex.EncodeToString(b), nil
+}
+
+func newSession(owner, model string, messages []api.Message, options map[string]interface{}, idle time.Duration) (*session, error) {
+	id, err := sessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		id:        id,
+		owner:     owner,
+		model:     model,
+		options:   options,
+		idle:      idle,
+		messages:  append([]api.Message{}, messages...),
+		createdAt: time.Now().UTC(),
+	}
+
+	s.expiresAt = time.Now().Add(idle)
+	s.timer = time.AfterFunc(idle, func() { expireSession(s) })
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sessions.m[id] = s
+	return s, nil
+}
+
+// getSession returns the session id if owner created it, a session created with another key isn't found
+func getSession(id, owner string) (*session, bool) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	s, ok := sessions.m[id]
+	if !ok || s.owner != owner {
+		return nil, false
+	}
+
+	return s, true
+}
+
+func deleteSession(id string) bool {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	s, ok := sessions.m[id]
+	if ok {
+		s.timer.Stop()
+		delete(sessions.m, id)
+	}
+
+	return ok
+}
+
+// expireSession deletes s once it has been idle for its timeout, a session in a chat expires once it's done
+func expireSession(s *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busy || time.Now().Before(s.expiresAt) {
+		return
+	}
+
+	deleteSession(s.id)
+}
+
+// begin starts a turn of the conversation, returning its history. end must be called once the turn is done
+func (s *session) begin() ([]api.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busy {
+		return nil, errSessionBusy
+	}
+
+	s.busy = true
+	return append([]api.Message{}, s.messages...), nil
+}
+
+// end finishes a turn, adding messages to the history. a turn which failed adds none
+func (s *session) end(messages ...api.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.busy = false
+	s.messages = append(s.messages, messages...)
+	s.expiresAt = time.Now().Add(s.idle)
+	s.timer.Reset(s.idle)
+}
+
+func (s *session) response(history bool) api.SessionResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := api.SessionResponse{
+		ID:           s.id,
+		Model:        s.model,
+		CreatedAt:    s.createdAt,
+		ExpiresAt:    s.expiresAt.UTC(),
+		MessageCount: len(s.messages),
+	}
+
+	if history {
+		resp.Messages = append([]api.Message{}, s.messages...)
+	}
+
+	return resp
+}
+
+// CreateSessionHandler creates a session for the model, loading it so the first chat doesn't wait
+func CreateSessionHandler(c *gin.Context) {
+	var req api.SessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if !checkOptions(c, req.Options) {
+		return
+	}
+
+	model, err := GetModel(req.Model)
+	if err != nil {
+		replyError(c, http.StatusNotFound, errModelNotFound(req.Model))
+		return
+	}
+
+	if !checkLicense(c, model) {
+		return
+	}
+
+	idle := defaultSessionIdle
+	if req.IdleTimeout != nil {
+		idle = req.IdleTimeout.Duration
+	}
+
+	if idle <= 0 {
+		replyError(c, http.StatusBadRequest, errors.New("idle_timeout must be positive"))
+		return
+	}
+
+	runner, err := acquireModel(c.Request.Context(), c.GetString("workDir"), model, req.Options, idle, nil)
+	if errors.Is(err, errQueueFull) {
+		replyError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+	runner.release()
+
+	s, err := newSession(c.GetString("apiKey"), req.Model, req.Messages, req.Options, idle)
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, s.response(false))
+}
+
+// ListSessionsHandler lists the sessions created with the request's key
+func ListSessionsHandler(c *gin.Context) {
+	owner := c.GetString("apiKey")
+	sessions.mu.Lock()
+	all := make([]*session, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		if s.owner == owner {
+			all = append(all, s)
+		}
+	}
+	sessions.mu.Unlock()
+
+	resp := api.ListSessionsResponse{Sessions: []api.SessionResponse{}}
+	for _, s := range all {
+		resp.Sessions = append(resp.Sessions, s.response(false))
+	}
+
+	sort.Slice(resp.Sessions, func(i, j int) bool {
+		return resp.Sessions[i].CreatedAt.Before(resp.Sessions[j].CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetSessionHandler returns a session with its conversation so far
+func GetSessionHandler(c *gin.Context) {
+	s, ok := getSession(c.Param("id"), c.GetString("apiKey"))
+	if !ok {
+		replyError(c, http.StatusNotFound, fmt.Errorf("session '%s' not found", c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, s.response(true))
+}
+
+func DeleteSessionHandler(c *gin.Context) {
+	s, ok := getSession(c.Param("id"), c.GetString("apiKey"))
+	if !ok || !deleteSession(s.id) {
+		replyError(c, http.StatusNotFound, fmt.Errorf("session '%s' not found", c.Param("id")))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestSessionTurns(t *testing.T) {
+	s, err := newSession("", "llama2", []api.Message{{Role: "system", Content: "be brief"}}, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteSession(s.id)
+
+	history, err := s.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 1 {
+		t.Fatalf("expected the system message, got %+v", history)
+	}
+
+	if _, err := s.begin(); !errors.Is(err, errSessionBusy) {
+		t.Fatalf("expected a second turn to be refused while the first runs, got %v", err)
+	}
+
+	s.end(api.Message{Role: "user", Content: "hi"}, api.Message{Role: "assistant", Content: "hello"})
+
+	// a failed turn adds nothing
+	if _, err := s.begin(); err != nil {
+		t.Fatal(err)
+	}
+	s.end()
+
+	r := gin.New()
+	r.GET("/api/sessions/:id", GetSessionHandler)
+	r.DELETE("/api/sessions/:id", DeleteSessionHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/sessions/"+s.id, nil))
+
+	var resp api.SessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.MessageCount != 3 || len(resp.Messages) != 3 || resp.Messages[2].Content != "hello" {
+		t.Errorf("unexpected session %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/sessions/"+s.id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/sessions/"+s.id, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a deleted session to be gone, got %d", w.Code)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	s, err := newSession("", "llama2", nil, nil, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session in a chat is kept until the chat is done
+	if _, err := s.begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := getSession(s.id, ""); !ok {
+		t.Fatal("expected a busy session to be kept")
+	}
+
+	s.end()
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := getSession(s.id, ""); ok {
+		t.Fatal("expected an idle session to expire")
+	}
+}
+
+func TestSessionOwners(t *testing.T) {
+	keys := map[string]apiRole{"alice": roleGenerate, "bob": roleGenerate}
+
+	r := gin.New()
+	r.Use(apiKeyMiddleware(keys))
+	r.GET("/api/sessions", ListSessionsHandler)
+	r.GET("/api/sessions/:id", GetSessionHandler)
+	r.DELETE("/api/sessions/:id", DeleteSessionHandler)
+	r.POST("/api/chat", ChatHandler)
+
+	s, err := newSession(apiKeyID("alice"), "llama2", []api.Message{{Role: "user", Content: "a secret"}}, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteSession(s.id)
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	list := func(key string) []api.SessionResponse {
+		var resp api.ListSessionsResponse
+		if err := json.Unmarshal(do(http.MethodGet, "/api/sessions", key, "").Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Sessions
+	}
+
+	if sessions := list("alice"); len(sessions) != 1 || sessions[0].ID != s.id {
+		t.Errorf("expected alice to see the session, got %+v", sessions)
+	}
+
+	// another key can't list, read, chat in or delete the session
+	if sessions := list("bob"); len(sessions) != 0 {
+		t.Errorf("expected bob to see no sessions, got %+v", sessions)
+	}
+
+	if w := do(http.MethodGet, "/api/sessions/"+s.id, "bob", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 reading another key's session, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodPost, "/api/chat", "bob", `{"session": "`+s.id+`", "messages": [{"role": "user", "content": "hi"}]}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 chatting in another key's session, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodDelete, "/api/sessions/"+s.id, "bob", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting another key's session, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodGet, "/api/sessions/"+s.id, "alice", ""); w.Code != http.StatusOK {
+		t.Errorf("expected alice to read the session, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := do(http.MethodDelete, "/api/sessions/"+s.id, "alice", ""); w.Code != http.StatusOK {
+		t.Errorf("expected alice to delete the session, got %d: %s", w.Code, w.Body)
+	}
+}
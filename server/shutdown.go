@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is how long requests get to finish once the server is asked to stop, override it with
+// OLLAMA_SHUTDOWN_TIMEOUT
+const defaultShutdownTimeout = 30 * time.Second
+
+const cancelServerShutdown cancelReason = "server shutting down"
+
+// activeDownloads counts the downloads writing blobs, so shutdown waits for them to save what they have
+var activeDownloads sync.WaitGroup
+
+// shutdown stops the server accepting requests and waits for the ones running to finish. downloads are stopped
+// straight away, their partial blobs are kept so pulls carry on where they stopped once the server is back.
+// requests still running after the timeout are cancelled, then the loaded models are unloaded
+func shutdown(s *http.Server) {
+	timeout := envDuration("OLLAMA_SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	log.Printf("shutting down, waiting up to %s for requests to finish", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	downloadControls.Range(func(_, v any) bool {
+		v.(*downloadControl).cancel(cancelServerShutdown)
+		return true
+	})
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("requests didn't finish in %s, cancelling them", timeout)
+		generations.Range(func(_, v any) bool {
+			v.(context.CancelCauseFunc)(cancelServerShutdown)
+			return true
+		})
+
+		s.Close()
+	}
+
+	downloaded := make(chan struct{})
+	go func() {
+		activeDownloads.Wait()
+		close(downloaded)
+	}()
+
+	select {
+	case <-downloaded:
+	case <-time.After(5 * time.Second):
+		log.Print("downloads didn't stop in time, their partial blobs are resumed from the last full chunk")
+	}
+
+	flushModelStats()
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	for name, r := range loaded.runners {
+		log.Printf("unloading %s", name)
+		r.llm.Close()
+	}
+}
+
+// exitOnSecondSignal exits without waiting for requests if the server is asked to stop again while shutting down
+func exitOnSecondSignal(signals chan os.Signal) {
+	<-signals
+	log.Print("asked to stop again, exiting without waiting for requests")
+	os.Exit(1)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Setenv("OLLAMA_SHUTDOWN_TIMEOUT", "5s")
+
+	saved := loaded.runners
+	defer func() { loaded.runners = saved }()
+
+	model := &fakeLLM{}
+	loaded.runners = map[string]*runner{"test": {key: "test", llm: model, model: &Model{ShortName: "test"}}}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	downloadControls.Store("sha256:shutdown", &downloadControl{file: &FileDownload{}, cancel: cancel})
+	defer downloadControls.Delete("sha256:shutdown")
+
+	started := make(chan struct{})
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+
+		bts, _ := io.ReadAll(resp.Body)
+		body <- string(bts)
+	}()
+
+	<-started
+	shutdown(s)
+
+	if got := <-body; got != "finished" {
+		t.Errorf("expected the running request to finish, got %q", got)
+	}
+
+	if !errors.Is(context.Cause(ctx), cancelServerShutdown) {
+		t.Errorf("expected downloads to be stopped, got %v", context.Cause(ctx))
+	}
+
+	if !model.closed {
+		t.Error("expected the loaded model to be unloaded")
+	}
+
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Error("expected new requests to be refused")
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// readStateFile reads the json in fp, one of the server's files in ~/.ollama, into v. a missing file leaves v as
+// it is. a file which can't be parsed, e.g. one truncated by a crash, is moved aside to fp.corrupt and v is left
+// as it is too, so the server starts over rather than failing every request which reads it
+func readStateFile(fp string, v any) error {
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if len(bts) == 0 {
+		return nil
+	}
+
+	// decode into a new value so a file which is only partly valid doesn't change v
+	parsed := reflect.New(reflect.TypeOf(v).Elem())
+	if err := json.Unmarshal(bts, parsed.Interface()); err != nil {
+		log.Printf("couldn't parse %s, starting over: %v", fp, err)
+		if err := os.Rename(fp, fp+".corrupt"); err != nil {
+			log.Printf("couldn't move %s aside: %v", fp, err)
+		}
+
+		return nil
+	}
+
+	reflect.ValueOf(v).Elem().Set(parsed.Elem())
+	return nil
+}
+
+// writeStateFile writes v as json to fp through a temp file in the same directory, which is synced and then
+// renamed over fp so a crash leaves either the old file or the new one
+func writeStateFile(fp string, v any) error {
+	bts, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fp), filepath.Base(fp)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(bts); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fp)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// tagName returns the name tag gives the model source. a bare tag, such as v2, is a tag of the source's
+// repository, anything else is a full model name
+func tagName(source, tag string) (string, error) {
+	if tag == "" {
+		return "", errors.New("empty tag")
+	}
+
+	if strings.ContainsAny(tag, ":/") {
+		return tag, nil
+	}
+
+	mp := ParseModelPath(source)
+	mp.Tag = tag
+	return mp.GetShortTagname(), nil
+}
+
+// TagModel gives the model source each of tags. tags are manifests referring to the same blobs, no data is copied
+func TagModel(source string, tags []string) ([]string, error) {
+	var names []string
+	for _, tag := range tags {
+		name, err := tagName(source, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := CopyModel(source, name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// sharedModels returns the other local models which share layers with the model name, models with the same
+// manifest are its tags
+func sharedModels(name string) ([]api.SharedModel, error) {
+	mp := ParseModelPath(name)
+	manifest, digest, err := GetManifest(mp)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int)
+	for _, l := range append(manifest.Layers, &manifest.Config) {
+		sizes[l.Digest] = l.Size
+	}
+
+	models, err := listModels()
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []api.SharedModel
+	for _, m := range models {
+		if m.Name == mp.GetShortTagname() {
+			continue
+		}
+
+		s := api.SharedModel{Name: m.Name, Digest: m.Digest, Tag: m.Digest == digest}
+		for _, l := range m.Layers {
+			if size, ok := sizes[l]; ok {
+				s.SharedLayers++
+				s.SharedSize += size
+			}
+		}
+
+		if s.SharedLayers > 0 {
+			shared = append(shared, s)
+		}
+	}
+
+	// tags first, then the models sharing the most
+	sort.SliceStable(shared, func(i, j int) bool {
+		if shared[i].Tag != shared[j].Tag {
+			return shared[i].Tag
+		}
+
+		return shared[i].SharedSize > shared[j].SharedSize
+	})
+
+	return shared, nil
+}
+
+// tagResponse describes the model name and what it shares layers with
+func tagResponse(name string) (*api.TagResponse, error) {
+	shared, err := sharedModels(name)
+	if err != nil {
+		return nil, fmt.Errorf("model '%s' not found: %w", name, err)
+	}
+
+	return &api.TagResponse{Name: ParseModelPath(name).GetShortTagname(), Shared: shared}, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestTagModel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	writeTestModel(t, "myproject/model:v1", []byte("weights"))
+	writeTestModel(t, "other", []byte("other weights"))
+
+	names, err := TagModel("myproject/model:v1", []string{"latest", "backup/model:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 || names[0] != "myproject/model:latest" || names[1] != "backup/model:v1" {
+		t.Errorf("unexpected tags %v", names)
+	}
+
+	shared, err := sharedModels("myproject/model:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shared) != 2 {
+		t.Fatalf("expected the two tags to share layers, got %+v", shared)
+	}
+
+	for _, s := range shared {
+		if !s.Tag || s.SharedLayers != 1 {
+			t.Errorf("expected %s to be a tag with all the layers, got %+v", s.Name, s)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// filterModels filters, sorts and pages models by the query parameters of a list request, returning the page and
+// how many models matched before paging
+func filterModels(models []api.ModelResponse, query url.Values) ([]api.ModelResponse, int, error) {
+	name := query.Get("name")
+	family := query.Get("family")
+	parameterSize := query.Get("parameter_size")
+	quantization := query.Get("quantization_level")
+
+	var matched []api.ModelResponse
+	for _, m := range models {
+		switch {
+		case name != "" && !strings.HasPrefix(m.Name, name):
+		case family != "" && !strings.EqualFold(m.Details.Family, family):
+		case parameterSize != "" && !strings.EqualFold(m.Details.ParameterSize, parameterSize):
+		case quantization != "" && !strings.EqualFold(m.Details.QuantizationLevel, quantization):
+		default:
+			matched = append(matched, m)
+		}
+	}
+
+	// a leading - sorts in descending order
+	order := query.Get("sort")
+	if order == "" {
+		order = "name"
+	}
+	desc := strings.HasPrefix(order, "-")
+	order = strings.TrimPrefix(order, "-")
+
+	var less func(a, b api.ModelResponse) bool
+	switch order {
+	case "name":
+		less = func(a, b api.ModelResponse) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b api.ModelResponse) bool { return a.Size < b.Size }
+	case "modified_at":
+		less = func(a, b api.ModelResponse) bool { return a.ModifiedAt.Before(b.ModifiedAt) }
+	case "last_used_at":
+		// models which haven't been used sort first
+		less = func(a, b api.ModelResponse) bool {
+			return b.LastUsedAt != nil && (a.LastUsedAt == nil || a.LastUsedAt.Before(*b.LastUsedAt))
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported sort %q, expected name, size, modified_at or last_used_at", order)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	offset, err := queryInt(query, "offset")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit, err := queryInt(query, "limit")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(matched)
+	if offset > total {
+		offset = total
+	}
+	matched = matched[offset:]
+
+	if limit > 0 && limit < len(matched) {
+		matched = matched[:limit]
+	}
+
+	return matched, total, nil
+}
+
+func queryInt(query url.Values, key string) (int, error) {
+	s := query.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, s)
+	}
+
+	return n, nil
+}
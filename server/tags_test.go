@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestFilterModels(t *testing.T) {
+	now := time.Now()
+	models := []api.ModelResponse{
+		{Name: "llama2:7b", Size: 3, Details: api.ModelDetails{Family: "llama", QuantizationLevel: "Q4_0"}},
+		{Name: "llama2:13b", Size: 7, Details: api.ModelDetails{Family: "llama", QuantizationLevel: "Q4_0"}, LastUsedAt: &now},
+		{Name: "falcon:7b", Size: 4, Details: api.ModelDetails{Family: "falcon", QuantizationLevel: "Q8_0"}},
+	}
+
+	cases := []struct {
+		query string
+		names []string
+		total int
+	}{
+		{"", []string{"falcon:7b", "llama2:13b", "llama2:7b"}, 3},
+		{"name=llama2", []string{"llama2:13b", "llama2:7b"}, 2},
+		{"family=llama&sort=size", []string{"llama2:7b", "llama2:13b"}, 2},
+		{"quantization_level=q8_0", []string{"falcon:7b"}, 1},
+		{"sort=-size&limit=2", []string{"llama2:13b", "falcon:7b"}, 3},
+		{"sort=-last_used_at&limit=1", []string{"llama2:13b"}, 3},
+		{"offset=2&limit=5", []string{"llama2:7b"}, 3},
+	}
+
+	for _, tt := range cases {
+		query, _ := url.ParseQuery(tt.query)
+		got, total, err := filterModels(models, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range got {
+			names = append(names, m.Name)
+		}
+
+		if len(names) != len(tt.names) || total != tt.total {
+			t.Errorf("%q: got %v (%d), want %v (%d)", tt.query, names, total, tt.names, tt.total)
+			continue
+		}
+
+		for i := range names {
+			if names[i] != tt.names[i] {
+				t.Errorf("%q: got %v, want %v", tt.query, names, tt.names)
+				break
+			}
+		}
+	}
+
+	if _, _, err := filterModels(models, url.Values{"sort": {"family"}}); err == nil {
+		t.Error("expected an error for an unsupported sort")
+	}
+}
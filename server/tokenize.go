@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// tokenizerModel loads name to use its tokenizer, replying with an error if it can't. the caller releases the
+// runner once it's done
+func tokenizerModel(c *gin.Context, name string, opts map[string]interface{}) (*runnerRef, bool) {
+	if name == "" {
+		replyError(c, http.StatusBadRequest, errors.New("model is required"))
+		return nil, false
+	}
+
+	auditModel(c, name)
+	model, err := GetModel(name)
+	if err != nil {
+		replyError(c, http.StatusNotFound, errModelNotFound(name))
+		return nil, false
+	}
+
+	if !checkLicense(c, model) {
+		return nil, false
+	}
+
+	runner, err := acquireModel(c.Request.Context(), c.GetString("workDir"), model, opts, defaultSessionDuration, nil)
+	if errors.Is(err, errQueueFull) {
+		replyError(c, http.StatusServiceUnavailable, err)
+		return nil, false
+	} else if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	return runner, true
+}
+
+// TokenizeHandler converts text to the model's tokens, the text isn't templated and has no bos token
+func TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	runner, ok := tokenizerModel(c, req.Model, req.Options)
+	if !ok {
+		return
+	}
+	defer runner.release()
+
+	tokens, err := runner.llm.Encode(c.Request.Context(), req.Text)
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if tokens == nil {
+		tokens = []int{}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Tokens: tokens, Count: len(tokens)})
+}
+
+func DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		replyError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	runner, ok := tokenizerModel(c, req.Model, req.Options)
+	if !ok {
+		return
+	}
+	defer runner.release()
+
+	text, err := runner.llm.Decode(c.Request.Context(), req.Tokens)
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Text: text, Count: len(req.Tokens)})
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenizeModel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	r := gin.New()
+	r.POST("/api/tokenize", TokenizeHandler)
+	r.POST("/api/detokenize", DetokenizeHandler)
+
+	cases := []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/tokenize", `{"text": "hello"}`, http.StatusBadRequest},
+		{"/api/tokenize", `{"model": "missing", "text": "hello"}`, http.StatusNotFound},
+		{"/api/detokenize", `{"model": "missing", "tokens": [1, 2]}`, http.StatusNotFound},
+		{"/api/detokenize", `{"model": "missing", "tokens": "1, 2"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.path, tt.body, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
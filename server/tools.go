@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// toolReply is what the model replies with when it has tools, either tool calls or a message
+type toolReply struct {
+	ToolCalls []api.ToolCallFunction `json:"tool_calls,omitempty"`
+	Content   *string                `json:"content,omitempty"`
+}
+
+// toolsPrompt describes tools and how to call them to the model, it's added to the system prompt
+func toolsPrompt(tools []api.Tool) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("You can call these tools, each is described by its name, what it does and a JSON schema of its arguments:\n")
+	for _, t := range tools {
+		bts, err := json.Marshal(t.Function)
+		if err != nil {
+			return "", err
+		}
+
+		sb.Write(bts)
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString(`To call tools reply with {"tool_calls": [{"name": "<tool name>", "arguments": <arguments>}]}, otherwise reply with {"content": "<message>"}. `)
+	sb.WriteString(`The results of tool calls are sent back as messages starting with "Tool result:".`)
+	return sb.String(), nil
+}
+
+// toolsGrammar constrains the model's output to a toolReply, its tool calls have the name and arguments of one
+// of tools
+func toolsGrammar(tools []api.Tool) (string, error) {
+	var calls []string
+	for _, t := range tools {
+		if t.Type != "" && t.Type != "function" {
+			return "", fmt.Errorf("unsupported tool type %q, tools must be functions", t.Type)
+		}
+
+		if t.Function.Name == "" {
+			return "", errors.New("tool functions need a name")
+		}
+
+		name, err := json.Marshal(t.Function.Name)
+		if err != nil {
+			return "", err
+		}
+
+		params := t.Function.Parameters
+		if len(params) == 0 {
+			params = json.RawMessage(`{"type": "object"}`)
+		}
+
+		// the schema is written out rather than marshalled to keep the name before the arguments
+		calls = append(calls, fmt.Sprintf(`{"type": "object", "properties": {"name": {"const": %s}, "arguments": %s}}`, name, params))
+	}
+
+	schema := fmt.Sprintf(`{"oneOf": [
+		{"type": "object", "properties": {"tool_calls": {"type": "array", "items": {"oneOf": [%s]}}}},
+		{"type": "object", "properties": {"content": {"type": "string"}}}
+	]}`, strings.Join(calls, ", "))
+
+	return schemaGrammar(json.RawMessage(schema))
+}
+
+// toolsMessage returns the assistant message for the model's reply when it has tools. a reply which isn't a
+// toolReply, such as one cut short by num_predict, is returned as it is
+func toolsMessage(content string) api.Message {
+	var reply toolReply
+	if err := json.Unmarshal([]byte(content), &reply); err != nil {
+		return api.Message{Role: "assistant", Content: content}
+	}
+
+	msg := api.Message{Role: "assistant"}
+	if reply.Content != nil {
+		msg.Content = *reply.Content
+	}
+
+	for _, f := range reply.ToolCalls {
+		msg.ToolCalls = append(msg.ToolCalls, api.ToolCall{Function: f})
+	}
+
+	return msg
+}
+
+// toolsContent renders an assistant message as the toolReply the model would have replied with
+func toolsContent(m api.Message) (string, error) {
+	var reply toolReply
+	if len(m.ToolCalls) > 0 {
+		for _, c := range m.ToolCalls {
+			reply.ToolCalls = append(reply.ToolCalls, c.Function)
+		}
+	} else {
+		reply.Content = &m.Content
+	}
+
+	bts, err := json.Marshal(reply)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bts), nil
+}
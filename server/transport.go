@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// transportOptions are the connection settings for a registry, each one set in RegistryOptions takes
+// precedence over the matching environment variable
+type transportOptions struct {
+	caCertFile         string
+	clientCertFile     string
+	clientKeyFile      string
+	insecureSkipVerify bool
+	proxyURL           string
+}
+
+func newTransportOptions(regOpts *RegistryOptions) transportOptions {
+	opts := transportOptions{
+		caCertFile:     os.Getenv("OLLAMA_REGISTRY_CA_CERT"),
+		clientCertFile: os.Getenv("OLLAMA_REGISTRY_CLIENT_CERT"),
+		clientKeyFile:  os.Getenv("OLLAMA_REGISTRY_CLIENT_KEY"),
+		proxyURL:       os.Getenv("OLLAMA_REGISTRY_PROXY"),
+	}
+
+	opts.insecureSkipVerify, _ = strconv.ParseBool(os.Getenv("OLLAMA_REGISTRY_INSECURE_SKIP_VERIFY"))
+
+	if regOpts == nil {
+		return opts
+	}
+
+	if regOpts.CACertFile != "" {
+		opts.caCertFile = regOpts.CACertFile
+	}
+
+	if regOpts.ClientCertFile != "" {
+		opts.clientCertFile, opts.clientKeyFile = regOpts.ClientCertFile, regOpts.ClientKeyFile
+	}
+
+	if regOpts.ProxyURL != "" {
+		opts.proxyURL = regOpts.ProxyURL
+	}
+
+	opts.insecureSkipVerify = opts.insecureSkipVerify || regOpts.InsecureSkipVerify
+	return opts
+}
+
+var transports sync.Map // map of transport options to the transport built for them
+
+// registryTransportFor returns the transport to use for requests made with regOpts, transports are built once
+// for each set of options so their connections are reused
+func registryTransportFor(regOpts *RegistryOptions) (http.RoundTripper, error) {
+	opts := newTransportOptions(regOpts)
+	if opts == (transportOptions{}) {
+		return registryTransport, nil
+	}
+
+	if t, ok := transports.Load(opts); ok {
+		return t.(http.RoundTripper), nil
+	}
+
+	t := registryTransport.Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: opts.insecureSkipVerify}
+
+	if opts.caCertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(opts.caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read registry ca certificate: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.caCertFile)
+		}
+
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	if opts.clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.clientCertFile, opts.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load registry client certificate: %w", err)
+		}
+
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.proxyURL != "" {
+		u, err := url.Parse(opts.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse registry proxy url: %w", err)
+		}
+
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	actual, _ := transports.LoadOrStore(opts, t)
+	return actual.(http.RoundTripper), nil
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// updateState is what the last check of a model found. local manifests are written again when they're pulled,
+// so their digest isn't the registry's, current is the registry's digest which was found to match local
+type updateState struct {
+	local     string
+	current   string
+	available bool
+	checkedAt time.Time
+}
+
+// updates are the last checks of each model by its short name, they start over when the server restarts
+var updates = struct {
+	sync.Mutex
+	m map[string]updateState
+}{m: make(map[string]updateState)}
+
+// updateAvailable reports whether the last check of name found an update, unless the model has changed since
+func updateAvailable(name, digest string) bool {
+	updates.Lock()
+	defer updates.Unlock()
+	state := updates.m[name]
+	return state.local == digest && state.available
+}
+
+// checkUpdate asks the registry for the digest of name's manifest, and records whether it has changed since the
+// model was pulled. the manifest itself is only fetched when the digest hasn't been seen before
+func checkUpdate(ctx context.Context, name string, regOpts *RegistryOptions) (api.ModelUpdate, error) {
+	mp := ParseModelPath(name)
+	local, localDigest, err := GetManifest(mp)
+	if err != nil {
+		return api.ModelUpdate{}, err
+	}
+
+	name = mp.GetShortTagname()
+	remoteDigest, err := headManifest(ctx, mp, regOpts)
+	if err != nil {
+		return api.ModelUpdate{}, err
+	}
+
+	updates.Lock()
+	state := updates.m[name]
+	updates.Unlock()
+
+	// the model was pulled, created or copied over since it was last checked
+	if state.local != localDigest {
+		state = updateState{local: localDigest}
+	}
+
+	if state.current == "" || state.current != remoteDigest {
+		remote, err := pullModelManifest(ctx, mp, regOpts)
+		if err != nil {
+			return api.ModelUpdate{}, err
+		}
+
+		if sameManifest(local, remote) {
+			state.current = remoteDigest
+		}
+	}
+
+	state.available = state.current != remoteDigest
+	state.checkedAt = time.Now().UTC()
+
+	updates.Lock()
+	updates.m[name] = state
+	updates.Unlock()
+
+	return api.ModelUpdate{Name: name, UpdateAvailable: state.available, CheckedAt: state.checkedAt}, nil
+}
+
+// sameManifest reports whether a and b have the same config and layers
+func sameManifest(a, b *ManifestV2) bool {
+	if a.Config.Digest != b.Config.Digest || len(a.Layers) != len(b.Layers) {
+		return false
+	}
+
+	for i := range a.Layers {
+		if a.Layers[i].Digest != b.Layers[i].Digest {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headManifest returns the registry's digest of mp's manifest without downloading it. mirrors aren't asked,
+// the registry is the one which knows of new versions
+func headManifest(ctx context.Context, mp ModelPath, regOpts *RegistryOptions) (string, error) {
+	headers := make(http.Header)
+	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+
+	if err := refreshToken(ctx, regOpts); err != nil {
+		return "", err
+	}
+
+	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	resp, err := makeRequest(ctx, http.MethodHead, requestURL, headers.Clone(), nil, regOpts)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if challenge := resp.Header.Get("www-authenticate"); resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(challenge, "Bearer ") {
+		if err := authenticate(ctx, challenge, regOpts); err != nil {
+			return "", err
+		}
+
+		resp, err = makeRequest(ctx, http.MethodHead, requestURL, headers.Clone(), nil, regOpts)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errors.New("model not found")
+	case resp.StatusCode >= http.StatusBadRequest:
+		return "", fmt.Errorf("on check registry responded with code %d", resp.StatusCode)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.New("registry didn't return the manifest's digest")
+	}
+
+	return digest, nil
+}
+
+// checkUpdates checks every installed model, or only name if it's set
+func checkUpdates(ctx context.Context, name string, regOpts *RegistryOptions) ([]api.ModelUpdate, error) {
+	names := []string{name}
+	if name == "" {
+		models, err := listModels()
+		if err != nil {
+			return nil, err
+		}
+
+		names = names[:0]
+		for _, m := range models {
+			names = append(names, m.Name)
+		}
+	}
+
+	checked := make([]api.ModelUpdate, 0, len(names))
+	for _, name := range names {
+		u, err := checkUpdate(ctx, name, regOpts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			u = api.ModelUpdate{Name: ParseModelPath(name).GetShortTagname(), Error: err.Error()}
+		}
+
+		checked = append(checked, u)
+	}
+
+	return checked, nil
+}
+
+// startUpdateChecker checks every installed model for updates each OLLAMA_UPDATE_CHECK, e.g. "24h". checks are off
+// if it's unset
+func startUpdateChecker() {
+	s := os.Getenv("OLLAMA_UPDATE_CHECK")
+	if s == "" {
+		return
+	}
+
+	every, err := time.ParseDuration(s)
+	if err != nil || every <= 0 {
+		log.Printf("invalid value for OLLAMA_UPDATE_CHECK: %q, not checking for updates", s)
+		return
+	}
+
+	log.Printf("checking models for updates every %s", every)
+	go func() {
+		// an event is sent once for each update found, not at every check
+		notified := make(map[string]bool)
+		for ; ; time.Sleep(every) {
+			checked, err := checkUpdates(context.Background(), "", &RegistryOptions{})
+			if err != nil {
+				log.Printf("couldn't check models for updates: %v", err)
+				continue
+			}
+
+			for _, u := range checked {
+				if u.UpdateAvailable && !notified[u.Name] {
+					events.publish(api.Event{Type: eventModelUpdateAvailable, Model: u.Name, Text: fmt.Sprintf("an update to %s is available", u.Name)})
+				}
+
+				notified[u.Name] = u.UpdateAvailable
+			}
+		}
+	}()
+}
+
+func CheckUpdatesHandler(c *gin.Context) {
+	var req api.CheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorResponse(http.StatusBadRequest, err))
+		return
+	}
+
+	if req.Name != "" {
+		if _, _, err := GetManifest(ParseModelPath(req.Name)); err != nil {
+			replyError(c, http.StatusNotFound, errModelNotFound(req.Name))
+			return
+		}
+	}
+
+	checked, err := checkUpdates(c.Request.Context(), req.Name, &RegistryOptions{Insecure: req.Insecure})
+	if err != nil {
+		replyError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.CheckResponse{Models: checked})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckUpdate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var manifest []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)))
+		w.Write(manifest)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	name := u.Host + "/library/test:latest"
+	writeTestModel(t, name, []byte("model data"))
+
+	local, _, err := GetManifest(ParseModelPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the registry's manifest is formatted differently, but has the same layers
+	manifest, _ = json.MarshalIndent(local, "", "  ")
+
+	regOpts := &RegistryOptions{Insecure: true}
+	checked, err := checkUpdate(context.Background(), name, regOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checked.UpdateAvailable {
+		t.Error("expected no update for the same layers")
+	}
+
+	newer := *local
+	newer.Config.Digest = "sha256:newer"
+	manifest, _ = json.Marshal(newer)
+
+	checked, err = checkUpdate(context.Background(), name, regOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, digest, _ := GetManifest(ParseModelPath(name))
+	if !checked.UpdateAvailable || !updateAvailable(checked.Name, digest) {
+		t.Error("expected an update once the registry's manifest changed")
+	}
+
+	if updateAvailable(checked.Name, "sha256:pulled") {
+		t.Error("expected the update to be forgotten once the local model changes")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/jmorganca/ollama/api"
 )
@@ -52,10 +53,9 @@ func startUpload(ctx context.Context, mp ModelPath, layer *Layer, regOpts *Regis
 }
 
 func uploadBlob(ctx context.Context, requestURL *url.URL, layer *Layer, chunkSize int64, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
-	// TODO allow resumability
 	// TODO allow canceling uploads via DELETE
 
-	fp, err := GetBlobsPath(layer.Digest)
+	fp, err := findBlob(layer.Digest)
 	if err != nil {
 		return err
 	}
@@ -73,6 +73,7 @@ func uploadBlob(ctx context.Context, requestURL *url.URL, layer *Layer, chunkSiz
 		fn:     fn,
 	}
 
+	var try int
 	for offset := int64(0); offset < int64(layer.Size); {
 		chunk := int64(layer.Size) - offset
 		if chunk > int64(chunkSize) {
@@ -81,16 +82,36 @@ func uploadBlob(ctx context.Context, requestURL *url.URL, layer *Layer, chunkSiz
 
 		resp, err := uploadBlobChunk(ctx, http.MethodPatch, requestURL, f, offset, chunk, regOpts, &pw)
 		if err != nil {
-			fn(api.ProgressResponse{
-				Status:    fmt.Sprintf("error uploading chunk: %v", err),
-				Digest:    layer.Digest,
-				Total:     layer.Size,
-				Completed: int(offset),
-			})
+			if ctx.Err() != nil || try >= maxRetry {
+				fn(api.ProgressResponse{
+					Status:    fmt.Sprintf("error uploading chunk: %v", err),
+					Digest:    layer.Digest,
+					Total:     layer.Size,
+					Completed: int(offset),
+					State:     api.ProgressStateStopped,
+				})
+
+				return err
+			}
 
-			return err
+			log.Printf("retrying upload of %s from offset %d: %v", layer.Digest, offset, err)
+			if err := sleepBackoff(ctx, try, 0); err != nil {
+				return err
+			}
+			try++
+
+			// the registry may have stored part of the chunk, carry on from wherever it got to
+			if statusURL, stored, err := uploadStatus(ctx, requestURL, regOpts); err != nil {
+				log.Printf("couldn't get upload status, retrying the whole chunk: %v", err)
+			} else {
+				requestURL, offset = statusURL, stored
+			}
+
+			pw.completed = int(offset)
+			continue
 		}
 
+		try = 0
 		offset += chunk
 		location := resp.Header.Get("Docker-Upload-Location")
 		if location == "" {
@@ -121,11 +142,48 @@ func uploadBlob(ctx context.Context, requestURL *url.URL, layer *Layer, chunkSiz
 
 	if resp.StatusCode >= http.StatusBadRequest {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("on finish upload registry responded with code %d: %v", resp.StatusCode, string(body))
+		return registryError("finish upload", resp.StatusCode, body)
 	}
 	return nil
 }
 
+// uploadStatus asks the registry how much of the upload at requestURL it has stored, it returns the
+// location to continue the upload at and the offset of the first byte the registry doesn't have
+func uploadStatus(ctx context.Context, requestURL *url.URL, regOpts *RegistryOptions) (*url.URL, int64, error) {
+	resp, err := makeRequest(ctx, http.MethodGet, requestURL, nil, nil, regOpts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, 0, registryError("upload status", resp.StatusCode, body)
+	}
+
+	location := requestURL
+	if l := resp.Header.Get("Location"); l != "" {
+		if location, err = requestURL.Parse(l); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// the range of stored bytes is inclusive, e.g. 0-1023 when the first 1024 bytes have been received
+	var start, end int64
+	if r := resp.Header.Get("Range"); r == "" {
+		return location, 0, nil
+	} else if _, err := fmt.Sscanf(r, "%d-%d", &start, &end); err != nil {
+		return nil, 0, fmt.Errorf("invalid upload range %q: %w", r, err)
+	}
+
+	if end == 0 {
+		// registries report an empty upload as 0-0 too, assume nothing was stored
+		return location, 0, nil
+	}
+
+	return location, end + 1, nil
+}
+
 func uploadBlobChunk(ctx context.Context, method string, requestURL *url.URL, r io.ReaderAt, offset, limit int64, opts *RegistryOptions, pw *ProgressWriter) (*http.Response, error) {
 	sectionReader := io.NewSectionReader(r, int64(offset), limit)
 
@@ -168,14 +226,14 @@ func uploadBlobChunk(ctx context.Context, method string, requestURL *url.URL, r
 				return nil, err
 			}
 
-			opts.Token = token
+			opts.setToken(token, auth, time.Time{})
 
 			pw.completed = int(offset)
 			sectionReader = io.NewSectionReader(r, offset, limit)
 			continue
 		case resp.StatusCode >= http.StatusBadRequest:
 			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("on upload registry responded with code %d: %s", resp.StatusCode, body)
+			return nil, registryError("upload", resp.StatusCode, body)
 		}
 
 		return resp, nil
@@ -191,20 +249,31 @@ type ProgressWriter struct {
 	completed int
 	total     int
 	fn        func(api.ProgressResponse)
+	rate      transferRate
 }
 
 func (pw *ProgressWriter) Write(b []byte) (int, error) {
 	n := len(b)
 	pw.bucket += n
 	pw.completed += n
+	pw.rate.update(int64(pw.completed))
 
 	// throttle status updates to not spam the client
 	if pw.bucket >= 1024*1024 || pw.completed >= pw.total {
+		state := api.ProgressStateUploading
+		if pw.completed >= pw.total {
+			state = api.ProgressStateComplete
+		}
+
+		bps, eta := pw.rate.estimate(int64(pw.completed), int64(pw.total))
 		pw.fn(api.ProgressResponse{
-			Status:    pw.status,
-			Digest:    pw.digest,
-			Total:     pw.total,
-			Completed: pw.completed,
+			Status:         pw.status,
+			Digest:         pw.digest,
+			Total:          pw.total,
+			Completed:      pw.completed,
+			BytesPerSecond: bps,
+			ETA:            eta,
+			State:          state,
 		})
 
 		pw.bucket = 0
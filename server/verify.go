@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// verifyProgressEvery is how many bytes of a blob are hashed between progress updates
+const verifyProgressEvery = 32 * 1024 * 1024
+
+// hashBlob re-hashes the blob with digest, calling fn with its progress. it returns whether the blob matches its
+// digest, a missing blob doesn't
+func hashBlob(ctx context.Context, digest string, fn func(api.ProgressResponse)) (bool, error) {
+	fp, err := findBlob(digest)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	status := fmt.Sprintf("verifying %s", digest)
+	h := sha256.New()
+	var completed int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		n, err := io.CopyN(h, f, verifyProgressEvery)
+		completed += n
+		fn(api.ProgressResponse{Status: status, Digest: digest, Total: int(fi.Size()), Completed: int(completed)})
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)) == digest, nil
+}
+
+// VerifyModel re-hashes each blob the manifest of the model name refers to, returning the digests of the ones
+// which are missing or don't match
+func VerifyModel(ctx context.Context, name string, fn func(api.ProgressResponse)) ([]string, error) {
+	blobsMu.RLock()
+	defer blobsMu.RUnlock()
+
+	return verifyModel(ctx, ParseModelPath(name), fn)
+}
+
+func verifyModel(ctx context.Context, mp ModelPath, fn func(api.ProgressResponse)) ([]string, error) {
+	manifest, _, err := GetManifest(mp)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupted []string
+	seen := make(map[string]bool)
+	for _, layer := range append(manifest.Layers, &manifest.Config) {
+		if seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+
+		ok, err := hashBlob(ctx, layer.Digest, fn)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			log.Printf("%s: blob %s is missing or doesn't match its digest", mp.GetShortTagname(), layer.Digest)
+			corrupted = append(corrupted, layer.Digest)
+		}
+	}
+
+	return corrupted, nil
+}
+
+// RepairModel verifies the model name and downloads its corrupted blobs again from its registry, other blobs are
+// left as they are
+func RepairModel(ctx context.Context, name string, regOpts *RegistryOptions, fn func(api.ProgressResponse)) error {
+	blobsMu.RLock()
+	defer blobsMu.RUnlock()
+
+	mp := ParseModelPath(name)
+	corrupted, err := verifyModel(ctx, mp, fn)
+	if err != nil {
+		return err
+	}
+
+	if len(corrupted) == 0 {
+		fn(api.ProgressResponse{Status: "success"})
+		return nil
+	}
+
+	if mp.ProtocolScheme == "http" && !regOpts.Insecure {
+		return fmt.Errorf("insecure protocol http")
+	}
+
+	for _, digest := range corrupted {
+		fp, err := GetBlobsPath(digest)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(fp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("repairing %s", digest), Digest: digest})
+		if err := downloadBlob(ctx, downloadOpts{mp: mp, digest: digest, regOpts: regOpts, fn: fn}); err != nil {
+			return err
+		}
+
+		if err := verifyBlob(digest); err != nil {
+			return err
+		}
+	}
+
+	fn(api.ProgressResponse{Status: "success"})
+	return nil
+}
+
+// corruptedError explains which blobs of a model are corrupted
+func corruptedError(name string, corrupted []string) error {
+	return fmt.Errorf("%d of the blobs of %s are missing or corrupted: %s, run `ollama repair %s` to download them again", len(corrupted), name, strings.Join(corrupted, ", "), name)
+}
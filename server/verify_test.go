@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestVerifyModel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	blob := []byte("weights")
+	writeTestModel(t, "test", blob)
+
+	corrupted, err := VerifyModel(context.Background(), "test", func(api.ProgressResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(corrupted) > 0 {
+		t.Fatalf("expected no corrupted blobs, got %v", corrupted)
+	}
+
+	digest, _ := GetSHA256Digest(bytes.NewReader(blob))
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp, []byte("damaged"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted, err = VerifyModel(context.Background(), "test", func(api.ProgressResponse) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(corrupted) != 1 || corrupted[0] != digest {
+		t.Errorf("expected %s to be corrupted, got %v", digest, corrupted)
+	}
+}
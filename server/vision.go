@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// projectorLayer returns a layer for a Modelfile's PROJECTOR, the clip model which turns images into embeddings
+// for a multimodal model such as llava. it's a gguf file relative to path, close the layer's file once it's saved
+func projectorLayer(path, name string) (*LayerReader, error) {
+	fp, err := filenameWithPath(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, fmt.Errorf("projector %s not found", name)
+	}
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if ggml.Name() != "gguf" || ggml.ModelFamily() != "clip" {
+		f.Close()
+		return nil, fmt.Errorf("projectors must be gguf clip models, %s is %s %s", name, ggml.Name(), ggml.ModelFamily())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	layer, err := CreateLayer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	layer.MediaType = "application/vnd.ollama.image.projector"
+	return layer, nil
+}
+
+// bindRequest binds a request's json body, or a multipart form with the json in its request field and image
+// files in its images fields. it returns the images which were uploaded as files
+func bindRequest(c *gin.Context, req any) ([]api.ImageData, error) {
+	if c.ContentType() != "multipart/form-data" {
+		return nil, c.ShouldBindJSON(req)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+
+	if v := form.Value["request"]; len(v) > 0 {
+		if err := json.Unmarshal([]byte(v[0]), req); err != nil {
+			return nil, err
+		}
+	}
+
+	var images []api.ImageData
+	for _, fh := range form.File["images"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		bts, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, bts)
+	}
+
+	return images, nil
+}
+
+// imagePrompt puts the tags of n images, numbered from first, before prompt
+func imagePrompt(prompt string, first, n int) string {
+	if n == 0 {
+		return prompt
+	}
+
+	tags := make([]string, n)
+	for i := range tags {
+		tags[i] = llm.ImageTag(first + i)
+	}
+
+	return strings.Join(tags, " ") + "\n" + prompt
+}
+
+// chatImages returns the images of messages in order, with messages' content tagged where each image goes
+func chatImages(messages []api.Message) ([]api.Message, []api.ImageData) {
+	var images []api.ImageData
+	tagged := make([]api.Message, len(messages))
+	for i, m := range messages {
+		m.Content = imagePrompt(m.Content, len(images), len(m.Images))
+		images = append(images, m.Images...)
+		tagged[i] = m
+	}
+
+	return tagged, images
+}
+
+var errNoImageMessage = errors.New("images need a message to go with them")
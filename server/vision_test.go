@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestChatImages(t *testing.T) {
+	messages := []api.Message{
+		{Role: "user", Content: "what's this?", Images: []api.ImageData{[]byte("a")}},
+		{Role: "assistant", Content: "a cat"},
+		{Role: "user", Content: "and these?", Images: []api.ImageData{[]byte("b"), []byte("c")}},
+	}
+
+	tagged, images := chatImages(messages)
+	if len(images) != 3 || string(images[2]) != "c" {
+		t.Fatalf("expected the three images in order, got %q", images)
+	}
+
+	if tagged[0].Content != "[img-0]\nwhat's this?" || tagged[1].Content != "a cat" || tagged[2].Content != "[img-1] [img-2]\nand these?" {
+		t.Errorf("unexpected tagged messages %q, %q, %q", tagged[0].Content, tagged[1].Content, tagged[2].Content)
+	}
+
+	if messages[0].Content != "what's this?" {
+		t.Error("expected the messages to be left as they were")
+	}
+}
+
+func TestBindRequestMultipart(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("request", `{"model": "llava", "prompt": "describe this"}`)
+	f, _ := w.CreateFormFile("images", "cat.png")
+	f.Write([]byte("png bytes"))
+	w.Close()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", &body)
+	c.Request.Header.Set("Content-Type", w.FormDataContentType())
+
+	var req api.GenerateRequest
+	images, err := bindRequest(c, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Model != "llava" || req.Prompt != "describe this" {
+		t.Errorf("expected the request from the form, got %+v", req)
+	}
+
+	if len(images) != 1 || string(images[0]) != "png bytes" {
+		t.Errorf("expected the uploaded image, got %q", images)
+	}
+}
+
+func TestProjectorLayer(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "mmproj.bin")
+	if err := os.WriteFile(fp, []byte("not a model"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := projectorLayer("", fp); err == nil {
+		t.Error("expected an error for a projector which isn't gguf")
+	}
+
+	if _, err := projectorLayer("", filepath.Join(t.TempDir(), "missing.gguf")); err == nil {
+		t.Error("expected an error for a missing projector")
+	}
+}